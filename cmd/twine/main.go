@@ -17,12 +17,13 @@ func main() {
 
 	repo, err := repository.Repo(args[1])
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Malformed repo: %s", err)
+		fmt.Fprintf(os.Stderr, "Malformed repo: %s\n", err)
+		os.Exit(1)
 	}
 
 	err = repo.Run(args[1:])
 	if err != nil {
-		fmt.Fprint(os.Stderr, err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 }
@@ -32,6 +33,31 @@ const HELP_TEXT = `usage: gat <command> [<args>...]
 
 	Commands:
 	init         Initialize a new, empty repository
+	init [--object-format=<sha1 | sha256>]
+
+	clone        Clone a repository from a local path or over smart HTTP into a new directory
+	clone [--bare | --mirror] [-b <branch>] [--depth <n>] [--shallow-since <date>] <path | file://path | http(s)://url> [<dir>]
+
+	fetch        Download objects and refs from another repository
+	fetch [-p | --prune] [-t | --tags | --no-tags] [-f] [-q] [--depth <n> | --deepen <n> | --shallow-since <date> | --unshallow] [<remote> [<refspec>...]]
+
+	pull         Fetch from another repository and merge or rebase onto it
+	pull [-r | --rebase | --no-rebase] [--ff-only] [<remote> [<refspec>...]]
+
+	push         Update remote refs along with the objects they need
+	push [-f | --force-with-lease[=<ref>[:<expect>]]] [-d] [--atomic] [--tags] [<remote> [<refspec>...]]
+
+	ls-remote    List references in a remote repository
+	ls-remote [--heads] [--tags] [--refs] [--symref] [--upload-pack=<exec>] [<repository> [<patterns>...]]
+
+	upload-pack  Send objects packed back to a fetching client
+	upload-pack [--stateless-rpc] [--advertise-refs] <directory>
+
+	receive-pack Receive what is pushed into the repository
+	receive-pack [--stateless-rpc] [--advertise-refs] <directory>
+
+	serve        Serve the repositories under a directory over smart HTTP
+	serve [-l | --listen <addr>] [--receive-pack] [<directory>]
 
 	cat-file     Provide content or type and size information for repository objects
 	cat-file (-s | -t | -p) <object> | cat-file <type> <object>
@@ -39,6 +65,24 @@ const HELP_TEXT = `usage: gat <command> [<args>...]
 	-t 		type of the <object>
 	-p 		pretty print the serialized <object>
 
+	fsck         Verify the connectivity and validity of the objects in the database
+	fsck [--unreachable] [--no-dangling] [--lost-found] [--connectivity-only] [--no-reflogs]
+
+	commit-graph Write and verify the commit-graph used to speed up walking history
+	commit-graph write [--reachable | --stdin-commits] [--split] | commit-graph verify
+
+	multi-pack-index Write, verify, expire and repack the index over every pack
+	multi-pack-index write [--preferred-pack=<pack>] | verify | expire | repack [--batch-size=<size>]
+
+	count-objects Count loose and packed objects and the disk space they take up
+	count-objects [-v] [--reachable]
+
+	gc           Pack refs and objects, expire old reflog entries and prune unreachable objects
+	gc [--auto] [--prune=<date> | --no-prune]
+
+	prune        Remove unreachable loose objects
+	prune [-n | --dry-run] [-v | --verbose] [--expire <date>]
+
 	hash-object  Compute object ID and optionally create a blob from a file
 	hash-object [-w] <files>...
 	-w 		write object into database
@@ -47,5 +91,30 @@ const HELP_TEXT = `usage: gat <command> [<args>...]
 	ls-tree [-r] <tree-ish>
 	-r 		recurse into sub-trees
 
+	archive      Create a tar or zip archive of the files in a tree
+	archive [--format=(tar | tar.gz | zip)] [--prefix=<prefix>/] [-o <file>] [-l] <tree-ish> [<path>...]
+
+	blame        Show what revision and author last modified each line of a file
+	blame [-L <start>,<end>] [--porcelain | --line-porcelain] [-w] [-M[<score>]] [-C[<score>]]... [--root]
+	      [--ignore-rev <rev>]... [--ignore-revs-file <file>]... <file> [<rev>]
+
 	log          Show commit logs
+
+	rev-list     List the commits, or all objects, reachable from some commits but not others
+	rev-list [--count] [--objects] [--use-bitmap-index] [--all] <commit>... [^<commit>...]
+
+	merge-base   Find the best common ancestor of two commits
+	merge-base [--is-ancestor] <commit> <commit>
+
+	tag          List, create or delete tags
+	tag [--contains <commit>] | tag [-d] <name> [<commit>] | tag -a <name> [<commit>] -m <msg>
+
+	config       Get and set repository or global options
+	config [--global | --system | --local | --worktree | -f <file>] <name> [<value> [<value-pattern>]]
+	--get, --get-all, --get-regexp   read values
+	--add, --replace-all             write values
+	--unset, --unset-all             remove values
+	--rename-section, --remove-section
+	-l, --list [--show-origin] [--show-scope]
+	--type (bool | int | path | color)
 `
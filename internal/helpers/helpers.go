@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 )
 
 func SearchRoot(path string) (string, error) {
@@ -13,7 +15,7 @@ func SearchRoot(path string) (string, error) {
 		return "", err
 	}
 
-	if isDir(filepath.Join(absPath, ".git")) {
+	if IsDir(filepath.Join(absPath, ".git")) {
 		return absPath, nil
 	}
 
@@ -25,7 +27,8 @@ func SearchRoot(path string) (string, error) {
 	return SearchRoot(parent)
 }
 
-func isDir(path string) bool {
+// IsDir reports whether path exists and is a directory
+func IsDir(path string) bool {
 	info, err := os.Stat(path)
 	if err != nil {
 		return false
@@ -38,3 +41,57 @@ func IsHex(str string) bool {
 	_, err := hex.DecodeString(str)
 	return err == nil
 }
+
+// WildMatch matches text against a git style glob pattern
+// where * and ? stop at slashes and ** crosses them
+func WildMatch(pattern, text string, foldCase bool) bool {
+	var sb strings.Builder
+	if foldCase {
+		sb.WriteString("(?i)")
+	}
+	sb.WriteByte('^')
+
+	for i := 0; i < len(pattern); i++ {
+		ch := pattern[i]
+		switch ch {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**/") {
+				sb.WriteString("(?:.*/)?")
+				i += 2
+			} else if strings.HasPrefix(pattern[i:], "**") {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	sb.WriteByte('$')
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return false
+	}
+	return re.MatchString(text)
+}
@@ -0,0 +1,658 @@
+package repository
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * git archive lays out entries the same way whatever the format
+ *
+ *   <prefix>                   a directory entry, when the prefix ends in a slash
+ *   <prefix>dir/               each directory right before what's in it, in tree order
+ *                              left out when nothing in it makes it into the archive
+ *   <prefix>dir/file
+ *   <prefix>sub/               a submodule is an empty directory
+ *
+ * every entry is stamped with the committer time, or the current time for a bare tree
+ *
+ * tar (ustar, pax headers where the names are too long)
+ *   pax_global_header   a 'g' record holding "comment=<commit sha>"
+ *   directories 0775, files 0664, executables 0775, symlinks 0777 with size 0 and the target as linkname
+ *   all of it owned by root:root, uid and gid 0, less whatever tar.umask (002 by default) takes away
+ *
+ * tar.gz is the same run through gzip with no name or time in its header
+ *
+ * zip
+ *   the archive comment is the commit sha
+ *   directories are stored with the msdos directory bit, files are deflated
+ *   executables and symlinks carry unix modes, a symlink's data is its target
+ *
+ * attributes from .gitattributes in the archived tree and $GIT_DIR/info/attributes
+ *   export-ignore  leaves a file or directory out
+ *   export-subst   expands $Format:<placeholders>$ in a file, only when archiving a commit
+ */
+
+var archiveFormats = []string{"tar", "tgz", "tar.gz", "zip"}
+
+type archiveEntry struct {
+	name string
+	mode string
+	size int64
+}
+
+func (entry *archiveEntry) isDir() bool {
+	return entry.mode == "40000" || entry.mode == "160000"
+}
+
+// archiveWriter takes entries in the order they go in the archive
+// a directory has no contents and a symlink's contents are its target
+type archiveWriter interface {
+	writeEntry(entry archiveEntry, contents io.Reader) error
+	Close() error
+}
+
+type archiver struct {
+	repo *Repository
+	out  archiveWriter
+	// the commit being archived, nil for a bare tree
+	commitSha string
+	commit    *Commit
+	prefix    string
+	paths     []string
+	info      []attrRule
+	// directories on the way down that nothing has been written into yet
+	pending []archiveEntry
+}
+
+func (repo *Repository) archive(args []string) error {
+	var format, prefix, output string
+	var list bool
+	archiveCmd := flag.NewFlagSet("archive", flag.ExitOnError)
+	archiveCmd.StringVar(&format, "format", "", "Format of the archive, tar, tar.gz or zip")
+	archiveCmd.StringVar(&prefix, "prefix", "", "Prepend <prefix> to every path in the archive")
+	archiveCmd.StringVar(&output, "o", "", "Write the archive to a file instead of stdout")
+	archiveCmd.StringVar(&output, "output", "", "Write the archive to a file instead of stdout")
+	archiveCmd.BoolVar(&list, "l", false, "List the formats")
+	archiveCmd.BoolVar(&list, "list", false, "List the formats")
+	if err := archiveCmd.Parse(args); err != nil {
+		return err
+	}
+	if list {
+		for _, name := range archiveFormats {
+			fmt.Println(name)
+		}
+		return nil
+	}
+	if archiveCmd.NArg() == 0 {
+		return fmt.Errorf("Expected a tree-ish to archive")
+	}
+
+	if format == "" {
+		format = archiveFormatOf(output)
+	}
+	if format == "tgz" {
+		format = "tar.gz"
+	}
+	if format != "tar" && format != "tar.gz" && format != "zip" {
+		return fmt.Errorf("Unknown archive format '%s'", format)
+	}
+
+	sha, err := repo.findObject(archiveCmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	arc := &archiver{repo: repo, prefix: prefix, info: repo.infoAttributes()}
+	treeSha, err := arc.resolve(sha)
+	if err != nil {
+		return err
+	}
+	for _, name := range archiveCmd.Args()[1:] {
+		name = strings.Trim(path.Clean(name), "/")
+		if _, err := repo.treeLookup(treeSha, name); err != nil {
+			return fmt.Errorf("pathspec '%s' did not match any files", name)
+		}
+		arc.paths = append(arc.paths, name)
+	}
+
+	var out io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	mtime := time.Now()
+	if arc.commit != nil {
+		mtime = time.Unix(arc.commit.commitTime(), 0)
+	}
+	switch format {
+	case "tar":
+		arc.out, err = repo.newTarArchive(out, nil, mtime, arc.commitSha)
+	case "tar.gz":
+		arc.out, err = repo.newTarArchive(out, gzip.NewWriter(out), mtime, arc.commitSha)
+	case "zip":
+		arc.out, err = newZipArchive(out, mtime, arc.commitSha)
+	}
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(prefix, "/") {
+		if err := arc.out.writeEntry(archiveEntry{name: prefix, mode: "40000"}, nil); err != nil {
+			return err
+		}
+	}
+	if err := arc.writeTree(treeSha, "", nil); err != nil {
+		return err
+	}
+	return arc.out.Close()
+}
+
+// archiveFormatOf guesses the format from the name of the file being written, tar if there's no telling
+func archiveFormatOf(output string) string {
+	switch {
+	case strings.HasSuffix(output, ".zip"):
+		return "zip"
+	case strings.HasSuffix(output, ".tgz"), strings.HasSuffix(output, ".tar.gz"):
+		return "tar.gz"
+	}
+	return "tar"
+}
+
+// resolve peels tags down to a commit or a tree, giving back the tree to archive
+func (arc *archiver) resolve(sha string) (string, error) {
+	for {
+		obj, err := arc.repo.makeObject(sha)
+		if err != nil {
+			return "", err
+		}
+		switch o := obj.(type) {
+		case *Commit:
+			arc.commitSha, arc.commit = sha, o
+			return o.getField("tree")
+		case *Tree:
+			return sha, nil
+		case *Tag:
+			if sha, err = o.getField("object"); err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("Object %s is a %s, not a tree-ish", sha, obj.Kind())
+		}
+	}
+}
+
+// treeLookup finds the entry at a slash separated path below a tree
+func (repo *Repository) treeLookup(treeSha, name string) (*TreeLeaf, error) {
+	leaf := &TreeLeaf{mode: "40000"}
+	leaf.sha, _ = hex.DecodeString(treeSha)
+	if name == "." || name == "" {
+		return leaf, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		if leaf.mode != "40000" {
+			return nil, fmt.Errorf("%s isn't in the tree", name)
+		}
+		tree, err := repo.readTree(hex.EncodeToString(leaf.sha))
+		if err != nil {
+			return nil, err
+		}
+		leaf = nil
+		for _, child := range tree.leaves {
+			if child.path == part {
+				leaf = child
+				break
+			}
+		}
+		if leaf == nil {
+			return nil, fmt.Errorf("%s isn't in the tree", name)
+		}
+	}
+	return leaf, nil
+}
+
+// wanted says if a path given on the command line takes in name
+// or whether name is a directory leading to one, in which case it's there but not all of it
+func (arc *archiver) wanted(name string) (bool, bool) {
+	if len(arc.paths) == 0 {
+		return true, true
+	}
+	leading := false
+	for _, want := range arc.paths {
+		if want == "." || name == want || strings.HasPrefix(name, want+"/") {
+			return true, true
+		}
+		if strings.HasPrefix(want, name+"/") {
+			leading = true
+		}
+	}
+	return leading, false
+}
+
+// writeTree writes out what's in a tree at dir, picking up its .gitattributes on the way
+func (arc *archiver) writeTree(treeSha, dir string, rules []attrRule) error {
+	tree, err := arc.repo.readTree(treeSha)
+	if err != nil {
+		return err
+	}
+	for _, leaf := range tree.leaves {
+		if leaf.path == ".gitattributes" && leaf.mode != "40000" && leaf.mode != "160000" {
+			_, contents, err := arc.repo.readObject(hex.EncodeToString(leaf.sha))
+			if err != nil {
+				return err
+			}
+			// rules can be shared with a sibling directory, so never append into it in place
+			rules = append(rules[:len(rules):len(rules)], parseAttributes(contents, dir)...)
+		}
+	}
+	all := append(rules[:len(rules):len(rules)], arc.info...)
+
+	for _, leaf := range tree.leaves {
+		name := leaf.path
+		if dir != "" {
+			name = dir + "/" + leaf.path
+		}
+		if attrValue(all, name, "export-ignore") == attrSet {
+			continue
+		}
+		included, whole := arc.wanted(name)
+		if !included {
+			continue
+		}
+		sha := hex.EncodeToString(leaf.sha)
+
+		switch leaf.mode {
+		case "40000":
+			depth := len(arc.pending)
+			arc.pending = append(arc.pending, archiveEntry{name: arc.prefix + name + "/", mode: leaf.mode})
+			if err := arc.writeTree(sha, name, rules); err != nil {
+				return err
+			}
+			// nothing below it was written, so neither is it
+			arc.pending = arc.pending[:min(depth, len(arc.pending))]
+		case "160000":
+			if err := arc.writePending(); err != nil {
+				return err
+			}
+			if err := arc.out.writeEntry(archiveEntry{name: arc.prefix + name + "/", mode: leaf.mode}, nil); err != nil {
+				return err
+			}
+		default:
+			if !whole {
+				continue
+			}
+			if err := arc.writePending(); err != nil {
+				return err
+			}
+			subst := arc.commit != nil && attrValue(all, name, "export-subst") == attrSet
+			if err := arc.writeBlob(archiveEntry{name: arc.prefix + name, mode: leaf.mode}, sha, subst); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writePending writes out the directories leading to an entry that's about to be written
+func (arc *archiver) writePending() error {
+	for _, entry := range arc.pending {
+		if err := arc.out.writeEntry(entry, nil); err != nil {
+			return err
+		}
+	}
+	arc.pending = arc.pending[:0]
+	return nil
+}
+
+// writeBlob streams a blob into the archive unless it has placeholders to expand
+func (arc *archiver) writeBlob(entry archiveEntry, sha string, subst bool) error {
+	if subst {
+		_, contents, err := arc.repo.readObject(sha)
+		if err != nil {
+			return err
+		}
+		contents = arc.expandFormats(contents)
+		entry.size = int64(len(contents))
+		return arc.out.writeEntry(entry, bytes.NewReader(contents))
+	}
+
+	_, size, r, err := arc.repo.openObject(sha)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	entry.size = size
+	return arc.out.writeEntry(entry, r)
+}
+
+// expandFormats replaces every $Format:...$ with the commit's fields, as export-subst asks for
+func (arc *archiver) expandFormats(contents []byte) []byte {
+	var out bytes.Buffer
+	for {
+		start := bytes.Index(contents, []byte("$Format:"))
+		if start == -1 {
+			break
+		}
+		end := bytes.IndexByte(contents[start+len("$Format:"):], '$')
+		if end == -1 {
+			break
+		}
+		end += start + len("$Format:")
+		out.Write(contents[:start])
+		out.WriteString(arc.repo.formatCommit(arc.commitSha, arc.commit, string(contents[start+len("$Format:"):end])))
+		contents = contents[end+1:]
+	}
+	out.Write(contents)
+	return out.Bytes()
+}
+
+// formatCommit expands the placeholders git log --format has, the common ones anyway
+// anything it doesn't know is left as it is
+func (repo *Repository) formatCommit(sha string, commit *Commit, format string) string {
+	var out strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			out.WriteByte(format[i])
+			continue
+		}
+
+		placeholder := format[i+1:]
+		value, width := repo.commitPlaceholder(sha, commit, placeholder)
+		if width == 0 {
+			out.WriteByte('%')
+			continue
+		}
+		out.WriteString(value)
+		i += width
+	}
+	return out.String()
+}
+
+// commitPlaceholder expands the placeholder at the start of s, giving how long it was
+// or zero if it isn't one
+func (repo *Repository) commitPlaceholder(sha string, commit *Commit, s string) (string, int) {
+	switch s[0] {
+	case '%':
+		return "%", 1
+	case 'n':
+		return "\n", 1
+	case 'H':
+		return sha, 1
+	case 'h':
+		return sha[:7], 1
+	case 'T':
+		tree, _ := commit.getField("tree")
+		return tree, 1
+	case 't':
+		tree, _ := commit.getField("tree")
+		return tree[:min(7, len(tree))], 1
+	case 'P':
+		return strings.Join(commit.parents(), " "), 1
+	case 'p':
+		var short []string
+		for _, parent := range commit.parents() {
+			short = append(short, parent[:7])
+		}
+		return strings.Join(short, " "), 1
+	case 's':
+		subject, _, _ := strings.Cut(commit.message, "\n\n")
+		return strings.Join(strings.Fields(subject), " "), 1
+	case 'b':
+		_, body, _ := strings.Cut(commit.message, "\n\n")
+		return body, 1
+	case 'B':
+		return commit.message, 1
+	case 'd', 'D':
+		decorations := repo.decorations(sha)
+		if s[0] == 'D' {
+			return strings.Join(decorations, ", "), 1
+		}
+		if len(decorations) == 0 {
+			return "", 1
+		}
+		return " (" + strings.Join(decorations, ", ") + ")", 1
+	case 'a', 'c':
+		if len(s) < 2 {
+			return "", 0
+		}
+		field := "author"
+		if s[0] == 'c' {
+			field = "committer"
+		}
+		line, _ := commit.getField(field)
+		name, email, when := splitIdent(line)
+		switch s[1] {
+		case 'n':
+			return name, 2
+		case 'e':
+			return email, 2
+		case 'd':
+			return when.Format("Mon Jan 2 15:04:05 2006 -0700"), 2
+		case 'D':
+			return when.Format("Mon, 2 Jan 2006 15:04:05 -0700"), 2
+		case 'i':
+			return when.Format("2006-01-02 15:04:05 -0700"), 2
+		case 'I':
+			return when.Format("2006-01-02T15:04:05-07:00"), 2
+		case 't':
+			return strconv.FormatInt(when.Unix(), 10), 2
+		}
+	}
+	return "", 0
+}
+
+// splitIdent pulls apart "name <email> timestamp zone", keeping the time in its own zone
+func splitIdent(line string) (string, string, time.Time) {
+	name, rest, _ := strings.Cut(line, " <")
+	email, rest, _ := strings.Cut(rest, "> ")
+	var timestamp int64
+	var zone string
+	fmt.Sscanf(rest, "%d %s", &timestamp, &zone)
+	when := time.Unix(timestamp, 0).UTC()
+	if tz, err := time.Parse("-0700", zone); err == nil {
+		when = when.In(tz.Location())
+	}
+	return name, email, when
+}
+
+// decorations names the refs pointing at a commit the way log --decorate does
+func (repo *Repository) decorations(sha string) []string {
+	refs, err := repo.readRefs()
+	if err != nil {
+		return nil
+	}
+	headBranch, _ := repo.readSymref("HEAD")
+	head, _ := repo.readRef("HEAD")
+
+	var decorations []string
+	if head == sha {
+		if branch, ok := strings.CutPrefix(headBranch, "refs/heads/"); ok && refs[headBranch] == sha {
+			decorations = append(decorations, "HEAD -> "+branch)
+		} else {
+			decorations = append(decorations, "HEAD")
+		}
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	// git ends up with them backwards, so tags come before branches and remotes last
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		if name == headBranch && head == sha {
+			continue
+		}
+		if tag, ok := strings.CutPrefix(name, "refs/tags/"); ok {
+			if peeled, _, err := repo.peelToCommit(refs[name]); err == nil && peeled == sha {
+				decorations = append(decorations, "tag: "+tag)
+			}
+			continue
+		}
+		if refs[name] != sha {
+			continue
+		}
+		if branch, ok := strings.CutPrefix(name, "refs/heads/"); ok {
+			decorations = append(decorations, branch)
+		} else if remote, ok := strings.CutPrefix(name, "refs/remotes/"); ok {
+			decorations = append(decorations, remote)
+		}
+	}
+	return decorations
+}
+
+type tarArchive struct {
+	tw    *tar.Writer
+	gz    *gzip.Writer
+	mtime time.Time
+	umask int64
+}
+
+// newTarArchive starts a tar, compressed through gz when it isn't nil
+// the commit sha goes first in a pax global header, as git puts it there
+func (repo *Repository) newTarArchive(w io.Writer, gz *gzip.Writer, mtime time.Time, commitSha string) (*tarArchive, error) {
+	umask, err := strconv.ParseInt(repo.conf.Value("tar.umask", "002"), 8, 64)
+	if err != nil {
+		// "user" means the umask of the process, which there's no reading without changing it
+		umask = 0o022
+	}
+	arc := &tarArchive{gz: gz, mtime: mtime, umask: umask}
+	if gz != nil {
+		// gzip -n marks it as made on unix, the one thing it does put in the header
+		gz.OS = 3
+		w = gz
+	}
+	arc.tw = tar.NewWriter(w)
+
+	if commitSha != "" {
+		header := &tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			Name:       "pax_global_header",
+			PAXRecords: map[string]string{"comment": commitSha},
+			Format:     tar.FormatPAX,
+		}
+		if err := arc.tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+	}
+	return arc, nil
+}
+
+func (arc *tarArchive) writeEntry(entry archiveEntry, contents io.Reader) error {
+	header := &tar.Header{
+		Name:    entry.name,
+		ModTime: arc.mtime,
+		Uname:   "root",
+		Gname:   "root",
+	}
+	switch {
+	case entry.isDir():
+		header.Typeflag = tar.TypeDir
+		header.Mode = 0o777
+	case entry.mode == "120000":
+		target, err := io.ReadAll(contents)
+		if err != nil {
+			return err
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = string(target)
+		header.Mode = 0o777
+		return arc.tw.WriteHeader(header)
+	case entry.mode == "100755":
+		header.Typeflag = tar.TypeReg
+		header.Mode = 0o777
+		header.Size = entry.size
+	default:
+		header.Typeflag = tar.TypeReg
+		header.Mode = 0o666
+		header.Size = entry.size
+	}
+	header.Mode &^= arc.umask
+
+	if err := arc.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if contents == nil {
+		return nil
+	}
+	_, err := io.Copy(arc.tw, contents)
+	return err
+}
+
+func (arc *tarArchive) Close() error {
+	if err := arc.tw.Close(); err != nil {
+		return err
+	}
+	if arc.gz != nil {
+		return arc.gz.Close()
+	}
+	return nil
+}
+
+type zipArchive struct {
+	zw    *zip.Writer
+	mtime time.Time
+}
+
+func newZipArchive(w io.Writer, mtime time.Time, commitSha string) (*zipArchive, error) {
+	arc := &zipArchive{zw: zip.NewWriter(w), mtime: mtime}
+	if commitSha != "" {
+		if err := arc.zw.SetComment(commitSha); err != nil {
+			return nil, err
+		}
+	}
+	return arc, nil
+}
+
+func (arc *zipArchive) writeEntry(entry archiveEntry, contents io.Reader) error {
+	header := &zip.FileHeader{
+		Name:     entry.name,
+		Method:   zip.Deflate,
+		Modified: arc.mtime,
+	}
+	switch {
+	case entry.isDir():
+		header.Method = zip.Store
+		// the msdos directory bit, which is all git sets
+		header.ExternalAttrs = 0x10
+	case entry.mode == "120000":
+		header.Method = zip.Store
+		header.SetMode(fs.ModeSymlink | 0o777)
+	case entry.mode == "100755":
+		header.SetMode(0o755)
+	}
+	if entry.size == 0 {
+		header.Method = zip.Store
+	}
+
+	w, err := arc.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if contents == nil {
+		return nil
+	}
+	_, err = io.Copy(w, contents)
+	return err
+}
+
+func (arc *zipArchive) Close() error {
+	return arc.zw.Close()
+}
@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestArchiveLeavesOutEmptiedDirectories(t *testing.T) {
+	repo := newTestRepo(t, true)
+	commit := commitTestFiles(t, repo, map[string]string{
+		".gitattributes": "p/d/x export-ignore\np/e/f/y export-ignore\n",
+		"p/d/x":          "a\n",
+		"p/e/f/y":        "b\n",
+		"p/g/w":          "c\n",
+		"q/k":            "d\n",
+	})
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{
+			[]string{commit},
+			[]string{".gitattributes", "p/", "p/g/", "p/g/w", "q/", "q/k"},
+		},
+		{
+			[]string{"--prefix=pre/", commit},
+			[]string{"pre/", "pre/.gitattributes", "pre/p/", "pre/p/g/", "pre/p/g/w", "pre/q/", "pre/q/k"},
+		},
+		{
+			[]string{commit, "p/d", "q"},
+			[]string{"q/", "q/k"},
+		},
+	}
+
+	for _, tt := range tests {
+		output := filepath.Join(t.TempDir(), "out.tar")
+		if err := repo.archive(append([]string{"-o", output}, tt.args...)); err != nil {
+			t.Fatal(err)
+		}
+		if got := tarNames(t, output); !slices.Equal(got, tt.want) {
+			t.Errorf("archive %q = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func tarNames(t *testing.T, name string) []string {
+	t.Helper()
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var names []string
+	r := tar.NewReader(file)
+	for {
+		header, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag != tar.TypeXGlobalHeader {
+			names = append(names, header.Name)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"strings"
+)
+
+/*
+ * .gitattributes lines are a pattern followed by the attributes it sets
+ *
+ *   *.txt      text -diff eol=lf !merge
+ *   docs/**    export-ignore
+ *
+ *   attr        set
+ *   -attr       unset
+ *   attr=value  set to a value
+ *   !attr       back to unspecified, as if no earlier line mentioned it
+ *
+ * a pattern without a slash matches the name of a file at any depth
+ * below the directory the .gitattributes is in, one with a slash is matched from that directory
+ * unlike .gitignore a trailing slash matches nothing, dir/** is how to get at a directory's contents
+ *
+ * the last line that matches wins, so deeper .gitattributes files beat shallower ones
+ * and $GIT_DIR/info/attributes beats all of them
+ * macros ([attr]binary ...) and quoted patterns aren't handled, those lines are skipped
+ */
+
+const (
+	attrSet   = "set"
+	attrUnset = "unset"
+	// what !attr leaves behind
+	attrUnspecified = ""
+)
+
+type attrRule struct {
+	// the directory the .gitattributes is in, "" for the top
+	dir     string
+	pattern string
+	attrs   map[string]string
+}
+
+func parseAttributes(data []byte, dir string) []attrRule {
+	var rules []attrRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") ||
+			strings.HasPrefix(fields[0], "[attr]") || strings.HasPrefix(fields[0], `"`) {
+			continue
+		}
+
+		rule := attrRule{dir: dir, pattern: fields[0], attrs: make(map[string]string)}
+		for _, attr := range fields[1:] {
+			switch {
+			case strings.HasPrefix(attr, "-"):
+				rule.attrs[attr[1:]] = attrUnset
+			case strings.HasPrefix(attr, "!"):
+				rule.attrs[attr[1:]] = attrUnspecified
+			default:
+				if name, value, ok := strings.Cut(attr, "="); ok {
+					rule.attrs[name] = value
+				} else {
+					rule.attrs[attr] = attrSet
+				}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// matches says if a slash separated path from the top of the tree falls under the rule
+func (rule *attrRule) matches(name string) bool {
+	rel := name
+	if rule.dir != "" {
+		var ok bool
+		if rel, ok = strings.CutPrefix(name, rule.dir+"/"); !ok {
+			return false
+		}
+	}
+
+	pattern := strings.TrimPrefix(rule.pattern, "/")
+	if !strings.Contains(rule.pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(rel))
+		return matched
+	}
+	return globMatch(strings.Split(pattern, "/"), strings.Split(rel, "/"))
+}
+
+// globMatch matches a path one component at a time, with ** standing in for any number of them
+func globMatch(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for skip := 0; skip <= len(name); skip++ {
+				if globMatch(pattern[1:], name[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], name[0]); !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// attrValue gives what the last rule mentioning attr that matches the path sets it to
+func attrValue(rules []attrRule, name, attr string) string {
+	for i := len(rules) - 1; i >= 0; i-- {
+		value, ok := rules[i].attrs[attr]
+		if ok && rules[i].matches(name) {
+			return value
+		}
+	}
+	return attrUnspecified
+}
+
+// infoAttributes are the rules in $GIT_DIR/info/attributes, which apply on top of every .gitattributes
+func (repo *Repository) infoAttributes() []attrRule {
+	if repo.gitDir == "" {
+		return nil
+	}
+	contents, err := os.ReadFile(repo.makePath("info", "attributes"))
+	if err != nil {
+		return nil
+	}
+	return parseAttributes(contents, "")
+}
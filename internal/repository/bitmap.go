@@ -0,0 +1,558 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+ * a reachability bitmap sits next to a pack as pack-<sum>.bitmap
+ * bit i stands for the object at the i-th smallest offset in the pack
+ *
+ *                          Bitmap
+ * +------+---------+-------+-------+----------+--------------+---------+----------+
+ * | BITM | version | flags | count | pack sum | type bitmaps | entries | sum      |
+ * |  4   |  2 (1)  |   2   |   4   | 20 or 32 | 4 ewah       |         | 20 or 32 |
+ * +------+---------+-------+-------+----------+--------------+---------+----------+
+ *
+ * the type bitmaps say which objects are commits, trees, blobs and tags
+ * the entries can be followed by a name hash cache (flag 0x4) and a lookup table (0x10)
+ * which only matter for picking deltas and finding entries without reading them all
+ *
+ * entry: position in the index (4), xor offset (1), flags (1), ewah
+ * the ewah is everything the commit at that position reaches
+ * xored with the bitmap of the entry xor offset entries before it, if that isn't 0
+ *
+ * ewah: bit count (4), word count (4), words (8 each), position of the last marker word (4)
+ * the words are marker words each followed by literal words
+ * marker: bit 0 is the bit a run repeats, bits 1-32 how many words the run is,
+ *         bits 33-63 how many literal words come after the marker
+ */
+
+const (
+	bitmapFullDag     = 0x1
+	bitmapHashCache   = 0x4
+	bitmapLookupTable = 0x10
+	// write a bitmap for one in this many commits along with every ref tip
+	bitmapCommitInterval = 100
+)
+
+// bitset is a bitmap laid out flat, bit i being bit i%64 of word i/64
+type bitset []uint64
+
+func (b *bitset) set(i int) {
+	for len(*b) <= i/64 {
+		*b = append(*b, 0)
+	}
+	(*b)[i/64] |= 1 << (i % 64)
+}
+
+func (b bitset) has(i int) bool {
+	return i/64 < len(b) && b[i/64]&(1<<(i%64)) != 0
+}
+
+func (b *bitset) or(other bitset) {
+	for len(*b) < len(other) {
+		*b = append(*b, 0)
+	}
+	for i, word := range other {
+		(*b)[i] |= word
+	}
+}
+
+// and keeps what's in both, andNot what isn't in other
+func (b bitset) and(other bitset) bitset {
+	out := make(bitset, min(len(b), len(other)))
+	for i := range out {
+		out[i] = b[i] & other[i]
+	}
+	return out
+}
+
+func (b bitset) andNot(other bitset) bitset {
+	out := append(bitset{}, b...)
+	for i := range out {
+		if i < len(other) {
+			out[i] &^= other[i]
+		}
+	}
+	return out
+}
+
+func (b bitset) xor(other bitset) bitset {
+	out := append(bitset{}, b...)
+	for len(out) < len(other) {
+		out = append(out, 0)
+	}
+	for i, word := range other {
+		out[i] ^= word
+	}
+	return out
+}
+
+func (b bitset) count() int {
+	n := 0
+	for _, word := range b {
+		n += bits.OnesCount64(word)
+	}
+	return n
+}
+
+// each calls fn with every bit that's set, lowest first
+func (b bitset) each(fn func(i int)) {
+	for w, word := range b {
+		for word != 0 {
+			fn(w*64 + bits.TrailingZeros64(word))
+			word &= word - 1
+		}
+	}
+}
+
+// readEWAH inflates a compressed bitmap, giving back how many bytes it took up
+func readEWAH(data []byte) (bitset, int, error) {
+	if len(data) < 8 {
+		return nil, 0, fmt.Errorf("truncated bitmap")
+	}
+	bitCount := int(binary.BigEndian.Uint32(data))
+	wordCount := int(binary.BigEndian.Uint32(data[4:]))
+	size := 8 + wordCount*8 + 4
+	if len(data) < size {
+		return nil, 0, fmt.Errorf("truncated bitmap")
+	}
+
+	maxWords := (bitCount + 63) / 64
+	out := make(bitset, 0, maxWords)
+	for i := 0; i < wordCount; {
+		marker := binary.BigEndian.Uint64(data[8+i*8:])
+		i++
+		fill := uint64(0)
+		if marker&1 != 0 {
+			fill = ^uint64(0)
+		}
+		run := int(marker >> 1 & 0xffffffff)
+		literals := int(marker >> 33)
+		if len(out)+run+literals > maxWords || i+literals > wordCount {
+			return nil, 0, fmt.Errorf("bitmap runs past its end")
+		}
+		for ; run > 0; run-- {
+			out = append(out, fill)
+		}
+		for ; literals > 0; literals-- {
+			out = append(out, binary.BigEndian.Uint64(data[8+i*8:]))
+			i++
+		}
+	}
+	return out, size, nil
+}
+
+// writeEWAH compresses the first bitCount bits of b
+func writeEWAH(w *bytes.Buffer, b bitset, bitCount int) {
+	wordCount := (bitCount + 63) / 64
+	word := func(i int) uint64 {
+		if i < len(b) {
+			return b[i]
+		}
+		return 0
+	}
+	clean := func(w uint64) bool { return w == 0 || w == ^uint64(0) }
+
+	var words []uint64
+	lastMarker := 0
+	for i := 0; i < wordCount; {
+		var run, fill uint64
+		if first := word(i); clean(first) {
+			fill = first & 1
+			for i < wordCount && word(i) == first && run < 0xffffffff {
+				run++
+				i++
+			}
+		}
+		start := i
+		for i < wordCount && !clean(word(i)) && i-start < 0x7fffffff {
+			i++
+		}
+		lastMarker = len(words)
+		words = append(words, fill|run<<1|uint64(i-start)<<33)
+		for j := start; j < i; j++ {
+			words = append(words, word(j))
+		}
+	}
+	if len(words) == 0 {
+		words = append(words, 0)
+	}
+
+	binary.Write(w, binary.BigEndian, uint32(bitCount))
+	binary.Write(w, binary.BigEndian, uint32(len(words)))
+	binary.Write(w, binary.BigEndian, words)
+	binary.Write(w, binary.BigEndian, uint32(lastMarker))
+}
+
+type packBitmap struct {
+	pack *packFile
+	// bit -> position in the index and back
+	order []int
+	bits  []int
+	// which objects are of each kind
+	commits bitset
+	trees   bitset
+	blobs   bitset
+	tags    bitset
+	// everything each commit with a bitmap reaches
+	reachable map[string]bitset
+	// commits in the order their bitmaps were worked out, which is how they get written
+	selected []string
+}
+
+func newPackBitmap(pack *packFile) *packBitmap {
+	bm := &packBitmap{pack: pack, reachable: make(map[string]bitset)}
+	n := pack.count()
+	bm.order = make([]int, n)
+	for i := range bm.order {
+		bm.order[i] = i
+	}
+	sort.Slice(bm.order, func(i, j int) bool {
+		return pack.offsets[bm.order[i]] < pack.offsets[bm.order[j]]
+	})
+	bm.bits = make([]int, n)
+	for bit, pos := range bm.order {
+		bm.bits[pos] = bit
+	}
+	return bm
+}
+
+// loadBitmap reads the first pack bitmap there is once
+// shallow repositories and ones with pack.useBitmaps off get an empty one
+// since a shallow history stops where the bitmaps don't
+func (repo *Repository) loadBitmap() *packBitmap {
+	repo.odb.bitmapMu.Lock()
+	defer repo.odb.bitmapMu.Unlock()
+	if repo.bitmap != nil {
+		return repo.bitmap
+	}
+	repo.bitmap = &packBitmap{}
+	useBitmaps, err := repo.conf.Bool("pack.useBitmaps", true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: ignoring bitmaps: %s\n", err)
+	}
+	if !useBitmaps || len(repo.shallowCommits()) > 0 {
+		return repo.bitmap
+	}
+
+	packs, err := repo.loadPacks()
+	if err != nil {
+		return repo.bitmap
+	}
+	for _, pack := range packs {
+		path := strings.TrimSuffix(pack.path, ".pack") + ".bitmap"
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		bm, err := readBitmap(data, pack)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: ignoring %s: %s\n", path, err)
+			continue
+		}
+		repo.bitmap = bm
+		break
+	}
+	return repo.bitmap
+}
+
+func readBitmap(data []byte, pack *packFile) (*packBitmap, error) {
+	size := pack.hashSize
+	if len(data) < 12+2*size || !bytes.Equal(data[:4], []byte("BITM")) {
+		return nil, fmt.Errorf("bad signature")
+	}
+	if version := binary.BigEndian.Uint16(data[4:]); version != 1 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	flags := binary.BigEndian.Uint16(data[6:])
+	if flags&bitmapFullDag == 0 {
+		return nil, fmt.Errorf("not a full DAG bitmap")
+	}
+	if flags&^(bitmapFullDag|bitmapHashCache|bitmapLookupTable) != 0 {
+		return nil, fmt.Errorf("unsupported options %#x", flags)
+	}
+	count := int(binary.BigEndian.Uint32(data[8:]))
+	if !bytes.Equal(data[12:12+size], pack.sum) {
+		return nil, fmt.Errorf("doesn't match its pack")
+	}
+
+	bm := newPackBitmap(pack)
+	pos := 12 + size
+	for _, kind := range []*bitset{&bm.commits, &bm.trees, &bm.blobs, &bm.tags} {
+		b, size, err := readEWAH(data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		*kind = b
+		pos += size
+	}
+
+	entries := make([]bitset, 0, count)
+	for i := 0; i < count; i++ {
+		if len(data) < pos+6 {
+			return nil, fmt.Errorf("truncated entry %d", i)
+		}
+		idxPos := int(binary.BigEndian.Uint32(data[pos:]))
+		xorOffset := int(data[pos+4])
+		b, size, err := readEWAH(data[pos+6:])
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		pos += 6 + size
+		if idxPos >= pack.count() || xorOffset > len(entries) {
+			return nil, fmt.Errorf("entry %d points outside the pack", i)
+		}
+		if xorOffset > 0 {
+			b = b.xor(entries[len(entries)-xorOffset])
+		}
+		entries = append(entries, b)
+		sha := hex.EncodeToString(pack.shaAt(idxPos))
+		bm.reachable[sha] = b
+		bm.selected = append(bm.selected, sha)
+	}
+	return bm, nil
+}
+
+// position gives an object's bit, if it's in the pack
+func (bm *packBitmap) position(sha string) (int, bool) {
+	raw, err := hex.DecodeString(sha)
+	if err != nil || len(raw) != bm.pack.hashSize {
+		return 0, false
+	}
+	i := bm.pack.find(raw)
+	if i == -1 {
+		return 0, false
+	}
+	return bm.bits[i], true
+}
+
+func (bm *packBitmap) shaAt(bit int) string {
+	return hex.EncodeToString(bm.pack.shaAt(bm.order[bit]))
+}
+
+// reachableFrom is every object the tips lead to, as bits for what's in the pack
+// along with whatever isn't in it, like objects written since the pack
+// commits with a bitmap of their own stop the walk
+func (bm *packBitmap) reachableFrom(repo *Repository, tips []string) (bitset, map[string]bool, error) {
+	var result bitset
+	extra := make(map[string]bool)
+	mark := func(sha string) (int, bool, bool) {
+		bit, packed := bm.position(sha)
+		if packed {
+			if result.has(bit) {
+				return bit, packed, false
+			}
+			result.set(bit)
+			return bit, packed, true
+		}
+		if extra[sha] {
+			return bit, packed, false
+		}
+		extra[sha] = true
+		return bit, packed, true
+	}
+
+	stack := append([]string{}, tips...)
+	for len(stack) > 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if reachable, ok := bm.reachable[sha]; ok {
+			result.or(reachable)
+			continue
+		}
+		bit, packed, fresh := mark(sha)
+		if !fresh || packed && bm.blobs.has(bit) {
+			continue
+		}
+
+		if packed && bm.commits.has(bit) {
+			info, err := repo.commitInfo(sha)
+			if err != nil {
+				return nil, nil, err
+			}
+			stack = append(stack, info.tree)
+			if !repo.isShallow(sha) {
+				stack = append(stack, info.parents...)
+			}
+			continue
+		}
+
+		kind, contents, err := repo.readObject(sha)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch kind {
+		case "commit":
+			commit := &Commit{}
+			commit.Deserialize(contents)
+			tree, err := commit.getField("tree")
+			if err != nil {
+				return nil, nil, fmt.Errorf("Commit %s has no tree", sha)
+			}
+			stack = append(stack, tree)
+			if !repo.isShallow(sha) {
+				stack = append(stack, commit.parents()...)
+			}
+		case "tag":
+			tag := &Tag{}
+			tag.Deserialize(contents)
+			target, err := tag.getField("object")
+			if err != nil {
+				return nil, nil, fmt.Errorf("Tag %s has no object", sha)
+			}
+			stack = append(stack, target)
+		case "tree":
+			leaves, err := treeParseEntirety(contents, repo.format.size)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Malformed tree %s: %w", sha, err)
+			}
+			for _, leaf := range leaves {
+				switch leaf.mode {
+				case "40000":
+					stack = append(stack, hex.EncodeToString(leaf.sha))
+				case "160000":
+				default:
+					mark(hex.EncodeToString(leaf.sha))
+				}
+			}
+		}
+	}
+	return result, extra, nil
+}
+
+// bitmapObjectsToSend does upload-pack's want/have subtraction with bitmaps
+// giving up when there aren't any or something along the way can't be read
+func (repo *Repository) bitmapObjectsToSend(wants, haves []string) ([]string, bool) {
+	bm := repo.loadBitmap()
+	if bm.pack == nil {
+		return nil, false
+	}
+
+	var present []string
+	for _, have := range haves {
+		if repo.hasObject(have) {
+			present = append(present, have)
+		}
+	}
+	haveBits, haveExtra, err := bm.reachableFrom(repo, present)
+	if err != nil {
+		return nil, false
+	}
+	wantBits, wantExtra, err := bm.reachableFrom(repo, wants)
+	if err != nil {
+		return nil, false
+	}
+
+	var objects []string
+	wantBits.andNot(haveBits).each(func(bit int) {
+		objects = append(objects, bm.shaAt(bit))
+	})
+	var loose []string
+	for sha := range wantExtra {
+		if !haveExtra[sha] {
+			loose = append(loose, sha)
+		}
+	}
+	sort.Strings(loose)
+	return append(objects, loose...), true
+}
+
+// writeBitmap writes bitmaps for a pack holding everything the tips reach
+// every tip gets one, as does every bitmapCommitInterval-th commit behind them
+func (repo *Repository) writeBitmap(pack *packFile, tips []string) error {
+	bm := newPackBitmap(pack)
+
+	file, err := os.Open(pack.path)
+	if err != nil {
+		return fmt.Errorf("Couldn't open pack: %w", err)
+	}
+	defer file.Close()
+	for bit, pos := range bm.order {
+		kind, err := packEntryKind(file, pack.offsets[pos])
+		if err != nil {
+			return err
+		}
+		if kind == "" {
+			// deltas only say what they are once they're resolved
+			if kind, _, err = repo.readObject(hex.EncodeToString(pack.shaAt(pos))); err != nil {
+				return err
+			}
+		}
+		switch kind {
+		case "commit":
+			bm.commits.set(bit)
+		case "tree":
+			bm.trees.set(bit)
+		case "blob":
+			bm.blobs.set(bit)
+		case "tag":
+			bm.tags.set(bit)
+		}
+	}
+
+	isTip := make(map[string]bool)
+	for _, tip := range tips {
+		if sha, _, err := repo.peelToCommit(tip); err == nil {
+			isTip[sha] = true
+		}
+	}
+	commits := repo.reachableCommits(tips)
+	var selected []string
+	// oldest first so newer commits can build on the older bitmaps
+	for i := len(commits) - 1; i >= 0; i-- {
+		if isTip[commits[i]] || i%bitmapCommitInterval == 0 {
+			selected = append(selected, commits[i])
+		}
+	}
+
+	for _, sha := range selected {
+		reachable, extra, err := bm.reachableFrom(repo, []string{sha})
+		if err != nil {
+			return err
+		}
+		if len(extra) > 0 {
+			return fmt.Errorf("Couldn't write bitmap: %s reaches objects outside the pack", sha)
+		}
+		bm.reachable[sha] = reachable
+		bm.selected = append(bm.selected, sha)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("BITM")
+	binary.Write(&buf, binary.BigEndian, uint16(1))
+	binary.Write(&buf, binary.BigEndian, uint16(bitmapFullDag))
+	binary.Write(&buf, binary.BigEndian, uint32(len(bm.selected)))
+	buf.Write(pack.sum)
+	for _, kind := range []bitset{bm.commits, bm.trees, bm.blobs, bm.tags} {
+		writeEWAH(&buf, kind, pack.count())
+	}
+	for _, sha := range bm.selected {
+		raw, _ := hex.DecodeString(sha)
+		binary.Write(&buf, binary.BigEndian, uint32(pack.find(raw)))
+		buf.Write([]byte{0, 0})
+		writeEWAH(&buf, bm.reachable[sha], pack.count())
+	}
+	buf.Write(repo.format.sum(buf.Bytes()))
+
+	return repo.writeFileAtomic(strings.TrimSuffix(pack.path, ".pack")+".bitmap", buf.Bytes(), fsyncPackMetadata)
+}
+
+// packEntryKind reads what kind of object a pack entry is from its header
+// or an empty string for a delta
+func packEntryKind(file *os.File, offset uint64) (string, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(io.NewSectionReader(file, int64(offset), 1), b[:]); err != nil {
+		return "", fmt.Errorf("Couldn't read pack entry: %w", err)
+	}
+	return packKinds[b[0]>>4&7], nil
+}
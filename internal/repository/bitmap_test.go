@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBitmapsMatchAWalk(t *testing.T) {
+	repo := newTestRepo(t, true)
+	var chain []string
+	for i := range 150 {
+		files := map[string]string{"file": fmt.Sprintf("%d\n", i), fmt.Sprintf("dir/%d", i%7): "shared\n"}
+		chain = append(chain, commitTestFiles(t, repo, files, chain[max(len(chain)-1, 0):]...))
+	}
+	tip := chain[len(chain)-1]
+	if err := repo.writeRef("refs/heads/main", tip); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := repo.WriteTag(chain[10], "commit", "v1", testIdent, "v1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.writeRef("refs/tags/v1", tag); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.repack(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// read from the file it was written to
+	repo.forgetPacks()
+	bm := repo.loadBitmap()
+	if bm.pack == nil {
+		t.Fatal("repack wrote no bitmap")
+	}
+	if len(bm.reachable) < 2 {
+		t.Errorf("only %d commits have bitmaps, want the tip and one every %d commits", len(bm.reachable), bitmapCommitInterval)
+	}
+	if got := bm.commits.count(); got != len(chain) {
+		t.Errorf("%d objects are marked as commits, want %d", got, len(chain))
+	}
+	if got := bm.tags.count(); got != 1 {
+		t.Errorf("%d objects are marked as tags, want 1", got)
+	}
+
+	walked := func(tips ...string) []string {
+		objects, err := repo.reachableObjects(tips)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(objects)
+		return objects
+	}
+	for commit, reachable := range bm.reachable {
+		var got []string
+		reachable.each(func(bit int) { got = append(got, bm.shaAt(bit)) })
+		slices.Sort(got)
+		if want := walked(commit); !slices.Equal(got, want) {
+			t.Errorf("bitmap for %s has %d objects, a walk finds %d", commit, len(got), len(want))
+		}
+	}
+
+	// a commit written after the pack is walked and the rest comes from bitmaps
+	loose := commitTestFiles(t, repo, map[string]string{"file": "loose\n"}, tip)
+	have := chain[40]
+	got, ok := repo.bitmapObjectsToSend([]string{loose, tag}, []string{have})
+	if !ok {
+		t.Fatal("bitmaps weren't used")
+	}
+	slices.Sort(got)
+	haves := walked(have)
+	var want []string
+	for _, sha := range walked(loose, tag) {
+		if _, found := slices.BinarySearch(haves, sha); !found {
+			want = append(want, sha)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("bitmaps send %d objects, want %d", len(got), len(want))
+	}
+
+	// a bitmap for a different pack isn't used
+	bitmapPath := strings.TrimSuffix(bm.pack.path, ".pack") + ".bitmap"
+	data, err := os.ReadFile(bitmapPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data[12:], make([]byte, repo.format.size))
+	if _, err := readBitmap(data, bm.pack); err == nil {
+		t.Error("read a bitmap whose pack checksum doesn't match")
+	}
+}
@@ -0,0 +1,266 @@
+package repository
+
+/*
+ * the lines an ignored commit changed are guessed back onto lines of its parent's copy, the same way git does it
+ *
+ * a line is fingerprinted by the pairs of bytes in it, lower cased and with all whitespace as the same byte
+ * and two lines are as alike as the pairs they have in common
+ *
+ * for each hunk, each changed line is compared with the parent's lines within ten of where it would be
+ * if the hunk was stretched over the parent's side of it
+ * the line that's surest of its match, by how much better it is than the runner up, goes first
+ * its pairs are taken off the parent's line so another line can't match on the same ones,
+ * and the lines before and after it are matched the same way, each only against the parent's lines on its side
+ * so the guesses keep the order the lines were in
+ *
+ * a line that gets nothing from that, say one added where the parent has none, is compared with the parent's whole copy
+ * and goes to the most alike line if it shares at least ten pairs with it, the nearest one on a tie
+ */
+
+const (
+	// how far from where a line would be in the parent's hunk it's compared
+	guessSearchDistance = 10
+	// how many pairs a line has to share with one anywhere in the parent's copy
+	guessFileThreshold = 10
+
+	certaintyNotCalculated = -1
+	certainNothingMatches  = -2
+)
+
+type fingerprint map[[2]byte]int
+
+// lineFingerprint counts the pairs of bytes in a line
+// the line has whitespace either side, so a word's first and last letters make a pair too
+func lineFingerprint(line string) fingerprint {
+	fp := make(fingerprint)
+	var prev byte
+	for i := 0; i <= len(line); i++ {
+		var c byte
+		if i < len(line) {
+			switch c = line[i]; c {
+			case ' ', '\t', '\n', '\r':
+				c = 0
+			default:
+				if c >= 'A' && c <= 'Z' {
+					c += 'a' - 'A'
+				}
+			}
+		}
+		if prev != 0 || c != 0 {
+			fp[[2]byte{prev, c}]++
+		}
+		prev = c
+	}
+	return fp
+}
+
+func (fp fingerprint) similarity(other fingerprint) int {
+	same := 0
+	for pair, count := range other {
+		same += min(count, fp[pair])
+	}
+	return same
+}
+
+// subtract takes another line's pairs off this one
+func (fp fingerprint) subtract(other fingerprint) {
+	for pair, count := range other {
+		if have, ok := fp[pair]; ok {
+			if have <= count {
+				delete(fp, pair)
+			} else {
+				fp[pair] = have - count
+			}
+		}
+	}
+}
+
+func fingerprints(lines []string) []fingerprint {
+	prints := make([]fingerprint, len(lines))
+	for i, line := range lines {
+		prints[i] = lineFingerprint(line)
+	}
+	return prints
+}
+
+// guessLines gives for each line of b the line of a it's guessed to come from, -1 for none
+// only lines in the hunks are guessed, the hunks are gone through in order
+// as what a hunk matches is taken off a's fingerprints for the ones after
+func guessLines(a, b []string, hunks []diffHunk) []int {
+	printsA, printsB := fingerprints(a), fingerprints(b)
+	guesses := make([]int, len(b))
+	for i := range guesses {
+		guesses[i] = -1
+	}
+
+	for _, hunk := range hunks {
+		if hunk.bCount == 0 {
+			continue
+		}
+		var fuzzy []int
+		if hunk.aCount > 0 {
+			fuzzy = fuzzyMatch(printsA, printsB, hunk)
+		}
+		for i := 0; i < hunk.bCount; i++ {
+			line := hunk.bStart + i
+			if fuzzy != nil && fuzzy[i] >= 0 {
+				guesses[line] = fuzzy[i]
+			} else {
+				guesses[line] = scanFile(printsA, printsB[line], line)
+			}
+		}
+	}
+	return guesses
+}
+
+// scanFile finds the line of a most like a line of b, sharing at least guessFileThreshold pairs with it
+// the nearest to where the line is in b on a tie
+func scanFile(printsA []fingerprint, fp fingerprint, line int) int {
+	best, bestSimilarity := -1, guessFileThreshold
+	for i, printA := range printsA {
+		similarity := fp.similarity(printA)
+		if similarity < bestSimilarity {
+			continue
+		}
+		if similarity == bestSimilarity && best != -1 && abs(best-line) < abs(i-line) {
+			continue
+		}
+		best, bestSimilarity = i, similarity
+	}
+	return best
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// fuzzyGuess is the state of matching one hunk's lines of b against its lines of a
+type fuzzyGuess struct {
+	printsA, printsB []fingerprint
+	hunk             diffHunk
+	searchA          int
+	searchB          int
+	// for each line of the hunk in b, its similarity with the lines of a either side of where it maps to
+	// scaled down by the distance so nearer lines win ties, -1 where it has to be worked out again
+	similarities [][]int
+	certainties  []int
+	best         []int
+	secondBest   []int
+}
+
+// fuzzyMatch matches the lines of a hunk in b to its lines in a, giving the line of a for each or -1
+func fuzzyMatch(printsA, printsB []fingerprint, hunk diffHunk) []int {
+	g := &fuzzyGuess{
+		printsA: printsA, printsB: printsB, hunk: hunk,
+		searchA:      min(guessSearchDistance, hunk.aCount-1),
+		similarities: make([][]int, hunk.bCount),
+		certainties:  make([]int, hunk.bCount),
+		best:         make([]int, hunk.bCount),
+		secondBest:   make([]int, hunk.bCount),
+	}
+	// lines of b further apart than this never get compared with the same line of a
+	g.searchB = ((2*g.searchA+1)*hunk.bCount - 1) / hunk.aCount
+	for i := range g.similarities {
+		g.similarities[i] = make([]int, 2*g.searchA+1)
+		for j := range g.similarities[i] {
+			g.similarities[i][j] = -1
+		}
+		g.certainties[i] = certaintyNotCalculated
+	}
+	g.match(hunk.aStart, hunk.aCount, 0, hunk.bCount)
+	return g.best
+}
+
+// closestA is the line of a that a line of the hunk in b lines up with, stretching the hunk over a's side
+func (g *fuzzyGuess) closestA(local int) int {
+	return (local*2+1)*g.hunk.aCount/(g.hunk.bCount*2) + g.hunk.aStart
+}
+
+// similarity is where the similarity of a line of a with a line of the hunk in b is kept
+func (g *fuzzyGuess) similarity(lineA, local int) *int {
+	return &g.similarities[local][lineA-g.closestA(local)+g.searchA]
+}
+
+// findBest works out which lines of a[startA:startA+lengthA] a line of the hunk is most and next most like
+// and how sure a match that makes it
+func (g *fuzzyGuess) findBest(startA, lengthA, local int) {
+	if g.certainties[local] != certaintyNotCalculated {
+		return
+	}
+	closest := g.closestA(local)
+	from := max(closest-g.searchA, startA)
+	to := min(closest+g.searchA+1, startA+lengthA)
+
+	best, secondBest := 0, 0
+	bestAt, secondBestAt := startA, startA
+	for i := from; i < to; i++ {
+		similarity := g.similarity(i, local)
+		if *similarity == -1 {
+			*similarity = g.printsB[g.hunk.bStart+local].similarity(g.printsA[i]) * (1000 - abs(i-closest))
+		}
+		if *similarity > best {
+			secondBest, secondBestAt = best, bestAt
+			best, bestAt = *similarity, i
+		} else if *similarity > secondBest {
+			secondBest, secondBestAt = *similarity, i
+		}
+	}
+
+	if best == 0 {
+		g.certainties[local] = certainNothingMatches
+		g.best[local] = -1
+		return
+	}
+	// a line that matches two lines well is less sure than one that matches one,
+	// but still surer than one that only matches a line badly
+	g.certainties[local] = best*2 - secondBest
+	g.best[local] = bestAt
+	g.secondBest[local] = secondBestAt
+}
+
+// match settles the surest match among the hunk's lines startB ... startB+lengthB
+// then matches the lines before and after it against the lines of a on their side of it
+func (g *fuzzyGuess) match(startA, lengthA, startB, lengthB int) {
+	surest, certainty := -1, -1
+	for i := startB; i < startB+lengthB; i++ {
+		g.findBest(startA, lengthA, i)
+		if g.certainties[i] > certainty {
+			surest, certainty = i, g.certainties[i]
+		}
+	}
+	if surest == -1 {
+		return
+	}
+	lineA := g.best[surest]
+	g.printsA[lineA].subtract(g.printsB[g.hunk.bStart+surest])
+
+	// the line of a has changed, so what the lines near enough to be compared with it had for it goes
+	// and so do matches on the wrong side of the one just made
+	from := max(surest-g.searchB, startB)
+	to := min(surest+g.searchB+1, startB+lengthB)
+	for i := from; i < to; i++ {
+		if abs(lineA-g.closestA(i)) <= g.searchA {
+			*g.similarity(lineA, i) = -1
+		}
+	}
+	for i := surest - 1; i >= from; i-- {
+		if g.certainties[i] >= 0 && (g.best[i] >= lineA || g.secondBest[i] >= lineA) {
+			g.certainties[i] = certaintyNotCalculated
+		}
+	}
+	for i := surest + 1; i < to; i++ {
+		if g.certainties[i] >= 0 && (g.best[i] <= lineA || g.secondBest[i] <= lineA) {
+			g.certainties[i] = certaintyNotCalculated
+		}
+	}
+
+	if surest > startB {
+		g.match(startA, lineA+1-startA, startB, surest-startB)
+	}
+	if surest+1 < startB+lengthB {
+		g.match(lineA, startA+lengthA-lineA, surest+1, startB+lengthB-surest-1)
+	}
+}
@@ -0,0 +1,1070 @@
+package repository
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+ * blame hands each line of a file back through history until it gets to the commit that wrote it
+ *
+ * every line starts out on the commit being blamed, the first suspect
+ * suspects are taken newest first, and each one's copy of the file is diffed against its parents' copies
+ *   lines a parent has too are handed to it, to be looked at when its turn comes
+ *   lines the diff says changed stay on the suspect, unless
+ *     -M finds them moved from elsewhere in the parent's copy of the file
+ *     -C finds them copied from a file the commit changed, -C -C from any file in the parent if this one's new,
+ *     and -C -C -C from any file in the parent whatever
+ *     the commit is ignored, then they go to whichever line of the parent's hunk looks most like them
+ * a file missing from a parent is looked for under the name it had before, so renames are followed
+ * root commits and shallow ones keep whatever's still on them, they're the boundary
+ *
+ * with no revision the file in the work tree is blamed, lines not committed yet go on an all zero commit
+ *
+ * default output
+ *   <sha> [<path>] (<author> <date> <line number>) <line>
+ *   ^ in front of the sha marks a boundary commit
+ *   with blame.markIgnoredLines ? marks a line passed over an ignored commit
+ *   and with blame.markUnblamableLines * marks one an ignored commit added that couldn't be passed on
+ *
+ * --porcelain, each run of lines from the same commit is a group
+ *   <sha> <line in that commit's file> <line now> [<lines in the group>]   the count only starts a group
+ *   author, author-mail, author-time, author-tz, committer, committer-mail, committer-time, committer-tz,
+ *   summary, boundary, previous <parent> <path> and filename, the first time the commit comes up
+ *   \t<line>
+ * --line-porcelain repeats the commit's details for every line
+ */
+
+const (
+	blameMoveScore = 20
+	blameCopyScore = 40
+)
+
+type blameOptions struct {
+	ranges        []string
+	porcelain     bool
+	linePorcelain bool
+	ignoreSpace   bool
+	showRoot      bool
+	move          blameScore
+	copy          blameScore
+	ignoreRevs    []string
+}
+
+// blameScore is -M and -C, given alone or with how many alphanumerics a moved block needs, -M30
+// -C counts how many times it was given
+type blameScore struct {
+	level int
+	score int
+}
+
+func (s *blameScore) String() string {
+	return strconv.Itoa(s.score)
+}
+
+func (s *blameScore) IsBoolFlag() bool {
+	return true
+}
+
+func (s *blameScore) Set(value string) error {
+	s.level++
+	if value == "true" {
+		return nil
+	}
+	score, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("Invalid score %s", value)
+	}
+	s.score = score
+	return nil
+}
+
+// blameOrigin is a commit's copy of a file
+type blameOrigin struct {
+	commit string
+	path   string
+	blob   string
+	lines  []string
+	// the lines as they're compared, without whitespace for -w
+	keys []string
+	// the parent's copy it was diffed against
+	previous *blameOrigin
+}
+
+// blameEntry is a run of lines of the file being blamed that are on the same suspect
+type blameEntry struct {
+	// the first line now and in the origin's copy, counting from zero
+	final, source, count int
+	origin               *blameOrigin
+	// handed over an ignored commit, or added by one and kept on it
+	ignored, unblamable bool
+}
+
+// blameCommit is what's shown about a commit
+type blameCommit struct {
+	author, authorMail       string
+	authorTime               time.Time
+	committer, committerMail string
+	committerTime            time.Time
+	summary                  string
+	boundary                 bool
+}
+
+type blame struct {
+	repo    *Repository
+	opts    blameOptions
+	ignored map[string]bool
+	// the commit made up for the work tree, it has HEAD as its parent
+	worktreeSha string
+	// the copy of the file being blamed
+	final   *blameOrigin
+	origins map[string]*blameOrigin
+	pending map[string][]*blameEntry
+	queue   blameQueue
+	done    []*blameEntry
+	commits map[string]*blameCommit
+}
+
+func (repo *Repository) blame(args []string) error {
+	var opts blameOptions
+	var ignoreRevsFiles []string
+	ignoreRevsFilesGiven := false
+	blameCmd := flag.NewFlagSet("blame", flag.ExitOnError)
+	blameCmd.Func("L", "Blame only the lines in <start>,<end>", func(value string) error {
+		opts.ranges = append(opts.ranges, value)
+		return nil
+	})
+	blameCmd.BoolVar(&opts.porcelain, "porcelain", false, "Show the output in a format for machines")
+	blameCmd.BoolVar(&opts.linePorcelain, "line-porcelain", false, "Show the porcelain format with the commit's details on every line")
+	blameCmd.BoolVar(&opts.ignoreSpace, "w", false, "Ignore whitespace when comparing lines")
+	showRoot, err := repo.conf.Bool("blame.showRoot", false)
+	if err != nil {
+		return err
+	}
+	blameCmd.BoolVar(&opts.showRoot, "root", showRoot, "Don't treat root commits as boundaries")
+	blameCmd.Var(&opts.move, "M", "Find lines moved within the file")
+	blameCmd.Var(&opts.copy, "C", "Find lines moved or copied from other files, more times looks harder")
+	blameCmd.Func("ignore-rev", "Ignore the changes made by a revision", func(value string) error {
+		opts.ignoreRevs = append(opts.ignoreRevs, value)
+		return nil
+	})
+	blameCmd.Func("ignore-revs-file", "Ignore the revisions listed in a file, an empty name clears the list", func(value string) error {
+		if !ignoreRevsFilesGiven {
+			ignoreRevsFiles = nil
+			ignoreRevsFilesGiven = true
+		}
+		if value == "" {
+			ignoreRevsFiles = nil
+		} else {
+			ignoreRevsFiles = append(ignoreRevsFiles, value)
+		}
+		return nil
+	})
+	if err := blameCmd.Parse(attachedScores(args)); err != nil {
+		return err
+	}
+	opts.porcelain = opts.porcelain || opts.linePorcelain
+
+	var file, rev string
+	rest := blameCmd.Args()
+	switch {
+	case len(rest) == 3 && rest[1] == "--":
+		rev, file = rest[0], rest[2]
+	case len(rest) == 2 && rest[0] == "--":
+		file = rest[1]
+	case len(rest) == 1:
+		file = rest[0]
+	case len(rest) == 2:
+		file, rev = rest[0], rest[1]
+	default:
+		return fmt.Errorf("usage: twine blame [<options>] <file> [<rev>]")
+	}
+
+	if !ignoreRevsFilesGiven {
+		for _, name := range repo.conf.GetAll("blame.ignoreRevsFile") {
+			if expanded, err := expandConfigPath(name); err == nil {
+				name = expanded
+			}
+			ignoreRevsFiles = append(ignoreRevsFiles, name)
+		}
+	}
+	b := &blame{
+		repo:    repo,
+		opts:    opts,
+		ignored: make(map[string]bool),
+		origins: make(map[string]*blameOrigin),
+		pending: make(map[string][]*blameEntry),
+		commits: make(map[string]*blameCommit),
+	}
+	if err := b.loadIgnored(opts.ignoreRevs, ignoreRevsFiles); err != nil {
+		return err
+	}
+
+	final, err := b.start(repo.repoPath(file), rev)
+	if err != nil {
+		return err
+	}
+	b.final = final
+	ranges, err := blameRanges(opts.ranges, final.lines, final.path)
+	if err != nil {
+		return err
+	}
+	for _, lines := range ranges {
+		b.hand(final.commit, &blameEntry{final: lines[0], source: lines[0], count: lines[1] - lines[0], origin: final})
+	}
+	if err := b.run(); err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if opts.porcelain {
+		return b.writePorcelain(out, final)
+	}
+	return b.write(out, final)
+}
+
+// attachedScores splits -M30 and -C30 into -M=30 and -C=30, which is how flag wants them
+func attachedScores(args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		if len(arg) > 2 && (arg[:2] == "-M" || arg[:2] == "-C") && arg[2] >= '0' && arg[2] <= '9' {
+			arg = arg[:2] + "=" + arg[2:]
+		}
+		out[i] = arg
+	}
+	return out
+}
+
+// repoPath turns a path given from wherever twine was run into one from the top of the work tree
+func (repo *Repository) repoPath(name string) string {
+	if repo.worktree != "" {
+		if abs, err := filepath.Abs(name); err == nil {
+			if rel, err := filepath.Rel(repo.worktree, abs); err == nil && !strings.HasPrefix(rel, "..") {
+				return filepath.ToSlash(rel)
+			}
+		}
+	}
+	return filepath.ToSlash(filepath.Clean(name))
+}
+
+// loadIgnored resolves the commits from --ignore-rev and the ignore revs files
+func (b *blame) loadIgnored(revs, files []string) error {
+	for _, name := range files {
+		if !filepath.IsAbs(name) && b.repo.worktree != "" {
+			name = filepath.Join(b.repo.worktree, name)
+		}
+		contents, err := os.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("Couldn't read the ignore revs file %s: %w", name, err)
+		}
+		for _, line := range strings.Split(string(contents), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				revs = append(revs, line)
+			}
+		}
+	}
+	for _, rev := range revs {
+		sha, err := b.repo.findObject(rev)
+		if err != nil {
+			return err
+		}
+		commitSha, _, err := b.repo.peelToCommit(sha)
+		if err != nil {
+			return err
+		}
+		b.ignored[commitSha] = true
+	}
+	return nil
+}
+
+// start gives the copy of the file being blamed
+// with no revision that's the one in the work tree, on a made up commit if it differs from HEAD's
+func (b *blame) start(path, rev string) (*blameOrigin, error) {
+	name := rev
+	if name == "" {
+		name = "HEAD"
+	}
+	sha, err := b.repo.findObject(name)
+	if err != nil {
+		return nil, err
+	}
+	commitSha, _, err := b.repo.peelToCommit(sha)
+	if err != nil {
+		return nil, err
+	}
+	origin, err := b.originIn(commitSha, path)
+	if err != nil {
+		return nil, err
+	}
+	if origin == nil {
+		return nil, fmt.Errorf("no such path '%s' in %s", path, name)
+	}
+	if err := b.load(origin); err != nil {
+		return nil, err
+	}
+	if rev != "" || b.repo.files == nil {
+		return origin, nil
+	}
+
+	data, err := fs.ReadFile(b.repo.files, path)
+	if err != nil {
+		// deleted from the work tree, so there's nothing newer than HEAD
+		return origin, nil
+	}
+	blobSha, err := b.repo.writeRawObject("blob", data, false)
+	if err != nil {
+		return nil, err
+	}
+	if blobSha == origin.blob {
+		return origin, nil
+	}
+
+	b.worktreeSha = strings.Repeat("0", 2*b.repo.format.size)
+	now := time.Now()
+	b.commits[b.worktreeSha] = &blameCommit{
+		author:        "Not Committed Yet",
+		authorMail:    "not.committed.yet",
+		authorTime:    now,
+		committer:     "Not Committed Yet",
+		committerMail: "not.committed.yet",
+		committerTime: now,
+		summary:       fmt.Sprintf("Version of %s from %s", path, path),
+	}
+	worktree := b.origin(b.worktreeSha, path, blobSha)
+	b.setLines(worktree, data)
+	return worktree, nil
+}
+
+// origin gives the one copy of the file at path in a commit, so entries on it can be grouped
+func (b *blame) origin(commit, path, blob string) *blameOrigin {
+	key := commit + "\x00" + path
+	if origin, ok := b.origins[key]; ok {
+		return origin
+	}
+	origin := &blameOrigin{commit: commit, path: path, blob: blob}
+	b.origins[key] = origin
+	return origin
+}
+
+// originIn finds the file at path in a commit, nil if it isn't there
+func (b *blame) originIn(commit, path string) (*blameOrigin, error) {
+	info, err := b.repo.commitInfo(commit)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := b.repo.treeLookup(info.tree, path)
+	if err != nil || leaf.mode == "40000" || leaf.mode == "160000" {
+		return nil, nil
+	}
+	return b.origin(commit, path, leaf.Sha()), nil
+}
+
+// load reads in an origin's copy of the file the first time its lines are needed
+func (b *blame) load(origin *blameOrigin) error {
+	if origin.keys != nil {
+		return nil
+	}
+	_, data, err := b.repo.readObject(origin.blob)
+	if err != nil {
+		return err
+	}
+	b.setLines(origin, data)
+	return nil
+}
+
+func (b *blame) setLines(origin *blameOrigin, data []byte) {
+	text := string(data)
+	origin.lines = strings.SplitAfter(text, "\n")
+	if origin.lines[len(origin.lines)-1] == "" {
+		origin.lines = origin.lines[:len(origin.lines)-1]
+	}
+	origin.keys = make([]string, len(origin.lines))
+	for i, line := range origin.lines {
+		if b.opts.ignoreSpace {
+			line = strings.Join(strings.Fields(line), "")
+		}
+		origin.keys[i] = line
+	}
+}
+
+// hand puts an entry on its origin's commit, queueing the commit if it's new
+func (b *blame) hand(commit string, entry *blameEntry) {
+	if _, queued := b.pending[commit]; !queued {
+		when := time.Now().Unix()
+		if commit != b.worktreeSha {
+			if info, err := b.repo.commitInfo(commit); err == nil {
+				when = info.time
+			}
+		}
+		heap.Push(&b.queue, blameSuspect{commit, when})
+	}
+	b.pending[commit] = append(b.pending[commit], entry)
+}
+
+func (b *blame) run() error {
+	for b.queue.Len() > 0 {
+		suspect := heap.Pop(&b.queue).(blameSuspect)
+		entries := b.pending[suspect.sha]
+		delete(b.pending, suspect.sha)
+
+		parents, err := b.parents(suspect.sha)
+		if err != nil {
+			return err
+		}
+		var order []*blameOrigin
+		byOrigin := make(map[*blameOrigin][]*blameEntry)
+		for _, entry := range entries {
+			if _, ok := byOrigin[entry.origin]; !ok {
+				order = append(order, entry.origin)
+			}
+			byOrigin[entry.origin] = append(byOrigin[entry.origin], entry)
+		}
+		for _, origin := range order {
+			kept, err := b.pass(origin, parents, byOrigin[origin])
+			if err != nil {
+				return err
+			}
+			b.done = append(b.done, kept...)
+		}
+	}
+	return nil
+}
+
+// parents are the commits blame can be handed to, none past a root or shallow commit
+func (b *blame) parents(commit string) ([]string, error) {
+	if commit == b.worktreeSha {
+		head, err := b.repo.readRef("HEAD")
+		if err != nil {
+			return nil, nil
+		}
+		return []string{head}, nil
+	}
+	if b.repo.isShallow(commit) {
+		b.commitDetails(commit).boundary = true
+		return nil, nil
+	}
+	info, err := b.repo.commitInfo(commit)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.parents) == 0 && !b.opts.showRoot {
+		b.commitDetails(commit).boundary = true
+	}
+	return info.parents, nil
+}
+
+// pass hands what it can of an origin's entries to the parents, giving back the ones that stay
+func (b *blame) pass(origin *blameOrigin, parents []string, entries []*blameEntry) ([]*blameEntry, error) {
+	if len(parents) == 0 {
+		return entries, nil
+	}
+	if err := b.load(origin); err != nil {
+		return nil, err
+	}
+
+	parentOrigins := make([]*blameOrigin, len(parents))
+	for i, parent := range parents {
+		parentOrigin, err := b.findOrigin(parent, origin)
+		if err != nil {
+			return nil, err
+		}
+		if parentOrigin == nil {
+			continue
+		}
+		if origin.previous == nil {
+			origin.previous = parentOrigin
+		}
+		// nothing changed, so the whole lot is the parent's
+		if parentOrigin.blob == origin.blob {
+			for _, entry := range entries {
+				entry.origin = parentOrigin
+				b.hand(parent, entry)
+			}
+			return nil, nil
+		}
+		if err := b.load(parentOrigin); err != nil {
+			return nil, err
+		}
+		parentOrigins[i] = parentOrigin
+	}
+
+	matches := make([][]int, len(parents))
+	for i, parentOrigin := range parentOrigins {
+		if parentOrigin != nil {
+			matches[i] = matchLines(parentOrigin.lines, origin.lines, b.opts.ignoreSpace)
+			entries = b.passMatched(parents[i], parentOrigin, entries, matches[i])
+		}
+	}
+	// what an ignored commit changed goes to a parent where a line there looks like it, the first parent first
+	if b.ignored[origin.commit] {
+		found := false
+		for i, parentOrigin := range parentOrigins {
+			if parentOrigin != nil {
+				found = true
+				entries = b.passIgnored(parentOrigin, origin, entries, matches[i])
+			}
+		}
+		if !found {
+			for _, entry := range entries {
+				entry.unblamable = true
+			}
+		}
+	}
+
+	// -C finds moves within the file too
+	if b.opts.move.level > 0 || b.opts.copy.level > 0 {
+		score := b.opts.move.score
+		if score == 0 {
+			score = blameMoveScore
+		}
+		for i, parentOrigin := range parentOrigins {
+			if parentOrigin != nil {
+				entries = b.passMoved(parents[i], origin, entries, []*blameOrigin{parentOrigin}, score)
+			}
+		}
+	}
+	if b.opts.copy.level > 0 {
+		score := b.opts.copy.score
+		if score == 0 {
+			score = blameCopyScore
+		}
+		for i, parent := range parents {
+			if len(entries) == 0 {
+				break
+			}
+			candidates, err := b.copySources(parent, origin, parentOrigins[i])
+			if err != nil {
+				return nil, err
+			}
+			for _, candidate := range candidates {
+				if err := b.load(candidate); err != nil {
+					return nil, err
+				}
+			}
+			entries = b.passMoved(parent, origin, entries, candidates, score)
+		}
+	}
+	return entries, nil
+}
+
+// passMatched hands the parent the lines the diff says it has the same, splitting entries where that changes
+func (b *blame) passMatched(parent string, parentOrigin *blameOrigin, entries []*blameEntry, matches []int) []*blameEntry {
+	var kept []*blameEntry
+	for _, entry := range entries {
+		start := 0
+		for start < entry.count {
+			from := matches[entry.source+start]
+			end := start + 1
+			for end < entry.count {
+				next := matches[entry.source+end]
+				if (from == -1) != (next == -1) || (from != -1 && next != from+end-start) {
+					break
+				}
+				end++
+			}
+
+			part := &blameEntry{
+				final:   entry.final + start,
+				source:  entry.source + start,
+				count:   end - start,
+				origin:  entry.origin,
+				ignored: entry.ignored,
+			}
+			if from == -1 {
+				kept = append(kept, part)
+			} else {
+				part.source, part.origin = from, parentOrigin
+				b.hand(parent, part)
+			}
+			start = end
+		}
+	}
+	return kept
+}
+
+// passIgnored hands each line an ignored commit changed to the line of the parent's copy guessLines picks for it
+// a line it finds nothing like stays on the ignored commit, unblamable
+func (b *blame) passIgnored(parentOrigin, origin *blameOrigin, entries []*blameEntry, matches []int) []*blameEntry {
+	guesses := guessLines(parentOrigin.lines, origin.lines, diffHunks(matches, len(parentOrigin.lines)))
+
+	var kept []*blameEntry
+	for _, entry := range entries {
+		for i := 0; i < entry.count; i++ {
+			line := &blameEntry{
+				final:      entry.final + i,
+				source:     entry.source + i,
+				count:      1,
+				origin:     entry.origin,
+				ignored:    entry.ignored,
+				unblamable: entry.unblamable,
+			}
+			if from := guesses[line.source]; from != -1 {
+				line.source, line.origin, line.ignored = from, parentOrigin, true
+				b.hand(parentOrigin.commit, line)
+				continue
+			}
+			line.unblamable = true
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
+
+// blameSplit is the part of an entry found in another file, count lines from start in the entry
+// that are at from in source's copy
+type blameSplit struct {
+	source             *blameOrigin
+	start, from, count int
+	score              int
+}
+
+// passMoved looks for the entries' lines in the sources, handing over the best block of them found
+// as long as it scores more than minScore, and looking again for what's left either side of it
+// the lines looked for are the ones in the file being blamed, which only differ from the origin's
+// once they've been through an ignored commit or -w
+func (b *blame) passMoved(commit string, origin *blameOrigin, entries []*blameEntry, sources []*blameOrigin, minScore int) []*blameEntry {
+	var kept []*blameEntry
+	for len(entries) > 0 {
+		entry := entries[0]
+		entries = entries[1:]
+
+		var best blameSplit
+		for _, source := range sources {
+			if split := b.findSplit(entry, source); split.count > 0 && (best.count == 0 || split.score >= best.score) {
+				best = split
+			}
+		}
+		if best.count == 0 || best.score <= minScore {
+			kept = append(kept, entry)
+			continue
+		}
+
+		b.hand(commit, &blameEntry{
+			final:   entry.final + best.start,
+			source:  best.from,
+			count:   best.count,
+			origin:  best.source,
+			ignored: entry.ignored,
+		})
+		if best.start > 0 {
+			entries = append(entries, &blameEntry{final: entry.final, source: entry.source, count: best.start, origin: origin, ignored: entry.ignored})
+		}
+		if rest := entry.count - best.start - best.count; rest > 0 {
+			entries = append(entries, &blameEntry{
+				final:   entry.final + best.start + best.count,
+				source:  entry.source + best.start + best.count,
+				count:   rest,
+				origin:  origin,
+				ignored: entry.ignored,
+			})
+		}
+	}
+	return kept
+}
+
+// findSplit diffs an entry's lines against source's copy of a file
+// and gives the run the diff has unchanged that scores best, the last one on a tie
+func (b *blame) findSplit(entry *blameEntry, source *blameOrigin) blameSplit {
+	lines := b.final.lines[entry.final : entry.final+entry.count]
+	var best blameSplit
+	consider := func(start, from, end int) {
+		if start >= end {
+			return
+		}
+		score := blameScoreOf(lines[start:end])
+		if best.count == 0 || score >= best.score {
+			best = blameSplit{source: source, start: start, from: from, count: end - start, score: score}
+		}
+	}
+
+	sourceNext, next := 0, 0
+	for _, hunk := range diffHunks(matchLines(source.lines, lines, b.opts.ignoreSpace), len(source.lines)) {
+		consider(next, sourceNext, hunk.bStart)
+		sourceNext, next = hunk.aStart+hunk.aCount, hunk.bStart+hunk.bCount
+	}
+	consider(next, sourceNext, len(lines))
+	return best
+}
+
+// blameScoreOf is what a block of moved lines is scored by, one more than the ascii alphanumerics in it
+func blameScoreOf(lines []string) int {
+	score := 1
+	for _, line := range lines {
+		for i := 0; i < len(line); i++ {
+			if c := line[i]; c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+				score++
+			}
+		}
+	}
+	return score
+}
+
+// findOrigin finds the file in a parent, under the same path or the one it was renamed from
+func (b *blame) findOrigin(parent string, origin *blameOrigin) (*blameOrigin, error) {
+	found, err := b.originIn(parent, origin.path)
+	if err != nil || found != nil || origin.commit == b.worktreeSha {
+		return found, err
+	}
+
+	parentFiles, err := b.files(parent)
+	if err != nil {
+		return nil, err
+	}
+	files, err := b.files(origin.commit)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.load(origin); err != nil {
+		return nil, err
+	}
+
+	// a rename takes a file that's gone from the commit, the closest one if it's at least half the same
+	var best *blameOrigin
+	bestScore := 0.5
+	for path, entry := range parentFiles {
+		if _, ok := files[path]; ok || entry.mode == "160000" {
+			continue
+		}
+		candidate := b.origin(parent, path, entry.sha)
+		if entry.sha == origin.blob {
+			return candidate, nil
+		}
+		if err := b.load(candidate); err != nil {
+			return nil, err
+		}
+		same := 0
+		for _, from := range matchLines(candidate.lines, origin.lines, b.opts.ignoreSpace) {
+			if from != -1 {
+				same++
+			}
+		}
+		score := float64(same) / float64(max(len(candidate.keys), len(origin.keys), 1))
+		if score >= bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	return best, nil
+}
+
+// copySources are the parent's files lines could have been copied from
+func (b *blame) copySources(parent string, origin, parentOrigin *blameOrigin) ([]*blameOrigin, error) {
+	parentFiles, err := b.files(parent)
+	if err != nil {
+		return nil, err
+	}
+	// the files the commit changed are looked in, or every file for -C -C on a new or renamed one
+	everything := b.opts.copy.level >= 3 ||
+		b.opts.copy.level == 2 && (parentOrigin == nil || parentOrigin.path != origin.path)
+	var files map[string]treeEntry
+	if !everything {
+		if files, err = b.changedFiles(origin.commit); err != nil {
+			return nil, err
+		}
+	}
+
+	var paths []string
+	for path, entry := range parentFiles {
+		// the parent's copy of the file itself was already looked at for moves
+		if parentOrigin != nil && path == parentOrigin.path || entry.mode == "160000" {
+			continue
+		}
+		if files != nil {
+			if now, ok := files[path]; ok && now.sha == entry.sha && now.mode == entry.mode {
+				continue
+			}
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	sources := make([]*blameOrigin, 0, len(paths))
+	for _, path := range paths {
+		sources = append(sources, b.origin(parent, path, parentFiles[path].sha))
+	}
+	return sources, nil
+}
+
+func (b *blame) files(commit string) (map[string]treeEntry, error) {
+	info, err := b.repo.commitInfo(commit)
+	if err != nil {
+		return nil, err
+	}
+	return b.repo.flattenTree(info.tree)
+}
+
+// changedFiles is what a commit's files are compared to the parent's by for -C
+// for the work tree that's the index, as git looks at what's staged
+func (b *blame) changedFiles(commit string) (map[string]treeEntry, error) {
+	if commit != b.worktreeSha {
+		return b.files(commit)
+	}
+	index, err := b.repo.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]treeEntry, len(index.entries))
+	for _, entry := range index.entries {
+		files[entry.path] = treeEntry{mode: fmt.Sprintf("%o", entry.mode), sha: hex.EncodeToString(entry.sha)}
+	}
+	return files, nil
+}
+
+func (b *blame) commitDetails(sha string) *blameCommit {
+	if details, ok := b.commits[sha]; ok {
+		return details
+	}
+	details := &blameCommit{}
+	b.commits[sha] = details
+	obj, err := b.repo.makeObject(sha)
+	if err != nil {
+		return details
+	}
+	commit, ok := obj.(*Commit)
+	if !ok {
+		return details
+	}
+	author, _ := commit.getField("author")
+	committer, _ := commit.getField("committer")
+	details.author, details.authorMail, details.authorTime = splitIdent(author)
+	details.committer, details.committerMail, details.committerTime = splitIdent(committer)
+	subject, _, _ := strings.Cut(commit.message, "\n\n")
+	details.summary = strings.Join(strings.Fields(subject), " ")
+	return details
+}
+
+// blameRanges turns the -L ranges into [start, end) pairs of lines, sorted and merged
+// a range is <start>,<end>, <start>,+<count> or <start>,-<count>, either end can be /regex/
+func blameRanges(specs []string, lines []string, path string) ([][2]int, error) {
+	if len(specs) == 0 {
+		return [][2]int{{0, len(lines)}}, nil
+	}
+
+	var ranges [][2]int
+	for _, spec := range specs {
+		startSpec, endSpec, _ := strings.Cut(spec, ",")
+		start, err := blameLine(startSpec, lines, 0)
+		if err != nil {
+			return nil, err
+		}
+		if start >= len(lines) && len(lines) > 0 {
+			return nil, fmt.Errorf("file %s has only %d lines", path, len(lines))
+		}
+
+		end := len(lines)
+		switch {
+		case strings.HasPrefix(endSpec, "+"):
+			count, err := strconv.Atoi(endSpec[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid -L %s", spec)
+			}
+			end = start + count
+		case strings.HasPrefix(endSpec, "-"):
+			count, err := strconv.Atoi(endSpec[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid -L %s", spec)
+			}
+			start, end = max(start-count+1, 0), start+1
+		case endSpec != "":
+			last, err := blameLine(endSpec, lines, start+1)
+			if err != nil {
+				return nil, err
+			}
+			end = last + 1
+		}
+		if end < start {
+			start, end = end-1, start+1
+		}
+		ranges = append(ranges, [2]int{start, min(end, len(lines))})
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			last[1] = max(last[1], r[1])
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	return merged, nil
+}
+
+// blameLine gives the line a -L end names, a number counting from one or the first match of /regex/ from line from on
+func blameLine(spec string, lines []string, from int) (int, error) {
+	if pattern, ok := strings.CutPrefix(spec, "/"); ok {
+		re, err := regexp.Compile(strings.TrimSuffix(pattern, "/"))
+		if err != nil {
+			return 0, err
+		}
+		for i := from; i < len(lines); i++ {
+			if re.MatchString(lines[i]) {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("-L parameter '%s': no match", pattern)
+	}
+	line, err := strconv.Atoi(spec)
+	if err != nil || line < 1 {
+		return 0, fmt.Errorf("invalid -L line %s", spec)
+	}
+	return line - 1, nil
+}
+
+// sortedEntries gives the blamed entries in the order their lines are in the file
+// joining up the ones that were split but carry on from each other
+func (b *blame) sortedEntries() []*blameEntry {
+	sort.Slice(b.done, func(i, j int) bool { return b.done[i].final < b.done[j].final })
+	var entries []*blameEntry
+	for _, entry := range b.done {
+		if len(entries) > 0 {
+			last := entries[len(entries)-1]
+			if last.origin == entry.origin && last.final+last.count == entry.final && last.source+last.count == entry.source &&
+				last.ignored == entry.ignored && last.unblamable == entry.unblamable {
+				last.count += entry.count
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (b *blame) write(out io.Writer, final *blameOrigin) error {
+	entries := b.sortedEntries()
+	markIgnored, err := b.repo.conf.Bool("blame.markIgnoredLines", false)
+	if err != nil {
+		return err
+	}
+	markUnblamable, err := b.repo.conf.Bool("blame.markUnblamableLines", false)
+	if err != nil {
+		return err
+	}
+
+	showNames := false
+	nameWidth, authorWidth, lastLine := 0, 0, 0
+	for _, entry := range entries {
+		lastLine = max(lastLine, entry.final+entry.count)
+		if entry.origin.path != final.path {
+			showNames = true
+		}
+		nameWidth = max(nameWidth, len(entry.origin.path))
+		authorWidth = max(authorWidth, utf8.RuneCountInString(b.commitDetails(entry.origin.commit).author))
+	}
+	numberWidth := len(strconv.Itoa(lastLine))
+
+	for _, entry := range entries {
+		details := b.commitDetails(entry.origin.commit)
+		// each mark takes the place of a character of the sha
+		marks := ""
+		if details.boundary {
+			marks += "^"
+		}
+		if markUnblamable && entry.unblamable {
+			marks += "*"
+		}
+		if markIgnored && entry.ignored {
+			marks += "?"
+		}
+		sha := marks + entry.origin.commit[:8-len(marks)]
+		name := ""
+		if showNames {
+			name = fmt.Sprintf(" %-*s", nameWidth, entry.origin.path)
+		}
+		date := details.authorTime.Format("2006-01-02 15:04:05 -0700")
+
+		for i := 0; i < entry.count; i++ {
+			line := final.lines[entry.final+i]
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			fmt.Fprintf(out, "%s%s (%-*s %s %*d) %s", sha, name, authorWidth, details.author, date, numberWidth, entry.final+i+1, line)
+		}
+	}
+	return nil
+}
+
+func (b *blame) writePorcelain(out io.Writer, final *blameOrigin) error {
+	entries := b.sortedEntries()
+	paths := make(map[string]map[string]bool)
+	for _, entry := range entries {
+		if paths[entry.origin.commit] == nil {
+			paths[entry.origin.commit] = make(map[string]bool)
+		}
+		paths[entry.origin.commit][entry.origin.path] = true
+	}
+
+	shown := make(map[string]bool)
+	for _, entry := range entries {
+		commit := entry.origin.commit
+		for i := 0; i < entry.count; i++ {
+			if i == 0 {
+				fmt.Fprintf(out, "%s %d %d %d\n", commit, entry.source+1, entry.final+1, entry.count)
+			} else {
+				fmt.Fprintf(out, "%s %d %d\n", commit, entry.source+i+1, entry.final+i+1)
+			}
+
+			first := !shown[commit]
+			if first || b.opts.linePorcelain {
+				shown[commit] = true
+				details := b.commitDetails(commit)
+				fmt.Fprintf(out, "author %s\nauthor-mail <%s>\nauthor-time %d\nauthor-tz %s\n",
+					details.author, details.authorMail, details.authorTime.Unix(), details.authorTime.Format("-0700"))
+				fmt.Fprintf(out, "committer %s\ncommitter-mail <%s>\ncommitter-time %d\ncommitter-tz %s\n",
+					details.committer, details.committerMail, details.committerTime.Unix(), details.committerTime.Format("-0700"))
+				fmt.Fprintf(out, "summary %s\n", details.summary)
+				if details.boundary {
+					fmt.Fprintln(out, "boundary")
+				}
+			}
+			if (first || b.opts.linePorcelain || len(paths[commit]) > 1) && (i == 0 || b.opts.linePorcelain) {
+				if previous := entry.origin.previous; previous != nil {
+					fmt.Fprintf(out, "previous %s %s\n", previous.commit, previous.path)
+				}
+				fmt.Fprintf(out, "filename %s\n", entry.origin.path)
+			}
+
+			line := final.lines[entry.final+i]
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			fmt.Fprintf(out, "\t%s", line)
+		}
+	}
+	return nil
+}
+
+type blameSuspect struct {
+	sha  string
+	time int64
+}
+
+// blameQueue has the newest commit on top
+type blameQueue []blameSuspect
+
+func (q blameQueue) Len() int           { return len(q) }
+func (q blameQueue) Less(i, j int) bool { return q[i].time > q[j].time }
+func (q blameQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *blameQueue) Push(x any)        { *q = append(*q, x.(blameSuspect)) }
+
+func (q *blameQueue) Pop() any {
+	old := *q
+	last := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return last
+}
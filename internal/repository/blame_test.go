@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// blamedLine is who --line-porcelain says a line came from
+type blamedLine struct {
+	commit, filename, text string
+}
+
+// runBlame runs blame with args and reads what it printed with --line-porcelain
+func runBlame(t *testing.T, repo *Repository, args ...string) []blamedLine {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	blameErr := repo.blame(append([]string{"--line-porcelain"}, args...))
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	r.Close()
+	if blameErr != nil {
+		t.Fatalf("blame %v: %v", args, blameErr)
+	}
+
+	var lines []blamedLine
+	var line blamedLine
+	for _, row := range strings.Split(strings.TrimSuffix(string(out), "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(row, "\t"):
+			line.text = row[1:]
+			lines = append(lines, line)
+			line = blamedLine{}
+		case strings.HasPrefix(row, "filename "):
+			line.filename = strings.TrimPrefix(row, "filename ")
+		case line.commit == "" && repo.format.check(strings.Fields(row)[0]) == nil:
+			line.commit = strings.Fields(row)[0]
+		}
+	}
+	return lines
+}
+
+func TestBlameFindsMovedAndCopiedLinesAndSkipsIgnoredRevisions(t *testing.T) {
+	repo := newTestRepo(t, true)
+	var original []string
+	for _, word := range []string{"one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten"} {
+		original = append(original, fmt.Sprintf("the original line number %s, long enough to count as moved", word))
+	}
+	file := func(lines ...string) string {
+		return strings.Join(lines, "\n") + "\n"
+	}
+
+	first := commitTestFiles(t, repo, map[string]string{"a.txt": file(original...)})
+	// the first three lines go to the end
+	moved := append(append([]string{}, original[3:]...), original[:3]...)
+	second := commitTestFiles(t, repo, map[string]string{"a.txt": file(moved...)}, first)
+	// lines four to six go into a new file
+	kept := append(append([]string{}, original[6:]...), original[:3]...)
+	third := commitTestFiles(t, repo, map[string]string{"a.txt": file(kept...), "b.txt": file(original[3:6]...)}, second)
+	// a reformat of one line
+	reformatted := append([]string{}, kept...)
+	reformatted[0] = strings.ToUpper(reformatted[0])
+	fourth := commitTestFiles(t, repo, map[string]string{"a.txt": file(reformatted...), "b.txt": file(original[3:6]...)}, third)
+	if err := repo.writeRef("refs/heads/main", fourth); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(how string, got []blamedLine, want ...blamedLine) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("%s: blamed %d lines, want %d", how, len(got), len(want))
+		}
+		for i := range want {
+			if got[i].commit != want[i].commit || got[i].filename != want[i].filename {
+				t.Errorf("%s: line %d is on %s in %s, want %s in %s", how, i+1,
+					got[i].commit[:7], got[i].filename, want[i].commit[:7], want[i].filename)
+			}
+		}
+	}
+	on := func(commit, filename string, n int) []blamedLine {
+		lines := make([]blamedLine, n)
+		for i := range lines {
+			lines[i] = blamedLine{commit: commit, filename: filename}
+		}
+		return lines
+	}
+	lines := func(runs ...[]blamedLine) []blamedLine {
+		var all []blamedLine
+		for _, run := range runs {
+			all = append(all, run...)
+		}
+		return all
+	}
+
+	// without -M the moved lines are new in the second commit
+	check("a.txt", runBlame(t, repo, "a.txt", "main"),
+		lines(on(fourth, "a.txt", 1), on(first, "a.txt", 3), on(second, "a.txt", 3))...)
+	check("-M a.txt", runBlame(t, repo, "-M", "a.txt", "main"),
+		lines(on(fourth, "a.txt", 1), on(first, "a.txt", 6))...)
+
+	// the ignored reformat hands its line back to where it was before
+	check("-M --ignore-rev a.txt", runBlame(t, repo, "-M", "--ignore-rev", fourth, "a.txt", "main"),
+		on(first, "a.txt", 7)...)
+
+	// -C follows lines into the file the same commit took them out of
+	check("b.txt", runBlame(t, repo, "b.txt", "main"), on(third, "b.txt", 3)...)
+	check("-C b.txt", runBlame(t, repo, "-C", "b.txt", "main"), on(first, "a.txt", 3)...)
+}
@@ -8,6 +8,8 @@ type Blob struct {
 
 type Tree struct {
 	leaves []*TreeLeaf
+	// how long the raw shas in the serialized tree are
+	hashSize int
 }
 
 func (b *Blob) Kind() string {
@@ -18,8 +20,9 @@ func (b *Blob) Serialize() []byte {
 	return b.contents
 }
 
-func (b *Blob) Deserialize(raw []byte) {
+func (b *Blob) Deserialize(raw []byte) error {
 	b.contents = raw
+	return nil
 }
 
 func (t *Tree) Kind() string {
@@ -42,6 +45,11 @@ func (t *Tree) Serialize() []byte {
 	return serialized
 }
 
-func (t *Tree) Deserialize(data []byte) {
-	t.leaves = treeParseEntirety(data)
+func (t *Tree) Deserialize(data []byte) error {
+	leaves, err := treeParseEntirety(data, t.hashSize)
+	if err != nil {
+		return err
+	}
+	t.leaves = leaves
+	return nil
 }
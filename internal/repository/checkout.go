@@ -0,0 +1,205 @@
+package repository
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// peelToCommit follows annotated tags till it lands on a commit
+func (repo *Repository) peelToCommit(sha string) (string, *Commit, error) {
+	for {
+		obj, err := repo.makeObject(sha)
+		if err != nil {
+			return "", nil, err
+		}
+
+		switch o := obj.(type) {
+		case *Commit:
+			return sha, o, nil
+		case *Tag:
+			sha, err = o.getField("object")
+			if err != nil {
+				return "", nil, err
+			}
+		default:
+			return "", nil, fmt.Errorf("Object %s is a %s, not a commit", sha, obj.Kind())
+		}
+	}
+}
+
+// checkoutCommit writes out the tree of a commit into the worktree
+// and replaces the index with entries for every file in it
+// the whole tree is checked for paths that can't be written before anything is
+func (repo *Repository) checkoutCommit(sha string) error {
+	_, commit, err := repo.peelToCommit(sha)
+	if err != nil {
+		return err
+	}
+	treeSha, err := commit.getField("tree")
+	if err != nil {
+		return err
+	}
+	entries, err := repo.flattenTree(treeSha)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	index := emptyIndex(repo.format)
+	for _, p := range paths {
+		if err := repo.checkoutEntry(p, entries[p].mode, entries[p].sha, index); err != nil {
+			return err
+		}
+	}
+
+	return repo.writeIndex(index)
+}
+
+// verifyPath refuses a path git wouldn't put in a work tree, the way its verify_path does
+// every component has to be a name, and none of them can stand for .git on any filesystem
+func verifyPath(p string) error {
+	for _, name := range strings.Split(p, "/") {
+		if !validPathComponent(name) {
+			return fmt.Errorf("invalid path '%s'", p)
+		}
+	}
+	return nil
+}
+
+func validPathComponent(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00") && !isDotGit(name)
+}
+
+// isDotGit says if a name would open the .git directory somewhere
+// in any case, with the trailing dots and spaces or the stream suffix NTFS drops,
+// as NTFS's short name for it, or with the code points HFS+ ignores
+func isDotGit(name string) bool {
+	name = strings.Map(func(r rune) rune {
+		if hfsIgnorable(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name, _, _ = strings.Cut(name, ":")
+	name = strings.TrimRight(name, ". ")
+	return strings.EqualFold(name, ".git") || strings.EqualFold(name, "git~1")
+}
+
+func hfsIgnorable(r rune) bool {
+	switch {
+	case r >= 0x200c && r <= 0x200f, r >= 0x202a && r <= 0x202e, r >= 0x206a && r <= 0x206f, r == 0xfeff:
+		return true
+	}
+	return false
+}
+
+// checkLeadingPath refuses to write anything below a symlink, which could be pointing anywhere
+func (repo *Repository) checkLeadingPath(relPath string) error {
+	for dir := path.Dir(relPath); dir != "."; dir = path.Dir(dir) {
+		if info, err := repo.files.Lstat(dir); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("'%s' is beyond a symbolic link", relPath)
+		}
+	}
+	return nil
+}
+
+// checkoutEntry writes out a single file and adds it to the index
+func (repo *Repository) checkoutEntry(relPath, leafMode, shaStr string, index *Index) error {
+	mode, err := strconv.ParseUint(leafMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("unknown mode %s", leafMode)
+	}
+	if err := verifyPath(relPath); err != nil {
+		return err
+	}
+	if err := repo.checkLeadingPath(relPath); err != nil {
+		return err
+	}
+
+	switch leafMode {
+	case "160000":
+		// submodules only get an empty directory
+		err = repo.files.MkdirAll(relPath, 0o755)
+	case "120000":
+		err = repo.checkoutSymlink(shaStr, relPath)
+	default:
+		err = repo.checkoutFile(shaStr, relPath, leafMode == "100755")
+	}
+	if err != nil {
+		return fmt.Errorf("Couldn't check out %s: %w", relPath, err)
+	}
+
+	info, err := repo.files.Lstat(relPath)
+	if err != nil {
+		return err
+	}
+	sha, err := hex.DecodeString(shaStr)
+	if err != nil {
+		return err
+	}
+	index.entries = append(index.entries, newEntry(relPath, sha, uint32(mode), info))
+	return nil
+}
+
+func (repo *Repository) blobContents(sha string) ([]byte, error) {
+	obj, err := repo.makeObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	blob, ok := obj.(*Blob)
+	if !ok {
+		return nil, fmt.Errorf("Object %s is a %s, not a blob", sha, obj.Kind())
+	}
+	return blob.contents, nil
+}
+
+// checkoutFile copies a blob into the work tree as it's inflated
+func (repo *Repository) checkoutFile(sha, relPath string, executable bool) error {
+	kind, _, r, err := repo.openObject(sha)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if kind != "blob" {
+		return fmt.Errorf("Object %s is a %s, not a blob", sha, kind)
+	}
+	if err := repo.files.MkdirAll(path.Dir(relPath), 0o755); err != nil {
+		return err
+	}
+
+	perm := fs.FileMode(0o644)
+	if executable {
+		perm = 0o755
+	}
+	file, err := repo.files.Create(relPath, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (repo *Repository) checkoutSymlink(sha, relPath string) error {
+	target, err := repo.blobContents(sha)
+	if err != nil {
+		return err
+	}
+	if err := repo.files.MkdirAll(path.Dir(relPath), 0o755); err != nil {
+		return err
+	}
+	return repo.files.Symlink(string(target), relPath)
+}
@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hostileTree writes a tree with the entries as they are, none of the checks a tree normally gets
+func hostileTree(t *testing.T, repo *Repository, leaves ...*TreeLeaf) string {
+	t.Helper()
+	sha, err := repo.writeObject(&Tree{leaves: leaves, hashSize: repo.format.size}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
+
+func hostileLeaf(t *testing.T, repo *Repository, mode, name, sha string) *TreeLeaf {
+	t.Helper()
+	raw, err := hex.DecodeString(sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &TreeLeaf{mode: mode, path: name, sha: raw}
+}
+
+func TestCheckoutRefusesHostilePaths(t *testing.T) {
+	repo := newTestRepo(t, false)
+	configPath := filepath.Join(repo.gitDir, "config")
+	config, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evil, err := repo.WriteObject("blob", []byte("[credential]\n\thelper = !touch pwned\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	harmless, err := repo.WriteObject("blob", []byte("harmless\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inside := func(name string) string {
+		return hostileTree(t, repo, hostileLeaf(t, repo, "100644", name, evil))
+	}
+
+	trees := map[string]string{}
+	for _, name := range []string{".git", ".GIT", ".Git.", ".git ", "git~1", ".g‌it", ".git::$INDEX_ALLOCATION"} {
+		trees[name+"/config"] = hostileTree(t, repo,
+			hostileLeaf(t, repo, "100644", "a", harmless),
+			hostileLeaf(t, repo, "40000", name, inside("config")))
+	}
+	trees["../outside"] = hostileTree(t, repo, hostileLeaf(t, repo, "40000", "..", inside("outside")))
+	trees["./.git/config"] = hostileTree(t, repo, hostileLeaf(t, repo, "40000", ".", hostileTree(t, repo, hostileLeaf(t, repo, "40000", ".git", inside("config")))))
+	trees["empty name"] = hostileTree(t, repo, hostileLeaf(t, repo, "100644", "", evil))
+	trees["slash in a name"] = hostileTree(t, repo, hostileLeaf(t, repo, "100644", ".git/config", evil))
+	trees["duplicate names"] = hostileTree(t, repo,
+		hostileLeaf(t, repo, "100644", "a", harmless),
+		hostileLeaf(t, repo, "100644", "a", evil))
+
+	for name, tree := range trees {
+		commit, err := repo.WriteCommit(tree, nil, testIdent, testIdent, name+"\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.checkoutCommit(commit)
+		if err == nil || !strings.Contains(err.Error(), "invalid path") {
+			t.Errorf("%s: checkout gave %v, want an invalid path", name, err)
+		}
+		// nothing at all is written for a tree with a bad path in it
+		if _, err := os.Lstat(filepath.Join(repo.worktree, "a")); err == nil {
+			t.Fatalf("%s: a was checked out from a tree with a bad path", name)
+		}
+	}
+
+	// a symlink already in the work tree can't be written through
+	if err := os.Symlink(".git", filepath.Join(repo.worktree, "link")); err != nil {
+		t.Fatal(err)
+	}
+	commit := commitTestFiles(t, repo, map[string]string{"link/config": "[credential]\n\thelper = !touch pwned\n"})
+	if err := repo.checkoutCommit(commit); err == nil || !strings.Contains(err.Error(), "beyond a symbolic link") {
+		t.Errorf("checkout through a symlink gave %v", err)
+	}
+
+	if after, _ := os.ReadFile(configPath); string(after) != string(config) {
+		t.Fatalf(".git/config was overwritten:\n%s", after)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(repo.worktree), "outside")); err == nil {
+		t.Fatal("a file was written outside the work tree")
+	}
+}
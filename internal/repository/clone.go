@@ -0,0 +1,499 @@
+package repository
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/joeldotdias/twine/internal/helpers"
+	"github.com/joeldotdias/twine/pkg/iniparse"
+)
+
+type cloneOptions struct {
+	bare   bool
+	mirror bool
+	branch string
+	// --depth and --shallow-since
+	deepen shallowRequest
+	// --filter makes a partial clone with origin as its promisor remote
+	filter *objectFilter
+	// file:// urls copy objects instead of hardlinking them
+	hardlink bool
+}
+
+func (repo *Repository) clone(args []string) error {
+	var opts cloneOptions
+	cloneCmd := flag.NewFlagSet("clone", flag.ExitOnError)
+	cloneCmd.BoolVar(&opts.bare, "bare", false, "Create a bare repository")
+	cloneCmd.BoolVar(&opts.mirror, "mirror", false, "Create a mirror repository (implies bare)")
+	cloneCmd.StringVar(&opts.branch, "b", "", "Checkout <branch> instead of the remote's HEAD")
+	cloneCmd.StringVar(&opts.branch, "branch", "", "Checkout <branch> instead of the remote's HEAD")
+	depth := cloneCmd.Int("depth", 0, "Create a shallow clone of that depth")
+	since := cloneCmd.String("shallow-since", "", "Create a shallow clone of the commits made after a date")
+	filterSpec := cloneCmd.String("filter", "", "Create a partial clone leaving out the objects the filter-spec selects")
+	if err := cloneCmd.Parse(args); err != nil {
+		return err
+	}
+
+	valArgs := cloneCmd.Args()
+	if len(valArgs) == 0 || len(valArgs) > 2 {
+		return fmt.Errorf("usage: clone [<options>] <repo> [<dir>]")
+	}
+	if opts.mirror {
+		opts.bare = true
+	}
+
+	srcPath, isFileURL := strings.CutPrefix(valArgs[0], "file://")
+	opts.hardlink = !isFileURL
+	isHTTP := isHTTPURL(srcPath)
+	deepen, err := repo.deepenRequest(*depth, 0, *since, false)
+	if err != nil {
+		return err
+	}
+	opts.deepen = deepen
+	if opts.deepen.deepen() && !isFileURL && !isHTTP {
+		fmt.Fprintln(os.Stderr, "warning: --depth is ignored in local clones; use file:// instead.")
+		opts.deepen = shallowRequest{}
+	}
+	if *filterSpec != "" {
+		if opts.filter, err = parseObjectFilter(*filterSpec); err != nil {
+			return err
+		}
+		if !isFileURL && !isHTTP {
+			fmt.Fprintln(os.Stderr, "warning: --filter is ignored in local clones; use file:// instead.")
+			opts.filter = nil
+		}
+	}
+	// shallow and partial clones need upload-pack to work out what to leave out
+	viaUploadPack := isHTTP || opts.deepen.deepen() || opts.filter != nil
+
+	var src *Repository
+	if !isHTTP {
+		if src, err = openLocalRemote(srcPath); err != nil {
+			return err
+		}
+	}
+
+	var dest string
+	if len(valArgs) == 2 {
+		dest = valArgs[1]
+	} else {
+		dest = cloneDirName(srcPath, opts.bare)
+	}
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+
+	created, err := prepareCloneDir(dest)
+	if err != nil {
+		return err
+	}
+
+	if opts.bare {
+		fmt.Fprintf(os.Stderr, "Cloning into bare repository '%s'...\n", filepath.Base(dest))
+	} else {
+		fmt.Fprintf(os.Stderr, "Cloning into '%s'...\n", filepath.Base(dest))
+	}
+
+	if viaUploadPack {
+		err = repo.cloneFromURL(valArgs[0], dest, opts)
+	} else {
+		err = repo.cloneInto(src, dest, opts)
+	}
+	if err != nil && created {
+		// don't leave half a clone lying around
+		os.RemoveAll(dest)
+	}
+
+	return err
+}
+
+// openLocalRemote finds the repository at a path
+// which can be either a worktree or a bare repository
+func openLocalRemote(path string) (*Repository, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if helpers.IsDir(filepath.Join(abs, ".git")) {
+		return openAt(abs, filepath.Join(abs, ".git"))
+	}
+	if helpers.IsDir(filepath.Join(abs, "objects")) && helpers.IsDir(filepath.Join(abs, "refs")) {
+		return openAt("", abs)
+	}
+
+	return nil, fmt.Errorf("repository '%s' does not exist", path)
+}
+
+// cloneDirName is the humanish part of the source path
+// e.g. /srv/mirrors/twine.git clones into twine
+func cloneDirName(src string, bare bool) string {
+	name := filepath.Base(strings.TrimRight(src, "/"))
+	if name == ".git" {
+		name = filepath.Base(filepath.Dir(strings.TrimRight(src, "/")))
+	}
+	name = strings.TrimSuffix(name, ".git")
+	if bare {
+		name += ".git"
+	}
+	return name
+}
+
+// prepareCloneDir makes sure the destination is missing or empty
+// created says if it had to be made so that it can be cleaned up on failure
+func prepareCloneDir(dest string) (bool, error) {
+	entries, err := os.ReadDir(dest)
+	if err == nil {
+		if len(entries) > 0 {
+			return false, fmt.Errorf("destination path '%s' already exists and is not an empty directory.", filepath.Base(dest))
+		}
+		return false, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return false, fmt.Errorf("Couldn't create directory %s: %w", dest, err)
+	}
+	return true, nil
+}
+
+func (repo *Repository) cloneInto(src *Repository, dest string, opts cloneOptions) error {
+	dst, err := newCloneRepo(dest, opts)
+	if err != nil {
+		return err
+	}
+	if err := dst.setObjectFormat(src.format); err != nil {
+		return err
+	}
+
+	srcRefs, err := src.readRefs()
+	if err != nil {
+		return err
+	}
+	srcHead, err := src.readSymref("HEAD")
+	if err != nil {
+		return fmt.Errorf("Couldn't read remote HEAD: %w", err)
+	}
+
+	checkoutRef, err := cloneCheckoutRef(srcRefs, srcHead, opts)
+	if err != nil {
+		return err
+	}
+	if err := copyObjects(src.gitDir, dst.gitDir, opts.hardlink); err != nil {
+		return err
+	}
+
+	url := src.gitDir
+	if src.worktree != "" {
+		url = src.worktree
+	}
+	return dst.finishClone(url, srcRefs, srcHead, checkoutRef, opts)
+}
+
+// cloneFromURL clones through upload-pack instead of copying the objects over
+// which is the only way to get at a repository that isn't on this machine
+func (repo *Repository) cloneFromURL(url, dest string, opts cloneOptions) error {
+	dst, err := newCloneRepo(dest, opts)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dst.connectUploadPack(url, "")
+	if err != nil {
+		return err
+	}
+	format, err := conn.objectFormat()
+	if err == nil {
+		err = dst.setObjectFormat(format)
+	}
+	if err != nil {
+		conn.close()
+		return err
+	}
+	var prefixes []string
+	if !opts.mirror {
+		prefixes = []string{"HEAD", "refs/heads/", "refs/tags/"}
+	}
+	advertised, err := conn.listRefs(prefixes)
+	if err != nil {
+		conn.close()
+		return err
+	}
+
+	srcRefs := make(map[string]string)
+	srcHead := "refs/heads/" + dst.conf.DefaultBranch()
+	var wants []string
+	for _, ref := range advertised {
+		if ref.name == "HEAD" {
+			if ref.symref != "" {
+				srcHead = ref.symref
+			}
+			continue
+		}
+		if ref.sha == "" || strings.HasSuffix(ref.name, "^{}") {
+			continue
+		}
+		srcRefs[ref.name] = ref.sha
+		wants = append(wants, ref.sha)
+	}
+	sort.Strings(wants)
+
+	checkoutRef, err := cloneCheckoutRef(srcRefs, srcHead, opts)
+	if err != nil {
+		conn.close()
+		return err
+	}
+
+	tip, hasTip := srcRefs[checkoutRef]
+	shallow := opts.deepen.deepen() && hasTip
+	if shallow {
+		// a shallow clone only ever gets the one branch
+		wants = []string{tip}
+	}
+
+	conn.progress = &remoteProgress{w: os.Stderr}
+	conn.filter, conn.promisor = opts.filter, opts.filter != nil
+	if err := dst.fetchMissing(conn, wants, opts.deepen); err != nil {
+		return err
+	}
+	if shallow {
+		srcRefs = singleBranchRefs(dst, srcRefs, checkoutRef)
+	}
+	return dst.finishClone(url, srcRefs, srcHead, checkoutRef, opts)
+}
+
+func newCloneRepo(dest string, opts cloneOptions) (*Repository, error) {
+	worktree, gitDir := dest, filepath.Join(dest, ".git")
+	if opts.bare {
+		worktree, gitDir = "", dest
+	}
+	dst, err := openAt(worktree, gitDir)
+	if err != nil {
+		return nil, err
+	}
+	return dst, dst.createLayout(opts.bare)
+}
+
+// cloneCheckoutRef is the branch to check out, or a tag to detach at
+func cloneCheckoutRef(srcRefs map[string]string, srcHead string, opts cloneOptions) (string, error) {
+	checkoutRef := srcHead
+	if opts.branch != "" {
+		checkoutRef = "refs/heads/" + opts.branch
+		if _, ok := srcRefs[checkoutRef]; !ok {
+			checkoutRef = "refs/tags/" + opts.branch
+			if _, ok := srcRefs[checkoutRef]; !ok {
+				return "", fmt.Errorf("Remote branch %s not found in upstream origin", opts.branch)
+			}
+		}
+	}
+	if _, hasTip := srcRefs[checkoutRef]; !hasTip && len(srcRefs) > 0 {
+		fmt.Fprintln(os.Stderr, "warning: remote HEAD refers to nonexistent ref, unable to checkout")
+	}
+	if len(srcRefs) == 0 {
+		fmt.Fprintln(os.Stderr, "warning: You appear to have cloned an empty repository.")
+	}
+	return checkoutRef, nil
+}
+
+// finishClone sets up refs and config once the objects are in and checks out the tip
+func (repo *Repository) finishClone(url string, srcRefs map[string]string, srcHead, checkoutRef string, opts cloneOptions) error {
+	if err := repo.writeCloneRefs(srcRefs, srcHead, checkoutRef, opts); err != nil {
+		return err
+	}
+	if err := repo.writeCloneConfig(url, checkoutRef, opts); err != nil {
+		return err
+	}
+
+	tip, hasTip := srcRefs[checkoutRef]
+	if opts.bare || !hasTip {
+		return nil
+	}
+	if opts.filter != nil {
+		// everything the checkout needs in one go rather than a fetch per file
+		_, commit, err := repo.peelToCommit(tip)
+		if err != nil {
+			return err
+		}
+		treeSha, err := commit.getField("tree")
+		if err != nil {
+			return err
+		}
+		if err := repo.prefetchTree(treeSha); err != nil {
+			return err
+		}
+	}
+	return repo.checkoutCommit(tip)
+}
+
+// singleBranchRefs keeps the branch being cloned
+// along with any tag that points at something that came along with it
+func singleBranchRefs(dst *Repository, refs map[string]string, keep string) map[string]string {
+	kept := map[string]string{keep: refs[keep]}
+	for name, sha := range refs {
+		if !strings.HasPrefix(name, "refs/tags/") {
+			continue
+		}
+		if _, _, err := dst.readObject(sha); err == nil {
+			kept[name] = sha
+		}
+	}
+	return kept
+}
+
+func (repo *Repository) writeCloneRefs(srcRefs map[string]string, srcHead, checkoutRef string, opts cloneOptions) error {
+	for name, sha := range srcRefs {
+		target := name
+		switch {
+		case opts.mirror:
+		case strings.HasPrefix(name, "refs/tags/"):
+		case strings.HasPrefix(name, "refs/heads/"):
+			if !opts.bare {
+				target = "refs/remotes/origin/" + strings.TrimPrefix(name, "refs/heads/")
+			}
+		default:
+			// remote tracking refs and the like belong to the source
+			continue
+		}
+		if err := repo.writeRef(target, sha); err != nil {
+			return err
+		}
+	}
+
+	if opts.bare {
+		return repo.writeSymref("HEAD", srcHead)
+	}
+
+	if branch, ok := strings.CutPrefix(srcHead, "refs/heads/"); ok {
+		if _, exists := srcRefs[srcHead]; exists {
+			err := repo.writeSymref("refs/remotes/origin/HEAD", "refs/remotes/origin/"+branch)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	sha, ok := srcRefs[checkoutRef]
+	if !ok {
+		// an empty repository, HEAD just points at the unborn branch
+		return repo.writeSymref("HEAD", srcHead)
+	}
+	if strings.HasPrefix(checkoutRef, "refs/tags/") {
+		commit, _, err := repo.peelToCommit(sha)
+		if err != nil {
+			return err
+		}
+		return repo.writeRef("HEAD", commit)
+	}
+
+	if err := repo.writeRef(checkoutRef, sha); err != nil {
+		return err
+	}
+	return repo.writeSymref("HEAD", checkoutRef)
+}
+
+func (repo *Repository) writeCloneConfig(url, checkoutRef string, opts cloneOptions) error {
+	path := repo.makePath("config")
+	doc, err := iniparse.ReadDocument(path)
+	if err != nil {
+		return err
+	}
+
+	doc.Add("remote", "origin", "url", url)
+
+	switch {
+	case opts.mirror:
+		doc.Add("remote", "origin", "fetch", "+refs/*:refs/*")
+		doc.Add("remote", "origin", "mirror", "true")
+	case opts.bare:
+	case opts.deepen.deepen():
+		branch := strings.TrimPrefix(checkoutRef, "refs/heads/")
+		doc.Add("remote", "origin", "fetch", "+refs/heads/"+branch+":refs/remotes/origin/"+branch)
+	default:
+		doc.Add("remote", "origin", "fetch", "+refs/heads/*:refs/remotes/origin/*")
+	}
+
+	if branch, ok := strings.CutPrefix(checkoutRef, "refs/heads/"); ok && !opts.bare {
+		doc.Add("branch", branch, "remote", "origin")
+		doc.Add("branch", branch, "merge", checkoutRef)
+	}
+
+	if opts.filter != nil {
+		doc.Add("remote", "origin", "promisor", "true")
+		doc.Add("remote", "origin", "partialclonefilter", opts.filter.String())
+		// extensions only mean something from format version 1 on
+		if err := doc.Set("core", "", "repositoryformatversion", "1", nil); err != nil {
+			return err
+		}
+		doc.Add("extensions", "", "partialclone", "origin")
+	}
+
+	if err := doc.Write(path); err != nil {
+		return err
+	}
+	// objects left out get fetched from here on
+	repo.conf = loadConfig(repo.gitDir)
+	return nil
+}
+
+// copyObjects brings over every loose object and pack
+// hardlinking them when possible since objects never change
+func copyObjects(srcGitDir, dstGitDir string, hardlink bool) error {
+	srcObjects := filepath.Join(srcGitDir, "objects")
+	dstObjects := filepath.Join(dstGitDir, "objects")
+
+	return filepath.WalkDir(srcObjects, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcObjects, path)
+		if err != nil {
+			return err
+		}
+		// alternates and the like describe the source, not the clone
+		if rel == "info" && d.IsDir() {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dstObjects, rel), 0o755)
+		}
+
+		return copyFile(path, filepath.Join(dstObjects, rel), hardlink)
+	})
+}
+
+func copyFile(src, dst string, hardlink bool) error {
+	if hardlink {
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,822 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+ * the commit-graph keeps what walking history needs from each commit
+ * so commits don't have to be inflated and parsed along the way
+ *
+ * it's either objects/info/commit-graph or a chain of graphs in objects/info/commit-graphs/
+ * where commit-graph-chain names each graph-<sum>.graph oldest first
+ * and every graph in the chain only has commits the ones below it don't
+ *
+ *                         Commit graph
+ * +------+---------+------+--------+-------+-----------------+--------+----------+
+ * | CGPH | version | hash | chunks | bases | chunk table     | chunks | sum      |
+ * |  4   |  1 (1)  |  1   |   1    |   1   | (chunks+1) * 12 |        | 20 or 32 |
+ * +------+---------+------+--------+-------+-----------------+--------+----------+
+ *
+ * chunk table entries are a 4 byte id and an 8 byte offset, ending with a zero id
+ *
+ * OIDF  fanout, 256 * 4, like a pack index
+ * OIDL  the commit shas, sorted, N * 20
+ * CDAT  for each commit, N * 36
+ *       tree sha (20), first parent (4), second parent (4), generation and commit time (8)
+ *       parents are positions in the whole chain, 0x70000000 when there isn't one
+ *       a second parent with the high bit set is where the rest of the parents start in EDGE
+ *       the generation is the top 30 bits of the last 8 bytes and the commit time the other 34
+ * EDGE  parents of octopus merges past the first, the last one of each with the high bit set
+ * BASE  shas of the graphs below this one in a chain, bases * 20
+ *
+ * with sha256 the hash is 2 and every sha and sum above is 32 bytes instead of 20
+ *
+ * the generation of a commit is one more than the biggest generation of its parents
+ * so a commit can't reach anything with a generation that isn't lower than its own
+ */
+
+const (
+	graphNoParent   = 0x70000000
+	graphExtraEdges = 0x80000000
+	graphLastEdge   = 0x80000000
+	// generations past this are all written as this
+	graphMaxGeneration = 0x3fffffff
+	// what commits outside the graph get, nothing can be ruled out for them
+	generationInfinity = math.MaxUint32
+)
+
+type commitGraph struct {
+	// oldest first, a graph that isn't split is a single layer
+	layers []*graphLayer
+}
+
+type graphLayer struct {
+	path     string
+	hashSize int
+	fanout   [256]uint32
+	shas     []byte
+	data     []byte
+	edges    []byte
+	// how many commits are in the layers below this one
+	base uint32
+	// the file's trailer, which also names it in a chain
+	sum []byte
+}
+
+// graphCommit is what walking history needs from a commit
+type graphCommit struct {
+	tree       string
+	parents    []string
+	generation uint32
+	time       int64
+}
+
+// loadCommitGraph reads the commit-graph once
+// a repository without one, with core.commitGraph off or a shallow one gets an empty graph
+// since the parents in it don't know where a shallow history stops
+func (repo *Repository) loadCommitGraph() *commitGraph {
+	repo.odb.graphMu.Lock()
+	defer repo.odb.graphMu.Unlock()
+	if repo.graph != nil {
+		return repo.graph
+	}
+	repo.graph = &commitGraph{}
+	useGraph, err := repo.conf.Bool("core.commitGraph", true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: ignoring commit-graph: %s\n", err)
+	}
+	if !useGraph || len(repo.shallowCommits()) > 0 {
+		return repo.graph
+	}
+
+	layers, err := readCommitGraph(repo.makePath("objects", "info"), repo.format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: ignoring commit-graph: %s\n", err)
+		return repo.graph
+	}
+	repo.graph.layers = layers
+	return repo.graph
+}
+
+// readCommitGraph reads the chain in infoDir if there is one, or else the single commit-graph
+func readCommitGraph(infoDir string, format *objectFormat) ([]*graphLayer, error) {
+	chain, err := os.ReadFile(filepath.Join(infoDir, "commit-graphs", "commit-graph-chain"))
+	if os.IsNotExist(err) {
+		layer, err := readGraphLayer(filepath.Join(infoDir, "commit-graph"), nil, format)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []*graphLayer{layer}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var layers []*graphLayer
+	for _, name := range strings.Fields(string(chain)) {
+		layer, err := readGraphLayer(filepath.Join(infoDir, "commit-graphs", "graph-"+name+".graph"), layers, format)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+// readGraphLayer reads one commit-graph file sitting on top of the given layers
+func readGraphLayer(path string, below []*graphLayer, format *objectFormat) (*graphLayer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(path)
+	size := format.size
+	if len(data) < 8+12+size || !bytes.Equal(data[:4], []byte("CGPH")) {
+		return nil, fmt.Errorf("%s has a bad signature", name)
+	}
+	if data[4] != 1 {
+		return nil, fmt.Errorf("%s has unsupported version %d", name, data[4])
+	}
+	if data[5] != format.id {
+		return nil, fmt.Errorf("%s hash version %d does not match the repository's %s", name, data[5], format.name)
+	}
+	chunkCount, baseCount := int(data[6]), int(data[7])
+	if baseCount != len(below) {
+		return nil, fmt.Errorf("%s has %d base graphs but the chain has %d", name, baseCount, len(below))
+	}
+
+	layer := &graphLayer{path: path, hashSize: size, sum: data[len(data)-size:]}
+	for _, base := range below {
+		layer.base += uint32(base.count())
+	}
+
+	table := data[8:]
+	if len(table) < (chunkCount+1)*12 {
+		return nil, fmt.Errorf("%s has a truncated chunk table", name)
+	}
+	chunks := make(map[string][]byte)
+	for i := 0; i < chunkCount; i++ {
+		entry := table[i*12:]
+		start := binary.BigEndian.Uint64(entry[4:])
+		end := binary.BigEndian.Uint64(entry[16:])
+		if start > end || end > uint64(len(data)-size) {
+			return nil, fmt.Errorf("%s has a chunk out of bounds", name)
+		}
+		chunks[string(entry[:4])] = data[start:end]
+	}
+
+	fanout, shas, cdat := chunks["OIDF"], chunks["OIDL"], chunks["CDAT"]
+	if len(fanout) != 256*4 {
+		return nil, fmt.Errorf("%s is missing its fanout", name)
+	}
+	for i := range layer.fanout {
+		layer.fanout[i] = binary.BigEndian.Uint32(fanout[i*4:])
+		if i > 0 && layer.fanout[i] < layer.fanout[i-1] {
+			return nil, fmt.Errorf("%s has a fanout that goes backwards", name)
+		}
+	}
+	count := int(layer.fanout[255])
+	if len(shas) != count*size || len(cdat) != count*(size+16) {
+		return nil, fmt.Errorf("%s has chunks that don't match its %d commits", name, count)
+	}
+	layer.shas, layer.data, layer.edges = shas, cdat, chunks["EDGE"]
+
+	if baseCount > 0 {
+		bases := chunks["BASE"]
+		if len(bases) != baseCount*size {
+			return nil, fmt.Errorf("%s is missing its base graphs", name)
+		}
+		for i, base := range below {
+			if !bytes.Equal(bases[i*size:(i+1)*size], base.sum) {
+				return nil, fmt.Errorf("%s doesn't sit on top of %s", name, filepath.Base(base.path))
+			}
+		}
+	}
+	return layer, nil
+}
+
+func (layer *graphLayer) count() int {
+	return len(layer.shas) / layer.hashSize
+}
+
+func (layer *graphLayer) shaAt(i int) []byte {
+	return layer.shas[i*layer.hashSize : (i+1)*layer.hashSize]
+}
+
+// find gives the position of a commit in this layer or -1
+func (layer *graphLayer) find(sha []byte) int {
+	lo := 0
+	if sha[0] > 0 {
+		lo = int(layer.fanout[sha[0]-1])
+	}
+	hi := int(layer.fanout[sha[0]])
+
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(layer.shaAt(lo+i), sha) >= 0
+	})
+	if i < hi && bytes.Equal(layer.shaAt(i), sha) {
+		return i
+	}
+	return -1
+}
+
+func (graph *commitGraph) count() uint32 {
+	if len(graph.layers) == 0 {
+		return 0
+	}
+	top := graph.layers[len(graph.layers)-1]
+	return top.base + uint32(top.count())
+}
+
+// find gives the position of a commit in the whole chain
+func (graph *commitGraph) find(sha string) (uint32, bool) {
+	raw, err := hex.DecodeString(sha)
+	if err != nil || len(graph.layers) == 0 || len(raw) != graph.layers[0].hashSize {
+		return 0, false
+	}
+	for _, layer := range graph.layers {
+		if i := layer.find(raw); i != -1 {
+			return layer.base + uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+// layerAt gives the layer a position falls in and where it is in that layer
+func (graph *commitGraph) layerAt(pos uint32) (*graphLayer, int, bool) {
+	for _, layer := range graph.layers {
+		if pos >= layer.base && pos < layer.base+uint32(layer.count()) {
+			return layer, int(pos - layer.base), true
+		}
+	}
+	return nil, 0, false
+}
+
+func (graph *commitGraph) shaAt(pos uint32) (string, bool) {
+	layer, i, ok := graph.layerAt(pos)
+	if !ok {
+		return "", false
+	}
+	return hex.EncodeToString(layer.shaAt(i)), true
+}
+
+// commitAt reads a commit's entry, failing if it points anywhere it shouldn't
+func (graph *commitGraph) commitAt(pos uint32) (*graphCommit, bool) {
+	layer, i, ok := graph.layerAt(pos)
+	if !ok {
+		return nil, false
+	}
+	size := layer.hashSize
+	entry := layer.data[i*(size+16) : (i+1)*(size+16)]
+	high := binary.BigEndian.Uint32(entry[size+8:])
+	commit := &graphCommit{
+		tree:       hex.EncodeToString(entry[:size]),
+		generation: high >> 2,
+		time:       int64(high&3)<<32 | int64(binary.BigEndian.Uint32(entry[size+12:])),
+	}
+
+	var positions []uint32
+	if first := binary.BigEndian.Uint32(entry[size:]); first != graphNoParent {
+		positions = append(positions, first)
+	}
+	second := binary.BigEndian.Uint32(entry[size+4:])
+	switch {
+	case second == graphNoParent:
+	case second&graphExtraEdges != 0:
+		for j := int(second &^ graphExtraEdges); ; j++ {
+			if len(layer.edges) < j*4+4 {
+				return nil, false
+			}
+			edge := binary.BigEndian.Uint32(layer.edges[j*4:])
+			positions = append(positions, edge&^graphLastEdge)
+			if edge&graphLastEdge != 0 {
+				break
+			}
+		}
+	default:
+		positions = append(positions, second)
+	}
+
+	for _, p := range positions {
+		sha, ok := graph.shaAt(p)
+		if !ok {
+			return nil, false
+		}
+		commit.parents = append(commit.parents, sha)
+	}
+	return commit, true
+}
+
+// commitInfo gets a commit's parents, time and generation from the commit-graph
+// or from the commit itself when the graph doesn't have it
+func (repo *Repository) commitInfo(sha string) (*graphCommit, error) {
+	graph := repo.loadCommitGraph()
+	if pos, ok := graph.find(sha); ok {
+		if commit, ok := graph.commitAt(pos); ok {
+			return commit, nil
+		}
+	}
+
+	obj, err := repo.makeObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	commit, ok := obj.(*Commit)
+	if !ok {
+		return nil, fmt.Errorf("Object %s is a %s, not a commit", sha, obj.Kind())
+	}
+	tree, err := commit.getField("tree")
+	if err != nil {
+		return nil, err
+	}
+	return &graphCommit{
+		tree:       tree,
+		parents:    commit.parents(),
+		generation: generationInfinity,
+		time:       commit.commitTime(),
+	}, nil
+}
+
+func (repo *Repository) commitGraphCmd(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: twine commit-graph (write [--reachable | --stdin-commits] [--split] | verify)")
+	}
+
+	switch args[0] {
+	case "write":
+		var reachable, stdinCommits, split bool
+		writeCmd := flag.NewFlagSet("commit-graph write", flag.ExitOnError)
+		writeCmd.BoolVar(&reachable, "reachable", false, "Write the commits reachable from every ref")
+		writeCmd.BoolVar(&stdinCommits, "stdin-commits", false, "Write the commits listed on stdin")
+		writeCmd.BoolVar(&split, "split", false, "Add a graph to the chain instead of rewriting the whole thing")
+		if err := writeCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+		if reachable && stdinCommits {
+			return fmt.Errorf("fatal: --reachable and --stdin-commits can't be used together")
+		}
+
+		var tips []string
+		var err error
+		switch {
+		case reachable:
+			tips, err = repo.refTips()
+		case stdinCommits:
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				if line := strings.TrimSpace(scanner.Text()); line != "" {
+					sha, err := repo.findObject(line)
+					if err != nil {
+						return fmt.Errorf("fatal: invalid commit %s", line)
+					}
+					tips = append(tips, sha)
+				}
+			}
+			err = scanner.Err()
+		default:
+			tips, err = repo.packedCommits()
+		}
+		if err != nil {
+			return err
+		}
+		return repo.writeCommitGraph(tips, split)
+
+	case "verify":
+		return repo.verifyCommitGraph()
+
+	default:
+		return fmt.Errorf("unknown subcommand: %s", args[0])
+	}
+}
+
+// refTips is what every ref and HEAD point at
+func (repo *Repository) refTips() ([]string, error) {
+	refs, err := repo.readRefs()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tips []string
+	for _, name := range names {
+		tips = append(tips, refs[name])
+	}
+	if sha, err := repo.readRef("HEAD"); err == nil {
+		tips = append(tips, sha)
+	}
+	return tips, nil
+}
+
+// packedCommits lists every commit in a pack, which is what gets written by default
+func (repo *Repository) packedCommits() ([]string, error) {
+	packs, err := repo.loadPacks()
+	if err != nil {
+		return nil, err
+	}
+	var commits []string
+	for _, pack := range packs {
+		for i := 0; i < pack.count(); i++ {
+			sha := hex.EncodeToString(pack.shaAt(i))
+			if kind, _, err := repo.readObject(sha); err == nil && kind == "commit" {
+				commits = append(commits, sha)
+			}
+		}
+	}
+	return commits, nil
+}
+
+// writeCommitGraph writes a graph of the commits reachable from the tips
+// split adds a graph to the chain with only the commits it doesn't have yet
+// merging it with the graphs at the top of the chain that aren't at least twice its size
+func (repo *Repository) writeCommitGraph(tips []string, split bool) error {
+	if len(repo.shallowCommits()) > 0 {
+		// a graph can't say where shallow history stops
+		return nil
+	}
+	infoDir := repo.makePath("objects", "info")
+	chainDir := filepath.Join(infoDir, "commit-graphs")
+
+	var base []*graphLayer
+	if split {
+		layers, err := readCommitGraph(infoDir, repo.format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: rewriting commit-graph: %s\n", err)
+			layers = nil
+		}
+		base = layers
+	}
+	graph := &commitGraph{layers: base}
+
+	commits, err := repo.graphCommits(tips, graph)
+	if err != nil {
+		return err
+	}
+	for len(base) > 0 && len(commits)*2 > base[len(base)-1].count() {
+		top := base[len(base)-1]
+		for i := 0; i < top.count(); i++ {
+			sha := hex.EncodeToString(top.shaAt(i))
+			commit, ok := graph.commitAt(top.base + uint32(i))
+			if !ok {
+				return fmt.Errorf("Couldn't read commit %s from %s", sha, filepath.Base(top.path))
+			}
+			commits[sha] = commit
+		}
+		base = base[:len(base)-1]
+		graph = &commitGraph{layers: base}
+	}
+	if len(commits) == 0 {
+		return nil
+	}
+
+	data, err := buildGraphLayer(commits, graph, repo.format)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(infoDir, 0o755); err != nil {
+		return fmt.Errorf("Couldn't create directories: %w", err)
+	}
+	sum := data[len(data)-repo.format.size:]
+
+	if !split {
+		if err := repo.writeFileAtomic(filepath.Join(infoDir, "commit-graph"), data, fsyncCommitGraph); err != nil {
+			return fmt.Errorf("Couldn't write commit-graph: %w", err)
+		}
+		os.RemoveAll(chainDir)
+		repo.forgetCommitGraph()
+		return nil
+	}
+
+	if err := os.MkdirAll(chainDir, 0o755); err != nil {
+		return fmt.Errorf("Couldn't create directories: %w", err)
+	}
+	var chain []string
+	for _, layer := range base {
+		name := hex.EncodeToString(layer.sum)
+		path := filepath.Join(chainDir, "graph-"+name+".graph")
+		// a graph that wasn't split becomes the bottom of the chain
+		if layer.path != path {
+			if err := os.Rename(layer.path, path); err != nil {
+				return fmt.Errorf("Couldn't move %s into the chain: %w", filepath.Base(layer.path), err)
+			}
+		}
+		chain = append(chain, name)
+	}
+	chain = append(chain, hex.EncodeToString(sum))
+	if err := repo.writeFileAtomic(filepath.Join(chainDir, "graph-"+hex.EncodeToString(sum)+".graph"), data, fsyncCommitGraph); err != nil {
+		return fmt.Errorf("Couldn't write commit-graph: %w", err)
+	}
+	if err := repo.writeFileAtomic(filepath.Join(chainDir, "commit-graph-chain"), []byte(strings.Join(chain, "\n")+"\n"), fsyncCommitGraph); err != nil {
+		return fmt.Errorf("Couldn't write commit-graph chain: %w", err)
+	}
+
+	// graphs that were merged away and a commit-graph that isn't part of the chain anymore
+	inChain := make(map[string]bool)
+	for _, name := range chain {
+		inChain["graph-"+name+".graph"] = true
+	}
+	old, _ := filepath.Glob(filepath.Join(chainDir, "graph-*.graph"))
+	for _, path := range old {
+		if !inChain[filepath.Base(path)] {
+			os.Remove(path)
+		}
+	}
+	os.Remove(filepath.Join(infoDir, "commit-graph"))
+	repo.forgetCommitGraph()
+	return nil
+}
+
+// forgetCommitGraph has the commit-graph read again the next time it's wanted
+func (repo *Repository) forgetCommitGraph() {
+	repo.odb.graphMu.Lock()
+	repo.graph = nil
+	repo.odb.graphMu.Unlock()
+}
+
+// graphCommits reads every commit reachable from the tips that isn't in graph already
+func (repo *Repository) graphCommits(tips []string, graph *commitGraph) (map[string]*graphCommit, error) {
+	commits := make(map[string]*graphCommit)
+	queue := append([]string{}, tips...)
+	for len(queue) > 0 {
+		sha := queue[0]
+		queue = queue[1:]
+		if commits[sha] != nil {
+			continue
+		}
+		if _, ok := graph.find(sha); ok {
+			continue
+		}
+
+		commitSha, commit, err := repo.peelToCommit(sha)
+		if err != nil {
+			// refs to trees and blobs don't belong in the graph
+			if _, _, err := repo.readObject(sha); err == nil {
+				continue
+			}
+			return nil, fmt.Errorf("Couldn't read commit %s: %w", sha, err)
+		}
+		if commitSha != sha {
+			queue = append(queue, commitSha)
+			continue
+		}
+		tree, err := commit.getField("tree")
+		if err != nil {
+			return nil, fmt.Errorf("Commit %s has no tree", sha)
+		}
+		commits[sha] = &graphCommit{tree: tree, parents: commit.parents(), time: commit.commitTime()}
+		queue = append(queue, commit.parents()...)
+	}
+	return commits, nil
+}
+
+// buildGraphLayer lays out a commit-graph file for commits on top of the layers in base
+func buildGraphLayer(commits map[string]*graphCommit, base *commitGraph, format *objectFormat) ([]byte, error) {
+	shas := make([]string, 0, len(commits))
+	for sha := range commits {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+
+	offset := base.count()
+	positions := make(map[string]uint32, len(shas))
+	for i, sha := range shas {
+		positions[sha] = offset + uint32(i)
+	}
+	position := func(sha string) (uint32, error) {
+		if pos, ok := positions[sha]; ok {
+			return pos, nil
+		}
+		if pos, ok := base.find(sha); ok {
+			return pos, nil
+		}
+		return 0, fmt.Errorf("Parent %s isn't in the commit-graph", sha)
+	}
+
+	// parents before children so every generation can be worked out from ones already known
+	generation := func(sha string) uint32 {
+		if commit := commits[sha]; commit != nil {
+			return commit.generation
+		}
+		pos, _ := base.find(sha)
+		if commit, ok := base.commitAt(pos); ok {
+			return commit.generation
+		}
+		return 0
+	}
+	for _, sha := range shas {
+		stack := []string{sha}
+		for len(stack) > 0 {
+			top := commits[stack[len(stack)-1]]
+			if top.generation != 0 {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			pending := false
+			for _, parent := range top.parents {
+				if commits[parent] != nil && commits[parent].generation == 0 {
+					stack = append(stack, parent)
+					pending = true
+				}
+			}
+			if pending {
+				continue
+			}
+			gen := uint32(0)
+			for _, parent := range top.parents {
+				gen = max(gen, generation(parent))
+			}
+			top.generation = min(gen+1, graphMaxGeneration)
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	var fanout, oids, cdat, edges bytes.Buffer
+	var counts [256]uint32
+	for _, sha := range shas {
+		raw, _ := hex.DecodeString(sha)
+		counts[raw[0]]++
+		oids.Write(raw)
+
+		commit := commits[sha]
+		tree, _ := hex.DecodeString(commit.tree)
+		cdat.Write(tree)
+
+		parents := make([]uint32, len(commit.parents))
+		for i, parent := range commit.parents {
+			pos, err := position(parent)
+			if err != nil {
+				return nil, err
+			}
+			parents[i] = pos
+		}
+		first, second := uint32(graphNoParent), uint32(graphNoParent)
+		switch {
+		case len(parents) > 2:
+			first, second = parents[0], uint32(edges.Len()/4)|graphExtraEdges
+			for i, pos := range parents[1:] {
+				if i == len(parents)-2 {
+					pos |= graphLastEdge
+				}
+				binary.Write(&edges, binary.BigEndian, pos)
+			}
+		case len(parents) == 2:
+			first, second = parents[0], parents[1]
+		case len(parents) == 1:
+			first = parents[0]
+		}
+		binary.Write(&cdat, binary.BigEndian, first)
+		binary.Write(&cdat, binary.BigEndian, second)
+		binary.Write(&cdat, binary.BigEndian, commit.generation<<2|uint32(commit.time>>32)&3)
+		binary.Write(&cdat, binary.BigEndian, uint32(commit.time))
+	}
+	for i := 1; i < 256; i++ {
+		counts[i] += counts[i-1]
+	}
+	binary.Write(&fanout, binary.BigEndian, counts)
+
+	type chunk struct {
+		id   string
+		data []byte
+	}
+	chunks := []chunk{{"OIDF", fanout.Bytes()}, {"OIDL", oids.Bytes()}, {"CDAT", cdat.Bytes()}}
+	if edges.Len() > 0 {
+		chunks = append(chunks, chunk{"EDGE", edges.Bytes()})
+	}
+	if len(base.layers) > 0 {
+		var bases bytes.Buffer
+		for _, layer := range base.layers {
+			bases.Write(layer.sum)
+		}
+		chunks = append(chunks, chunk{"BASE", bases.Bytes()})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("CGPH")
+	buf.Write([]byte{1, format.id, byte(len(chunks)), byte(len(base.layers))})
+	at := uint64(8 + (len(chunks)+1)*12)
+	for _, c := range chunks {
+		buf.WriteString(c.id)
+		binary.Write(&buf, binary.BigEndian, at)
+		at += uint64(len(c.data))
+	}
+	buf.Write([]byte{0, 0, 0, 0})
+	binary.Write(&buf, binary.BigEndian, at)
+	for _, c := range chunks {
+		buf.Write(c.data)
+	}
+
+	buf.Write(format.sum(buf.Bytes()))
+	return buf.Bytes(), nil
+}
+
+// verifyCommitGraph checks each graph's checksum and every commit in it against the commit itself
+func (repo *Repository) verifyCommitGraph() error {
+	layers, err := readCommitGraph(repo.makePath("objects", "info"), repo.format)
+	if err != nil {
+		return fmt.Errorf("error: %s", err)
+	}
+	graph := &commitGraph{layers: layers}
+
+	problems := 0
+	fail := func(format string, args ...any) {
+		problems++
+		fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+	}
+	for _, layer := range layers {
+		data, err := os.ReadFile(layer.path)
+		if err != nil {
+			return err
+		}
+		if sum := repo.format.sum(data[:len(data)-layer.hashSize]); !bytes.Equal(sum, layer.sum) {
+			fail("the commit-graph file %s has an incorrect checksum and is likely corrupt", filepath.Base(layer.path))
+		}
+	}
+
+	for pos := uint32(0); pos < graph.count(); pos++ {
+		sha, _ := graph.shaAt(pos)
+		stored, ok := graph.commitAt(pos)
+		if !ok {
+			fail("commit-graph has a bad parent position for commit %s", sha)
+			continue
+		}
+		obj, err := repo.makeObject(sha)
+		if err != nil {
+			fail("failed to parse commit %s from object database for commit-graph", sha)
+			continue
+		}
+		commit, ok := obj.(*Commit)
+		if !ok {
+			fail("commit-graph has %s, which is a %s", sha, obj.Kind())
+			continue
+		}
+
+		if tree, _ := commit.getField("tree"); tree != stored.tree {
+			fail("root tree OID for commit %s in commit-graph is %s != %s", sha, stored.tree, tree)
+		}
+		if parents := commit.parents(); strings.Join(parents, " ") != strings.Join(stored.parents, " ") {
+			fail("commit-graph parent list for commit %s doesn't match", sha)
+		}
+		if commit.commitTime() != stored.time {
+			fail("commit date for commit %s in commit-graph is %d != %d", sha, stored.time, commit.commitTime())
+		}
+
+		expected := uint32(0)
+		for _, parent := range stored.parents {
+			if pos, ok := graph.find(parent); ok {
+				if p, ok := graph.commitAt(pos); ok {
+					expected = max(expected, p.generation)
+				}
+			}
+		}
+		if expected = min(expected+1, graphMaxGeneration); stored.generation != expected {
+			fail("commit-graph generation for commit %s is %d != %d", sha, stored.generation, expected)
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("fatal: commit-graph verify found %d problems", problems)
+	}
+	return nil
+}
+
+// writeFileAtomic writes a file next to where it goes and renames it into place
+// flushing it first if core.fsync wants files of component flushed
+func (repo *Repository) writeFileAtomic(path string, data []byte, component fsyncComponent) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "tmp_"+filepath.Base(path)+"_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := repo.syncFile(tmp, component); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o444); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
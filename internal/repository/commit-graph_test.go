@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommitGraphWriteReadAndVerify(t *testing.T) {
+	repo := newTestRepo(t, true)
+	main := commitChain(t, repo, "main", 5)
+	left := commitTestFiles(t, repo, map[string]string{"left": "1\n"}, main)
+	right := commitTestFiles(t, repo, map[string]string{"right": "1\n"}, main)
+	// three parents need the extra edges
+	octopus := commitTestFiles(t, repo, map[string]string{"merged": "1\n"}, main, left, right)
+
+	// what the graph says about a commit should be what reading it says
+	check := func(how string, shas ...string) {
+		t.Helper()
+		repo.forgetCommitGraph()
+		graph := repo.loadCommitGraph()
+		for _, sha := range shas {
+			pos, ok := graph.find(sha)
+			if !ok {
+				t.Errorf("%s: %s isn't in the graph", how, sha)
+				continue
+			}
+			stored, ok := graph.commitAt(pos)
+			if !ok {
+				t.Fatalf("%s: couldn't read %s from the graph", how, sha)
+			}
+			commit, err := repo.makeObject(sha)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := commit.(*Commit).parents(); strings.Join(stored.parents, " ") != strings.Join(want, " ") {
+				t.Errorf("%s: %s has parents %v in the graph, want %v", how, sha, stored.parents, want)
+			}
+		}
+		if err := repo.verifyCommitGraph(); err != nil {
+			t.Errorf("%s: %v", how, err)
+		}
+	}
+
+	if err := repo.writeCommitGraph([]string{octopus}, false); err != nil {
+		t.Fatal(err)
+	}
+	check("single graph", main, left, right, octopus)
+	graph := repo.loadCommitGraph()
+	pos, _ := graph.find(octopus)
+	if stored, _ := graph.commitAt(pos); stored.generation != 7 {
+		t.Errorf("octopus has generation %d, want 7", stored.generation)
+	}
+
+	more := commitChain(t, repo, "more", 2)
+	tip := commitTestFiles(t, repo, map[string]string{"tip": "1\n"}, octopus, more)
+	if err := repo.writeCommitGraph([]string{tip}, true); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := readCommitGraph(repo.makePath("objects", "info"), repo.format)
+	if err != nil || len(layers) != 2 {
+		t.Fatalf("want a chain of two graphs, got %d: %v", len(layers), err)
+	}
+	if _, err := os.Stat(repo.makePath("objects", "info", "commit-graph")); !os.IsNotExist(err) {
+		t.Errorf("commit-graph is still there next to the chain: %v", err)
+	}
+	check("split graph", main, octopus, more, tip)
+
+	// a flipped byte in the top layer is caught by its checksum
+	top := layers[len(layers)-1].path
+	data, err := os.ReadFile(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(top, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.verifyCommitGraph(); err == nil {
+		t.Errorf("verify passed %s with a flipped byte", filepath.Base(top))
+	}
+}
@@ -3,6 +3,7 @@ package repository
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 )
@@ -28,12 +29,15 @@ const (
 // i feel stupid having different structs for them
 
 type Commit struct {
-	metaKV  map[CommitField][]string
+	metaKV map[CommitField][]string
+	// the headers in the order they were read, one for each value
+	order   []string
 	message string
 }
 
 type Tag struct {
 	metaKV  map[TagField][]string
+	order   []string
 	message string
 }
 
@@ -42,13 +46,15 @@ func (c *Commit) Kind() string {
 }
 
 func (c *Commit) Serialize() []byte {
-	return serializeKvlm(c.toStringMap(), c.message)
+	return serializeKvlm(c.toStringMap(), c.order, c.message)
 }
 
-func (c *Commit) Deserialize(data []byte) {
-	kv, message := parseKvlm(data)
+func (c *Commit) Deserialize(data []byte) error {
+	kv, order, message := parseKvlm(data)
 	c.fromStringMap(kv)
+	c.order = order
 	c.message = message
+	return nil
 }
 
 func (t *Tag) Kind() string {
@@ -56,13 +62,15 @@ func (t *Tag) Kind() string {
 }
 
 func (t *Tag) Serialize() []byte {
-	return serializeKvlm(t.toStringMap(), t.message)
+	return serializeKvlm(t.toStringMap(), t.order, t.message)
 }
 
-func (t *Tag) Deserialize(data []byte) {
-	kv, message := parseKvlm(data)
+func (t *Tag) Deserialize(data []byte) error {
+	kv, order, message := parseKvlm(data)
 	t.fromStringMap(kv)
+	t.order = order
 	t.message = message
+	return nil
 }
 
 func (c *Commit) parseCommitLog(sha string, checkRef func() (string, bool)) (string, string, error) {
@@ -110,8 +118,10 @@ func (c *Commit) parseCommitLog(sha string, checkRef func() (string, bool)) (str
 // kvlm -> Key Value List with Message
 // this format is taken from Thibault Polge's "Write yourself a Git!" article
 // real lifesaver
-func parseKvlm(data []byte) (map[string][]string, string) {
+// a value that goes on over several lines, like a signature, has a space at the start of each line after the first
+func parseKvlm(data []byte) (map[string][]string, []string, string) {
 	kvlm := make(map[string][]string)
+	var order []string
 	lines := bytes.Split(data, []byte{'\n'})
 
 	var messageStartIndex int
@@ -125,13 +135,16 @@ func parseKvlm(data []byte) (map[string][]string, string) {
 
 		if line[0] == ' ' {
 			// Continuation of previous key
-			kvlm[currentKey] = append(kvlm[currentKey], string(line[1:]))
+			if values := kvlm[currentKey]; len(values) > 0 {
+				values[len(values)-1] += "\n" + string(line[1:])
+			}
 		} else {
 			parts := bytes.SplitN(line, []byte{' '}, 2)
 			if len(parts) == 2 {
 				key := string(parts[0])
 				value := string(parts[1])
 				currentKey = key
+				order = append(order, key)
 				if existingValue, ok := kvlm[key]; ok {
 					kvlm[key] = append(existingValue, value)
 				} else {
@@ -142,18 +155,43 @@ func parseKvlm(data []byte) (map[string][]string, string) {
 	}
 
 	message := string(bytes.Join(lines[messageStartIndex:], []byte{'\n'}))
-	return kvlm, message
+	return kvlm, order, message
 }
 
-func serializeKvlm(klvm map[string][]string, message string) []byte {
+// serializeKvlm writes headers back in the order they were read, so an object read and written again hashes the same
+// whatever order doesn't cover goes after, in the order git writes headers and then by name
+func serializeKvlm(klvm map[string][]string, order []string, message string) []byte {
 	var buffer bytes.Buffer
+	writeHeader := func(key, value string) {
+		buffer.WriteString(key)
+		buffer.WriteByte(' ')
+		buffer.WriteString(strings.Replace(value, "\n", "\n ", -1))
+		buffer.WriteByte('\n')
+	}
+
+	written := make(map[string]int)
+	for _, key := range order {
+		if values := klvm[key]; written[key] < len(values) {
+			writeHeader(key, values[written[key]])
+			written[key]++
+		}
+	}
+
+	keys := make([]string, 0, len(klvm))
+	for key := range klvm {
+		keys = append(keys, key)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		ki, kj := kvlmKeyOrder(keys[i]), kvlmKeyOrder(keys[j])
+		if ki != kj {
+			return ki < kj
+		}
+		return keys[i] < keys[j]
+	})
 
-	for key, values := range klvm {
-		for _, value := range values {
-			buffer.WriteString(key)
-			buffer.WriteByte(' ')
-			buffer.WriteString(strings.Replace(value, "\n", "\n ", -1))
-			buffer.WriteByte('\n')
+	for _, key := range keys {
+		for _, value := range klvm[key][written[key]:] {
+			writeHeader(key, value)
 		}
 	}
 
@@ -163,6 +201,17 @@ func serializeKvlm(klvm map[string][]string, message string) []byte {
 	return buffer.Bytes()
 }
 
+var kvlmKeys = []string{"tree", "parent", "object", "type", "tag", "author", "committer", "tagger", "encoding"}
+
+func kvlmKeyOrder(key string) int {
+	for i, k := range kvlmKeys {
+		if k == key {
+			return i
+		}
+	}
+	return len(kvlmKeys)
+}
+
 func (c *Commit) getField(key string) (string, error) {
 	field := CommitField(key)
 	values, ok := c.metaKV[field]
@@ -172,6 +221,34 @@ func (c *Commit) getField(key string) (string, error) {
 	return values[0], nil
 }
 
+func (c *Commit) parents() []string {
+	return c.metaKV[ParentField]
+}
+
+// commitTime is the unix time on the committer line, zero if it can't be read
+func (c *Commit) commitTime() int64 {
+	committer, err := c.getField("committer")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(committer[strings.LastIndexByte(committer, '>')+1:])
+	if len(fields) == 0 {
+		return 0
+	}
+	var timestamp int64
+	fmt.Sscanf(fields[0], "%d", &timestamp)
+	return timestamp
+}
+
+func (t *Tag) getField(key string) (string, error) {
+	field := TagField(key)
+	values, ok := t.metaKV[field]
+	if !ok || len(values) == 0 {
+		return "", fmt.Errorf("Field %s does not exist", key)
+	}
+	return values[0], nil
+}
+
 func (c *Commit) toStringMap() map[string][]string {
 	kv := make(map[string][]string)
 	for k, v := range c.metaKV {
@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKvlmRoundTripsHeaderOrder(t *testing.T) {
+	commit := "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+		"parent 1111111111111111111111111111111111111111\n" +
+		"parent 2222222222222222222222222222222222222222\n" +
+		"author A U Thor <author@example.com> 1700000000 +0000\n" +
+		"committer A U Thor <author@example.com> 1700000000 +0000\n" +
+		"mergetag object 2222222222222222222222222222222222222222\n" +
+		" type commit\n" +
+		" tag v1.0\n" +
+		" tagger A U Thor <author@example.com> 1700000000 +0000\n" +
+		" \n" +
+		" v1.0\n" +
+		"gpgsig -----BEGIN PGP SIGNATURE-----\n" +
+		" \n" +
+		" iQEzBAABCAAdFiEE\n" +
+		" -----END PGP SIGNATURE-----\n" +
+		"\n" +
+		"Merge tag 'v1.0'\n"
+
+	var c Commit
+	if err := c.Deserialize([]byte(commit)); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Serialize(); !bytes.Equal(got, []byte(commit)) {
+		t.Errorf("commit came back as\n%s\nwant\n%s", got, commit)
+	}
+	if sig, _ := c.getField("gpgsig"); sig != "-----BEGIN PGP SIGNATURE-----\n\niQEzBAABCAAdFiEE\n-----END PGP SIGNATURE-----" {
+		t.Errorf("gpgsig read as %q", sig)
+	}
+	if parents := c.parents(); len(parents) != 2 {
+		t.Errorf("parents read as %q", parents)
+	}
+
+	// headers that weren't read go after, in the order git writes them
+	made := &Commit{metaKV: map[CommitField][]string{
+		CommitterField: {"A U Thor <author@example.com> 1700000000 +0000"},
+		AuthorField:    {"A U Thor <author@example.com> 1700000000 +0000"},
+		TreeField:      {"4b825dc642cb6eb9a060e54bf8d69288fbee4904"},
+	}, message: "made\n"}
+	want := "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+		"author A U Thor <author@example.com> 1700000000 +0000\n" +
+		"committer A U Thor <author@example.com> 1700000000 +0000\n" +
+		"\nmade\n"
+	if got := made.Serialize(); string(got) != want {
+		t.Errorf("new commit serialized as\n%s", got)
+	}
+
+	tag := "object 1111111111111111111111111111111111111111\n" +
+		"type commit\n" +
+		"tag v1.0\n" +
+		"tagger A U Thor <author@example.com> 1700000000 +0000\n" +
+		"zzz unknown header\n" +
+		"encoding ISO-8859-1\n" +
+		"\n" +
+		"v1.0\n"
+	var tg Tag
+	if err := tg.Deserialize([]byte(tag)); err != nil {
+		t.Fatal(err)
+	}
+	if got := tg.Serialize(); !bytes.Equal(got, []byte(tag)) {
+		t.Errorf("tag came back as\n%s\nwant\n%s", got, tag)
+	}
+}
@@ -0,0 +1,181 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/joeldotdias/twine/internal/helpers"
+	"github.com/joeldotdias/twine/pkg/iniparse"
+)
+
+// git gives up after this many nested includes
+const maxIncludeDepth = 10
+
+type configLoader struct {
+	gitDir string
+	// branch HEAD points to, empty when detached
+	branch     string
+	remoteURLs []string
+	// hasconfig: conditions are never true till the remote urls are known
+	hasConfig bool
+	// some file has a hasconfig: condition, so the remote urls are worth knowing
+	wantsRemoteURLs bool
+	// every file read so far, by absolute path
+	parsed map[string]*iniparse.Ini
+	// what went wrong in the last pass, only reported once the last pass is done
+	errs []error
+}
+
+// include reads a config file into cfg, following include.path
+// and includeIf.<condition>.path right where they show up
+// stack holds the files that led here so cycles can be caught
+func (loader *configLoader) include(cfg *Config, path string, scope ConfigScope, stack []string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for _, seen := range stack {
+		if seen == abs {
+			return fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), abs)
+		}
+	}
+	if len(stack) > maxIncludeDepth {
+		return fmt.Errorf("exceeded maximum include depth (%d) while including %s", maxIncludeDepth, path)
+	}
+
+	ini, ok := loader.parsed[abs]
+	if !ok {
+		if ini, err = iniparse.Read(path); err != nil {
+			return err
+		}
+		loader.parsed[abs] = ini
+	}
+	stack = append(stack, abs)
+
+	for _, kv := range ini.Entries() {
+		cfg.set(kv.Name(), kv.Value(), scope, path)
+		if kv.Key() != "path" {
+			continue
+		}
+
+		var ok bool
+		switch kv.Section() {
+		case "include":
+			ok = kv.Subsection() == ""
+		case "includeif":
+			ok = loader.matches(kv.Subsection(), path)
+		}
+		if !ok {
+			continue
+		}
+
+		target, err := includePath(kv.Value(), path)
+		if err != nil {
+			return err
+		}
+		err = loader.include(cfg, target, scope, stack)
+		// a missing include is silently ignored, same as git
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// relative include paths are relative to the file they're in
+func includePath(value, from string) (string, error) {
+	path, err := expandConfigPath(value)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(from), path)
+	}
+	return path, nil
+}
+
+func (loader *configLoader) matches(condition, from string) bool {
+	kind, pattern, ok := strings.Cut(condition, ":")
+	if !ok {
+		return false
+	}
+
+	switch kind {
+	case "gitdir":
+		return loader.matchGitDir(pattern, from, false)
+
+	case "gitdir/i":
+		return loader.matchGitDir(pattern, from, true)
+
+	case "onbranch":
+		if loader.branch == "" {
+			return false
+		}
+		if strings.HasSuffix(pattern, "/") {
+			pattern += "**"
+		}
+		return helpers.WildMatch(pattern, loader.branch, false)
+
+	case "hasconfig":
+		urlPattern, ok := strings.CutPrefix(pattern, "remote.*.url:")
+		loader.wantsRemoteURLs = loader.wantsRemoteURLs || ok
+		if !ok || !loader.hasConfig {
+			return false
+		}
+		for _, url := range loader.remoteURLs {
+			if helpers.WildMatch(urlPattern, url, false) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (loader *configLoader) matchGitDir(pattern, from string, foldCase bool) bool {
+	dirSuffix := strings.HasSuffix(pattern, "/")
+
+	switch {
+	case strings.HasPrefix(pattern, "~"):
+		expanded, err := expandConfigPath(pattern)
+		if err != nil {
+			return false
+		}
+		pattern = expanded
+	case strings.HasPrefix(pattern, "./"):
+		pattern = filepath.Join(filepath.Dir(from), pattern[2:])
+	case !filepath.IsAbs(pattern):
+		pattern = "**/" + pattern
+	}
+
+	// a pattern for a directory matches everything under it
+	if dirSuffix {
+		pattern = strings.TrimSuffix(pattern, "/") + "/**"
+	}
+
+	dirs := []string{loader.gitDir}
+	if real, err := filepath.EvalSymlinks(loader.gitDir); err == nil && real != loader.gitDir {
+		dirs = append(dirs, real)
+	}
+	for _, dir := range dirs {
+		if helpers.WildMatch(pattern, dir, foldCase) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cfg *Config) remoteURLs() []string {
+	var urls []string
+	for _, entry := range cfg.entries {
+		if strings.HasPrefix(entry.name, "remote.") && strings.HasSuffix(entry.name, ".url") {
+			urls = append(urls, entry.value)
+		}
+	}
+	return urls
+}
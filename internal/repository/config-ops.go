@@ -0,0 +1,475 @@
+package repository
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/joeldotdias/twine/pkg/iniparse"
+)
+
+type configFlags struct {
+	list          bool
+	get           bool
+	getAll        bool
+	getRegexp     bool
+	add           bool
+	replaceAll    bool
+	unset         bool
+	unsetAll      bool
+	renameSection bool
+	removeSection bool
+
+	showOrigin bool
+	showScope  bool
+
+	global   bool
+	system   bool
+	local    bool
+	worktree bool
+	file     string
+
+	valueType string
+}
+
+func (repo *Repository) config(args []string) error {
+	var opts configFlags
+	configCmd := flag.NewFlagSet("config", flag.ExitOnError)
+	configCmd.BoolVar(&opts.list, "l", false, "List all variables set in config file")
+	configCmd.BoolVar(&opts.list, "list", false, "List all variables set in config file")
+	configCmd.BoolVar(&opts.get, "get", false, "Get the value for a given key")
+	configCmd.BoolVar(&opts.getAll, "get-all", false, "Get all values for a multivalued key")
+	configCmd.BoolVar(&opts.getRegexp, "get-regexp", false, "Get values for keys matching a regex")
+	configCmd.BoolVar(&opts.add, "add", false, "Add a new value without altering existing ones")
+	configCmd.BoolVar(&opts.replaceAll, "replace-all", false, "Replace all values matching a key")
+	configCmd.BoolVar(&opts.unset, "unset", false, "Remove a key")
+	configCmd.BoolVar(&opts.unsetAll, "unset-all", false, "Remove all values of a key")
+	configCmd.BoolVar(&opts.renameSection, "rename-section", false, "Rename a section")
+	configCmd.BoolVar(&opts.removeSection, "remove-section", false, "Remove a section")
+	configCmd.BoolVar(&opts.showOrigin, "show-origin", false, "Show where each value came from")
+	configCmd.BoolVar(&opts.showScope, "show-scope", false, "Show the scope of each value")
+	configCmd.BoolVar(&opts.global, "global", false, "Use the global config file")
+	configCmd.BoolVar(&opts.system, "system", false, "Use the system config file")
+	configCmd.BoolVar(&opts.local, "local", false, "Use the repository config file")
+	configCmd.BoolVar(&opts.worktree, "worktree", false, "Use the per worktree config file")
+	configCmd.StringVar(&opts.file, "f", "", "Use the given config file")
+	configCmd.StringVar(&opts.file, "file", "", "Use the given config file")
+	configCmd.StringVar(&opts.valueType, "type", "", "Value is of the given type (bool, int, path or color)")
+	boolType := configCmd.Bool("bool", false, "Value is true or false")
+	intType := configCmd.Bool("int", false, "Value is a decimal number")
+	if err := configCmd.Parse(args); err != nil {
+		return err
+	}
+	if *boolType {
+		opts.valueType = "bool"
+	}
+	if *intType {
+		opts.valueType = "int"
+	}
+	switch opts.valueType {
+	case "", "bool", "int", "path", "color":
+	default:
+		return fmt.Errorf("unrecognized --type argument, %s", opts.valueType)
+	}
+
+	actions := 0
+	for _, set := range []bool{
+		opts.list, opts.get, opts.getAll, opts.getRegexp, opts.add, opts.replaceAll,
+		opts.unset, opts.unsetAll, opts.renameSection, opts.removeSection,
+	} {
+		if set {
+			actions++
+		}
+	}
+	if actions > 1 {
+		return fmt.Errorf("only one action at a time")
+	}
+
+	path, scope, scoped, err := repo.configScope(opts)
+	if err != nil {
+		return err
+	}
+
+	// reads look at every scope unless one was asked for
+	source := repo.conf
+	if scoped {
+		source, err = configFromFile(path, scope)
+		if err != nil {
+			return err
+		}
+	}
+
+	valArgs := configCmd.Args()
+	switch {
+	case opts.list:
+		return listConfig(source, opts)
+
+	case opts.getRegexp:
+		if len(valArgs) == 0 || len(valArgs) > 2 {
+			return fmt.Errorf("usage: config --get-regexp <name-regex> [<value-pattern>]")
+		}
+		return getConfigRegexp(source, opts, valArgs)
+
+	case opts.get, opts.getAll, actions == 0 && len(valArgs) == 1:
+		if len(valArgs) == 0 || len(valArgs) > 2 {
+			return fmt.Errorf("usage: config --get <name> [<value-pattern>]")
+		}
+		return getConfig(source, opts, valArgs)
+
+	case opts.renameSection:
+		if len(valArgs) != 2 {
+			return fmt.Errorf("usage: config --rename-section <old-name> <new-name>")
+		}
+		return editConfig(path, func(doc *iniparse.Document) error {
+			oldSection, oldSubsection := splitSectionName(valArgs[0])
+			newSection, newSubsection := splitSectionName(valArgs[1])
+			if doc.RenameSection(oldSection, oldSubsection, newSection, newSubsection) == 0 {
+				return fmt.Errorf("no such section: %s", valArgs[0])
+			}
+			return nil
+		})
+
+	case opts.removeSection:
+		if len(valArgs) != 1 {
+			return fmt.Errorf("usage: config --remove-section <name>")
+		}
+		return editConfig(path, func(doc *iniparse.Document) error {
+			section, subsection := splitSectionName(valArgs[0])
+			if doc.RemoveSection(section, subsection) == 0 {
+				return fmt.Errorf("no such section: %s", valArgs[0])
+			}
+			return nil
+		})
+
+	case opts.unset, opts.unsetAll:
+		if len(valArgs) == 0 || len(valArgs) > 2 {
+			return fmt.Errorf("usage: config --unset <name> [<value-pattern>]")
+		}
+		section, subsection, key, err := splitConfigKey(valArgs[0])
+		if err != nil {
+			return err
+		}
+		match, err := valueMatcher(valArgs[1:])
+		if err != nil {
+			return err
+		}
+		return editConfig(path, func(doc *iniparse.Document) error {
+			removed, err := doc.Unset(section, subsection, key, opts.unsetAll, match)
+			if err != nil {
+				return err
+			}
+			if removed == 0 {
+				return fmt.Errorf("Didn't find config key %s", valArgs[0])
+			}
+			return nil
+		})
+
+	default:
+		if len(valArgs) < 2 || len(valArgs) > 3 {
+			return fmt.Errorf("usage: config [<options>] <name> <value> [<value-pattern>]")
+		}
+		section, subsection, key, err := splitConfigKey(valArgs[0])
+		if err != nil {
+			return err
+		}
+		value, err := canonicalConfigValue(valArgs[1], opts.valueType)
+		if err != nil {
+			return err
+		}
+		match, err := valueMatcher(valArgs[2:])
+		if err != nil {
+			return err
+		}
+		return editConfig(path, func(doc *iniparse.Document) error {
+			switch {
+			case opts.add:
+				doc.Add(section, subsection, key, value)
+			case opts.replaceAll:
+				if _, err := doc.Unset(section, subsection, key, true, match); err != nil {
+					return err
+				}
+				doc.Add(section, subsection, key, value)
+			default:
+				if err := doc.Set(section, subsection, key, value, match); err != nil {
+					return fmt.Errorf("%s\n       Use a regexp, --add or --replace-all to change %s.", err, valArgs[0])
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// configScope works out which file the scope flags point at
+// scoped is false when no flag was given, meaning reads see every scope
+// and writes go to the repository config
+func (repo *Repository) configScope(opts configFlags) (string, ConfigScope, bool, error) {
+	picked := 0
+	for _, set := range []bool{opts.global, opts.system, opts.local, opts.worktree, opts.file != ""} {
+		if set {
+			picked++
+		}
+	}
+	if picked > 1 {
+		return "", ScopeLocal, false, fmt.Errorf("only one config file at a time")
+	}
+
+	switch {
+	case opts.global:
+		if global, ok := os.LookupEnv("GIT_CONFIG_GLOBAL"); ok {
+			return global, ScopeGlobal, true, nil
+		}
+		homedir, err := os.UserHomeDir()
+		if err != nil {
+			return "", ScopeGlobal, false, fmt.Errorf("$HOME not set")
+		}
+		return filepath.Join(homedir, ".gitconfig"), ScopeGlobal, true, nil
+
+	case opts.system:
+		system := os.Getenv("GIT_CONFIG_SYSTEM")
+		if system == "" {
+			system = "/etc/gitconfig"
+		}
+		return system, ScopeSystem, true, nil
+
+	case opts.file != "":
+		return opts.file, ScopeCommand, true, nil
+	}
+
+	// reads can still see the other scopes, writes will complain
+	if _, err := os.Stat(repo.gitDir); err != nil {
+		if opts.local || opts.worktree {
+			return "", ScopeLocal, false, fmt.Errorf("Not in a repository. Run twine init to make one.")
+		}
+		return "", ScopeLocal, false, nil
+	}
+	worktreeConfig, err := repo.conf.Bool("extensions.worktreeConfig", false)
+	if err != nil {
+		return "", ScopeLocal, false, err
+	}
+	if opts.worktree && worktreeConfig {
+		return repo.makePath("config.worktree"), ScopeWorktree, true, nil
+	}
+
+	return repo.makePath("config"), ScopeLocal, opts.local || opts.worktree, nil
+}
+
+// configFromFile reads a single config file without following includes
+// the way git does for --file and the scope flags
+func configFromFile(path string, scope ConfigScope) (*Config, error) {
+	cfg := &Config{}
+	ini, err := iniparse.Read(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+
+	for _, kv := range ini.Entries() {
+		cfg.set(kv.Name(), kv.Value(), scope, path)
+	}
+	return cfg, nil
+}
+
+func editConfig(path string, edit func(doc *iniparse.Document) error) error {
+	if path == "" {
+		return fmt.Errorf("Not in a repository. Run twine init to make one.")
+	}
+
+	doc, err := iniparse.ReadDocument(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		doc = iniparse.NewDocument()
+	}
+
+	if err = edit(doc); err != nil {
+		return err
+	}
+
+	return doc.Write(path)
+}
+
+func listConfig(source *Config, opts configFlags) error {
+	for _, entry := range source.entries {
+		fmt.Println(entryPrefix(entry, opts) + entry.name + "=" + entry.value)
+	}
+	return nil
+}
+
+func getConfig(source *Config, opts configFlags, args []string) error {
+	match, err := valueMatcher(args[1:])
+	if err != nil {
+		return err
+	}
+
+	name := normalizeConfigKey(args[0])
+	var found []configEntry
+	for _, entry := range source.entries {
+		if entry.name == name && (match == nil || match(entry.value)) {
+			found = append(found, entry)
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("Didn't find config key %s", args[0])
+	}
+	if !opts.getAll {
+		found = found[len(found)-1:]
+	}
+
+	for _, entry := range found {
+		value, err := formatConfigValue(entry.value, opts.valueType)
+		if err != nil {
+			return err
+		}
+		fmt.Println(entryPrefix(entry, opts) + value)
+	}
+
+	return nil
+}
+
+func getConfigRegexp(source *Config, opts configFlags, args []string) error {
+	nameRe, err := regexp.Compile(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid key pattern: %s", args[0])
+	}
+	match, err := valueMatcher(args[1:])
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, entry := range source.entries {
+		if !nameRe.MatchString(entry.name) || (match != nil && !match(entry.value)) {
+			continue
+		}
+		value, err := formatConfigValue(entry.value, opts.valueType)
+		if err != nil {
+			return err
+		}
+		fmt.Println(entryPrefix(entry, opts) + entry.name + " " + value)
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("Didn't find config keys matching %s", args[0])
+	}
+
+	return nil
+}
+
+func entryPrefix(entry configEntry, opts configFlags) string {
+	var prefix string
+	if opts.showScope {
+		prefix += entry.scope.String() + "\t"
+	}
+	if opts.showOrigin {
+		if entry.scope == ScopeCommand && entry.origin == "command line:" {
+			prefix += entry.origin + "\t"
+		} else {
+			prefix += "file:" + entry.origin + "\t"
+		}
+	}
+	return prefix
+}
+
+// valueMatcher builds a matcher out of an optional value pattern
+// a leading ! negates it, same as git
+func valueMatcher(args []string) (func(string) bool, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	pattern := args[0]
+	negate := strings.HasPrefix(pattern, "!")
+	re, err := regexp.Compile(strings.TrimPrefix(pattern, "!"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %s", pattern)
+	}
+
+	return func(value string) bool {
+		return re.MatchString(value) != negate
+	}, nil
+}
+
+func formatConfigValue(value, valueType string) (string, error) {
+	switch valueType {
+	case "bool":
+		b, err := parseConfigBool(value)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatBool(b), nil
+	case "int":
+		n, err := parseConfigInt(value)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(n, 10), nil
+	case "path":
+		return expandConfigPath(value)
+	case "color":
+		return parseConfigColor(value)
+	default:
+		return value, nil
+	}
+}
+
+// canonicalConfigValue is what gets written for a typed value
+func canonicalConfigValue(value, valueType string) (string, error) {
+	switch valueType {
+	case "bool", "int":
+		return formatConfigValue(value, valueType)
+	case "color":
+		if _, err := parseConfigColor(value); err != nil {
+			return "", err
+		}
+	}
+	return value, nil
+}
+
+// splitConfigKey breaks a dotted config name into section, subsection and key
+func splitConfigKey(name string) (string, string, string, error) {
+	first := strings.IndexByte(name, '.')
+	last := strings.LastIndexByte(name, '.')
+	if first <= 0 || last == len(name)-1 {
+		return "", "", "", fmt.Errorf("key does not contain a section: %s", name)
+	}
+
+	section, key := name[:first], name[last+1:]
+	var subsection string
+	if first != last {
+		subsection = name[first+1 : last]
+	}
+
+	if !validConfigName(section, true) || !validConfigName(key, false) {
+		return "", "", "", fmt.Errorf("invalid key: %s", name)
+	}
+	return section, subsection, key, nil
+}
+
+func validConfigName(name string, isSection bool) bool {
+	for i, ch := range name {
+		switch {
+		case 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z':
+		case '0' <= ch && ch <= '9', ch == '-':
+			if i == 0 && !isSection {
+				return false
+			}
+		case ch == '.' && isSection:
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// section names on the command line are either section or section.subsection
+func splitSectionName(name string) (string, string) {
+	section, subsection, _ := strings.Cut(name, ".")
+	return section, subsection
+}
@@ -1,32 +1,568 @@
 package repository
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/joeldotdias/twine/pkg/iniparse"
 )
 
+// ConfigScope says where a config value came from
+// later scopes override earlier ones
+type ConfigScope int
+
+const (
+	ScopeSystem ConfigScope = iota
+	ScopeGlobal
+	ScopeLocal
+	ScopeWorktree
+	ScopeCommand
+)
+
+func (s ConfigScope) String() string {
+	switch s {
+	case ScopeSystem:
+		return "system"
+	case ScopeGlobal:
+		return "global"
+	case ScopeLocal:
+		return "local"
+	case ScopeWorktree:
+		return "worktree"
+	case ScopeCommand:
+		return "command"
+	default:
+		return "unknown"
+	}
+}
+
+type configEntry struct {
+	// section[.subsection].key with section and key lowercased
+	name   string
+	value  string
+	scope  ConfigScope
+	origin string
+}
+
+// Config is the merged view of every config file git would read
+// system < global (xdg, then ~/.gitconfig) < local < worktree < environment
 type Config struct {
-	username      string
-	email         string
-	defaultBranch string
+	entries []configEntry
+}
+
+type configFile struct {
+	path  string
+	scope ConfigScope
+}
+
+func loadConfig(gitDir string) *Config {
+	loader := &configLoader{
+		gitDir: gitDir,
+		branch: currentBranch(gitDir),
+		parsed: make(map[string]*iniparse.Ini),
+	}
+
+	// hasconfig: conditions are checked against every remote url
+	// so when a file has one everything is gone through again knowing them
+	// the files themselves are only parsed the first time
+	cfg := loader.load()
+	if loader.wantsRemoteURLs {
+		loader.remoteURLs = cfg.remoteURLs()
+		loader.hasConfig = true
+		cfg = loader.load()
+	}
+	for _, err := range loader.errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	if err := cfg.readEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't read config from environment: %v\n", err)
+	}
+
+	return cfg
 }
 
-func makeCfg() Config {
-	homedir, _ := os.UserHomeDir()
-	cfg, err := iniparse.Read(filepath.Join(homedir, ".gitconfig"))
+func (loader *configLoader) load() *Config {
+	cfg := &Config{}
+	loader.errs = nil
+
+	for _, file := range configFiles(loader.gitDir) {
+		loader.readFile(cfg, file.path, file.scope)
+	}
+
+	// the worktree config only counts once the repo opts into it
+	if on, err := cfg.Bool("extensions.worktreeConfig", false); err != nil {
+		loader.errs = append(loader.errs, err)
+	} else if on {
+		loader.readFile(cfg, filepath.Join(loader.gitDir, "config.worktree"), ScopeWorktree)
+	}
+
+	return cfg
+}
+
+func configFiles(gitDir string) []configFile {
+	var files []configFile
+
+	if !envBool("GIT_CONFIG_NOSYSTEM") {
+		system := os.Getenv("GIT_CONFIG_SYSTEM")
+		if system == "" {
+			system = "/etc/gitconfig"
+		}
+		files = append(files, configFile{system, ScopeSystem})
+	}
+
+	if global, ok := os.LookupEnv("GIT_CONFIG_GLOBAL"); ok {
+		files = append(files, configFile{global, ScopeGlobal})
+	} else {
+		homedir, _ := os.UserHomeDir()
+		xdg := os.Getenv("XDG_CONFIG_HOME")
+		if xdg == "" && homedir != "" {
+			xdg = filepath.Join(homedir, ".config")
+		}
+		if xdg != "" {
+			files = append(files, configFile{filepath.Join(xdg, "git", "config"), ScopeGlobal})
+		}
+		if homedir != "" {
+			files = append(files, configFile{filepath.Join(homedir, ".gitconfig"), ScopeGlobal})
+		}
+	}
+
+	files = append(files, configFile{filepath.Join(gitDir, "config"), ScopeLocal})
+
+	return files
+}
+
+func (loader *configLoader) readFile(cfg *Config, path string, scope ConfigScope) {
+	if path == "" || path == os.DevNull {
+		return
+	}
+
+	err := loader.include(cfg, path, scope, nil)
+	if err != nil && !os.IsNotExist(err) {
+		loader.errs = append(loader.errs, fmt.Errorf("Couldn't read %s config file: %w", scope, err))
+	}
+}
+
+// readEnv picks up GIT_CONFIG_COUNT/GIT_CONFIG_KEY_<n>/GIT_CONFIG_VALUE_<n>
+// and the 'key=value' pairs git itself passes down in GIT_CONFIG_PARAMETERS
+func (cfg *Config) readEnv() error {
+	if params := os.Getenv("GIT_CONFIG_PARAMETERS"); params != "" {
+		pairs, err := splitConfigParameters(params)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				v = "true"
+			}
+			cfg.set(k, v, ScopeCommand, "command line:")
+		}
+	}
+
+	countStr := os.Getenv("GIT_CONFIG_COUNT")
+	if countStr == "" {
+		return nil
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count < 0 {
+		return fmt.Errorf("bogus GIT_CONFIG_COUNT %q", countStr)
+	}
+
+	for i := 0; i < count; i++ {
+		key, ok := os.LookupEnv(fmt.Sprintf("GIT_CONFIG_KEY_%d", i))
+		if !ok || key == "" {
+			return fmt.Errorf("missing config key GIT_CONFIG_KEY_%d", i)
+		}
+		value, ok := os.LookupEnv(fmt.Sprintf("GIT_CONFIG_VALUE_%d", i))
+		if !ok {
+			return fmt.Errorf("missing config value GIT_CONFIG_VALUE_%d", i)
+		}
+		cfg.set(key, value, ScopeCommand, "command line:")
+	}
+
+	return nil
+}
+
+// GIT_CONFIG_PARAMETERS is a list of shell single quoted words
+// e.g. 'user.name=joel' 'core.bare'
+func splitConfigParameters(params string) ([]string, error) {
+	var words []string
+	var sb strings.Builder
+	inWord := false
+
+	for i := 0; i < len(params); i++ {
+		ch := params[i]
+		switch {
+		case ch == '\'':
+			end := strings.IndexByte(params[i+1:], '\'')
+			if end == -1 {
+				return nil, fmt.Errorf("bogus format in GIT_CONFIG_PARAMETERS")
+			}
+			sb.WriteString(params[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case ch == '\\' && i+1 < len(params):
+			i++
+			sb.WriteByte(params[i])
+			inWord = true
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inWord {
+				words = append(words, sb.String())
+				sb.Reset()
+				inWord = false
+			}
+		default:
+			sb.WriteByte(ch)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, sb.String())
+	}
+
+	return words, nil
+}
+
+func (cfg *Config) set(name, value string, scope ConfigScope, origin string) {
+	cfg.entries = append(cfg.entries, configEntry{
+		name:   normalizeConfigKey(name),
+		value:  value,
+		scope:  scope,
+		origin: origin,
+	})
+}
+
+// normalizeConfigKey lowercases the section and key of a dotted config name
+// leaving the subsection alone since that one is case sensitive
+func normalizeConfigKey(name string) string {
+	first := strings.IndexByte(name, '.')
+	last := strings.LastIndexByte(name, '.')
+	if first == -1 {
+		return strings.ToLower(name)
+	}
+	if first == last {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(name[:first]) + name[first:last] + strings.ToLower(name[last:])
+}
+
+// Get returns the value with the highest precedence
+func (cfg *Config) Get(name string) (string, bool) {
+	name = normalizeConfigKey(name)
+	for i := len(cfg.entries) - 1; i >= 0; i-- {
+		if cfg.entries[i].name == name {
+			return cfg.entries[i].value, true
+		}
+	}
+	return "", false
+}
+
+// GetAll returns every value for a multivalued key, lowest precedence first
+func (cfg *Config) GetAll(name string) []string {
+	name = normalizeConfigKey(name)
+	var values []string
+	for _, entry := range cfg.entries {
+		if entry.name == name {
+			values = append(values, entry.value)
+		}
+	}
+	return values
+}
+
+// GetAllForURL is GetAll for keys that can also be set for a url
+// section.<url>.key applies to every url underneath it, as in http.https://example.com.extraHeader
+// an empty value clears out whatever came before it
+func (cfg *Config) GetAllForURL(section, key, url string) []string {
+	section, key = strings.ToLower(section), strings.ToLower(key)
+	var values []string
+	for _, entry := range cfg.entries {
+		first := strings.IndexByte(entry.name, '.')
+		last := strings.LastIndexByte(entry.name, '.')
+		if first == -1 || entry.name[:first] != section || entry.name[last+1:] != key {
+			continue
+		}
+		if first != last && !urlMatches(entry.name[first+1:last], url) {
+			continue
+		}
+		if entry.value == "" {
+			values = nil
+			continue
+		}
+		values = append(values, entry.value)
+	}
+	return values
+}
+
+// GetForURL is the value of a url specific key with the highest precedence
+func (cfg *Config) GetForURL(section, key, url string) string {
+	values := cfg.GetAllForURL(section, key, url)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+// urlMatches says if url is pattern or somewhere underneath it
+func urlMatches(pattern, url string) bool {
+	pattern = strings.TrimSuffix(pattern, "/")
+	rest, ok := strings.CutPrefix(url, pattern)
+	return ok && (rest == "" || rest[0] == '/')
+}
+
+func (cfg *Config) Value(name, fallback string) string {
+	if v, ok := cfg.Get(name); ok {
+		return v
+	}
+	return fallback
+}
+
+// Bool is a boolean key, fallback when it isn't set
+// a value that isn't a boolean is an error naming the key rather than the fallback
+func (cfg *Config) Bool(name string, fallback bool) (bool, error) {
+	v, ok := cfg.Get(name)
+	if !ok {
+		return fallback, nil
+	}
+	return configBool(name, v)
+}
+
+// Int is a numeric key with an optional k, m or g suffix, fallback when it isn't set
+func (cfg *Config) Int(name string, fallback int64) (int64, error) {
+	v, ok := cfg.Get(name)
+	if !ok {
+		return fallback, nil
+	}
+	return configInt(name, v)
+}
+
+func (cfg *Config) Path(name string) (string, error) {
+	v, ok := cfg.Get(name)
+	if !ok {
+		return "", nil
+	}
+	p, err := expandConfigPath(v)
+	if err != nil {
+		return "", fmt.Errorf("%w for '%s'", err, name)
+	}
+	return p, nil
+}
+
+// Color gives the ANSI escape sequence for a color config
+// fallback is a color spec too, used when the key isn't set
+func (cfg *Config) Color(name, fallback string) (string, error) {
+	color, err := parseConfigColor(cfg.Value(name, fallback))
+	if err != nil {
+		return "", fmt.Errorf("%w for '%s'", err, name)
+	}
+	return color, nil
+}
+
+func (cfg *Config) Username() string {
+	return cfg.Value("user.name", "")
+}
+
+func (cfg *Config) Email() string {
+	return cfg.Value("user.email", "")
+}
+
+func (cfg *Config) DefaultBranch() string {
+	return cfg.Value("init.defaultBranch", "master")
+}
+
+func parseConfigBool(v string) (bool, error) {
+	switch strings.ToLower(v) {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off", "":
+		return false, nil
+	}
+
+	n, err := parseConfigInt(v)
+	if err != nil {
+		return false, fmt.Errorf("bad boolean config value '%s'", v)
+	}
+	return n != 0, nil
+}
+
+// configBool parses the value of a boolean key, naming the key if it isn't one
+func configBool(name, v string) (bool, error) {
+	b, err := parseConfigBool(v)
+	if err != nil {
+		return false, fmt.Errorf("bad boolean config value '%s' for '%s'", v, name)
+	}
+	return b, nil
+}
+
+// configInt parses the value of a numeric key, naming the key if it isn't one
+func configInt(name, v string) (int64, error) {
+	n, err := parseConfigInt(v)
+	if errors.Is(err, errOutOfRange) {
+		return 0, fmt.Errorf("bad numeric config value '%s' for '%s': %w", v, name, errOutOfRange)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't read global config file: %v", err)
+		return 0, fmt.Errorf("bad numeric config value '%s' for '%s'", v, name)
 	}
+	return n, nil
+}
+
+var errOutOfRange = errors.New("out of range")
+
+// parseConfigInt understands the k, m and g suffixes git allows
+func parseConfigInt(v string) (int64, error) {
+	if v == "" {
+		return 0, fmt.Errorf("bad numeric config value ''")
+	}
+
+	digits := v
+	factor := int64(1)
+	switch v[len(v)-1] {
+	case 'k', 'K':
+		factor = 1 << 10
+	case 'm', 'M':
+		factor = 1 << 20
+	case 'g', 'G':
+		factor = 1 << 30
+	}
+	if factor != 1 {
+		digits = v[:len(v)-1]
+	}
+
+	n, err := strconv.ParseInt(digits, 0, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("bad numeric config value '%s'", v)
+	}
+	if err != nil || n > math.MaxInt64/factor || n < math.MinInt64/factor {
+		return 0, fmt.Errorf("bad numeric config value '%s': %w", v, errOutOfRange)
+	}
+	return n * factor, nil
+}
+
+func expandConfigPath(p string) (string, error) {
+	if !strings.HasPrefix(p, "~") {
+		return p, nil
+	}
+
+	name, rest, _ := strings.Cut(p[1:], "/")
+	var home string
+	if name == "" {
+		var err error
+		home, err = os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		home = u.HomeDir
+	}
+
+	return filepath.Join(home, rest), nil
+}
+
+var (
+	configColors = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+	configAttrs  = map[string]int{
+		"bold":    1,
+		"dim":     2,
+		"italic":  3,
+		"ul":      4,
+		"blink":   5,
+		"reverse": 7,
+		"strike":  9,
+	}
+)
+
+// parseConfigColor turns a spec like "bold red black" or "#ff0000 ul"
+// into the matching ANSI escape sequence
+func parseConfigColor(spec string) (string, error) {
+	if spec == "" || spec == "normal" {
+		return "", nil
+	}
+	if spec == "reset" {
+		return "\033[m", nil
+	}
+
+	var codes []string
+	colorsSeen := 0
+	for _, word := range strings.Fields(strings.ToLower(spec)) {
+		if attr, ok := configAttrs[strings.TrimPrefix(word, "no")]; ok {
+			if strings.HasPrefix(word, "no") {
+				// bold and dim share the same reset code
+				if attr == 1 {
+					attr = 2
+				}
+				attr += 20
+			}
+			codes = append(codes, strconv.Itoa(attr))
+			continue
+		}
+
+		code, err := colorCode(word, colorsSeen == 1)
+		if err != nil {
+			return "", fmt.Errorf("invalid color value: %s", spec)
+		}
+		colorsSeen++
+		if colorsSeen > 2 {
+			return "", fmt.Errorf("invalid color value: %s", spec)
+		}
+		if code != "" {
+			codes = append(codes, code)
+		}
+	}
+
+	if len(codes) == 0 {
+		return "", nil
+	}
+	return "\033[" + strings.Join(codes, ";") + "m", nil
+}
 
-	init := cfg.Section("init")
-	user := cfg.Section("user")
+func colorCode(word string, background bool) (string, error) {
+	base := 30
+	if background {
+		base = 40
+	}
+
+	switch {
+	case word == "normal":
+		return "", nil
+	case word == "default":
+		return strconv.Itoa(base + 9), nil
+	case strings.HasPrefix(word, "#") && len(word) == 7:
+		rgb, err := strconv.ParseUint(word[1:], 16, 32)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d;2;%d;%d;%d", base+8, rgb>>16, (rgb>>8)&0xff, rgb&0xff), nil
+	}
 
-	return Config{
-		username:      user.Key("name"),
-		email:         user.Key("email"),
-		defaultBranch: init.Key("defaultBranch"),
+	bright := strings.HasPrefix(word, "bright")
+	name := strings.TrimPrefix(word, "bright")
+	for i, c := range configColors {
+		if c == name {
+			if bright {
+				return strconv.Itoa(base + 60 + i), nil
+			}
+			return strconv.Itoa(base + i), nil
+		}
 	}
+
+	n, err := strconv.Atoi(word)
+	if err != nil || n < 0 || n > 255 {
+		return "", fmt.Errorf("unknown color %s", word)
+	}
+	return fmt.Sprintf("%d;5;%d", base+8, n), nil
+}
+
+func envBool(name string) bool {
+	b, err := parseConfigBool(os.Getenv(name))
+	return err == nil && b
 }
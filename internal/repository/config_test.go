@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigInt(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		// part of the error, empty when the value is fine
+		err string
+	}{
+		{"42", 42, ""},
+		{"8k", 8 << 10, ""},
+		{"3M", 3 << 20, ""},
+		{"2g", 2 << 30, ""},
+		{"-1", -1, ""},
+		{"0x10", 16, ""},
+		{"8589934591g", 8589934591 << 30, ""},
+		{"8589934592g", 0, "out of range"},
+		{"-8589934593g", 0, "out of range"},
+		{"99999999999999999999", 0, "out of range"},
+		{"12q", 0, "bad numeric config value '12q'"},
+		{"k", 0, "bad numeric config value 'k'"},
+		{"", 0, "bad numeric config value ''"},
+	}
+
+	for _, tt := range tests {
+		got, err := parseConfigInt(tt.value)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%q: %v", tt.value, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%q: got %d, %v, want an error about %q", tt.value, got, err, tt.err)
+		case got != tt.want:
+			t.Errorf("%q is %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestConfigGettersNameBadKeys(t *testing.T) {
+	cfg := &Config{}
+	cfg.set("core.bigFileThreshold", "9999999999g", ScopeLocal, "test")
+	cfg.set("core.bare", "maybe", ScopeLocal, "test")
+	cfg.set("gc.auto", "10k", ScopeLocal, "test")
+
+	if n, err := cfg.Int("gc.auto", 1); err != nil || n != 10<<10 {
+		t.Errorf("gc.auto is %d, %v", n, err)
+	}
+	if n, err := cfg.Int("gc.autoPackLimit", 50); err != nil || n != 50 {
+		t.Errorf("unset gc.autoPackLimit is %d, %v", n, err)
+	}
+	if _, err := cfg.Int("core.bigFileThreshold", 1); err == nil || !strings.Contains(err.Error(), "'core.bigFileThreshold'") {
+		t.Errorf("out of range core.bigFileThreshold: %v", err)
+	}
+	if _, err := cfg.Bool("core.bare", true); err == nil || !strings.Contains(err.Error(), "'core.bare'") {
+		t.Errorf("core.bare = maybe: %v", err)
+	}
+}
+
+func TestLoadConfigHasConfigIncludes(t *testing.T) {
+	gitDir := filepath.Join(t.TempDir(), ".git")
+	if err := os.MkdirAll(gitDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+
+	write := func(name, contents string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(gitDir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("work", "[user]\n\temail = me@work.example\n")
+	write("home", "[user]\n\temail = me@home.example\n")
+	write("config", `[includeIf "hasconfig:remote.*.url:https://work.example/**"]
+	path = work
+[includeIf "hasconfig:remote.*.url:https://home.example/**"]
+	path = home
+[remote "origin"]
+	url = https://work.example/repo.git
+`)
+
+	cfg := loadConfig(gitDir)
+	if got := cfg.Email(); got != "me@work.example" {
+		t.Errorf("user.email is %q, want the one the work remote brings in", got)
+	}
+}
@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// countObjects reports how many objects there are and how much space they take up
+// --reachable also counts how many of them refs, HEAD, the index and reflogs lead to
+func (repo *Repository) countObjects(args []string) error {
+	var verbose, reachable bool
+	countCmd := flag.NewFlagSet("count-objects", flag.ExitOnError)
+	countCmd.BoolVar(&verbose, "v", false, "Report packs and garbage as well")
+	countCmd.BoolVar(&verbose, "verbose", false, "Report packs and garbage as well")
+	countCmd.BoolVar(&reachable, "reachable", false, "Count the objects that can be reached")
+	if err := countCmd.Parse(args); err != nil {
+		return err
+	}
+
+	shas, err := repo.looseObjects()
+	if err != nil {
+		return err
+	}
+	packs, err := repo.loadPacks()
+	if err != nil {
+		return err
+	}
+
+	var looseSize int64
+	prunePackable := 0
+	for _, sha := range shas {
+		if info, err := os.Stat(repo.makePath("objects", sha[:2], sha[2:])); err == nil {
+			looseSize += diskUsage(info)
+		}
+		if inPacks(packs, sha) {
+			prunePackable++
+		}
+	}
+
+	inPack := 0
+	var packSize int64
+	for _, pack := range packs {
+		inPack += pack.count()
+		for _, path := range []string{pack.path, strings.TrimSuffix(pack.path, ".pack") + ".idx"} {
+			if info, err := os.Stat(path); err == nil {
+				packSize += info.Size()
+			}
+		}
+	}
+	garbage, garbageSize := repo.packGarbage()
+
+	reachableCount := 0
+	if reachable {
+		if reachableCount, err = repo.countReachable(); err != nil {
+			return err
+		}
+	}
+
+	if !verbose {
+		fmt.Printf("%d objects, %d kilobytes\n", len(shas), looseSize/1024)
+		if reachable {
+			fmt.Printf("%d reachable objects\n", reachableCount)
+		}
+		return nil
+	}
+	fmt.Printf("count: %d\n", len(shas))
+	fmt.Printf("size: %d\n", looseSize/1024)
+	fmt.Printf("in-pack: %d\n", inPack)
+	fmt.Printf("packs: %d\n", len(packs))
+	fmt.Printf("size-pack: %d\n", packSize/1024)
+	fmt.Printf("prune-packable: %d\n", prunePackable)
+	fmt.Printf("garbage: %d\n", garbage)
+	fmt.Printf("size-garbage: %d\n", garbageSize/1024)
+	if reachable {
+		fmt.Printf("reachable: %d\n", reachableCount)
+	}
+	return nil
+}
+
+// packGarbage counts the files in objects/pack that don't belong to a pack
+func (repo *Repository) packGarbage() (int, int64) {
+	dir := repo.makePath("objects", "pack")
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0
+	}
+
+	count := 0
+	var size int64
+	for _, file := range files {
+		name := file.Name()
+		base, ext, _ := strings.Cut(name, ".")
+		belongs := false
+		switch ext {
+		case "pack", "idx", "keep", "promisor", "bitmap", "rev", "mtimes":
+			_, packErr := os.Stat(filepath.Join(dir, base+".pack"))
+			_, idxErr := os.Stat(filepath.Join(dir, base+".idx"))
+			belongs = strings.HasPrefix(base, "pack-") && packErr == nil && idxErr == nil
+		}
+		if belongs || name == "multi-pack-index" || strings.HasPrefix(name, "tmp_") || file.IsDir() {
+			continue
+		}
+		count++
+		if info, err := file.Info(); err == nil {
+			size += diskUsage(info)
+		}
+	}
+	return count, size
+}
+
+// countReachable counts every object that can be reached, using bitmaps when there are some
+func (repo *Repository) countReachable() (int, error) {
+	roots, err := repo.reachabilityRoots()
+	if err != nil {
+		return 0, err
+	}
+	if bm := repo.loadBitmap(); bm.pack != nil {
+		if reachable, extra, err := bm.reachableFrom(repo, roots); err == nil {
+			return reachable.count() + len(extra), nil
+		}
+	}
+	objects, err := repo.reachableObjects(roots)
+	return len(objects), err
+}
@@ -0,0 +1,173 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * credential helpers speak key=value lines on stdin and stdout
+ *
+ * twine:  protocol=https\nhost=example.com\n[path=repo.git\n][username=...\n]\n
+ * helper: username=...\npassword=...\n
+ *
+ * "get" asks for a credential, "store" says it worked and "erase" says it didn't
+ */
+
+type credential struct {
+	protocol string
+	host     string
+	path     string
+	username string
+	password string
+}
+
+func newCredential(u *url.URL, useHTTPPath bool) *credential {
+	cred := &credential{protocol: u.Scheme, host: u.Host}
+	if useHTTPPath {
+		cred.path = strings.TrimPrefix(u.Path, "/")
+	}
+	if u.User != nil {
+		cred.username = u.User.Username()
+		cred.password, _ = u.User.Password()
+	}
+	return cred
+}
+
+func (cred *credential) complete() bool {
+	return cred.username != "" && cred.password != ""
+}
+
+// url is what a credential is for, the way prompts show it
+func (cred *credential) url() string {
+	u := cred.protocol + "://"
+	if cred.username != "" {
+		u += url.PathEscape(cred.username) + "@"
+	}
+	return u + cred.host
+}
+
+func (cred *credential) encode() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "protocol=%s\nhost=%s\n", cred.protocol, cred.host)
+	if cred.path != "" {
+		fmt.Fprintf(&buf, "path=%s\n", cred.path)
+	}
+	if cred.username != "" {
+		fmt.Fprintf(&buf, "username=%s\n", cred.username)
+	}
+	if cred.password != "" {
+		fmt.Fprintf(&buf, "password=%s\n", cred.password)
+	}
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+// credentialHelpers are the configured helpers for a url, in the order they're asked
+func (repo *Repository) credentialHelpers(rawURL string) []string {
+	return repo.conf.GetAllForURL("credential", "helper", rawURL)
+}
+
+// fillCredential asks each helper in turn until there's a username and password
+// then falls back to GIT_ASKPASS or core.askPass
+func (repo *Repository) fillCredential(cred *credential, rawURL string) error {
+	if cred.username == "" {
+		cred.username = repo.conf.GetForURL("credential", "username", rawURL)
+	}
+
+	for _, helper := range repo.credentialHelpers(rawURL) {
+		if cred.complete() {
+			break
+		}
+		out, err := runCredentialHelper(helper, "get", cred.encode())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: credential helper '%s' failed: %s\n", helper, err)
+			continue
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			k, v, _ := strings.Cut(scanner.Text(), "=")
+			switch k {
+			case "username":
+				cred.username = v
+			case "password":
+				cred.password = v
+			case "quit":
+				if b, _ := parseConfigBool(v); b {
+					return fmt.Errorf("credential helper '%s' told us to quit", helper)
+				}
+			}
+		}
+	}
+
+	askpass := os.Getenv("GIT_ASKPASS")
+	if askpass == "" {
+		askpass = repo.conf.Value("core.askPass", os.Getenv("SSH_ASKPASS"))
+	}
+	if cred.username == "" {
+		username, err := askPass(askpass, fmt.Sprintf("Username for '%s://%s': ", cred.protocol, cred.host))
+		if err != nil {
+			return fmt.Errorf("could not read Username for '%s://%s': %w", cred.protocol, cred.host, err)
+		}
+		cred.username = username
+	}
+	if cred.password == "" {
+		password, err := askPass(askpass, fmt.Sprintf("Password for '%s': ", cred.url()))
+		if err != nil {
+			return fmt.Errorf("could not read Password for '%s': %w", cred.url(), err)
+		}
+		cred.password = password
+	}
+	return nil
+}
+
+// approveCredential has the helpers store a credential that worked
+func (repo *Repository) approveCredential(cred *credential, rawURL string) {
+	for _, helper := range repo.credentialHelpers(rawURL) {
+		runCredentialHelper(helper, "store", cred.encode())
+	}
+}
+
+// rejectCredential has the helpers forget a credential that was turned down
+func (repo *Repository) rejectCredential(cred *credential, rawURL string) {
+	for _, helper := range repo.credentialHelpers(rawURL) {
+		runCredentialHelper(helper, "erase", cred.encode())
+	}
+}
+
+// runCredentialHelper runs a helper the way git would
+// !cmd is a shell snippet, an absolute path is run as is
+// and anything else names git's credential-<name> helper
+func runCredentialHelper(helper, action string, input []byte) ([]byte, error) {
+	var script string
+	switch {
+	case strings.HasPrefix(helper, "!"):
+		script = helper[1:]
+	case filepath.IsAbs(helper):
+		script = helper
+	default:
+		script = "git credential-" + helper
+	}
+
+	cmd := exec.Command("sh", "-c", script+` "$@"`, helper, action)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+func askPass(program, prompt string) (string, error) {
+	if program == "" {
+		return "", fmt.Errorf("terminal prompts disabled")
+	}
+	out, err := exec.Command(program, prompt).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+ *                   Cruft pack mtimes
+ * +------+---------+------+--------+----------+------+
+ * | MTME | version | hash | mtimes | pack sum | sum  |
+ * | 4    | 4 (1)   | 4    | N*4    |          |      |
+ * +------+---------+------+--------+----------+------+
+ *
+ * a cruft pack holds the unreachable objects gc isn't ready to prune yet
+ * the .mtimes next to it has the time each of them was last written, in index order
+ * so every gc can drop the ones that have expired and write the rest into a new cruft pack
+ * readers don't need to know, to them it's a pack like any other
+ */
+
+func packCruft(pack *packFile) bool {
+	_, err := os.Stat(strings.TrimSuffix(pack.path, ".pack") + ".mtimes")
+	return err == nil
+}
+
+// cruftObjects is everything in packs and loose objects that isn't in keep
+// and was written at or after expire, along with when that was
+func (repo *Repository) cruftObjects(packs []*packFile, keep func(sha string) bool, expire int64) ([]string, map[string]int64, error) {
+	mtimes := make(map[string]int64)
+	seen := func(sha string, mtime int64) {
+		if mtime >= expire && mtime > mtimes[sha] && !keep(sha) {
+			mtimes[sha] = mtime
+		}
+	}
+
+	for _, pack := range packs {
+		info, err := os.Stat(pack.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		var times []uint32
+		if packCruft(pack) {
+			if times, err = readPackMtimes(pack, repo.format); err != nil {
+				// the pack's own time is never earlier than what it holds
+				fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+			}
+		}
+		for i := 0; i < pack.count(); i++ {
+			mtime := info.ModTime().Unix()
+			if times != nil {
+				mtime = int64(times[i])
+			}
+			seen(hex.EncodeToString(pack.shaAt(i)), mtime)
+		}
+	}
+
+	loose, err := repo.looseObjects()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, sha := range loose {
+		if info, err := os.Stat(repo.makePath("objects", sha[:2], sha[2:])); err == nil {
+			seen(sha, info.ModTime().Unix())
+		}
+	}
+
+	shas := make([]string, 0, len(mtimes))
+	for sha := range mtimes {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+	return shas, mtimes, nil
+}
+
+// writeCruftPack writes objects into a pack with a .mtimes saying when each was written
+// giving back the pack's path without the extension
+func (repo *Repository) writeCruftPack(objects []string, mtimes map[string]int64) (string, error) {
+	name, err := repo.writeRepack(objects)
+	if err != nil {
+		return "", err
+	}
+	pack, err := readPackIndex(name+".idx", repo.format)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("MTME")
+	binary.Write(&buf, binary.BigEndian, uint32(1))
+	binary.Write(&buf, binary.BigEndian, uint32(repo.format.id))
+	for i := 0; i < pack.count(); i++ {
+		binary.Write(&buf, binary.BigEndian, uint32(mtimes[hex.EncodeToString(pack.shaAt(i))]))
+	}
+	buf.Write(pack.sum)
+	buf.Write(repo.format.sum(buf.Bytes()))
+	if err := repo.writeFileAtomic(name+".mtimes", buf.Bytes(), fsyncPackMetadata); err != nil {
+		return "", fmt.Errorf("Couldn't write %s: %w", filepath.Base(name)+".mtimes", err)
+	}
+	return name, nil
+}
+
+// readPackMtimes gives the time of every object in a cruft pack in index order
+func readPackMtimes(pack *packFile, format *objectFormat) ([]uint32, error) {
+	path := strings.TrimSuffix(pack.path, ".pack") + ".mtimes"
+	name := filepath.Base(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read %s: %w", name, err)
+	}
+	n := pack.count()
+	if len(data) != 12+n*4+2*format.size || !bytes.Equal(data[:4], []byte("MTME")) {
+		return nil, fmt.Errorf("%s is malformed", name)
+	}
+	if version := binary.BigEndian.Uint32(data[4:]); version != 1 {
+		return nil, fmt.Errorf("%s has unsupported version %d", name, version)
+	}
+	if id := binary.BigEndian.Uint32(data[8:]); id != uint32(format.id) {
+		return nil, fmt.Errorf("%s hash version %d does not match the repository's %s", name, id, format.name)
+	}
+	if !bytes.Equal(data[12+n*4:len(data)-format.size], pack.sum) {
+		return nil, fmt.Errorf("%s is for a different pack", name)
+	}
+
+	times := make([]uint32, n)
+	for i := range times {
+		times[i] = binary.BigEndian.Uint32(data[12+i*4:])
+	}
+	return times, nil
+}
@@ -62,9 +62,9 @@ func (repo *Repository) dbgInfo(w io.Writer) {
 	field("Git Directory", repo.gitDir, w)
 
 	sectionHeader("Config", w)
-	field("Username", repo.conf.username, w)
-	field("Email", repo.conf.email, w)
-	field("Default Branch", repo.conf.defaultBranch, w)
+	field("Username", repo.conf.Username(), w)
+	field("Email", repo.conf.Email(), w)
+	field("Default Branch", repo.conf.DefaultBranch(), w)
 
 	sectionHeader("RefStore", w)
 	lineWithoutColon("Heads:", w)
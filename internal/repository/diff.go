@@ -0,0 +1,721 @@
+package repository
+
+import "strings"
+
+/*
+ * lines are diffed the way xdiff does it, which is what git uses by default
+ * so that blame lands on the same line as git's when a file has the same line many times over
+ *
+ * each line is turned into a number first so comparing two is cheap
+ * and the lines both sides start and end with are taken off
+ * then a line that's nowhere on the other side can't be unchanged, so it's marked changed and left out of the search,
+ * and so is one that's on the other side a lot of times when it sits among those
+ *
+ * what's left goes to myers' algorithm in linear space:
+ * paths are grown from both corners at once, d = 1, 2 ... edits, keeping for every diagonal k = x - y
+ * how far along a the furthest one reaches, until a forward and a backward path meet
+ * the box is split where they met and each half is done the same way
+ * once the cost gets high the search settles for a good long run of matching lines, or failing that the furthest path,
+ * so a huge diff doesn't take forever at the price of not being the shortest
+ *
+ * where the same lines are next to a run of changes the script could have had them either side of it
+ * so like xdiff the runs are slid afterwards, as far down as they go, lined up with a run on the other side if one's in reach,
+ * and otherwise to where the indent heuristic says reads best, which mostly means a function gets added whole
+ * instead of starting with the closing brace of the one before
+ */
+
+const (
+	// a line on the other side at least this many times, or the square root of the line count if that's less, counts as common
+	maxEqualLimit = 1024
+	// how far either side of a common line is looked at to decide if it's among lines that aren't on the other side
+	simScanWindow = 100
+	// common lines are left out when fewer than one in this many of the lines around them are common
+	keepCommonRun = 4
+	// the cost past which the search stops insisting on the shortest script
+	heuristicMinCost = 256
+	maxCostMin       = 256
+	// how many matching lines in a row make a run worth splitting on
+	snakeCount = 20
+	heuristicK = 4
+)
+
+// diffHunk is a run of lines that changed, a[aStart:aStart+aCount] became b[bStart:bStart+bCount]
+type diffHunk struct {
+	aStart, aCount int
+	bStart, bCount int
+}
+
+// matchLines lines up b against a, giving for each line of b the line of a it's unchanged from
+// or -1 where it was added or changed
+// with ignoreSpace two lines that only differ in whitespace count as the same
+func matchLines(a, b []string, ignoreSpace bool) []int {
+	// git cuts off the tail both end with before a diff without context, to the line, in whole kilobytes
+	// it's done here too as it changes how many lines there are and so which lines count as common below
+	tail := commonTail(a, b)
+	a, b = a[:len(a)-tail], b[:len(b)-tail]
+
+	ids := make(map[string]int)
+	var counts [2][]int
+	intern := func(keys []string, side int) []int {
+		out := make([]int, len(keys))
+		for i, key := range keys {
+			id, ok := ids[key]
+			if !ok {
+				id = len(ids)
+				ids[key] = id
+				counts[0] = append(counts[0], 0)
+				counts[1] = append(counts[1], 0)
+			}
+			counts[side][id]++
+			out[i] = id
+		}
+		return out
+	}
+	sideA := newDiffSide(a, ignoreSpace)
+	sideB := newDiffSide(b, ignoreSpace)
+	x, y := intern(sideA.keys, 0), intern(sideB.keys, 1)
+
+	prefix := 0
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(x)-prefix && suffix < len(y)-prefix && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+
+	ha, indexA := sideA.cleanup(x, prefix, len(x)-suffix, counts[1])
+	hb, indexB := sideB.cleanup(y, prefix, len(y)-suffix, counts[0])
+	d := &diffSearch{
+		a: ha, b: hb, sideA: sideA, sideB: sideB, indexA: indexA, indexB: indexB,
+		forward:  make([]int, len(ha)+len(hb)+3),
+		backward: make([]int, len(ha)+len(hb)+3),
+		offset:   len(hb) + 1,
+		maxCost:  max(bogoSqrt(len(ha)+len(hb)+3), maxCostMin),
+	}
+	d.compare(0, len(ha), 0, len(hb), false)
+
+	sideA.compact(sideB)
+	sideB.compact(sideA)
+
+	// the lines left unchanged on both sides pair up in order
+	matches := make([]int, len(b), len(b)+tail)
+	i := 0
+	for j := range matches {
+		matches[j] = -1
+		if sideB.isChanged(j) {
+			continue
+		}
+		for sideA.isChanged(i) {
+			i++
+		}
+		matches[j] = i
+		i++
+	}
+	for n := 0; n < tail; n++ {
+		matches = append(matches, len(a)+n)
+	}
+	return matches
+}
+
+// commonTail gives how many lines at the end of a and b git's trim of their common tail takes off
+func commonTail(a, b []string) int {
+	const block = 1024
+	textA, textB := strings.Join(a, ""), strings.Join(b, "")
+	trimmed := 0
+	for trimmed+block <= min(len(textA), len(textB)) &&
+		textA[len(textA)-trimmed-block:len(textA)-trimmed] == textB[len(textB)-trimmed-block:len(textB)-trimmed] {
+		trimmed += block
+	}
+	// the cut goes back to just past the first line end after it
+	cut := len(textA) - trimmed
+	recovered := 0
+	for recovered < trimmed {
+		recovered++
+		if textA[cut+recovered-1] == '\n' {
+			break
+		}
+	}
+
+	lines := 0
+	for dropped := trimmed - recovered; dropped > 0; lines++ {
+		dropped -= len(a[len(a)-1-lines])
+	}
+	return lines
+}
+
+// bogoSqrt is the power of two at or above the square root, roughly
+func bogoSqrt(n int) int {
+	i := 1
+	for ; n > 0; n >>= 2 {
+		i <<= 1
+	}
+	return i
+}
+
+// cleanup marks the lines of ids[start:end] that can't or needn't go through the search as changed
+// and gives the ones that do, with where each of them is in the side
+// others counts how many times each line is on the other side
+func (side *diffSide) cleanup(ids []int, start, end int, others []int) ([]int, []int) {
+	const (
+		noMatch = iota
+		match
+		common
+	)
+	limit := min(bogoSqrt(len(ids)), maxEqualLimit)
+	kind := make([]int, len(ids))
+	for i := start; i < end; i++ {
+		switch n := others[ids[i]]; {
+		case n == 0:
+			kind[i] = noMatch
+		case n >= limit:
+			kind[i] = common
+		default:
+			kind[i] = match
+		}
+	}
+
+	// a common line is left out when the lines around it are mostly ones with no match at all
+	amongUnmatched := func(i int) bool {
+		lo, hi := max(start, i-simScanWindow), min(end-1, i+simScanWindow)
+		unmatched, common := 0, 2
+		for r := i - 1; r >= lo && kind[r] != match; r-- {
+			if kind[r] == noMatch {
+				unmatched++
+			} else {
+				common++
+			}
+		}
+		if unmatched == 0 {
+			return false
+		}
+		unmatchedAfter := 0
+		for r := i + 1; r <= hi && kind[r] != match; r++ {
+			if kind[r] == noMatch {
+				unmatchedAfter++
+			} else {
+				common++
+			}
+		}
+		if unmatchedAfter == 0 {
+			return false
+		}
+		return common*keepCommonRun < common+unmatched+unmatchedAfter
+	}
+
+	var kept, index []int
+	for i := start; i < end; i++ {
+		if kind[i] == match || (kind[i] == common && !amongUnmatched(i)) {
+			kept = append(kept, ids[i])
+			index = append(index, i)
+		} else {
+			side.set(i, true)
+		}
+	}
+	return kept, index
+}
+
+// diffSearch is the linear space myers over the lines cleanup left in
+type diffSearch struct {
+	a, b           []int
+	sideA, sideB   *diffSide
+	indexA, indexB []int
+	// the furthest reaching paths from the top left and the bottom right, by diagonal plus offset
+	forward, backward []int
+	offset            int
+	maxCost           int
+}
+
+// compare marks what changed between a[aLo:aHi] and b[bLo:bHi]
+func (d *diffSearch) compare(aLo, aHi, bLo, bHi int, minimal bool) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		aLo++
+		bLo++
+	}
+	for aLo < aHi && bLo < bHi && d.a[aHi-1] == d.b[bHi-1] {
+		aHi--
+		bHi--
+	}
+
+	switch {
+	case aLo == aHi:
+		for ; bLo < bHi; bLo++ {
+			d.sideB.set(d.indexB[bLo], true)
+		}
+	case bLo == bHi:
+		for ; aLo < aHi; aLo++ {
+			d.sideA.set(d.indexA[aLo], true)
+		}
+	default:
+		x, y, minLo, minHi := d.split(aLo, aHi, bLo, bHi, minimal)
+		d.compare(aLo, x, bLo, y, minLo)
+		d.compare(x, aHi, y, bHi, minHi)
+	}
+}
+
+// split finds where to divide the box, normally where the forward and backward paths meet
+// minLo and minHi say if the halves still have to be done the shortest way
+func (d *diffSearch) split(aLo, aHi, bLo, bHi int, minimal bool) (x, y int, minLo, minHi bool) {
+	a, b := d.a, d.b
+	fwd := func(k int) *int { return &d.forward[k+d.offset] }
+	bwd := func(k int) *int { return &d.backward[k+d.offset] }
+
+	dmin, dmax := aLo-bHi, aHi-bLo
+	fmid, bmid := aLo-bLo, aHi-bHi
+	odd := (fmid-bmid)&1 != 0
+	fmin, fmax := fmid, fmid
+	bmin, bmax := bmid, bmid
+
+	*fwd(fmid) = aLo
+	*bwd(bmid) = aHi
+
+	for cost := 1; ; cost++ {
+		gotSnake := false
+
+		// the diagonals grow by one each way, or shrink back where they'd leave the box
+		// the ones just outside are set so they never look like the better move
+		if fmin > dmin {
+			fmin--
+			*fwd(fmin - 1) = -1
+		} else {
+			fmin++
+		}
+		if fmax < dmax {
+			fmax++
+			*fwd(fmax + 1) = -1
+		} else {
+			fmax--
+		}
+		for k := fmax; k >= fmin; k -= 2 {
+			var i int
+			if *fwd(k - 1) >= *fwd(k + 1) {
+				i = *fwd(k - 1) + 1
+			} else {
+				i = *fwd(k + 1)
+			}
+			from := i
+			j := i - k
+			for i < aHi && j < bHi && a[i] == b[j] {
+				i++
+				j++
+			}
+			if i-from > snakeCount {
+				gotSnake = true
+			}
+			*fwd(k) = i
+			if odd && bmin <= k && k <= bmax && *bwd(k) <= i {
+				return i, j, true, true
+			}
+		}
+
+		if bmin > dmin {
+			bmin--
+			*bwd(bmin - 1) = int(^uint(0) >> 1)
+		} else {
+			bmin++
+		}
+		if bmax < dmax {
+			bmax++
+			*bwd(bmax + 1) = int(^uint(0) >> 1)
+		} else {
+			bmax--
+		}
+		for k := bmax; k >= bmin; k -= 2 {
+			var i int
+			if *bwd(k - 1) < *bwd(k + 1) {
+				i = *bwd(k - 1)
+			} else {
+				i = *bwd(k + 1) - 1
+			}
+			from := i
+			j := i - k
+			for i > aLo && j > bLo && a[i-1] == b[j-1] {
+				i--
+				j--
+			}
+			if from-i > snakeCount {
+				gotSnake = true
+			}
+			*bwd(k) = i
+			if !odd && fmin <= k && k <= fmax && i <= *fwd(k) {
+				return i, j, true, true
+			}
+		}
+
+		if minimal {
+			continue
+		}
+
+		// past the heuristic cost a path that's come a long way and ends on a good run of matches will do
+		if gotSnake && cost > heuristicMinCost {
+			best := 0
+			for k := fmax; k >= fmin; k -= 2 {
+				i := *fwd(k)
+				j := i - k
+				v := (i - aLo) + (j - bLo) - abs(k-fmid)
+				if v > heuristicK*cost && v > best &&
+					aLo+snakeCount <= i && i < aHi && bLo+snakeCount <= j && j < bHi {
+					for r := 1; a[i-r] == b[j-r]; r++ {
+						if r == snakeCount {
+							best, x, y = v, i, j
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return x, y, true, false
+			}
+
+			for k := bmax; k >= bmin; k -= 2 {
+				i := *bwd(k)
+				j := i - k
+				v := (aHi - i) + (bHi - j) - abs(k-bmid)
+				if v > heuristicK*cost && v > best &&
+					aLo < i && i <= aHi-snakeCount && bLo < j && j <= bHi-snakeCount {
+					for r := 0; a[i+r] == b[j+r]; r++ {
+						if r == snakeCount-1 {
+							best, x, y = v, i, j
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return x, y, false, true
+			}
+		}
+
+		// enough, go with whichever path got furthest
+		if cost >= d.maxCost {
+			fbest, fbestX := -1, -1
+			for k := fmax; k >= fmin; k -= 2 {
+				i := min(*fwd(k), aHi)
+				j := i - k
+				if bHi < j {
+					i, j = bHi+k, bHi
+				}
+				if fbest < i+j {
+					fbest, fbestX = i+j, i
+				}
+			}
+			bbest, bbestX := int(^uint(0)>>1), 0
+			for k := bmax; k >= bmin; k -= 2 {
+				i := max(aLo, *bwd(k))
+				j := i - k
+				if j < bLo {
+					i, j = bLo+k, bLo
+				}
+				if i+j < bbest {
+					bbest, bbestX = i+j, i
+				}
+			}
+			if (aHi+bHi)-bbest < fbest-(aLo+bLo) {
+				return fbestX, fbest - fbestX, true, false
+			}
+			return bbestX, bbest - bbestX, false, true
+		}
+	}
+}
+
+// diffHunks gives the runs of changed lines between a and b from what matchLines found
+func diffHunks(matches []int, aLen int) []diffHunk {
+	var hunks []diffHunk
+	aNext, bNext := 0, 0
+	for j := 0; j <= len(matches); j++ {
+		i := aLen
+		if j < len(matches) {
+			if matches[j] == -1 {
+				continue
+			}
+			i = matches[j]
+		}
+		if i > aNext || j > bNext {
+			hunks = append(hunks, diffHunk{aNext, i - aNext, bNext, j - bNext})
+		}
+		aNext, bNext = i+1, j+1
+	}
+	return hunks
+}
+
+// diffSide is one side of a diff while its runs of changes are slid about
+type diffSide struct {
+	lines []string
+	// what the lines are compared by, without their whitespace for ignoreSpace
+	keys []string
+	// with a false either side, so every run has an end
+	changed []bool
+}
+
+// diffGroup is a run of changed lines, [start, end), empty where the other side has the changes
+type diffGroup struct {
+	start, end int
+}
+
+func newDiffSide(lines []string, ignoreSpace bool) *diffSide {
+	keys := lines
+	if ignoreSpace {
+		keys = make([]string, len(lines))
+		for i, line := range lines {
+			keys[i] = strings.Join(strings.Fields(line), "")
+		}
+	}
+	return &diffSide{lines: lines, keys: keys, changed: make([]bool, len(lines)+2)}
+}
+
+func (side *diffSide) isChanged(i int) bool {
+	return side.changed[i+1]
+}
+
+func (side *diffSide) set(i int, changed bool) {
+	side.changed[i+1] = changed
+}
+
+func (side *diffSide) firstGroup() diffGroup {
+	var g diffGroup
+	for side.isChanged(g.end) {
+		g.end++
+	}
+	return g
+}
+
+func (side *diffSide) nextGroup(g *diffGroup) bool {
+	if g.end == len(side.lines) {
+		return false
+	}
+	g.start = g.end + 1
+	for g.end = g.start; side.isChanged(g.end); g.end++ {
+	}
+	return true
+}
+
+func (side *diffSide) previousGroup(g *diffGroup) bool {
+	if g.start == 0 {
+		return false
+	}
+	g.end = g.start - 1
+	for g.start = g.end; side.isChanged(g.start - 1); g.start-- {
+	}
+	return true
+}
+
+// slideDown moves a run one line down, swallowing the run after it if they meet
+func (side *diffSide) slideDown(g *diffGroup) bool {
+	if g.end >= len(side.lines) || side.keys[g.start] != side.keys[g.end] {
+		return false
+	}
+	side.set(g.start, false)
+	side.set(g.end, true)
+	g.start++
+	for g.end++; side.isChanged(g.end); g.end++ {
+	}
+	return true
+}
+
+func (side *diffSide) slideUp(g *diffGroup) bool {
+	if g.start == 0 || side.keys[g.start-1] != side.keys[g.end-1] {
+		return false
+	}
+	g.start--
+	g.end--
+	side.set(g.start, true)
+	side.set(g.end, false)
+	for side.isChanged(g.start - 1) {
+		g.start--
+	}
+	return true
+}
+
+// compact slides each run of changes on this side, keeping track of where it is on the other side
+// the same as xdiff's xdl_change_compact
+func (side *diffSide) compact(other *diffSide) {
+	g, og := side.firstGroup(), other.firstGroup()
+	for {
+		if g.end != g.start {
+			var size, earliestEnd int
+			endMatchingOther := -1
+			for {
+				size = g.end - g.start
+				endMatchingOther = -1
+				for side.slideUp(&g) {
+					other.previousGroup(&og)
+				}
+				earliestEnd = g.end
+				if og.end > og.start {
+					endMatchingOther = g.end
+				}
+				for side.slideDown(&g) {
+					other.nextGroup(&og)
+					if og.end > og.start {
+						endMatchingOther = g.end
+					}
+				}
+				if size == g.end-g.start {
+					break
+				}
+			}
+
+			switch {
+			case g.end == earliestEnd:
+				// it couldn't move
+			case endMatchingOther != -1:
+				for og.end == og.start {
+					side.slideUp(&g)
+					other.previousGroup(&og)
+				}
+			default:
+				best := side.bestShift(g, size, earliestEnd)
+				for g.end > best {
+					side.slideUp(&g)
+					other.previousGroup(&og)
+				}
+			}
+		}
+		if !side.nextGroup(&g) {
+			break
+		}
+		other.nextGroup(&og)
+	}
+}
+
+/*
+ * the indent heuristic scores where a run of changes could go by what's either side of where it starts and ends
+ * blank lines next to a split are good, a split that leaves the run starting more indented than the line before is bad
+ * and among splits with the same penalties the least indented one wins
+ * the weights are xdiff's, which were tuned on a lot of real code
+ */
+
+const (
+	maxIndent                       = 200
+	maxBlanks                       = 20
+	startOfFilePenalty              = 1
+	endOfFilePenalty                = 21
+	totalBlankWeight                = -30
+	postBlankWeight                 = 6
+	relativeIndentPenalty           = -4
+	relativeIndentWithBlankPenalty  = 10
+	relativeOutdentPenalty          = 24
+	relativeOutdentWithBlankPenalty = 17
+	relativeDedentPenalty           = 23
+	relativeDedentWithBlankPenalty  = 17
+	indentWeight                    = 60
+	indentHeuristicMaxSliding       = 100
+)
+
+type splitScore struct {
+	effectiveIndent int
+	penalty         int
+}
+
+// bestShift gives where the end of a run that slides between earliestEnd and g.end reads best
+func (side *diffSide) bestShift(g diffGroup, size, earliestEnd int) int {
+	shift := max(earliestEnd, g.end-size-1, g.end-indentHeuristicMaxSliding)
+	best := -1
+	var bestScore splitScore
+	for ; shift <= g.end; shift++ {
+		var score splitScore
+		side.scoreSplit(shift, &score)
+		side.scoreSplit(shift-size, &score)
+		if best == -1 || indentWeight*cmpInt(score.effectiveIndent, bestScore.effectiveIndent)+score.penalty-bestScore.penalty <= 0 {
+			best, bestScore = shift, score
+		}
+	}
+	return best
+}
+
+// lineIndent counts a tab as up to the next multiple of eight, -1 for a line that's only whitespace
+func lineIndent(line string) int {
+	indent := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case ' ':
+			indent++
+		case '\t':
+			indent += 8 - indent%8
+		case '\n', '\r', '\v', '\f':
+		default:
+			return indent
+		}
+		if indent >= maxIndent {
+			return maxIndent
+		}
+	}
+	return -1
+}
+
+// scoreSplit adds the penalties for splitting the lines just before split
+func (side *diffSide) scoreSplit(split int, score *splitScore) {
+	endOfFile := split >= len(side.lines)
+	indent := -1
+	if !endOfFile {
+		indent = lineIndent(side.lines[split])
+	}
+
+	preBlank, preIndent := 0, -1
+	for i := split - 1; i >= 0; i-- {
+		if preIndent = lineIndent(side.lines[i]); preIndent != -1 {
+			break
+		}
+		preBlank++
+		if preBlank == maxBlanks {
+			preIndent = 0
+			break
+		}
+	}
+	postBlank, postIndent := 0, -1
+	for i := split + 1; i < len(side.lines); i++ {
+		if postIndent = lineIndent(side.lines[i]); postIndent != -1 {
+			break
+		}
+		postBlank++
+		if postBlank == maxBlanks {
+			postIndent = 0
+			break
+		}
+	}
+
+	if preIndent == -1 && preBlank == 0 {
+		score.penalty += startOfFilePenalty
+	}
+	if endOfFile {
+		score.penalty += endOfFilePenalty
+	}
+	blankAfter := 0
+	if indent == -1 {
+		blankAfter = 1 + postBlank
+	}
+	totalBlank := preBlank + blankAfter
+	score.penalty += totalBlankWeight*totalBlank + postBlankWeight*blankAfter
+	if indent == -1 {
+		indent = postIndent
+	}
+	score.effectiveIndent += indent
+
+	anyBlanks := totalBlank != 0
+	switch {
+	case indent == -1 || preIndent == -1 || indent == preIndent:
+	case indent > preIndent:
+		score.penalty += pick(anyBlanks, relativeIndentWithBlankPenalty, relativeIndentPenalty)
+	case postIndent != -1 && postIndent > indent:
+		score.penalty += pick(anyBlanks, relativeOutdentWithBlankPenalty, relativeOutdentPenalty)
+	default:
+		score.penalty += pick(anyBlanks, relativeDedentWithBlankPenalty, relativeDedentPenalty)
+	}
+}
+
+func pick(cond bool, yes, no int) int {
+	if cond {
+		return yes
+	}
+	return no
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a > b:
+		return 1
+	case a < b:
+		return -1
+	}
+	return 0
+}
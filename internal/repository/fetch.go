@@ -0,0 +1,489 @@
+package repository
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+type fetchOptions struct {
+	prune  bool
+	tags   bool
+	noTags bool
+	force  bool
+	quiet  bool
+	// upload-pack to run instead of serving a local path in process
+	uploadPack string
+	// how far back to fetch for --depth, --shallow-since and --unshallow
+	deepen shallowRequest
+	// a promisor remote keeps its packs whole and filtered the way the clone was
+	promisor bool
+	filter   *objectFilter
+}
+
+// fetchedRef is one remote ref that was brought over
+type fetchedRef struct {
+	remote string
+	sha    string
+	// where it is kept locally, empty when it only goes in FETCH_HEAD
+	local string
+	force bool
+	// pull merges the refs marked for merge in FETCH_HEAD
+	merge bool
+}
+
+func (repo *Repository) fetch(args []string) error {
+	var opts fetchOptions
+	fetchCmd := flag.NewFlagSet("fetch", flag.ExitOnError)
+	fetchCmd.BoolVar(&opts.prune, "p", false, "Remove remote-tracking refs that no longer exist on the remote")
+	fetchCmd.BoolVar(&opts.prune, "prune", false, "Remove remote-tracking refs that no longer exist on the remote")
+	fetchCmd.BoolVar(&opts.tags, "t", false, "Fetch all tags")
+	fetchCmd.BoolVar(&opts.tags, "tags", false, "Fetch all tags")
+	fetchCmd.BoolVar(&opts.noTags, "no-tags", false, "Don't follow tags")
+	fetchCmd.BoolVar(&opts.force, "f", false, "Allow updates that aren't fast-forwards")
+	fetchCmd.BoolVar(&opts.force, "force", false, "Allow updates that aren't fast-forwards")
+	fetchCmd.BoolVar(&opts.quiet, "q", false, "Don't report progress")
+	fetchCmd.BoolVar(&opts.quiet, "quiet", false, "Don't report progress")
+	fetchCmd.StringVar(&opts.uploadPack, "upload-pack", "", "Path to upload-pack on the remote end")
+	depth := fetchCmd.Int("depth", 0, "Only fetch this many commits from the tip of each ref")
+	relative := fetchCmd.Int("deepen", 0, "Fetch this many more commits past where a shallow history stops")
+	since := fetchCmd.String("shallow-since", "", "Only fetch commits made after a date")
+	unshallow := fetchCmd.Bool("unshallow", false, "Fetch the rest of history for a shallow repository")
+	if err := fetchCmd.Parse(args); err != nil {
+		return err
+	}
+
+	deepen, err := repo.deepenRequest(*depth, *relative, *since, *unshallow)
+	if err != nil {
+		return err
+	}
+	opts.deepen = deepen
+
+	remote := repo.defaultRemote()
+	specs := fetchCmd.Args()
+	if len(specs) > 0 {
+		remote, specs = specs[0], specs[1:]
+	}
+
+	_, err = repo.fetchRemote(remote, specs, opts)
+	return err
+}
+
+// defaultRemote is the remote the current branch tracks, or origin
+func (repo *Repository) defaultRemote() string {
+	if branch := currentBranch(repo.gitDir); branch != "" {
+		if remote, ok := repo.conf.Get("branch." + branch + ".remote"); ok {
+			return remote
+		}
+	}
+	return "origin"
+}
+
+// fetchRemote brings over what the refspecs point at, falling back to the
+// remote's configured refspecs, and records everything in FETCH_HEAD
+func (repo *Repository) fetchRemote(remote string, specArgs []string, opts fetchOptions) ([]fetchedRef, error) {
+	url := repo.remoteURL(remote)
+	if opts.uploadPack == "" {
+		opts.uploadPack = repo.conf.Value("remote."+remote+".uploadpack", "")
+	}
+	switch repo.conf.Value("remote."+remote+".tagOpt", "") {
+	case "--tags":
+		opts.tags = opts.tags || !opts.noTags
+	case "--no-tags":
+		opts.noTags = opts.noTags || !opts.tags
+	}
+	if !opts.prune {
+		prune, err := repo.conf.Bool("fetch.prune", false)
+		if err != nil {
+			return nil, err
+		}
+		if opts.prune, err = repo.conf.Bool("remote."+remote+".prune", prune); err != nil {
+			return nil, err
+		}
+	}
+	promisor, err := repo.conf.Bool("remote."+remote+".promisor", false)
+	if err != nil {
+		return nil, err
+	}
+	if promisor {
+		filter, err := repo.remoteFilter(remote)
+		if err != nil {
+			return nil, err
+		}
+		opts.promisor, opts.filter = true, filter
+	}
+
+	configured := len(specArgs) == 0
+	if configured {
+		specArgs = repo.conf.GetAll("remote." + remote + ".fetch")
+	}
+	if len(specArgs) == 0 {
+		// a bare url with nothing configured just fetches its HEAD
+		specArgs = []string{"HEAD"}
+		configured = false
+	}
+	if opts.tags {
+		specArgs = append(specArgs, "refs/tags/*:refs/tags/*")
+	}
+
+	var specs []refspec
+	for _, arg := range specArgs {
+		spec, err := parseRefspec(arg)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+
+	conn, err := repo.connectUploadPack(url, opts.uploadPack)
+	if err != nil {
+		return nil, err
+	}
+	advertised, err := conn.listRefs(nil)
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+	remoteRefs := make(map[string]string)
+	for _, ref := range advertised {
+		if ref.sha != "" {
+			remoteRefs[ref.name] = ref.sha
+		}
+	}
+
+	fetched, err := repo.mapRemoteRefs(remote, advertised, remoteRefs, specs, configured)
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+
+	var wants []string
+	for _, ref := range fetched {
+		wants = append(wants, ref.sha)
+	}
+	if !opts.quiet {
+		conn.progress = &remoteProgress{w: os.Stderr}
+	}
+	conn.promisor, conn.filter = opts.promisor, opts.filter
+	if err := repo.fetchMissing(conn, wants, opts.deepen); err != nil {
+		return nil, err
+	}
+
+	if !opts.tags && !opts.noTags {
+		tags, err := repo.followTags(url, advertised, opts)
+		if err != nil {
+			return nil, err
+		}
+		fetched = append(fetched, tags...)
+	}
+
+	report := fetchReport{url: anonymizeURL(url), quiet: opts.quiet}
+	for _, ref := range fetched {
+		if ref.local != "" {
+			repo.updateFetchedRef(ref, opts.force, &report)
+		} else {
+			report.line('*', refKind(ref.remote), ref.remote, "FETCH_HEAD", "")
+		}
+	}
+	if opts.prune {
+		if err := repo.pruneRemoteRefs(specs, remoteRefs, &report); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := repo.writeFetchHead(anonymizeURL(url), fetched); err != nil {
+		return nil, err
+	}
+	if report.rejected {
+		return fetched, fmt.Errorf("error: some local refs could not be updated")
+	}
+	return fetched, nil
+}
+
+// mapRemoteRefs works out which remote refs each refspec picks up and where they go
+func (repo *Repository) mapRemoteRefs(remote string, advertised []advertisedRef, remoteRefs map[string]string, specs []refspec, configured bool) ([]fetchedRef, error) {
+	var mergeRef string
+	if branch := currentBranch(repo.gitDir); branch != "" && configured {
+		if repo.conf.Value("branch."+branch+".remote", "") == remote {
+			mergeRef = repo.conf.Value("branch."+branch+".merge", "")
+		}
+	}
+
+	var fetched []fetchedRef
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		spec = spec.expandSrc(remoteRefs)
+		if spec.dst != "" && !strings.HasPrefix(spec.dst, "refs/") {
+			if strings.HasPrefix(spec.src, "refs/tags/") {
+				spec.dst = "refs/tags/" + spec.dst
+			} else {
+				spec.dst = "refs/heads/" + spec.dst
+			}
+		}
+
+		found := false
+		for _, ref := range advertised {
+			local, ok := spec.match(ref.name)
+			if !ok || ref.sha == "" {
+				continue
+			}
+			found = true
+			key := ref.name + ":" + local
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			merge := ref.name == mergeRef
+			if !configured {
+				// refs named on the command line are the ones to merge
+				merge = !spec.isGlob()
+			}
+			fetched = append(fetched, fetchedRef{
+				remote: ref.name,
+				sha:    ref.sha,
+				local:  local,
+				force:  spec.force,
+				merge:  merge,
+			})
+		}
+		if !found && !spec.isGlob() {
+			return nil, fmt.Errorf("fatal: couldn't find remote ref %s", spec.src)
+		}
+	}
+
+	return fetched, nil
+}
+
+// fetchMissing asks for whichever wants aren't already here
+// and hangs up either way
+// deepening asks for every want since the history behind them is what's missing
+func (repo *Repository) fetchMissing(conn *remoteConn, wants []string, deepen shallowRequest) error {
+	var missing []string
+	seen := make(map[string]bool)
+	for _, sha := range wants {
+		if seen[sha] {
+			continue
+		}
+		seen[sha] = true
+		if _, _, err := repo.readObject(sha); err != nil || deepen.deepen() {
+			missing = append(missing, sha)
+		}
+	}
+
+	if len(missing) == 0 {
+		return conn.close()
+	}
+	deepen.shallow = repo.shallowCommits()
+
+	refs, err := repo.readRefs()
+	if err != nil {
+		conn.close()
+		return err
+	}
+	tips := make([]string, 0, len(refs))
+	for _, sha := range refs {
+		// refs to trees and blobs have no history to offer
+		if commit, _, err := repo.peelToCommit(sha); err == nil {
+			tips = append(tips, commit)
+		}
+	}
+	sort.Strings(tips)
+	// the newest commits are the likeliest to be in common, and a walk cut short by missing history still has those
+	var haves []string
+	repo.walkHistory(tips, func(sha string) bool {
+		haves = append(haves, sha)
+		return len(haves) < maxHaves
+	})
+
+	_, update, err := conn.fetch(repo, missing, haves, deepen)
+	if err != nil {
+		conn.close()
+		return fmt.Errorf("Couldn't fetch: %w", err)
+	}
+	if err := repo.applyShallow(update); err != nil {
+		conn.close()
+		return err
+	}
+	return conn.close()
+}
+
+// followTags picks up tags on the remote that point at something we now have
+// fetching the tag objects themselves if they didn't come along already
+func (repo *Repository) followTags(url string, advertised []advertisedRef, opts fetchOptions) ([]fetchedRef, error) {
+	var tags []fetchedRef
+	var wants []string
+	for _, ref := range advertised {
+		if !strings.HasPrefix(ref.name, "refs/tags/") || ref.sha == "" {
+			continue
+		}
+		if _, err := repo.readRef(ref.name); err == nil {
+			continue
+		}
+		target := ref.sha
+		if ref.peeled != "" {
+			target = ref.peeled
+		}
+		if _, _, err := repo.readObject(target); err != nil {
+			continue
+		}
+		if _, _, err := repo.readObject(ref.sha); err != nil {
+			wants = append(wants, ref.sha)
+		}
+		tags = append(tags, fetchedRef{remote: ref.name, sha: ref.sha, local: ref.name})
+	}
+
+	if len(wants) > 0 {
+		conn, err := repo.connectUploadPack(url, opts.uploadPack)
+		if err != nil {
+			return nil, err
+		}
+		conn.promisor, conn.filter = opts.promisor, opts.filter
+		if err := repo.fetchMissing(conn, wants, shallowRequest{}); err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// fetchReport prints the per ref summary the way git does
+// with the url on top once there's something to say
+type fetchReport struct {
+	url      string
+	quiet    bool
+	started  bool
+	rejected bool
+}
+
+func (report *fetchReport) line(flag byte, summary, from, to, reason string) {
+	if flag == '!' {
+		report.rejected = true
+	}
+	if report.quiet && flag != '!' {
+		return
+	}
+	if !report.started {
+		fmt.Fprintf(os.Stderr, "From %s\n", report.url)
+		report.started = true
+	}
+	fmt.Fprintf(os.Stderr, " %c %-17s %-10s -> %s%s\n", flag, summary, shortRefName(from), shortRefName(to), reason)
+}
+
+func shortRefName(name string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/"} {
+		if short, ok := strings.CutPrefix(name, prefix); ok {
+			return short
+		}
+	}
+	return name
+}
+
+func refKind(name string) string {
+	switch {
+	case strings.HasPrefix(name, "refs/heads/"):
+		return "branch"
+	case strings.HasPrefix(name, "refs/tags/"):
+		return "tag"
+	default:
+		return "ref"
+	}
+}
+
+// updateFetchedRef moves a local ref to what was fetched
+// refusing anything that would lose commits or move an existing tag unless forced
+func (repo *Repository) updateFetchedRef(ref fetchedRef, force bool, report *fetchReport) {
+	force = force || ref.force
+	old, err := repo.readRef(ref.local)
+	if err != nil {
+		old = ""
+	}
+	if old == ref.sha {
+		return
+	}
+
+	if branch, ok := strings.CutPrefix(ref.local, "refs/heads/"); ok && repo.worktree != "" && branch == currentBranch(repo.gitDir) {
+		report.line('!', "[rejected]", ref.remote, ref.local, " (refusing to fetch into current branch)")
+		return
+	}
+
+	var flag byte
+	var summary, reason string
+	switch {
+	case old == "":
+		flag, summary = '*', "[new "+refKind(ref.remote)+"]"
+	case strings.HasPrefix(ref.local, "refs/tags/") && !force:
+		report.line('!', "[rejected]", ref.remote, ref.local, " (would clobber existing tag)")
+		return
+	case strings.HasPrefix(ref.local, "refs/tags/"):
+		flag, summary = 't', "[tag update]"
+	case repo.isAncestor(old, ref.sha):
+		flag, summary = ' ', old[:7]+".."+ref.sha[:7]
+	case force:
+		flag, summary, reason = '+', old[:7]+"..."+ref.sha[:7], " (forced update)"
+	default:
+		report.line('!', "[rejected]", ref.remote, ref.local, " (non-fast-forward)")
+		return
+	}
+
+	// only if it still holds what the checks above were made against
+	if err := repo.changeRefs([]refChange{{name: ref.local, old: old, value: ref.sha}}); err != nil {
+		report.line('!', "[rejected]", ref.remote, ref.local, " (unable to update local ref)")
+		return
+	}
+	report.line(flag, summary, ref.remote, ref.local, reason)
+}
+
+// pruneRemoteRefs deletes local refs that the refspecs map from remote refs which are gone
+func (repo *Repository) pruneRemoteRefs(specs []refspec, remoteRefs map[string]string, report *fetchReport) error {
+	localRefs, err := repo.readRefs()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(localRefs))
+	for name := range localRefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if target, _ := repo.readSymref(name); target != "" {
+			continue
+		}
+		for _, spec := range specs {
+			src, ok := spec.reverse(name)
+			if !ok {
+				continue
+			}
+			if _, exists := remoteRefs[src]; exists {
+				break
+			}
+			if err := repo.deleteRef(name); err != nil {
+				return err
+			}
+			report.line('-', "[deleted]", "(none)", name, "")
+			break
+		}
+	}
+	return nil
+}
+
+/*
+ * FETCH_HEAD has one line per fetched ref
+ * <sha> TAB [not-for-merge] TAB <description>
+ * with the refs to merge first
+ */
+func (repo *Repository) writeFetchHead(url string, fetched []fetchedRef) error {
+	var merge, rest strings.Builder
+	for _, ref := range fetched {
+		desc := fetchHeadDescription(ref.remote, url)
+		if ref.merge {
+			fmt.Fprintf(&merge, "%s\t\t%s\n", ref.sha, desc)
+		} else {
+			fmt.Fprintf(&rest, "%s\tnot-for-merge\t%s\n", ref.sha, desc)
+		}
+	}
+
+	return os.WriteFile(repo.makePath("FETCH_HEAD"), []byte(merge.String()+rest.String()), 0o644)
+}
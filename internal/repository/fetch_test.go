@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// commitChain commits n commits one on top of the other, each with its own contents, giving back the last
+func commitChain(t *testing.T, repo *Repository, name string, n int) string {
+	t.Helper()
+	var tip string
+	for i := range n {
+		var parents []string
+		if tip != "" {
+			parents = []string{tip}
+		}
+		tip = commitTestFiles(t, repo, map[string]string{name: fmt.Sprintf("%d\n", i)}, parents...)
+	}
+	return tip
+}
+
+func TestFetchSendsHavesInRounds(t *testing.T) {
+	remote := newTestRepo(t, true)
+	shared := commitChain(t, remote, "shared", 100)
+	tip := commitTestFiles(t, remote, map[string]string{"shared": "new\n"}, shared)
+	if err := remote.writeRef("refs/heads/main", tip); err != nil {
+		t.Fatal(err)
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	// every POST is counted along with the haves in it
+	var mu sync.Mutex
+	var posts, haves int
+	handler := &smartHTTP{root: filepath.Dir(remote.gitDir)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var body io.Reader = r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				body = gz
+				r.Header.Del("Content-Encoding")
+			}
+			data, _ := io.ReadAll(body)
+			mu.Lock()
+			posts++
+			haves += strings.Count(string(data), "have ")
+			mu.Unlock()
+			r.Body = io.NopCloser(bytes.NewReader(data))
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	url := server.URL + "/" + filepath.Base(remote.gitDir)
+
+	tests := []struct {
+		name    string
+		version int
+		// what the local repository has, the same history as the remote or one of its own
+		local     string
+		wantHaves int
+		wantPosts int
+	}{
+		// the newest have is common, so there's one round and the ACKed have again with done
+		{"v0 common", 0, "shared", haveBatchSize + 1, 2},
+		// nothing's common, so every round goes by and then done on its own
+		{"v0 unrelated", 0, "unrelated", maxHaves, maxHaves/haveBatchSize + 1},
+		// v2 has the server say it's ready and send the pack in the same round
+		{"v2 common", 2, "shared", haveBatchSize, 1},
+		{"v2 unrelated", 2, "unrelated", maxHaves, maxHaves / haveBatchSize},
+	}
+	for _, tt := range tests {
+		repo := newTestRepo(t, true)
+		var local string
+		if tt.local == "shared" {
+			local = commitChain(t, repo, "shared", 100)
+		} else {
+			local = commitChain(t, repo, "unrelated", maxHaves+50)
+		}
+		if err := repo.writeRef("refs/heads/main", local); err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := repo.connectHTTP(url, "git-upload-pack", tt.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		posts, haves = 0, 0
+		mu.Unlock()
+		if err := repo.fetchMissing(conn, []string{tip}, shallowRequest{}); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !repo.hasObject(tip) {
+			t.Fatalf("%s: the fetch didn't bring %s", tt.name, tip)
+		}
+		mu.Lock()
+		if haves != tt.wantHaves || posts != tt.wantPosts {
+			t.Errorf("%s: %d haves in %d requests, want %d in %d", tt.name, haves, posts, tt.wantHaves, tt.wantPosts)
+		}
+		mu.Unlock()
+	}
+}
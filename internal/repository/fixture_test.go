@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testIdent = "A U Thor <author@example.com> 1700000000 +0000"
+
+// newTestRepo makes an empty repository that no config outside it can reach
+func newTestRepo(t *testing.T, bare bool) *Repository {
+	t.Helper()
+	return newTestRepoFormat(t, bare, "")
+}
+
+// newTestRepoFormat is newTestRepo with objects named by the given format
+func newTestRepoFormat(t *testing.T, bare bool, format string) *Repository {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+
+	repo, err := Init(t.TempDir(), bare, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// writeTestTree stores files, slash separated paths to contents, as nested trees
+func writeTestTree(t *testing.T, repo *Repository, files map[string]string) string {
+	t.Helper()
+	blobs := make(map[string]string)
+	subdirs := make(map[string]map[string]string)
+	for name, contents := range files {
+		if dir, rest, ok := strings.Cut(name, "/"); ok {
+			if subdirs[dir] == nil {
+				subdirs[dir] = make(map[string]string)
+			}
+			subdirs[dir][rest] = contents
+		} else {
+			blobs[name] = contents
+		}
+	}
+
+	var leaves []*TreeLeaf
+	add := func(mode, name, sha string) {
+		leaf, err := NewTreeLeaf(mode, name, sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, leaf)
+	}
+	for name, contents := range blobs {
+		sha, err := repo.WriteObject("blob", []byte(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		add("100644", name, sha)
+	}
+	for dir, sub := range subdirs {
+		add("40000", dir, writeTestTree(t, repo, sub))
+	}
+
+	sha, err := repo.WriteTree(leaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
+
+// commitTestFiles commits files on top of the given parents
+func commitTestFiles(t *testing.T, repo *Repository, files map[string]string, parents ...string) string {
+	t.Helper()
+	tree := writeTestTree(t, repo, files)
+	sha, err := repo.WriteCommit(tree, parents, testIdent, testIdent, fmt.Sprintf("commit %d\n", len(files)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sha
+}
@@ -0,0 +1,708 @@
+package repository
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * fsck goes over everything in the object database
+ *
+ * every loose and packed object is hashed again and compared with its name
+ * and trees, commits and tags are checked the way git checks them
+ *
+ * tree:   <mode> <name>\0<sha>... with known modes, sorted, no duplicate or odd names
+ * commit: tree, parent..., author and committer, in that order
+ * tag:    object, type, tag and an optional tagger
+ * ident:  Name <email> <unix time> <+hhmm>
+ *
+ * every link between objects is followed to make sure what it points at is there
+ * then everything reachable from refs, HEAD, the index and reflogs is walked
+ * whatever is left over is unreachable, and dangling when nothing else left over points at it
+ */
+
+type fsckOptions struct {
+	unreachable      bool
+	dangling         bool
+	lostFound        bool
+	connectivityOnly bool
+	reflogs          bool
+}
+
+// fsckObject is what fsck learned about one object
+type fsckObject struct {
+	kind  string
+	links []fsckLink
+	// came from a promisor pack so what it points at may be missing on purpose
+	promisor bool
+}
+
+// fsckLink is one object pointing at another, which should be of kind
+// an empty kind is anything, like what a ref points at
+type fsckLink struct {
+	sha  string
+	kind string
+	// how a root that's broken gets reported, like "HEAD: invalid reflog entry"
+	root string
+}
+
+type fsckCheck struct {
+	repo    *Repository
+	opts    fsckOptions
+	objects map[string]*fsckObject
+	errors  int
+}
+
+func (repo *Repository) fsck(args []string) error {
+	opts := fsckOptions{dangling: true, reflogs: true}
+	noDangling, noReflogs := false, false
+	fsckCmd := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fsckCmd.BoolVar(&opts.unreachable, "unreachable", false, "Show objects that exist but can't be reached from any reference")
+	fsckCmd.BoolVar(&noDangling, "no-dangling", false, "Don't show dangling objects")
+	fsckCmd.BoolVar(&opts.lostFound, "lost-found", false, "Write dangling objects into .git/lost-found")
+	fsckCmd.BoolVar(&opts.connectivityOnly, "connectivity-only", false, "Only check that reachable objects are there")
+	fsckCmd.BoolVar(&noReflogs, "no-reflogs", false, "Don't count reflog entries as references")
+	if err := fsckCmd.Parse(args); err != nil {
+		return err
+	}
+	opts.dangling = !noDangling
+	opts.reflogs = !noReflogs
+
+	check := &fsckCheck{repo: repo, opts: opts, objects: make(map[string]*fsckObject)}
+	if err := check.scanLoose(); err != nil {
+		return err
+	}
+	if err := check.scanPacks(); err != nil {
+		return err
+	}
+
+	check.checkLinks()
+	roots, err := check.roots()
+	if err != nil {
+		return err
+	}
+	reachable := check.walk(roots)
+	if err := check.reportUnreachable(reachable); err != nil {
+		return err
+	}
+
+	if check.errors > 0 {
+		return fmt.Errorf("fatal: fsck found %d problems", check.errors)
+	}
+	return nil
+}
+
+// scanLoose checks every object under objects/xx/
+func (check *fsckCheck) scanLoose() error {
+	objectsDir := check.repo.makePath("objects")
+	dirs, err := os.ReadDir(objectsDir)
+	if err != nil {
+		return fmt.Errorf("Couldn't read %s: %w", objectsDir, err)
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 || validSha(dir.Name()+strings.Repeat("0", 38)) != nil {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(objectsDir, dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			sha := dir.Name() + file.Name()
+			rel := filepath.Join("objects", dir.Name(), file.Name())
+			if check.repo.format.check(sha) != nil {
+				fmt.Fprintf(os.Stderr, "warning: garbage found: %s\n", rel)
+				continue
+			}
+
+			kind, contents, err := readLooseObject(check.repo.makePath(rel))
+			if err != nil {
+				check.fail("error: object file %s is corrupt: %s", rel, err)
+				continue
+			}
+			if !check.opts.connectivityOnly {
+				if actual := objectSha(check.repo.format, kind, contents); actual != sha {
+					check.fail("error: hash mismatch for %s (expected %s, got %s)", rel, sha, actual)
+					continue
+				}
+			}
+			check.record(sha, kind, contents, false)
+		}
+	}
+	return nil
+}
+
+// scanPacks checks each pack's checksums and then every object in it
+func (check *fsckCheck) scanPacks() error {
+	packs, err := check.repo.loadPacks()
+	if err != nil {
+		return err
+	}
+
+	for _, pack := range packs {
+		if !check.opts.connectivityOnly {
+			check.verifyPackFile(pack)
+		}
+
+		file, err := os.Open(pack.path)
+		if err != nil {
+			check.fail("error: Couldn't open %s: %s", filepath.Base(pack.path), err)
+			continue
+		}
+		for i := 0; i < pack.count(); i++ {
+			sha := hex.EncodeToString(pack.shaAt(i))
+			if _, ok := check.objects[sha]; ok {
+				continue
+			}
+			kind, contents, err := check.repo.readPackEntry(file, pack.offsets[i])
+			if err != nil {
+				check.fail("error: Couldn't read %s from %s: %s", sha, filepath.Base(pack.path), err)
+				continue
+			}
+			if !check.opts.connectivityOnly {
+				if actual := objectSha(check.repo.format, kind, contents); actual != sha {
+					check.fail("error: hash mismatch for %s in %s (got %s)", sha, filepath.Base(pack.path), actual)
+					continue
+				}
+			}
+			check.record(sha, kind, contents, pack.promisor)
+		}
+		file.Close()
+	}
+	return nil
+}
+
+// verifyPackFile checks the trailers of a pack and its index
+// and that the index is for that pack
+func (check *fsckCheck) verifyPackFile(pack *packFile) {
+	format := check.repo.format
+	idxPath := strings.TrimSuffix(pack.path, ".pack") + ".idx"
+	idx, err := os.ReadFile(idxPath)
+	if err != nil || len(idx) < 2*format.size {
+		check.fail("error: index file %s is too small", filepath.Base(idxPath))
+		return
+	}
+	if sum := format.sum(idx[:len(idx)-format.size]); !bytes.Equal(sum, idx[len(idx)-format.size:]) {
+		check.fail("error: index file %s is corrupt", filepath.Base(idxPath))
+	}
+
+	file, err := os.Open(pack.path)
+	if err != nil {
+		check.fail("error: Couldn't open %s: %s", filepath.Base(pack.path), err)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.Size() < int64(12+format.size) {
+		check.fail("error: %s is too small to be a pack", filepath.Base(pack.path))
+		return
+	}
+
+	sum := format.newHash()
+	if _, err := io.CopyN(sum, file, info.Size()-int64(format.size)); err != nil {
+		check.fail("error: Couldn't read %s: %s", filepath.Base(pack.path), err)
+		return
+	}
+	trailer := make([]byte, format.size)
+	if _, err := io.ReadFull(file, trailer); err != nil {
+		check.fail("error: Couldn't read %s: %s", filepath.Base(pack.path), err)
+		return
+	}
+	if !bytes.Equal(sum.Sum(nil), trailer) {
+		check.fail("error: %s SHA1 checksum mismatch", filepath.Base(pack.path))
+	}
+	if !bytes.Equal(idx[len(idx)-2*format.size:len(idx)-format.size], trailer) {
+		check.fail("error: %s does not match %s", filepath.Base(idxPath), filepath.Base(pack.path))
+	}
+}
+
+// readLooseObject inflates a loose object, making sure its header adds up
+// unlike readObject, which trusts whatever it finds
+func readLooseObject(path string) (string, []byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	zr, err := zlib.NewReader(file)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to unpack header: %w", err)
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to inflate: %w", err)
+	}
+
+	header, contents, ok := bytes.Cut(data, []byte{0})
+	if !ok {
+		return "", nil, fmt.Errorf("no null byte after the header")
+	}
+	kind, sizeStr, _ := strings.Cut(string(header), " ")
+	switch kind {
+	case "commit", "tree", "blob", "tag":
+	default:
+		return "", nil, fmt.Errorf("unknown object type '%s'", kind)
+	}
+	if size, err := strconv.Atoi(sizeStr); err != nil || size != len(contents) {
+		return "", nil, fmt.Errorf("size in the header is %s but there are %d bytes", sizeStr, len(contents))
+	}
+	return kind, contents, nil
+}
+
+func objectSha(format *objectFormat, kind string, contents []byte) string {
+	return hex.EncodeToString(format.sum(append([]byte(fmt.Sprintf("%s %d\x00", kind, len(contents))), contents...)))
+}
+
+// record checks an object's structure and remembers what it points at
+func (check *fsckCheck) record(sha, kind string, contents []byte, promisor bool) {
+	obj := &fsckObject{kind: kind, promisor: promisor}
+	problems := &fsckProblems{check: check, kind: kind, sha: sha}
+	switch kind {
+	case "tree":
+		obj.links = checkTree(contents, problems)
+	case "commit":
+		obj.links = checkCommit(contents, problems)
+	case "tag":
+		obj.links = checkTag(contents, problems)
+	}
+	check.objects[sha] = obj
+}
+
+func (check *fsckCheck) fail(format string, args ...any) {
+	check.errors++
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+// fsckProblems reports what's wrong with one object, each kind of problem once
+type fsckProblems struct {
+	check *fsckCheck
+	kind  string
+	sha   string
+	seen  map[string]bool
+}
+
+func (p *fsckProblems) report(warning bool, id, msg string) {
+	if p.check.opts.connectivityOnly || p.seen[id] {
+		return
+	}
+	if p.seen == nil {
+		p.seen = make(map[string]bool)
+	}
+	p.seen[id] = true
+
+	if warning {
+		fmt.Fprintf(os.Stderr, "warning in %s %s: %s: %s\n", p.kind, p.sha, id, msg)
+		return
+	}
+	p.check.fail("error in %s %s: %s: %s", p.kind, p.sha, id, msg)
+}
+
+func checkTree(contents []byte, problems *fsckProblems) []fsckLink {
+	leaves, err := treeParseEntirety(contents, problems.check.repo.format.size)
+	if err != nil {
+		problems.report(false, "badTree", err.Error())
+		return nil
+	}
+
+	var links []fsckLink
+	names := make(map[string]bool)
+	for i, leaf := range leaves {
+		kind := "blob"
+		switch leaf.mode {
+		case "100644", "100755", "120000":
+		case "40000":
+			kind = "tree"
+		case "160000":
+			// submodule commits live in another repository
+			kind = ""
+		case "040000":
+			problems.report(true, "zeroPaddedFilemode", "contains zero-padded file modes")
+			kind = "tree"
+		default:
+			// old versions of git wrote modes like 100664, which git still reads as a blob
+			problems.report(true, "badFilemode", "contains bad file modes")
+		}
+
+		switch {
+		case leaf.path == "":
+			problems.report(true, "emptyName", "contains empty pathname")
+		case strings.Contains(leaf.path, "/"):
+			problems.report(true, "fullPathname", "contains full pathnames")
+		case leaf.path == ".":
+			problems.report(true, "hasDot", "contains '.'")
+		case leaf.path == "..":
+			problems.report(true, "hasDotdot", "contains '..'")
+		case isDotGit(leaf.path):
+			problems.report(true, "hasDotgit", "contains '.git'")
+		}
+		if names[leaf.path] {
+			problems.report(false, "duplicateEntries", "contains duplicate file entries")
+		} else if i > 0 && sortLeafByKey(leaves[i-1]) >= sortLeafByKey(leaf) {
+			problems.report(false, "treeNotSorted", "not properly sorted")
+		}
+		names[leaf.path] = true
+
+		sha := hex.EncodeToString(leaf.sha)
+		if isZeroSha(sha) {
+			problems.report(true, "nullSha1", "contains entries pointing to null sha1")
+			continue
+		}
+		if kind != "" {
+			links = append(links, fsckLink{sha: sha, kind: kind})
+		}
+	}
+	return links
+}
+
+// headerLines splits the headers of a commit or tag off from its message
+func headerLines(contents []byte) []string {
+	header, _, _ := bytes.Cut(contents, []byte("\n\n"))
+	return strings.Split(string(header), "\n")
+}
+
+func checkCommit(contents []byte, problems *fsckProblems) []fsckLink {
+	if bytes.IndexByte(contents, 0) != -1 {
+		problems.report(false, "nulInCommit", "NUL byte in the commit object body")
+	}
+	lines := headerLines(contents)
+	next := func(key string) (string, bool) {
+		if len(lines) == 0 {
+			return "", false
+		}
+		value, ok := strings.CutPrefix(lines[0], key+" ")
+		if ok {
+			lines = lines[1:]
+		}
+		return value, ok
+	}
+
+	var links []fsckLink
+	tree, ok := next("tree")
+	switch {
+	case !ok:
+		problems.report(false, "missingTree", "invalid format - expected 'tree' line")
+	case problems.check.repo.format.check(tree) != nil:
+		problems.report(false, "badTreeSha1", "invalid 'tree' line format - bad sha1")
+	default:
+		links = append(links, fsckLink{sha: tree, kind: "tree"})
+	}
+	for {
+		parent, ok := next("parent")
+		if !ok {
+			break
+		}
+		if problems.check.repo.format.check(parent) != nil {
+			problems.report(false, "badParentSha1", "invalid 'parent' line format - bad sha1")
+			continue
+		}
+		links = append(links, fsckLink{sha: parent, kind: "commit"})
+	}
+
+	if author, ok := next("author"); !ok {
+		problems.report(false, "missingAuthor", "invalid format - expected 'author' line")
+	} else if id, msg := checkIdent(author); id != "" {
+		problems.report(false, id, msg)
+	}
+	if committer, ok := next("committer"); !ok {
+		problems.report(false, "missingCommitter", "invalid format - expected 'committer' line")
+	} else if id, msg := checkIdent(committer); id != "" {
+		problems.report(false, id, msg)
+	}
+	return links
+}
+
+func checkTag(contents []byte, problems *fsckProblems) []fsckLink {
+	lines := headerLines(contents)
+	next := func(key string) (string, bool) {
+		if len(lines) == 0 {
+			return "", false
+		}
+		value, ok := strings.CutPrefix(lines[0], key+" ")
+		if ok {
+			lines = lines[1:]
+		}
+		return value, ok
+	}
+
+	object, ok := next("object")
+	if !ok {
+		problems.report(false, "missingObject", "invalid format - expected 'object' line")
+		return nil
+	}
+	if problems.check.repo.format.check(object) != nil {
+		problems.report(false, "badObjectSha1", "invalid 'object' line format - bad sha1")
+		return nil
+	}
+
+	kind, ok := next("type")
+	if !ok {
+		problems.report(false, "missingTypeEntry", "invalid format - unexpected end after 'type' line")
+		return nil
+	}
+	if _, err := newObject(kind, problems.check.repo.format); err != nil {
+		problems.report(false, "badType", "invalid 'type' value")
+		kind = ""
+	}
+
+	if _, ok := next("tag"); !ok {
+		problems.report(false, "missingTagEntry", "invalid format - expected 'tag' line")
+	}
+	if tagger, ok := next("tagger"); ok {
+		if id, msg := checkIdent(tagger); id != "" {
+			problems.report(false, id, msg)
+		}
+	}
+	return []fsckLink{{sha: object, kind: kind}}
+}
+
+// checkIdent looks over an author, committer or tagger line
+// giving the id and message for what's wrong with it, if anything
+func checkIdent(ident string) (string, string) {
+	const prefix = "invalid author/committer line - "
+	lt := strings.IndexByte(ident, '<')
+	switch {
+	case lt == -1:
+		return "missingEmail", prefix + "missing email"
+	case lt == 0:
+		return "missingNameBeforeEmail", prefix + "missing space before email"
+	case ident[lt-1] != ' ':
+		return "missingSpaceBeforeEmail", prefix + "missing space before email"
+	case strings.ContainsRune(ident[:lt], '>'):
+		return "badName", prefix + "bad name"
+	}
+
+	rest := ident[lt+1:]
+	gt := strings.IndexByte(rest, '>')
+	if gt == -1 || strings.ContainsRune(rest[:gt], '<') {
+		return "badEmail", prefix + "bad email"
+	}
+	rest, ok := strings.CutPrefix(rest[gt+1:], " ")
+	if !ok {
+		return "missingSpaceBeforeDate", prefix + "missing space before date"
+	}
+
+	date, tz, _ := strings.Cut(rest, " ")
+	switch {
+	case date == "" || strings.Trim(date, "0123456789") != "":
+		return "badDate", prefix + "bad date"
+	case len(date) > 1 && date[0] == '0':
+		return "zeroPaddedDate", prefix + "zero-padded date"
+	}
+	if _, err := strconv.ParseUint(date, 10, 64); err != nil {
+		return "badDateOverflow", prefix + "date causes integer overflow"
+	}
+	if len(tz) != 5 || tz[0] != '+' && tz[0] != '-' || strings.Trim(tz[1:], "0123456789") != "" {
+		return "badTimezone", prefix + "bad time zone"
+	}
+	return "", ""
+}
+
+// checkLinks makes sure everything each object points at is there and of the right kind
+// which is only expected to fail for a promisor object or a shallow commit's parents
+func (check *fsckCheck) checkLinks() {
+	shas := make([]string, 0, len(check.objects))
+	for sha := range check.objects {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+
+	missing := make(map[string]string)
+	for _, sha := range shas {
+		obj := check.objects[sha]
+		shallow := obj.kind == "commit" && check.repo.isShallow(sha)
+		broken := false
+		for _, link := range obj.links {
+			target, ok := check.objects[link.sha]
+			switch {
+			case !ok && (obj.promisor || shallow && link.kind == "commit"):
+			case !ok:
+				fmt.Printf("broken link from %7s %s\n", obj.kind, sha)
+				fmt.Printf("              to %7s %s\n", link.kind, link.sha)
+				missing[link.sha] = link.kind
+			case link.kind != "" && target.kind != link.kind:
+				check.fail("error: object %s is a %s, not a %s", link.sha, target.kind, link.kind)
+				broken = true
+			}
+		}
+		if broken {
+			check.fail("error in %s %s: broken links", obj.kind, sha)
+		}
+	}
+
+	shas = shas[:0]
+	for sha := range missing {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+	for _, sha := range shas {
+		check.errors++
+		fmt.Printf("missing %s %s\n", missing[sha], sha)
+	}
+}
+
+// roots are where reachability starts: refs, HEAD, the index and reflogs
+func (check *fsckCheck) roots() ([]fsckLink, error) {
+	refs, err := check.repo.readRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []fsckLink
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		roots = append(roots, fsckLink{sha: refs[name], root: name + ": invalid sha1 pointer"})
+	}
+
+	if sha, err := check.repo.readRef("HEAD"); err == nil {
+		roots = append(roots, fsckLink{sha: sha, root: "HEAD: invalid sha1 pointer"})
+	} else if target, _ := check.repo.readSymref("HEAD"); target != "" {
+		fmt.Fprintf(os.Stderr, "notice: HEAD points to an unborn branch (%s)\n", strings.TrimPrefix(target, "refs/heads/"))
+	}
+	if len(refs) == 0 {
+		fmt.Fprintln(os.Stderr, "notice: No default references")
+	}
+
+	if check.repo.worktree != "" {
+		index, err := check.repo.readIndex()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range index.entries {
+			if entry.mode == 0o160000 {
+				continue
+			}
+			roots = append(roots, fsckLink{sha: hex.EncodeToString(entry.sha[:]), kind: "blob", root: entry.path + ": invalid sha1 pointer in the index"})
+		}
+	}
+
+	if check.opts.reflogs {
+		logs, err := check.reflogRoots()
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, logs...)
+	}
+	return roots, nil
+}
+
+// reflogRoots are the old and new values of every reflog entry
+func (check *fsckCheck) reflogRoots() ([]fsckLink, error) {
+	names, err := check.repo.reflogNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []fsckLink
+	for _, name := range names {
+		entries, err := check.repo.readReflog(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			for _, sha := range []string{entry.old, entry.new} {
+				if check.repo.format.check(sha) == nil && !isZeroSha(sha) {
+					roots = append(roots, fsckLink{sha: sha, root: name + ": invalid reflog entry"})
+				}
+			}
+		}
+	}
+	return roots, nil
+}
+
+// walk marks everything the roots lead to
+// links to missing objects were already reported, only broken roots are left to report
+func (check *fsckCheck) walk(roots []fsckLink) map[string]bool {
+	reachable := make(map[string]bool)
+	queue := append([]fsckLink{}, roots...)
+	for len(queue) > 0 {
+		link := queue[0]
+		queue = queue[1:]
+		if reachable[link.sha] {
+			continue
+		}
+
+		obj, ok := check.objects[link.sha]
+		if !ok {
+			if link.root != "" {
+				check.fail("error: %s %s", link.root, link.sha)
+			}
+			continue
+		}
+		reachable[link.sha] = true
+		queue = append(queue, obj.links...)
+	}
+	return reachable
+}
+
+// reportUnreachable lists what the walk didn't get to
+// either every unreachable object or just the dangling ones nothing else points at
+func (check *fsckCheck) reportUnreachable(reachable map[string]bool) error {
+	var unreachable []string
+	pointedAt := make(map[string]bool)
+	for sha, obj := range check.objects {
+		if reachable[sha] || obj.promisor {
+			continue
+		}
+		unreachable = append(unreachable, sha)
+		for _, link := range obj.links {
+			pointedAt[link.sha] = true
+		}
+	}
+	sort.Strings(unreachable)
+
+	for _, sha := range unreachable {
+		kind := check.objects[sha].kind
+		dangling := !pointedAt[sha]
+		switch {
+		case check.opts.unreachable:
+			fmt.Printf("unreachable %s %s\n", kind, sha)
+		case dangling && check.opts.dangling:
+			fmt.Printf("dangling %s %s\n", kind, sha)
+		}
+
+		if dangling && check.opts.lostFound {
+			if err := check.writeLostFound(sha, kind); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeLostFound saves a dangling object under lost-found
+// blobs as their contents and everything else as its name
+func (check *fsckCheck) writeLostFound(sha, kind string) error {
+	dir := check.repo.makePath("lost-found", "other")
+	if kind == "commit" {
+		dir = check.repo.makePath("lost-found", "commit")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("Couldn't create directories: %w", err)
+	}
+
+	contents := []byte(sha + "\n")
+	if kind == "blob" {
+		_, blob, err := check.repo.readObject(sha)
+		if err != nil {
+			return err
+		}
+		contents = blob
+	}
+	return os.WriteFile(filepath.Join(dir, sha), contents, 0o644)
+}
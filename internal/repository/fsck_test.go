@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestFsckRejectsBadTrees(t *testing.T) {
+	repo := newTestRepo(t, true)
+	blob, err := repo.WriteObject("blob", []byte("contents\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := hex.DecodeString(blob)
+	entry := func(mode, name string) string {
+		return mode + " " + name + "\x00" + string(raw)
+	}
+
+	cases := []struct {
+		name     string
+		contents string
+		id       string
+		warning  bool
+	}{
+		{"truncated sha", entry("100644", "a")[:12], "badTree", false},
+		{"no NUL after the name", "100644 a", "badTree", false},
+		{"not sorted", entry("100644", "b") + entry("100644", "a"), "treeNotSorted", false},
+		{"duplicate names", entry("100644", "a") + entry("100644", "a"), "duplicateEntries", false},
+		{"directory sorts after a file with a longer name", entry("40000", "a") + entry("100644", "a.c"), "treeNotSorted", false},
+		{".git", entry("40000", ".git"), "hasDotgit", true},
+		{"..", entry("40000", ".."), "hasDotdot", true},
+		{"odd mode", entry("100664", "a"), "badFilemode", true},
+		{"zero padded mode", entry("040000", "a"), "zeroPaddedFilemode", true},
+	}
+	for _, c := range cases {
+		check := &fsckCheck{repo: repo, objects: make(map[string]*fsckObject)}
+		problems := &fsckProblems{check: check, kind: "tree", sha: c.name}
+		checkTree([]byte(c.contents), problems)
+		if !problems.seen[c.id] {
+			t.Errorf("%s: %s wasn't reported, got %v", c.name, c.id, problems.seen)
+		}
+		if failed := check.errors > 0; failed == c.warning {
+			t.Errorf("%s: %d errors, want only a warning: %v", c.name, check.errors, c.warning)
+		}
+	}
+
+	// a good tree is fine, and the whole repository with it
+	good := entry("100644", "a") + entry("40000", "a.c") + entry("100644", "b")
+	check := &fsckCheck{repo: repo, objects: make(map[string]*fsckObject)}
+	problems := &fsckProblems{check: check, kind: "tree", sha: "good"}
+	if links := checkTree([]byte(good), problems); len(problems.seen) != 0 || len(links) != 3 {
+		t.Errorf("good tree: problems %v, %d links", problems.seen, len(links))
+	}
+	commit := commitTestFiles(t, repo, map[string]string{"a": "contents\n"})
+	if err := repo.writeRef("refs/heads/main", commit); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.fsck(nil); err != nil {
+		t.Fatalf("fsck of a good repository: %v", err)
+	}
+
+	// a reachable commit with a broken tree fails fsck without it panicking
+	broken, err := repo.writeRawObject("tree", []byte(entry("100644", "b")+entry("100644", "a")[:12]), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := repo.WriteCommit(broken, nil, testIdent, testIdent, "broken\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.writeRef("refs/heads/bad", bad); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.fsck(nil); err == nil || !strings.Contains(err.Error(), "fsck found") {
+		t.Errorf("fsck of a repository with a broken tree: %v", err)
+	}
+}
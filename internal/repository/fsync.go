@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+ * core.fsync says which files get flushed to disk before they're renamed into place
+ * it's a comma separated list of components, added to the defaults
+ * unless "none" comes first, and taken away from them with a leading -
+ *
+ *   loose-object      objects/xx/*
+ *   pack              objects/pack/*.pack
+ *   pack-metadata     .idx, .bitmap, .mtimes and the multi-pack-index
+ *   commit-graph      the commit-graph and its chain
+ *   index             .git/index
+ *   reference         understood, but refs aren't synced yet
+ *
+ *   objects           loose-object and pack
+ *   derived-metadata  pack-metadata and commit-graph
+ *   committed         objects and reference
+ *   added             committed and index
+ *   all               everything
+ *
+ * the default is everything under objects but loose objects, like git
+ * core.fsyncObjectFiles turns on loose-object too
+ *
+ * all of these are written to a tmp_ or .lock file first, so a crash leaves that behind
+ * and never a half written file where the real one goes
+ */
+
+type fsyncComponent uint
+
+const (
+	fsyncLooseObject fsyncComponent = 1 << iota
+	fsyncPack
+	fsyncPackMetadata
+	fsyncCommitGraph
+	fsyncIndex
+	fsyncReference
+
+	fsyncObjects         = fsyncLooseObject | fsyncPack
+	fsyncDerivedMetadata = fsyncPackMetadata | fsyncCommitGraph
+	fsyncCommitted       = fsyncObjects | fsyncReference
+	fsyncAdded           = fsyncCommitted | fsyncIndex
+	fsyncAll             = fsyncAdded | fsyncDerivedMetadata
+
+	defaultFsync = (fsyncObjects | fsyncDerivedMetadata) &^ fsyncLooseObject
+)
+
+var fsyncComponentNames = map[string]fsyncComponent{
+	"loose-object":     fsyncLooseObject,
+	"pack":             fsyncPack,
+	"pack-metadata":    fsyncPackMetadata,
+	"commit-graph":     fsyncCommitGraph,
+	"index":            fsyncIndex,
+	"reference":        fsyncReference,
+	"objects":          fsyncObjects,
+	"derived-metadata": fsyncDerivedMetadata,
+	"committed":        fsyncCommitted,
+	"added":            fsyncAdded,
+	"all":              fsyncAll,
+}
+
+// parseFsync works out the components a core.fsync value turns on
+func parseFsync(value string) fsyncComponent {
+	current := fsyncComponent(defaultFsync)
+	var positive, negative fsyncComponent
+	for _, word := range strings.Split(value, ",") {
+		word = strings.TrimSpace(word)
+		if word == "" {
+			continue
+		}
+		if word == "none" {
+			current = 0
+			continue
+		}
+		name, negated := strings.CutPrefix(word, "-")
+		component, ok := fsyncComponentNames[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "warning: ignoring unknown core.fsync component '%s'\n", name)
+			continue
+		}
+		if negated {
+			negative |= component
+		} else {
+			positive |= component
+		}
+	}
+	return (current &^ negative) | positive
+}
+
+// fsyncs says if core.fsync wants files of component flushed
+func (repo *Repository) fsyncs(component fsyncComponent) (bool, error) {
+	repo.odb.fsyncMu.Lock()
+	defer repo.odb.fsyncMu.Unlock()
+	if repo.fsync == nil {
+		components := parseFsync(repo.conf.Value("core.fsync", ""))
+		objectFiles, err := repo.conf.Bool("core.fsyncObjectFiles", false)
+		if err != nil {
+			return false, err
+		}
+		if objectFiles {
+			components |= fsyncLooseObject
+		}
+		repo.fsync = &components
+	}
+	return *repo.fsync&component != 0, nil
+}
+
+// syncFile flushes file to disk when core.fsync asks for component
+func (repo *Repository) syncFile(file *os.File, component fsyncComponent) error {
+	if sync, err := repo.fsyncs(component); !sync {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("Couldn't fsync %s: %w", file.Name(), err)
+	}
+	return nil
+}
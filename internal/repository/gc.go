@@ -0,0 +1,630 @@
+package repository
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+ * gc tidies up the object database
+ *
+ *   refs under refs/ go into packed-refs and their loose files are removed
+ *   reflog entries older than gc.reflogExpire are dropped, along with those
+ *     older than gc.reflogExpireUnreachable the ref can't reach anymore
+ *   everything reachable is written into a single pack that replaces the old ones
+ *     unreachable objects no older than gc.pruneExpire go into a cruft pack
+ *     which remembers when each was written, so a later gc can tell how old they are
+ *   the new pack gets reachability bitmaps when repack.writeBitmaps is on
+ *     which it is by default for bare repositories
+ *   the commit-graph is rewritten, or removed if gc.writeCommitGraph is off
+ *   loose objects that are now in a pack are removed
+ *   prune drops unreachable loose objects older than gc.pruneExpire
+ *
+ * reachable is anything refs, HEAD, the index or a reflog leads to
+ * promisor packs and packs with a .keep file next to them are left alone
+ */
+
+const (
+	defaultPruneExpire             = "2.weeks.ago"
+	defaultReflogExpire            = "90.days.ago"
+	defaultReflogExpireUnreachable = "30.days.ago"
+	// gc --auto runs when there are about this many loose objects
+	defaultGcAuto = 6700
+	// or this many packs
+	defaultGcAutoPackLimit = 50
+)
+
+func (repo *Repository) gc(args []string) error {
+	var pruneExpire string
+	var noPrune, auto bool
+	gcCmd := flag.NewFlagSet("gc", flag.ExitOnError)
+	gcCmd.StringVar(&pruneExpire, "prune", "", "Prune loose objects older than date (default is gc.pruneExpire)")
+	gcCmd.BoolVar(&noPrune, "no-prune", false, "Don't prune any loose objects")
+	gcCmd.BoolVar(&auto, "auto", false, "Only tidy up when there's enough to tidy")
+	if err := gcCmd.Parse(args); err != nil {
+		return err
+	}
+
+	if auto {
+		needed, err := repo.needsGc()
+		if err != nil || !needed {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Auto packing the repository for optimum performance.")
+	}
+
+	if pruneExpire == "" {
+		pruneExpire = repo.conf.Value("gc.pruneExpire", defaultPruneExpire)
+	}
+	if noPrune {
+		pruneExpire = "never"
+	}
+	pruneBefore, err := parseExpiry(pruneExpire)
+	if err != nil {
+		return fmt.Errorf("Invalid prune expiry: %w", err)
+	}
+	reflogBefore, err := parseExpiry(repo.conf.Value("gc.reflogExpire", defaultReflogExpire))
+	if err != nil {
+		return fmt.Errorf("Invalid gc.reflogExpire: %w", err)
+	}
+	unreachableBefore, err := parseExpiry(repo.conf.Value("gc.reflogExpireUnreachable", defaultReflogExpireUnreachable))
+	if err != nil {
+		return fmt.Errorf("Invalid gc.reflogExpireUnreachable: %w", err)
+	}
+
+	if err := repo.packRefs(); err != nil {
+		return err
+	}
+	if err := repo.expireReflogs(reflogBefore, unreachableBefore); err != nil {
+		return err
+	}
+	if err := repo.repack(pruneBefore); err != nil {
+		return err
+	}
+	if err := repo.prunePacked(); err != nil {
+		return err
+	}
+	return repo.pruneObjects(pruneBefore, false, false)
+}
+
+func (repo *Repository) prune(args []string) error {
+	var dryRun, verbose bool
+	var expire string
+	pruneCmd := flag.NewFlagSet("prune", flag.ExitOnError)
+	pruneCmd.BoolVar(&dryRun, "n", false, "Only report what would be removed")
+	pruneCmd.BoolVar(&dryRun, "dry-run", false, "Only report what would be removed")
+	pruneCmd.BoolVar(&verbose, "v", false, "Report every object that gets removed")
+	pruneCmd.BoolVar(&verbose, "verbose", false, "Report every object that gets removed")
+	pruneCmd.StringVar(&expire, "expire", "now", "Only prune loose objects older than date")
+	if err := pruneCmd.Parse(args); err != nil {
+		return err
+	}
+
+	before, err := parseExpiry(expire)
+	if err != nil {
+		return fmt.Errorf("Invalid expiry: %w", err)
+	}
+	return repo.pruneObjects(before, dryRun, verbose)
+}
+
+// parseExpiry turns a date like 2.weeks.ago into the time objects have to be older than
+// "now" takes everything and "never" nothing
+func parseExpiry(value string) (int64, error) {
+	switch strings.ToLower(value) {
+	case "now", "all":
+		return math.MaxInt64, nil
+	case "never", "false":
+		return math.MinInt64, nil
+	}
+	return parseApproxDate(value)
+}
+
+// needsGc is what gc --auto goes by
+// loose objects are counted in objects/17 alone, which is about 1/256 of them
+func (repo *Repository) needsGc() (bool, error) {
+	limit, err := repo.conf.Int("gc.auto", defaultGcAuto)
+	if limit <= 0 {
+		return false, err
+	}
+
+	files, err := os.ReadDir(repo.makePath("objects", "17"))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	loose := int64(0)
+	for _, file := range files {
+		if repo.format.check("17"+file.Name()) == nil {
+			loose++
+		}
+	}
+	if loose > (limit+255)/256 {
+		return true, nil
+	}
+
+	packLimit, err := repo.conf.Int("gc.autoPackLimit", defaultGcAutoPackLimit)
+	if err != nil {
+		return false, err
+	}
+	packs, err := repo.loadPacks()
+	if err != nil {
+		return false, err
+	}
+	count := int64(0)
+	for _, pack := range packs {
+		if !pack.promisor && !packKept(pack) && !packCruft(pack) {
+			count++
+		}
+	}
+	return packLimit > 0 && count > packLimit, nil
+}
+
+// reachabilityRoots is every sha refs, HEAD, the index and reflogs point at
+func (repo *Repository) reachabilityRoots() ([]string, error) {
+	refs, err := repo.readRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	// in order so the same refs always give the same pack
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var roots []string
+	for _, name := range names {
+		roots = append(roots, refs[name])
+	}
+	if sha, err := repo.readRef("HEAD"); err == nil {
+		roots = append(roots, sha)
+	}
+
+	if repo.worktree != "" {
+		index, err := repo.readIndex()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range index.entries {
+			if entry.mode != 0o160000 {
+				roots = append(roots, hex.EncodeToString(entry.sha[:]))
+			}
+		}
+	}
+
+	logs, err := repo.reflogNames()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range logs {
+		entries, err := repo.readReflog(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			for _, sha := range []string{entry.old, entry.new} {
+				if repo.format.check(sha) == nil && !isZeroSha(sha) {
+					roots = append(roots, sha)
+				}
+			}
+		}
+	}
+	return roots, nil
+}
+
+// packRefs moves every ref under refs/ into packed-refs
+// annotated tags get the object they peel to on the line after them
+func (repo *Repository) packRefs() error {
+	// held from before the refs are read, so nothing deleted meanwhile comes back
+	packed, err := lockPath(repo.makePath("packed-refs"))
+	if err != nil {
+		return err
+	}
+	defer packed.release()
+
+	refs, err := repo.readRefs()
+	if err != nil {
+		return err
+	}
+	loose := make(map[string]bool)
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		// symrefs stay where they are
+		if target, _ := repo.readSymref(name); target != "" {
+			delete(refs, name)
+			continue
+		}
+		if _, err := os.Stat(repo.makePath(filepath.FromSlash(name))); err == nil {
+			loose[name] = true
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("# pack-refs with: peeled fully-peeled sorted \n")
+	for _, name := range names {
+		fmt.Fprintf(&sb, "%s %s\n", refs[name], name)
+		if peeled, err := repo.peelTag(refs[name]); err == nil && peeled != refs[name] {
+			fmt.Fprintf(&sb, "^%s\n", peeled)
+		}
+	}
+
+	if err := packed.commit([]byte(sb.String())); err != nil {
+		return fmt.Errorf("Couldn't update packed-refs: %w", err)
+	}
+
+	for _, name := range names {
+		if loose[name] {
+			if err := repo.pruneLooseRef(name, refs[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneLooseRef removes a loose ref now in packed-refs
+// one that's locked or moved since it was packed stays loose
+func (repo *Repository) pruneLooseRef(name, sha string) error {
+	path := repo.makePath(filepath.FromSlash(name))
+	lock, err := lockPath(path)
+	if err != nil {
+		return nil
+	}
+	defer lock.release()
+
+	if current, err := repo.readRef(name); err != nil || current != sha {
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("Couldn't remove loose ref %s: %w", name, err)
+	}
+	lock.release()
+	removeEmptyDirs(path, repo.makePath("refs"))
+	return nil
+}
+
+// removeEmptyDirs removes the directories above path that are left empty
+// stopping at the ones directly under stop, like refs/heads
+func removeEmptyDirs(path, stop string) {
+	for dir := filepath.Dir(path); filepath.Dir(dir) != stop && strings.HasPrefix(dir, stop); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+func inPacks(packs []*packFile, sha string) bool {
+	raw, _ := hex.DecodeString(sha)
+	for _, pack := range packs {
+		if pack.find(raw) != -1 {
+			return true
+		}
+	}
+	return false
+}
+
+func packKept(pack *packFile) bool {
+	_, err := os.Stat(strings.TrimSuffix(pack.path, ".pack") + ".keep")
+	return err == nil
+}
+
+// repack writes everything reachable into a single pack and removes the packs it replaces
+// unreachable objects in those packs and loose ones go into a cruft pack unless they're older than expire
+func (repo *Repository) repack(expire int64) error {
+	roots, err := repo.reachabilityRoots()
+	if err != nil {
+		return err
+	}
+	reachable, err := repo.reachableObjects(roots)
+	if err != nil {
+		return err
+	}
+	packs, err := repo.loadPacks()
+	if err != nil {
+		return err
+	}
+
+	// what's in promisor and kept packs stays there
+	var replaced, leftAlone []*packFile
+	for _, pack := range packs {
+		if pack.promisor || packKept(pack) {
+			leftAlone = append(leftAlone, pack)
+		} else {
+			replaced = append(replaced, pack)
+		}
+	}
+
+	var objects []string
+	packed := make(map[string]bool)
+	for _, sha := range reachable {
+		if !inPacks(leftAlone, sha) {
+			objects = append(objects, sha)
+			packed[sha] = true
+		}
+	}
+
+	name := ""
+	if len(objects) > 0 {
+		if name, err = repo.writeRepack(objects); err != nil {
+			return err
+		}
+		if err := repo.repackBitmap(name, len(leftAlone) > 0); err != nil {
+			return err
+		}
+	}
+
+	cruft, mtimes, err := repo.cruftObjects(replaced, func(sha string) bool {
+		return packed[sha] || inPacks(leftAlone, sha)
+	}, expire)
+	if err != nil {
+		return err
+	}
+	cruftName := ""
+	if len(cruft) > 0 {
+		if cruftName, err = repo.writeCruftPack(cruft, mtimes); err != nil {
+			return err
+		}
+	}
+
+	// a multi-pack-index would name packs that are going away
+	if len(replaced) > 0 {
+		if err := os.Remove(repo.makePath("objects", "pack", "multi-pack-index")); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Couldn't remove multi-pack-index: %w", err)
+		}
+	}
+	// forgetting the packs closes them too, which some systems need before they can be removed
+	repo.forgetPacks()
+	for _, pack := range replaced {
+		base := strings.TrimSuffix(pack.path, ".pack")
+		// kept since repack started means someone wants it as it is
+		if base == name || base == cruftName || packKept(pack) {
+			continue
+		}
+		if err := removePack(base); err != nil {
+			return err
+		}
+	}
+	return repo.rewriteCommitGraph()
+}
+
+// removePack removes a pack along with its index and everything else next to it
+// the index goes first so nothing finds objects in a pack that's going away
+func removePack(base string) error {
+	files, err := filepath.Glob(base + ".*")
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return strings.HasSuffix(files[i], ".idx") && !strings.HasSuffix(files[j], ".idx")
+	})
+	for _, file := range files {
+		// another gc may have got to it first
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Couldn't remove old pack: %w", err)
+		}
+	}
+	return nil
+}
+
+// rewriteCommitGraph writes the commit-graph again after a repack, or removes it if gc.writeCommitGraph is off
+// either way nothing is left naming commits that were pruned
+func (repo *Repository) rewriteCommitGraph() error {
+	write, err := repo.conf.Bool("gc.writeCommitGraph", true)
+	if err != nil {
+		return err
+	}
+	infoDir := repo.makePath("objects", "info")
+	if err := os.Remove(filepath.Join(infoDir, "commit-graph")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Couldn't remove commit-graph: %w", err)
+	}
+	if err := os.RemoveAll(filepath.Join(infoDir, "commit-graphs")); err != nil {
+		return fmt.Errorf("Couldn't remove commit-graph chain: %w", err)
+	}
+	repo.forgetCommitGraph()
+	if !write {
+		return nil
+	}
+
+	tips, err := repo.refTips()
+	if err != nil {
+		return err
+	}
+	return repo.writeCommitGraph(tips, false)
+}
+
+// repackBitmap writes bitmaps for the pack repack wrote if repack.writeBitmaps says so
+// bitmaps need everything reachable to be in the one pack
+func (repo *Repository) repackBitmap(name string, partial bool) error {
+	if write, err := repo.conf.Bool("repack.writeBitmaps", repo.worktree == ""); !write {
+		return err
+	}
+	if partial || len(repo.shallowCommits()) > 0 {
+		fmt.Fprintln(os.Stderr, "warning: disabling bitmap writing, as some objects are not being packed")
+		return nil
+	}
+
+	pack, err := readPackIndex(name+".idx", repo.format)
+	if err != nil {
+		return err
+	}
+	tips, err := repo.refTips()
+	if err != nil {
+		return err
+	}
+	return repo.writeBitmap(pack, tips)
+}
+
+// writeRepack writes a pack and its index under objects/pack
+// giving back the pack's path without the extension
+func (repo *Repository) writeRepack(objects []string) (string, error) {
+	dir := repo.makePath("objects", "pack")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("Couldn't create directories: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, "tmp_pack_")
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create pack: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	entries, sum, err := repo.writeIndexedPack(tmp, objects)
+	if err == nil {
+		err = repo.syncFile(tmp, fsyncPack)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("Couldn't write pack: %w", err)
+	}
+
+	name := filepath.Join(dir, "pack-"+hex.EncodeToString(sum))
+	if _, err := os.Stat(name + ".idx"); err == nil {
+		// exactly this pack is already here
+		return name, nil
+	}
+	if err := os.Chmod(tmp.Name(), 0o444); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), name+".pack"); err != nil {
+		return "", fmt.Errorf("Couldn't store pack: %w", err)
+	}
+	if err := repo.writePackIndex(name+".idx", entries, sum); err != nil {
+		return "", fmt.Errorf("Couldn't write pack index: %w", err)
+	}
+	return name, nil
+}
+
+// looseObjects lists the sha of every object under objects/xx/
+func (repo *Repository) looseObjects() ([]string, error) {
+	dirs, err := os.ReadDir(repo.makePath("objects"))
+	if err != nil {
+		return nil, err
+	}
+
+	var shas []string
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		files, err := os.ReadDir(repo.makePath("objects", dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if sha := dir.Name() + file.Name(); repo.format.check(sha) == nil {
+				shas = append(shas, sha)
+			}
+		}
+	}
+	return shas, nil
+}
+
+// prunePacked removes loose objects that are in a pack as well
+func (repo *Repository) prunePacked() error {
+	shas, err := repo.looseObjects()
+	if err != nil {
+		return err
+	}
+	packs, err := repo.loadPacks()
+	if err != nil {
+		return err
+	}
+
+	for _, sha := range shas {
+		if !inPacks(packs, sha) {
+			continue
+		}
+		path := repo.makePath("objects", sha[:2], sha[2:])
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("Couldn't remove %s: %w", sha, err)
+		}
+		os.Remove(filepath.Dir(path))
+	}
+	return nil
+}
+
+// pruneObjects removes unreachable loose objects last changed before expire
+// along with temporary files left behind by writes that never finished
+func (repo *Repository) pruneObjects(expire int64, dryRun, verbose bool) error {
+	roots, err := repo.reachabilityRoots()
+	if err != nil {
+		return err
+	}
+	objects, err := repo.reachableObjects(roots)
+	if err != nil {
+		return err
+	}
+	reachable := make(map[string]bool, len(objects))
+	for _, sha := range objects {
+		reachable[sha] = true
+	}
+
+	shas, err := repo.looseObjects()
+	if err != nil {
+		return err
+	}
+	for _, sha := range shas {
+		if reachable[sha] {
+			continue
+		}
+		path := repo.makePath("objects", sha[:2], sha[2:])
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Unix() >= expire {
+			continue
+		}
+
+		if dryRun || verbose {
+			kind, _, err := readLooseObject(path)
+			if err != nil {
+				kind = "unknown"
+			}
+			fmt.Printf("%s %s\n", sha, kind)
+		}
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("Couldn't remove %s: %w", sha, err)
+		}
+		os.Remove(filepath.Dir(path))
+	}
+
+	return repo.pruneTemporary(expire, dryRun)
+}
+
+// pruneTemporary removes tmp_ files in the object directories older than expire
+func (repo *Repository) pruneTemporary(expire int64, dryRun bool) error {
+	dirs := []string{repo.makePath("objects"), repo.makePath("objects", "pack")}
+	fanout, err := filepath.Glob(repo.makePath("objects", "[0-9a-f][0-9a-f]"))
+	if err != nil {
+		return err
+	}
+	dirs = append(dirs, fanout...)
+
+	for _, dir := range dirs {
+		tmps, err := filepath.Glob(filepath.Join(dir, "tmp_*"))
+		if err != nil {
+			return err
+		}
+		for _, tmp := range tmps {
+			info, err := os.Stat(tmp)
+			if err != nil || info.ModTime().Unix() >= expire {
+				continue
+			}
+			if dryRun {
+				fmt.Printf("Removing stale temporary file %s\n", tmp)
+				continue
+			}
+			os.Remove(tmp)
+		}
+	}
+	return nil
+}
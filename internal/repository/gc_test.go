@@ -0,0 +1,137 @@
+package repository
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGcKeepsUnreachableObjectsInACruftPackUntilTheyExpire(t *testing.T) {
+	repo := newTestRepo(t, true)
+	daysAgo := func(days int) time.Time {
+		return time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	}
+	age := func(path string, days int) {
+		if err := os.Chtimes(path, daysAgo(days), daysAgo(days)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the repository that ran gc may still have objects it read cached
+	exists := func(sha string) bool {
+		fresh, err := Open(repo.gitDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = fresh.readObject(sha)
+		return err == nil
+	}
+	ageLoose := func(sha string, days int) {
+		for _, obj := range objectsOf(t, repo, sha) {
+			age(repo.makePath("objects", obj[:2], obj[2:]), days)
+		}
+	}
+
+	tip := commitTestFiles(t, repo, map[string]string{"kept": "reachable\n"})
+	if err := repo.writeRef("refs/heads/main", tip); err != nil {
+		t.Fatal(err)
+	}
+	recent := commitTestFiles(t, repo, map[string]string{"recent": "written three days ago\n"})
+	ageLoose(recent, 3)
+	old := commitTestFiles(t, repo, map[string]string{"old": "written a month ago\n"})
+	ageLoose(old, 30)
+
+	src := newTestRepo(t, true)
+	packed := commitTestFiles(t, src, map[string]string{"packed": "in a pack from three days ago\n"})
+	packTestObjects(t, repo, src, objectsOf(t, src, packed))
+	oldPacks, _ := filepath.Glob(repo.makePath("objects", "pack", "pack-*.pack"))
+	for _, pack := range oldPacks {
+		age(pack, 3)
+	}
+	repo.forgetPacks()
+
+	// an existing graph may name commits gc is about to drop
+	if err := repo.writeCommitGraph([]string{tip, old}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.gc([]string{"--prune=2.weeks.ago"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if loose, err := repo.looseObjects(); err != nil || len(loose) != 0 {
+		t.Errorf("loose objects left after gc: %v %v", loose, err)
+	}
+	for _, pack := range oldPacks {
+		if _, err := os.Stat(pack); !os.IsNotExist(err) {
+			t.Errorf("%s is still there: %v", filepath.Base(pack), err)
+		}
+	}
+	for _, sha := range []string{tip, recent, packed} {
+		for _, obj := range objectsOf(t, repo, sha) {
+			if !exists(obj) {
+				t.Errorf("%s from %s is gone", obj, sha)
+			}
+		}
+	}
+	if exists(old) {
+		t.Errorf("%s from a month ago wasn't pruned", old)
+	}
+
+	packs, err := repo.loadPacks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cruft *packFile
+	for _, pack := range packs {
+		if packCruft(pack) {
+			cruft = pack
+		}
+	}
+	if len(packs) != 2 || cruft == nil {
+		t.Fatalf("want a pack and a cruft pack, got %d packs, cruft %v", len(packs), cruft != nil)
+	}
+	if inPacks([]*packFile{cruft}, tip) {
+		t.Errorf("reachable %s is in the cruft pack", tip)
+	}
+	times, err := readPackMtimes(cruft, repo.format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sha := range []string{recent, packed} {
+		raw, _ := hex.DecodeString(sha)
+		i := cruft.find(raw)
+		if i == -1 {
+			t.Fatalf("%s isn't in the cruft pack", sha)
+		}
+		if got := time.Unix(int64(times[i]), 0); got.Sub(daysAgo(3)).Abs() > time.Minute {
+			t.Errorf("%s has time %v in the cruft pack, want three days ago", sha, got)
+		}
+	}
+
+	graph, err := readCommitGraph(repo.makePath("objects", "info"), repo.format)
+	if err != nil || len(graph) != 1 || graph[0].count() != 1 {
+		t.Errorf("commit-graph wasn't rewritten with only %s: %v", tip, err)
+	}
+
+	// the cruft pack's own time is now, but its objects keep theirs
+	repo.conf.set("gc.writeCommitGraph", "false", ScopeLocal, "test")
+	if err := repo.gc([]string{"--prune=2.days.ago"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, sha := range []string{recent, packed} {
+		if exists(sha) {
+			t.Errorf("%s from three days ago wasn't pruned", sha)
+		}
+	}
+	if !exists(tip) {
+		t.Errorf("reachable %s is gone", tip)
+	}
+	if packs, _ := filepath.Glob(repo.makePath("objects", "pack", "pack-*")); len(packs) != 3 {
+		t.Errorf("want just the pack, its index and bitmap, got %v", packs)
+	}
+	if _, err := os.Stat(repo.makePath("objects", "info", "commit-graph")); !os.IsNotExist(err) {
+		t.Errorf("commit-graph is still there with gc.writeCommitGraph off: %v", err)
+	}
+}
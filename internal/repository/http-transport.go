@@ -0,0 +1,481 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/joeldotdias/twine/pkg/pktline"
+)
+
+/*
+ * the client side of smart HTTP
+ *
+ * GET  <url>/info/refs?service=git-<service>   the advertisement
+ * POST <url>/git-<service>                      everything written since the last response
+ *
+ * the server forgets everything between requests, which is why fetch
+ * sends its wants again with every round of haves
+ */
+
+// gzip request bodies bigger than this, small ones aren't worth it
+const httpGzipThreshold = 1024
+
+// requests bigger than http.postBuffer are streamed with chunked encoding
+// instead of being held in memory until they're sent
+const defaultPostBuffer = 1 << 20
+
+type httpClient struct {
+	repo   *Repository
+	client *http.Client
+	// the repository url, moved along if the advertisement was redirected
+	base    string
+	service string
+	version int
+	headers []string
+	// whatever the url carried to begin with, filled in once the server asks
+	// it only ever goes to the scheme and host it's for
+	cred        *credential
+	useHTTPPath bool
+	// whether cred came from a helper and is still to be stored
+	approve bool
+	// the url was https, so nothing secret goes anywhere over plain http
+	secure bool
+	// how much of a request is held before it's streamed instead
+	postBuffer int64
+}
+
+func isHTTPURL(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// anonymizeURL drops any username and password from a url
+// so they don't end up in output or FETCH_HEAD
+func anonymizeURL(rawURL string) string {
+	if !isHTTPURL(rawURL) {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
+
+// connectHTTP starts a conversation with git-<service> over smart HTTP
+func (repo *Repository) connectHTTP(rawURL, service string, version int) (*remoteConn, error) {
+	u, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse url %s: %w", rawURL, err)
+	}
+	useHTTPPath, err := configBool("credential.useHttpPath", repo.conf.GetForURL("credential", "useHttpPath", rawURL))
+	if err != nil {
+		return nil, err
+	}
+	cred := newCredential(u, useHTTPPath)
+	u.User = nil
+
+	c := &httpClient{
+		repo:        repo,
+		base:        u.String(),
+		service:     service,
+		version:     version,
+		headers:     repo.conf.GetAllForURL("http", "extraHeader", rawURL),
+		cred:        cred,
+		useHTTPPath: useHTTPPath,
+		secure:      u.Scheme == "https",
+		postBuffer:  defaultPostBuffer,
+	}
+	if v := repo.conf.GetForURL("http", "postBuffer", rawURL); v != "" {
+		n, err := configInt("http.postBuffer", v)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			c.postBuffer = n
+		}
+	}
+
+	followRedirects := repo.conf.GetForURL("http", "followRedirects", rawURL)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if v := repo.conf.GetForURL("http", "sslVerify", rawURL); v != "" {
+		verify, err := configBool("http.sslVerify", v)
+		if err != nil {
+			return nil, err
+		}
+		if !verify {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+	}
+	if envBool("GIT_SSL_NO_VERIFY") {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	c.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			switch {
+			case followRedirects == "false":
+				return http.ErrUseLastResponse
+			// by default only the advertisement gets to move the repository somewhere else
+			case followRedirects != "true" && via[0].Method != http.MethodGet:
+				return http.ErrUseLastResponse
+			case len(via) >= 20:
+				return fmt.Errorf("too many redirects")
+			}
+			// a credential is only ever for the scheme and host it was given for
+			if req.URL.Scheme != via[0].URL.Scheme || req.URL.Host != via[0].URL.Host {
+				req.Header.Del("Authorization")
+			}
+			return nil
+		},
+	}
+
+	advertisement, err := c.advertisement()
+	if err != nil {
+		return nil, err
+	}
+
+	rpc := &httpRPC{client: c, resp: advertisement}
+	conn := &remoteConn{
+		enc:       pktline.NewEncoder(rpc),
+		dec:       pktline.NewDecoder(rpc),
+		progress:  io.Discard,
+		stateless: true,
+		wait:      rpc.close,
+	}
+	if err := conn.readAdvertisement(); err != nil {
+		rpc.close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// advertisement fetches info/refs with the "# service=" preamble taken off
+func (c *httpClient) advertisement() (io.ReadCloser, error) {
+	requested := c.base + "/info/refs?service=" + c.service
+	resp, err := c.do(http.MethodGet, requested, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if final := resp.Request.URL.String(); final != requested {
+		if base, ok := strings.CutSuffix(strings.SplitN(final, "?", 2)[0], "/info/refs"); ok {
+			fmt.Fprintf(os.Stderr, "warning: redirecting to %s\n", base+"/")
+			c.base = base
+		}
+	}
+
+	if resp.Header.Get("Content-Type") != "application/x-"+c.service+"-advertisement" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s/info/refs not valid: is this a git repository? (dumb http isn't supported)", c.base)
+	}
+
+	// a v0 server starts with "# service=<service>" and a flush, v2 goes straight to "version 2"
+	body := bufio.NewReader(resp.Body)
+	preamble := fmt.Sprintf("%04x# service=%s\n", 4+len("# service=")+len(c.service)+1, c.service)
+	if peek, _ := body.Peek(len(preamble)); string(peek) == preamble {
+		dec := pktline.NewDecoder(body)
+		if _, err := dec.Decode(); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if packet, err := dec.Decode(); err != nil || !packet.IsFlush() {
+			resp.Body.Close()
+			return nil, fmt.Errorf("protocol error: expected flush after service line")
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}, nil
+}
+
+// rpc sends one request to the service and checks what comes back
+func (c *httpClient) rpc(body []byte) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodPost, c.base+"/"+c.service, body)
+	if err != nil {
+		return nil, err
+	}
+	return c.result(resp)
+}
+
+// streamRPC sends a request as it's read from body
+// it can't be sent again, so the credential has to be sorted out beforehand
+func (c *httpClient) streamRPC(body io.Reader) (io.ReadCloser, error) {
+	req, err := c.request(http.MethodPost, c.base+"/"+c.service, body)
+	if err != nil {
+		return nil, err
+	}
+	// with no length known up front it goes out chunked
+	req.ContentLength = -1
+	resp, err := c.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("unable to access '%s': %w", c.base+"/", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unable to access '%s': The requested URL returned error: %d", c.base+"/", resp.StatusCode)
+	}
+	return c.result(resp)
+}
+
+func (c *httpClient) result(resp *http.Response) (io.ReadCloser, error) {
+	if resp.Header.Get("Content-Type") != "application/x-"+c.service+"-result" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s/%s: unexpected Content-Type %q", c.base, c.service, resp.Header.Get("Content-Type"))
+	}
+	return resp.Body, nil
+}
+
+// do sends a request, asking for credentials and trying again when the server wants them
+func (c *httpClient) do(method, target string, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(method, target, body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to access '%s': %w", c.base+"/", err)
+		}
+		if final := resp.Request.URL; final.Scheme != c.cred.protocol || final.Host != c.cred.host {
+			c.redirected(final)
+			// asking again goes straight to whoever asked for the credential
+			target = final.String()
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			if c.approve {
+				c.repo.approveCredential(c.cred, c.base)
+				c.approve = false
+			}
+			return resp, nil
+
+		case resp.StatusCode == http.StatusUnauthorized && c.secure && c.cred.protocol != "https":
+			resp.Body.Close()
+			return nil, fmt.Errorf("unable to access '%s': refusing to send credentials over http after a redirect from https", c.base+"/")
+
+		case resp.StatusCode == http.StatusUnauthorized && attempt == 0 && !c.cred.complete():
+			resp.Body.Close()
+			if err := c.repo.fillCredential(c.cred, c.base); err != nil {
+				return nil, err
+			}
+			c.approve = true
+			continue
+
+		case resp.StatusCode == http.StatusUnauthorized:
+			resp.Body.Close()
+			c.repo.rejectCredential(c.cred, c.base)
+			return nil, fmt.Errorf("Authentication failed for '%s'", c.base+"/")
+
+		case resp.StatusCode == http.StatusNotFound:
+			resp.Body.Close()
+			return nil, fmt.Errorf("repository '%s' not found", c.base+"/")
+
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("unable to access '%s': The requested URL returned error: %d", c.base+"/", resp.StatusCode)
+		}
+	}
+}
+
+// redirected starts over with a credential for where a request ended up
+// when that's another scheme or host, what one server was given isn't handed to another
+func (c *httpClient) redirected(final *url.URL) {
+	repoPath := strings.TrimSuffix(strings.TrimSuffix(final.Path, "/info/refs"), "/"+c.service)
+	c.cred = newCredential(&url.URL{Scheme: final.Scheme, Host: final.Host, Path: repoPath}, c.useHTTPPath)
+	c.approve = false
+}
+
+func (c *httpClient) send(method, target string, body []byte) (*http.Response, error) {
+	var payload io.Reader
+	gzipped := false
+	if body != nil {
+		payload = bytes.NewReader(body)
+		// packs are already compressed so there's no point for receive-pack
+		if c.service == "git-upload-pack" && len(body) > httpGzipThreshold {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(body)
+			gz.Close()
+			payload, gzipped = &buf, true
+		}
+	}
+
+	req, err := c.request(method, target, payload)
+	if err != nil {
+		return nil, err
+	}
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// request builds a request with everything every request to the server carries
+func (c *httpClient) request(method, target string, payload io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, target, payload)
+	if err != nil {
+		return nil, err
+	}
+	// some servers only speak the smart protocol to clients that look like git
+	req.Header.Set("User-Agent", "git/"+agent)
+	req.Header.Set("Pragma", "no-cache")
+	if c.version == 2 {
+		req.Header.Set("Git-Protocol", "version=2")
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/x-"+c.service+"-request")
+		req.Header.Set("Accept", "application/x-"+c.service+"-result")
+	}
+	for _, header := range c.headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return nil, fmt.Errorf("bad http.extraHeader '%s'", header)
+		}
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if c.cred.complete() && (req.URL.Scheme == "https" || !c.secure) {
+		req.SetBasicAuth(c.cred.username, c.cred.password)
+	}
+	return req, nil
+}
+
+// httpRPC lets a remoteConn talk over smart HTTP as if it were a pipe
+// writes pile up until the next read, which POSTs them and reads the response
+// once they pile past http.postBuffer the request is started and the rest streamed into it
+type httpRPC struct {
+	client  *httpClient
+	pending bytes.Buffer
+	resp    io.ReadCloser
+	// the request being streamed and where its response turns up
+	stream   *io.PipeWriter
+	streamed chan streamedResponse
+}
+
+type streamedResponse struct {
+	resp io.ReadCloser
+	err  error
+}
+
+func (rpc *httpRPC) Write(p []byte) (int, error) {
+	if rpc.stream != nil {
+		return rpc.stream.Write(p)
+	}
+	rpc.pending.Write(p)
+	if int64(rpc.pending.Len()) > rpc.client.postBuffer {
+		if err := rpc.startStream(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// startStream begins a chunked request with what's pending
+// like git it first sends a lone flush so the server can ask for a credential
+// while there's still nothing that would have to be sent again
+func (rpc *httpRPC) startStream() error {
+	rpc.dropResponse()
+	probe, err := rpc.client.rpc([]byte("0000"))
+	if err != nil {
+		return err
+	}
+	probe.Close()
+
+	r, w := io.Pipe()
+	rpc.stream, rpc.streamed = w, make(chan streamedResponse, 1)
+	go func() {
+		resp, err := rpc.client.streamRPC(r)
+		// whatever is still being written has nowhere to go
+		closeErr := err
+		if closeErr == nil {
+			closeErr = fmt.Errorf("the server answered before the whole request was sent")
+		}
+		r.CloseWithError(closeErr)
+		rpc.streamed <- streamedResponse{resp, err}
+	}()
+
+	_, err = w.Write(rpc.pending.Bytes())
+	rpc.pending.Reset()
+	return err
+}
+
+// finishStream ends the streamed request and waits for its response
+func (rpc *httpRPC) finishStream() error {
+	rpc.stream.Close()
+	result := <-rpc.streamed
+	rpc.stream, rpc.streamed = nil, nil
+	if result.err != nil {
+		return result.err
+	}
+	rpc.resp = result.resp
+	return nil
+}
+
+func (rpc *httpRPC) dropResponse() {
+	if rpc.resp != nil {
+		rpc.resp.Close()
+		rpc.resp = nil
+	}
+}
+
+func (rpc *httpRPC) Read(p []byte) (int, error) {
+	if rpc.stream != nil {
+		if err := rpc.finishStream(); err != nil {
+			return 0, err
+		}
+	} else if rpc.pending.Len() > 0 {
+		rpc.dropResponse()
+		resp, err := rpc.client.rpc(rpc.pending.Bytes())
+		rpc.pending.Reset()
+		if err != nil {
+			return 0, err
+		}
+		rpc.resp = resp
+	}
+	if rpc.resp == nil {
+		return 0, io.EOF
+	}
+	n, err := rpc.resp.Read(p)
+	if err == io.EOF && n > 0 {
+		// bufio would hold on to the EOF and hand it to the read
+		// that comes after the next request, so keep it for later
+		err = nil
+	}
+	return n, err
+}
+
+// close drops whatever was never sent, like the flush that hangs up
+// since there's no connection to hang up on
+func (rpc *httpRPC) close() error {
+	if rpc.stream != nil {
+		rpc.stream.CloseWithError(fmt.Errorf("request abandoned"))
+		if result := <-rpc.streamed; result.resp != nil {
+			result.resp.Close()
+		}
+		rpc.stream, rpc.streamed = nil, nil
+	}
+	if rpc.resp != nil {
+		return rpc.resp.Close()
+	}
+	return nil
+}
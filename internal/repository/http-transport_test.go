@@ -0,0 +1,406 @@
+package repository
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// transportTestServer serves a bare repository with a main branch through wrap
+// which sees every request before the smart HTTP handler does
+func transportTestServer(t *testing.T, wrap func(w http.ResponseWriter, r *http.Request, next http.Handler)) (string, string) {
+	t.Helper()
+	remote := newTestRepo(t, true)
+	commit := commitTestFiles(t, remote, map[string]string{"a": "a\n"})
+	if err := remote.writeRef("refs/heads/main", commit); err != nil {
+		t.Fatal(err)
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	handler := &smartHTTP{root: filepath.Dir(remote.gitDir)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wrap(w, r, handler)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/" + filepath.Base(remote.gitDir), commit
+}
+
+// fetchOver asks conn for want in a single round, sending haves made up shas first
+// and gives back the first line of the response
+func fetchOver(t *testing.T, conn *remoteConn, want string, haves int) string {
+	t.Helper()
+	conn.enc.Encodef("want %s no-progress\n", want)
+	conn.enc.Flush()
+	for i := range haves {
+		conn.enc.Encodef("have %040x\n", i+1)
+	}
+	conn.enc.Encodef("done\n")
+	packet, err := conn.dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.wait(); err != nil {
+		t.Fatal(err)
+	}
+	return packet.Text()
+}
+
+// requestLog remembers what every request looked like
+type requestLog struct {
+	sync.Mutex
+	requests []string
+	headers  []http.Header
+}
+
+func (l *requestLog) add(r *http.Request) {
+	l.Lock()
+	defer l.Unlock()
+	l.requests = append(l.requests, r.Method+" "+r.URL.Path)
+	l.headers = append(l.headers, r.Header.Clone())
+}
+
+func TestHTTPCredentialHelper(t *testing.T) {
+	var seen requestLog
+	url, commit := transportTestServer(t, func(w http.ResponseWriter, r *http.Request, next http.Handler) {
+		seen.add(r)
+		if user, password, ok := r.BasicAuth(); !ok || user != "alice" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="twine"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	t.Setenv("GIT_ASKPASS", "")
+	t.Setenv("SSH_ASKPASS", "")
+
+	// the helper writes down how it was called and always hands out the same password
+	helper := func(password string) (*Repository, string) {
+		repo := newTestRepo(t, false)
+		calls := filepath.Join(t.TempDir(), "calls")
+		script := fmt.Sprintf(`!f() { echo "$1" >>%s; cat >>%s; echo username=alice; echo password=%s; }; f`, calls, calls, password)
+		repo.conf.set("credential.helper", script, ScopeLocal, "test")
+		return repo, calls
+	}
+	host := strings.TrimPrefix(url, "http://")
+	host = host[:strings.IndexByte(host, '/')]
+
+	repo, calls := helper("secret")
+	conn, err := repo.connectHTTP(url, "git-upload-pack", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fetchOver(t, conn, commit, 0); got != "NAK" {
+		t.Errorf("fetch with the helper's credential answered %q", got)
+	}
+	got, _ := os.ReadFile(calls)
+	want := fmt.Sprintf("get\nprotocol=http\nhost=%s\n\nstore\nprotocol=http\nhost=%[1]s\nusername=alice\npassword=secret\n\n", host)
+	if string(got) != want {
+		t.Errorf("helper calls %q, want %q", got, want)
+	}
+	for i, request := range seen.requests {
+		// the first request goes out without one to find out one is needed
+		r := &http.Request{Header: seen.headers[i]}
+		if _, _, ok := r.BasicAuth(); i > 0 && !ok {
+			t.Errorf("%s went without the credential that worked", request)
+		}
+	}
+
+	repo, calls = helper("wrong")
+	if _, err := repo.connectHTTP(url, "git-upload-pack", 0); err == nil || !strings.Contains(err.Error(), "Authentication failed") {
+		t.Fatalf("connecting with a wrong password: %v", err)
+	}
+	got, _ = os.ReadFile(calls)
+	want = fmt.Sprintf("get\nprotocol=http\nhost=%s\n\nerase\nprotocol=http\nhost=%[1]s\nusername=alice\npassword=wrong\n\n", host)
+	if string(got) != want {
+		t.Errorf("helper calls %q, want %q", got, want)
+	}
+
+	// a password in the url is used as it is, no helper gets asked
+	repo, calls = helper("secret")
+	if _, err := repo.connectHTTP(strings.Replace(url, "://", "://alice:secret@", 1), "git-upload-pack", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(calls); err == nil {
+		t.Error("helper was asked for a credential the url already had")
+	}
+}
+
+func TestHTTPExtraHeader(t *testing.T) {
+	var seen requestLog
+	url, commit := transportTestServer(t, func(w http.ResponseWriter, r *http.Request, next http.Handler) {
+		seen.add(r)
+		next.ServeHTTP(w, r)
+	})
+
+	repo := newTestRepo(t, false)
+	repo.conf.set("http.extraHeader", "X-Twine-Test: one", ScopeLocal, "test")
+	repo.conf.set("http."+url+".extraHeader", "X-Twine-Test: two", ScopeLocal, "test")
+	repo.conf.set("http.http://elsewhere.example.extraHeader", "X-Twine-Test: never", ScopeLocal, "test")
+
+	conn, err := repo.connectHTTP(url, "git-upload-pack", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchOver(t, conn, commit, 0)
+
+	if len(seen.requests) != 2 {
+		t.Fatalf("requests %q, want the advertisement and one rpc", seen.requests)
+	}
+	for i, request := range seen.requests {
+		if got := seen.headers[i].Values("X-Twine-Test"); strings.Join(got, ",") != "one,two" {
+			t.Errorf("%s had X-Twine-Test %q, want one and two", request, got)
+		}
+	}
+
+	// an empty value clears the ones before it
+	repo.conf.set("http.extraHeader", "", ScopeLocal, "test")
+	if _, err := repo.connectHTTP(url, "git-upload-pack", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := seen.headers[2].Values("X-Twine-Test"); len(got) != 0 {
+		t.Errorf("cleared http.extraHeader still sent %q", got)
+	}
+
+	repo.conf.set("http.extraHeader", "no colon here", ScopeLocal, "test")
+	if _, err := repo.connectHTTP(url, "git-upload-pack", 0); err == nil || !strings.Contains(err.Error(), "bad http.extraHeader") {
+		t.Errorf("header without a colon: %v", err)
+	}
+}
+
+func TestHTTPRedirectMovesBaseURL(t *testing.T) {
+	var seen requestLog
+	var redirectRPC atomic.Bool
+	url, commit := transportTestServer(t, func(w http.ResponseWriter, r *http.Request, next http.Handler) {
+		seen.add(r)
+		// a 307 keeps a POST a POST with its body
+		redirect := func(path string, status int) {
+			target := *r.URL
+			target.Path = path
+			http.Redirect(w, r, target.String(), status)
+		}
+		if moved, ok := strings.CutPrefix(r.URL.Path, "/old"); ok {
+			redirect(moved, http.StatusMovedPermanently)
+			return
+		}
+		if moved, ok := strings.CutPrefix(r.URL.Path, "/new"); ok {
+			r.URL.Path = moved
+		} else if redirectRPC.Load() && r.Method == http.MethodPost {
+			redirect("/new"+r.URL.Path, http.StatusTemporaryRedirect)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	slash := strings.LastIndexByte(url, '/')
+	old := url[:slash] + "/old" + url[slash:]
+
+	repo := newTestRepo(t, false)
+	conn, err := repo.connectHTTP(old, "git-upload-pack", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fetchOver(t, conn, commit, 0); got != "NAK" {
+		t.Errorf("fetch after the redirect answered %q", got)
+	}
+
+	repoPath := url[slash:]
+	want := []string{
+		"GET /old" + repoPath + "/info/refs",
+		"GET " + repoPath + "/info/refs",
+		"POST " + repoPath + "/git-upload-pack",
+	}
+	if strings.Join(seen.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests %q, want %q", seen.requests, want)
+	}
+
+	// only the advertisement can move things unless http.followRedirects says so
+	redirectRPC.Store(true)
+	conn, err = repo.connectHTTP(url, "git-upload-pack", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.enc.Encodef("want %s\n", commit)
+	conn.enc.Flush()
+	conn.enc.Encodef("done\n")
+	if _, err := conn.dec.Decode(); err == nil || !strings.Contains(err.Error(), "returned error: 307") {
+		t.Errorf("redirected rpc: %v", err)
+	}
+
+	repo.conf.set("http.followRedirects", "true", ScopeLocal, "test")
+	conn, err = repo.connectHTTP(url, "git-upload-pack", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fetchOver(t, conn, commit, 0); got != "NAK" {
+		t.Errorf("redirected rpc with http.followRedirects answered %q", got)
+	}
+}
+
+func TestHTTPGzipsLargeRequests(t *testing.T) {
+	var encodings []string
+	var mu sync.Mutex
+	url, commit := transportTestServer(t, func(w http.ResponseWriter, r *http.Request, next http.Handler) {
+		if r.Method == http.MethodPost {
+			mu.Lock()
+			encodings = append(encodings, r.Header.Get("Content-Encoding"))
+			mu.Unlock()
+			// make sure what claims to be gzip really is before the server gets it
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				body, err := io.ReadAll(gz)
+				if err != nil || !strings.Contains(string(body), "done") {
+					http.Error(w, "bad gzip body", http.StatusBadRequest)
+					return
+				}
+				r.Body = io.NopCloser(strings.NewReader(string(body)))
+				r.Header.Del("Content-Encoding")
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+
+	repo := newTestRepo(t, false)
+	for _, haves := range []int{0, 64} {
+		conn, err := repo.connectHTTP(url, "git-upload-pack", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fetchOver(t, conn, commit, haves); got != "NAK" {
+			t.Errorf("fetch with %d haves answered %q", haves, got)
+		}
+	}
+	if want := []string{"", "gzip"}; strings.Join(encodings, ",") != strings.Join(want, ",") {
+		t.Errorf("Content-Encoding of a small and a large request %q, want %q", encodings, want)
+	}
+}
+
+func TestHTTPRedirectKeepsCredentialsToTheirHost(t *testing.T) {
+	var seen requestLog
+	url, commit := transportTestServer(t, func(w http.ResponseWriter, r *http.Request, next http.Handler) {
+		seen.add(r)
+		if user, password, ok := r.BasicAuth(); !ok || user != "bob" || password != "helper-secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	target := strings.TrimPrefix(url, "http://")
+	host, repoPath, _ := strings.Cut(target, "/")
+	moved := func(w http.ResponseWriter, r *http.Request) {
+		to := *r.URL
+		to.Scheme, to.Host = "http", host
+		http.Redirect(w, r, to.String(), http.StatusMovedPermanently)
+	}
+	old := httptest.NewServer(http.HandlerFunc(moved))
+	defer old.Close()
+	oldTLS := httptest.NewTLSServer(http.HandlerFunc(moved))
+	defer oldTLS.Close()
+	t.Setenv("GIT_ASKPASS", "")
+	t.Setenv("SSH_ASKPASS", "")
+
+	repo := newTestRepo(t, false)
+	calls := filepath.Join(t.TempDir(), "calls")
+	repo.conf.set("credential.helper", fmt.Sprintf(`!f() { echo "$1" >>%s; cat >>%s; echo username=bob; echo password=helper-secret; }; f`, calls, calls), ScopeLocal, "test")
+	repo.conf.set("http.sslVerify", "false", ScopeLocal, "test")
+
+	// the password in the url is for the old host, the new one gets what the helper has for it
+	oldURL := strings.Replace(old.URL, "://", "://alice:url-secret@", 1) + "/" + repoPath
+	conn, err := repo.connectHTTP(oldURL, "git-upload-pack", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fetchOver(t, conn, commit, 0); got != "NAK" {
+		t.Errorf("fetch after the redirect answered %q", got)
+	}
+	got, _ := os.ReadFile(calls)
+	want := fmt.Sprintf("get\nprotocol=http\nhost=%s\n\nstore\nprotocol=http\nhost=%[1]s\nusername=bob\npassword=helper-secret\n\n", host)
+	if string(got) != want {
+		t.Errorf("helper calls %q, want %q", got, want)
+	}
+
+	// nothing goes over plain http once the url said https
+	os.Remove(calls)
+	tlsURL := strings.Replace(oldTLS.URL, "://", "://alice:url-secret@", 1) + "/" + repoPath
+	if _, err := repo.connectHTTP(tlsURL, "git-upload-pack", 0); err == nil || !strings.Contains(err.Error(), "refusing to send credentials") {
+		t.Errorf("redirect from https to http: %v", err)
+	}
+	if _, err := os.Stat(calls); err == nil {
+		t.Error("helper was asked for a credential to send over http")
+	}
+
+	for i, request := range seen.requests {
+		if user, password, ok := (&http.Request{Header: seen.headers[i]}).BasicAuth(); ok && (user != "bob" || password != "helper-secret") {
+			t.Errorf("%s was sent %s:%s", request, user, password)
+		}
+	}
+}
+
+func TestHTTPStreamsRequestsPastPostBuffer(t *testing.T) {
+	remote := newTestRepo(t, true)
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	var seen requestLog
+	var chunked []bool
+	handler := &smartHTTP{root: filepath.Dir(remote.gitDir), receivePack: true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			seen.add(r)
+			seen.Lock()
+			chunked = append(chunked, slices.Contains(r.TransferEncoding, "chunked"))
+			seen.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	url := server.URL + "/" + filepath.Base(remote.gitDir)
+
+	repo := newTestRepo(t, false)
+	repo.conf.set("http.postBuffer", "4k", ScopeLocal, "test")
+	small := commitTestFiles(t, repo, map[string]string{"a": "a\n"})
+	if err := repo.writeRef("refs/heads/small", small); err != nil {
+		t.Fatal(err)
+	}
+	blob := make([]byte, 64<<10)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range blob {
+		blob[i] = byte(rng.Uint32())
+	}
+	large := commitTestFiles(t, repo, map[string]string{"a": "a\n", "big": string(blob)}, small)
+	if err := repo.writeRef("refs/heads/large", large); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, branch := range []string{"small", "large"} {
+		if err := repo.pushRemote(url, []string{"refs/heads/" + branch}, pushOptions{quiet: true}); err != nil {
+			t.Fatalf("pushing %s: %v", branch, err)
+		}
+	}
+	for branch, want := range map[string]string{"small": small, "large": large} {
+		if sha, err := remote.readRef("refs/heads/" + branch); err != nil || sha != want {
+			t.Errorf("refs/heads/%s on the remote is %s, %v, want %s", branch, sha, err, want)
+		}
+	}
+	// the large push probes with a lone flush before streaming the pack
+	if want := []bool{false, false, true}; !slices.Equal(chunked, want) {
+		t.Errorf("chunked POSTs %v, want %v", chunked, want)
+	}
+	if _, data, err := remote.readObject(objectSha(repo.format, "blob", blob)); err != nil || !bytes.Equal(data, blob) {
+		t.Errorf("the streamed blob didn't arrive whole: %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package repository
+
+import "os"
+
+// only the modification time and size are portable
+func fillStat(entry *Entry, info os.FileInfo) {
+	entry.mTimeSec = uint32(info.ModTime().Unix())
+	entry.mTimeNano = uint32(info.ModTime().Nanosecond())
+	entry.size = uint32(info.Size())
+}
+
+func diskUsage(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package repository
+
+import (
+	"os"
+	"syscall"
+)
+
+// fillStat copies the stat data git uses to tell if a file changed
+func fillStat(entry *Entry, info os.FileInfo) {
+	entry.mTimeSec = uint32(info.ModTime().Unix())
+	entry.mTimeNano = uint32(info.ModTime().Nanosecond())
+	entry.size = uint32(info.Size())
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	entry.cTimeSec = uint32(stat.Ctim.Sec)
+	entry.cTimeNano = uint32(stat.Ctim.Nsec)
+	entry.dev = uint32(stat.Dev)
+	entry.inode = uint32(stat.Ino)
+	entry.uid = stat.Uid
+	entry.gid = stat.Gid
+}
+
+// diskUsage is how much space a file takes up on disk, which is what git reports sizes in
+func diskUsage(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+	return info.Size()
+}
@@ -3,13 +3,19 @@ package repository
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"sort"
 )
 
 type Index struct {
 	header  *Header
 	entries []*Entry
+	// names the shas in entries and the checksum at the end
+	format *objectFormat
 }
 
 // Header represents the 12 byte header of the Git index file.
@@ -37,7 +43,7 @@ type Entry struct {
 	uid   uint32
 	gid   uint32
 	size  uint32
-	sha   [20]byte
+	sha   []byte
 	flags uint16
 	path  string
 }
@@ -59,31 +65,44 @@ func parseFlags(flags uint16) IndexFlags {
 	}
 }
 
+// calcPadding gives the NULs that end an entry of n bytes so far
+// there's always at least one and the entry ends on an 8 byte boundary
+// with a 20 byte sha that's 62 fixed bytes before the path, 74 with a 32 byte one
 func calcPadding(n int) int {
-	// first, reserve 2 bytes for variable path length
-	// this can be gotten from namelen, encoded in the flags
-	// representing length of the path
-	// apparently namelen provides some kind of optimization
-	// so that length of the path could be accessed directly
-	// without extra calculations
-	// these 2 bytes have ruined almost 2 days of mine
-	baseLen := (n - 2) / 8
-
-	// move to next 8 byte boundary
-	alignedBoundary := (baseLen+1)*8 + 2
-	return alignedBoundary - n
+	return 8 - n%8
 }
 
-func parseIndex(path string) (*Index, error) {
-	contents, err := os.ReadFile(path)
+// a freshly initialized repo doesn't have an index file yet
+func emptyIndex(format *objectFormat) *Index {
+	return &Index{
+		header: &Header{
+			Signature: [4]byte{'D', 'I', 'R', 'C'},
+			Version:   2,
+		},
+		format: format,
+	}
+}
+
+// readIndex reads the index as it's stored now
+func (repo *Repository) readIndex() (*Index, error) {
+	contents, err := repo.indexFile.ReadIndex()
 	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return emptyIndex(repo.format), nil
+		}
 		return nil, fmt.Errorf("Couldn't read index file: %w", err)
 	}
+	return parseIndex(contents, repo.format)
+}
 
-	var index Index
+func parseIndex(contents []byte, format *objectFormat) (*Index, error) {
+	if len(contents) < 12 {
+		return nil, fmt.Errorf("Couldn't parse index header: index is too short")
+	}
+	index := Index{format: format}
 	header := &Header{}
 	reader := bytes.NewReader(contents[:12])
-	err = binary.Read(reader, binary.BigEndian, header)
+	err := binary.Read(reader, binary.BigEndian, header)
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't parse index header: %w", err)
 	}
@@ -93,7 +112,7 @@ func parseIndex(path string) (*Index, error) {
 
 	offset := 12
 	for i := 0; i < int(numEntries); i++ {
-		entry, bytesRead, err := parseEntry(contents[offset:])
+		entry, bytesRead, err := parseEntry(contents[offset:], format.size)
 		if err != nil {
 			return nil, fmt.Errorf("Error parsing entry %d: %w", i+1, err)
 		}
@@ -105,7 +124,7 @@ func parseIndex(path string) (*Index, error) {
 	return &index, nil
 }
 
-func parseEntry(data []byte) (*Entry, int, error) {
+func parseEntry(data []byte, hashSize int) (*Entry, int, error) {
 	var fixedEntry struct {
 		CTimeSeconds uint32
 		CTimeNanosec uint32
@@ -117,19 +136,27 @@ func parseEntry(data []byte) (*Entry, int, error) {
 		Uid          uint32
 		Gid          uint32
 		Size         uint32
-		Sha          [20]byte
-		Flags        uint16
 	}
+	// the sha and flags follow, and then the path
+	fixedSize := 40 + hashSize + 2
 
 	reader := bytes.NewReader(data)
 	err := binary.Read(reader, binary.BigEndian, &fixedEntry)
 	if err != nil {
 		return nil, 0, err
 	}
+	sha := make([]byte, hashSize)
+	if _, err := io.ReadFull(reader, sha); err != nil {
+		return nil, 0, err
+	}
+	var flags uint16
+	if err := binary.Read(reader, binary.BigEndian, &flags); err != nil {
+		return nil, 0, err
+	}
 
 	// bits 0-11 represent the length of path
-	pathLen := int(fixedEntry.Flags & 0x0FFF)
-	if pathLen <= 0 || pathLen > len(data)-62 {
+	pathLen := int(flags & 0x0FFF)
+	if pathLen <= 0 || pathLen > len(data)-fixedSize {
 		return nil, 0, fmt.Errorf("Invalid path length %d", pathLen)
 	}
 
@@ -139,8 +166,8 @@ func parseEntry(data []byte) (*Entry, int, error) {
 		return nil, 0, err
 	}
 
-	entrySize := 62 + pathLen
-	padding := calcPadding(pathLen)
+	entrySize := fixedSize + pathLen
+	padding := calcPadding(entrySize)
 	totalBytesRead := entrySize + padding
 
 	entry := &Entry{
@@ -154,10 +181,73 @@ func parseEntry(data []byte) (*Entry, int, error) {
 		uid:       fixedEntry.Uid,
 		gid:       fixedEntry.Gid,
 		size:      fixedEntry.Size,
-		sha:       fixedEntry.Sha,
+		sha:       sha,
 		path:      string(path),
-		flags:     fixedEntry.Flags,
+		flags:     flags,
 	}
 
 	return entry, totalBytesRead, nil
 }
+
+// newEntry makes an index entry for a file that was just written to the worktree
+func newEntry(path string, sha []byte, mode uint32, info os.FileInfo) *Entry {
+	entry := &Entry{
+		mode: mode,
+		sha:  sha,
+		path: path,
+	}
+	fillStat(entry, info)
+
+	// bits 0-11 hold the path length, capped when it doesn't fit
+	entry.flags = uint16(min(len(path), 0x0FFF))
+	return entry
+}
+
+// serialize writes the index back out the way parseIndex reads it
+// entries are sorted by path and the whole thing ends with its own sha
+func (index *Index) serialize() ([]byte, error) {
+	sort.Slice(index.entries, func(i, j int) bool {
+		return index.entries[i].path < index.entries[j].path
+	})
+	index.header.NumEntries = uint32(len(index.entries))
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, index.header); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range index.entries {
+		fixedEntry := []any{
+			entry.cTimeSec, entry.cTimeNano,
+			entry.mTimeSec, entry.mTimeNano,
+			entry.dev, entry.inode, entry.mode,
+			entry.uid, entry.gid, entry.size,
+			entry.sha, entry.flags,
+		}
+		for _, field := range fixedEntry {
+			if err := binary.Write(&buf, binary.BigEndian, field); err != nil {
+				return nil, err
+			}
+		}
+		buf.WriteString(entry.path)
+		buf.Write(make([]byte, calcPadding(40+len(entry.sha)+2+len(entry.path))))
+	}
+
+	buf.Write(index.format.sum(buf.Bytes()))
+
+	return buf.Bytes(), nil
+}
+
+// writeIndex stores the index and makes it the one the repository works with
+func (repo *Repository) writeIndex(index *Index) error {
+	data, err := index.serialize()
+	if err != nil {
+		return fmt.Errorf("Couldn't serialize index: %w", err)
+	}
+	if err := repo.indexFile.WriteIndex(data); err != nil {
+		return fmt.Errorf("Couldn't write index: %w", err)
+	}
+
+	repo.index = index
+	return nil
+}
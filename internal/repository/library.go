@@ -0,0 +1,432 @@
+package repository
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joeldotdias/twine/internal/helpers"
+)
+
+/*
+ * what pkg/twine builds on to let other programs use a repository
+ * nothing in here prints, whatever goes wrong comes back as an error
+ */
+
+// Open opens the bare repository at path or the repository with a work tree path is in
+func Open(path string) (*Repository, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	worktree, gitDir := "", abs
+	if !helpers.IsDir(filepath.Join(abs, "objects")) || !helpers.IsDir(filepath.Join(abs, "refs")) {
+		if worktree, err = helpers.SearchRoot(abs); err != nil {
+			return nil, err
+		}
+		gitDir = filepath.Join(worktree, ".git")
+	}
+	repo, err := openAt(worktree, gitDir)
+	if err != nil {
+		return nil, err
+	}
+	// openAt lets an unknown format through, which is no good for reading objects
+	if repo.format, err = formatFromConfig(repo.conf); err != nil {
+		return nil, err
+	}
+
+	if err := repo.findRefs(); err != nil {
+		return nil, err
+	}
+	if repo.worktree != "" {
+		if repo.index, err = repo.readIndex(); err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+// Init creates an empty repository at path, bare or with path as its work tree
+// the object format is sha1 or sha256, sha1 when it's empty
+func Init(path string, bare bool, objectFormat string) (*Repository, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	format := formatSHA1
+	if objectFormat != "" {
+		if format, err = objectFormatNamed(objectFormat); err != nil {
+			return nil, err
+		}
+	}
+
+	gitDir := filepath.Join(abs, ".git")
+	if bare {
+		gitDir = abs
+	}
+	if helpers.IsDir(filepath.Join(gitDir, "objects")) {
+		return nil, fmt.Errorf("%s already has a repository", abs)
+	}
+
+	worktree := abs
+	if bare {
+		worktree = ""
+	}
+	repo, err := openAt(worktree, gitDir)
+	if err != nil {
+		return nil, err
+	}
+	repo.format = format
+	repo.index = emptyIndex(format)
+	if err := repo.createLayout(bare); err != nil {
+		return nil, err
+	}
+	repo.conf = loadConfig(gitDir)
+	return repo, nil
+}
+
+// GitDir is where the repository keeps its objects, refs and config
+func (repo *Repository) GitDir() string {
+	return repo.gitDir
+}
+
+// WorkTree is the directory the repository checks files out into, empty for a bare one
+func (repo *Repository) WorkTree() string {
+	return repo.worktree
+}
+
+// ObjectFormat is the hash objects are named with, sha1 or sha256
+func (repo *Repository) ObjectFormat() string {
+	return repo.format.name
+}
+
+// Config is the repository's configuration, along with the global and system ones
+func (repo *Repository) Config() *Config {
+	return repo.conf
+}
+
+// ResolveRevision turns a full or abbreviated sha, or a ref name, into a full sha
+func (repo *Repository) ResolveRevision(rev string) (string, error) {
+	return repo.findObject(rev)
+}
+
+// ReadObject reads and parses the object named by sha
+func (repo *Repository) ReadObject(sha string) (Object, error) {
+	return repo.makeObject(sha)
+}
+
+// OpenObject gives the kind and size of an object with a reader for its contents
+// which is how blobs too big to hold in memory should be read
+func (repo *Repository) OpenObject(sha string) (string, int64, io.ReadCloser, error) {
+	return repo.openObject(sha)
+}
+
+// WalkHistory calls fn for each commit reachable from rev, newest first by committer date like git log
+// a shallow clone's history ends at its shallow commits, and fn returning false stops the walk
+func (repo *Repository) WalkHistory(rev string, fn func(sha string) bool) error {
+	sha, err := repo.findObject(rev)
+	if err != nil {
+		return err
+	}
+	return repo.walkHistory([]string{sha}, fn)
+}
+
+// Refs lists every ref under refs/ with the sha it points at
+func (repo *Repository) Refs() (map[string]string, error) {
+	return repo.readRefs()
+}
+
+// Head gives the ref HEAD points at, empty when it's detached, and the sha it resolves to
+// which is empty on an unborn branch
+func (repo *Repository) Head() (string, string, error) {
+	target, err := repo.readSymref("HEAD")
+	if err != nil {
+		return "", "", err
+	}
+	sha, err := repo.readRef("HEAD")
+	if err != nil && target == "" {
+		return "", "", err
+	}
+	return target, sha, nil
+}
+
+// IndexEntries reads the index as it is now
+func (repo *Repository) IndexEntries() ([]*Entry, error) {
+	if repo.files == nil {
+		return nil, fmt.Errorf("a bare repository has no index")
+	}
+	index, err := repo.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	return index.entries, nil
+}
+
+// Worktree is where the repository checks files out, nil for a bare one
+func (repo *Repository) Worktree() WorktreeFS {
+	return repo.files
+}
+
+// WriteObject stores an object, giving back its sha
+func (repo *Repository) WriteObject(kind string, contents []byte) (string, error) {
+	if _, err := newObject(kind, repo.format); err != nil {
+		return "", err
+	}
+	return repo.writeRawObject(kind, contents, true)
+}
+
+// WriteTree stores a tree of the given entries, sorting them the way git does
+func (repo *Repository) WriteTree(leaves []*TreeLeaf) (string, error) {
+	seen := make(map[string]bool)
+	for _, leaf := range leaves {
+		if len(leaf.sha) != repo.format.size {
+			return "", fmt.Errorf("%s isn't a %s object name", hex.EncodeToString(leaf.sha), repo.format.name)
+		}
+		if seen[leaf.path] {
+			return "", fmt.Errorf("%s is in the tree twice", leaf.path)
+		}
+		seen[leaf.path] = true
+	}
+	tree := &Tree{leaves: append([]*TreeLeaf(nil), leaves...), hashSize: repo.format.size}
+	return repo.writeObject(tree, true)
+}
+
+// WriteCommit stores a commit, with author and committer as "name <email> time zone" lines
+func (repo *Repository) WriteCommit(tree string, parents []string, author, committer, message string) (string, error) {
+	commit := &Commit{
+		metaKV: map[CommitField][]string{
+			TreeField:      {tree},
+			AuthorField:    {author},
+			CommitterField: {committer},
+		},
+		message: message,
+	}
+	if len(parents) > 0 {
+		commit.metaKV[ParentField] = append([]string(nil), parents...)
+	}
+	return repo.writeObject(commit, true)
+}
+
+// WriteTag stores an annotated tag, leaving out the tagger line when it's empty
+func (repo *Repository) WriteTag(target, targetKind, name, tagger, message string) (string, error) {
+	tag := &Tag{
+		metaKV: map[TagField][]string{
+			ObjectField:  {target},
+			TypeField:    {targetKind},
+			TagNameField: {name},
+		},
+		message: message,
+	}
+	if tagger != "" {
+		tag.metaKV[TaggerField] = []string{tagger}
+	}
+	return repo.writeObject(tag, true)
+}
+
+// SetRef points a ref at an object that has to be here already
+func (repo *Repository) SetRef(name, sha string) error {
+	if !repo.hasObject(sha) {
+		return fmt.Errorf("Can't point %s at %s, there's no such object", name, sha)
+	}
+	return repo.writeRef(name, sha)
+}
+
+// SetSymref makes name a symbolic ref pointing at target, the way HEAD points at a branch
+func (repo *Repository) SetSymref(name, target string) error {
+	return repo.writeSymref(name, target)
+}
+
+func (repo *Repository) DeleteRef(name string) error {
+	return repo.deleteRef(name)
+}
+
+// Checkout writes out the tree of a commit into the work tree and makes the index match it
+// leaving HEAD where it is
+func (repo *Repository) Checkout(sha string) error {
+	if repo.files == nil {
+		return fmt.Errorf("a bare repository has no work tree")
+	}
+	return repo.checkoutCommit(sha)
+}
+
+// Add stages the file at path in the work tree, a regular file or a symlink
+func (repo *Repository) Add(name string) error {
+	if repo.files == nil {
+		return fmt.Errorf("a bare repository has no work tree")
+	}
+	if err := verifyPath(name); err != nil {
+		return err
+	}
+	info, err := repo.files.Lstat(name)
+	if err != nil {
+		return err
+	}
+
+	var contents []byte
+	var mode uint32
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := repo.files.ReadLink(name)
+		if err != nil {
+			return err
+		}
+		contents, mode = []byte(target), 0o120000
+	case info.Mode().IsRegular():
+		if contents, err = fs.ReadFile(repo.files, name); err != nil {
+			return err
+		}
+		mode = 0o100644
+		if info.Mode()&0o111 != 0 {
+			mode = 0o100755
+		}
+	default:
+		return fmt.Errorf("Can't add %s, it isn't a file", name)
+	}
+
+	sha, err := repo.writeRawObject("blob", contents, true)
+	if err != nil {
+		return err
+	}
+	raw, err := hex.DecodeString(sha)
+	if err != nil {
+		return err
+	}
+
+	index, err := repo.readIndex()
+	if err != nil {
+		return err
+	}
+	// a conflicted file is resolved by adding it, so every stage of it goes
+	index.entries = slices.DeleteFunc(index.entries, func(entry *Entry) bool {
+		return entry.path == name
+	})
+	index.entries = append(index.entries, newEntry(name, raw, mode, info))
+	return repo.writeIndex(index)
+}
+
+// NewTreeLeaf makes a tree entry from an octal mode like 100644, a name and a sha
+func NewTreeLeaf(mode, name, sha string) (*TreeLeaf, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return nil, fmt.Errorf("%q can't be the name of a tree entry", name)
+	}
+	if _, err := strconv.ParseUint(mode, 8, 32); err != nil {
+		return nil, fmt.Errorf("%s isn't a mode", mode)
+	}
+	raw, err := hex.DecodeString(sha)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't an object name", sha)
+	}
+	// trees store 40000 for a directory, which is what sorting them looks for
+	return &TreeLeaf{mode: strings.TrimPrefix(mode, "0"), path: name, sha: raw}, nil
+}
+
+// Tree is the sha of the commit's tree
+func (c *Commit) Tree() string {
+	tree, _ := c.getField("tree")
+	return tree
+}
+
+// Parents are the shas of the commit's parents, first parent first
+func (c *Commit) Parents() []string {
+	return append([]string(nil), c.parents()...)
+}
+
+// Author is the commit's author line, "name <email> time zone"
+func (c *Commit) Author() string {
+	author, _ := c.getField("author")
+	return author
+}
+
+// Committer is the commit's committer line, like Author
+func (c *Commit) Committer() string {
+	committer, _ := c.getField("committer")
+	return committer
+}
+
+func (c *Commit) Message() string {
+	return c.message
+}
+
+// Target is the sha of the object the tag points at
+func (t *Tag) Target() string {
+	object, _ := t.getField("object")
+	return object
+}
+
+// TargetKind is the kind of object the tag points at
+func (t *Tag) TargetKind() string {
+	kind, _ := t.getField("type")
+	return kind
+}
+
+func (t *Tag) Name() string {
+	name, _ := t.getField("tag")
+	return name
+}
+
+// Tagger is the tag's tagger line, empty for the odd tag that has none
+func (t *Tag) Tagger() string {
+	tagger, _ := t.getField("tagger")
+	return tagger
+}
+
+func (t *Tag) Message() string {
+	return t.message
+}
+
+// Entries are the tree's entries in the order they're stored
+func (t *Tree) Entries() []*TreeLeaf {
+	return append([]*TreeLeaf(nil), t.leaves...)
+}
+
+// Mode is the entry's octal mode as the tree has it, like 100644 or 40000
+func (leaf *TreeLeaf) Mode() string {
+	return leaf.mode
+}
+
+func (leaf *TreeLeaf) Name() string {
+	return leaf.path
+}
+
+func (leaf *TreeLeaf) Sha() string {
+	return hex.EncodeToString(leaf.sha)
+}
+
+// Contents are the blob's bytes, which mustn't be changed since they may be cached
+func (b *Blob) Contents() []byte {
+	return b.contents
+}
+
+// Path is where the entry is in the work tree, with forward slashes
+func (e *Entry) Path() string {
+	return e.path
+}
+
+func (e *Entry) Sha() string {
+	return hex.EncodeToString(e.sha)
+}
+
+func (e *Entry) Mode() uint32 {
+	return e.mode
+}
+
+// Size is the file's size when it was added, cut down to 32 bits
+func (e *Entry) Size() uint32 {
+	return e.size
+}
+
+func (e *Entry) ModTime() time.Time {
+	return time.Unix(int64(e.mTimeSec), int64(e.mTimeNano))
+}
+
+// Stage is 0 for a merged entry and 1 to 3 for the sides of a conflict
+func (e *Entry) Stage() int {
+	return int(parseFlags(e.flags).stage)
+}
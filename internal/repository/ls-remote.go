@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/joeldotdias/twine/internal/helpers"
+)
+
+func (repo *Repository) lsRemote(args []string) error {
+	lsRemoteCmd := flag.NewFlagSet("ls-remote", flag.ExitOnError)
+	heads := lsRemoteCmd.Bool("heads", false, "Only show branches")
+	tags := lsRemoteCmd.Bool("tags", false, "Only show tags")
+	refsOnly := lsRemoteCmd.Bool("refs", false, "Don't show peeled tags or pseudorefs like HEAD")
+	symref := lsRemoteCmd.Bool("symref", false, "Show what symbolic refs point at")
+	program := lsRemoteCmd.String("upload-pack", "", "Path to upload-pack on the remote end")
+	if err := lsRemoteCmd.Parse(args); err != nil {
+		return err
+	}
+
+	remote := "origin"
+	patterns := lsRemoteCmd.Args()
+	if len(patterns) > 0 {
+		remote, patterns = patterns[0], patterns[1:]
+	}
+	url := repo.remoteURL(remote)
+	if *program == "" {
+		*program = repo.conf.Value("remote."+remote+".uploadpack", "")
+	}
+
+	var prefixes []string
+	if *heads {
+		prefixes = append(prefixes, "refs/heads/")
+	}
+	if *tags {
+		prefixes = append(prefixes, "refs/tags/")
+	}
+	if len(prefixes) == 0 && *refsOnly {
+		prefixes = append(prefixes, "refs/")
+	}
+
+	conn, err := repo.connectUploadPack(url, *program)
+	if err != nil {
+		return err
+	}
+	refs, err := conn.listRefs(prefixes)
+	if err != nil {
+		conn.close()
+		return err
+	}
+	if err := conn.close(); err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		if *refsOnly && !strings.HasPrefix(ref.name, "refs/") {
+			continue
+		}
+		if !matchesPatterns(ref.name, patterns) {
+			continue
+		}
+		if *symref && ref.symref != "" {
+			fmt.Printf("ref: %s\t%s\n", ref.symref, ref.name)
+		}
+		if ref.sha != "" {
+			fmt.Printf("%s\t%s\n", ref.sha, ref.name)
+		}
+		if ref.peeled != "" && !*refsOnly {
+			fmt.Printf("%s\t%s^{}\n", ref.peeled, ref.name)
+		}
+	}
+	return nil
+}
+
+// remoteURL looks up the url of a named remote
+// anything that isn't a configured remote is taken to be a url already
+func (repo *Repository) remoteURL(remote string) string {
+	if url, ok := repo.conf.Get("remote." + remote + ".url"); ok {
+		return url
+	}
+	return remote
+}
+
+// matchesPatterns compares the tail of a ref name against each pattern
+// so main matches refs/heads/main but not refs/heads/domain
+func matchesPatterns(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if helpers.WildMatch("**/"+pattern, name, false) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,483 @@
+package repository
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryObjects keeps objects in a map, never compressed
+type memoryObjects struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	kind     string
+	contents []byte
+}
+
+func newMemoryObjects() *memoryObjects {
+	return &memoryObjects{objects: make(map[string]memoryObject)}
+}
+
+func (objects *memoryObjects) ReadObject(sha string) (string, []byte, error) {
+	objects.mu.RLock()
+	defer objects.mu.RUnlock()
+	obj, ok := objects.objects[sha]
+	if !ok {
+		return "", nil, fmt.Errorf("Didn't find object %s: %w", sha, fs.ErrNotExist)
+	}
+	return obj.kind, obj.contents, nil
+}
+
+func (objects *memoryObjects) HasObject(sha string) bool {
+	objects.mu.RLock()
+	defer objects.mu.RUnlock()
+	_, ok := objects.objects[sha]
+	return ok
+}
+
+func (objects *memoryObjects) WriteObject(sha, kind string, contents []byte) error {
+	objects.mu.Lock()
+	defer objects.mu.Unlock()
+	if _, ok := objects.objects[sha]; !ok {
+		// whoever wrote it might go on to change their copy
+		objects.objects[sha] = memoryObject{kind, bytes.Clone(contents)}
+	}
+	return nil
+}
+
+func (objects *memoryObjects) ObjectsWithPrefix(prefix string) ([]string, error) {
+	objects.mu.RLock()
+	defer objects.mu.RUnlock()
+	var matches []string
+	for sha := range objects.objects {
+		if strings.HasPrefix(sha, prefix) {
+			matches = append(matches, sha)
+		}
+	}
+	slices.Sort(matches)
+	return matches, nil
+}
+
+// memoryRefs keeps refs, HEAD included, in a map
+type memoryRefs struct {
+	mu   sync.RWMutex
+	refs map[string]string
+}
+
+func newMemoryRefs() *memoryRefs {
+	return &memoryRefs{refs: make(map[string]string)}
+}
+
+func (refs *memoryRefs) ReadRef(name string) (string, error) {
+	refs.mu.RLock()
+	defer refs.mu.RUnlock()
+	value, ok := refs.refs[name]
+	if !ok {
+		return "", fmt.Errorf("Didn't find ref %s: %w", name, fs.ErrNotExist)
+	}
+	return value, nil
+}
+
+func (refs *memoryRefs) WriteRef(name, value string) error {
+	refs.mu.Lock()
+	defer refs.mu.Unlock()
+	refs.refs[name] = value
+	return nil
+}
+
+func (refs *memoryRefs) DeleteRef(name string) error {
+	refs.mu.Lock()
+	defer refs.mu.Unlock()
+	delete(refs.refs, name)
+	return nil
+}
+
+func (refs *memoryRefs) changeRefs(changes []refChange) error {
+	refs.mu.Lock()
+	defer refs.mu.Unlock()
+	for _, change := range changes {
+		if current := refs.refs[change.name]; current != change.old {
+			return fmt.Errorf("cannot lock ref '%s': is at %s but expected %s", change.name, orNothing(current), orNothing(change.old))
+		}
+	}
+	for _, change := range changes {
+		if change.value == "" {
+			delete(refs.refs, change.name)
+		} else {
+			refs.refs[change.name] = change.value
+		}
+	}
+	return nil
+}
+
+func (refs *memoryRefs) ListRefs() (map[string]string, error) {
+	refs.mu.RLock()
+	defer refs.mu.RUnlock()
+	values := make(map[string]string)
+	for name, value := range refs.refs {
+		if strings.HasPrefix(name, "refs/") {
+			values[name] = value
+		}
+	}
+	return values, nil
+}
+
+// memoryIndex is the serialized index, nil until it's first written
+type memoryIndex struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+func (index *memoryIndex) ReadIndex() ([]byte, error) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+	if index.data == nil {
+		return nil, fmt.Errorf("no index yet: %w", fs.ErrNotExist)
+	}
+	return index.data, nil
+}
+
+func (index *memoryIndex) WriteIndex(data []byte) error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.data = bytes.Clone(data)
+	return nil
+}
+
+/*
+ * the work tree in memory is a map from slash separated paths to files
+ * directories are entries of their own, so one can be empty
+ * symlinks hold their target as data and one that's opened is followed, as long as it stays inside
+ */
+
+type memoryWorktree struct {
+	mu    sync.RWMutex
+	files map[string]*memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+// symlinks to symlinks are followed this many times when opening
+const maxMemorySymlinks = 40
+
+func newMemoryWorktree() *memoryWorktree {
+	return &memoryWorktree{files: make(map[string]*memoryFile)}
+}
+
+func memoryPathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// lookup gives the file at name without following it if it's a symlink
+// the top of the tree is "." and always there
+func (wt *memoryWorktree) lookup(op, name string) (*memoryFile, error) {
+	if !fs.ValidPath(name) {
+		return nil, memoryPathError(op, name, fs.ErrInvalid)
+	}
+	if name == "." {
+		return &memoryFile{mode: fs.ModeDir | 0o755}, nil
+	}
+	file, ok := wt.files[name]
+	if !ok {
+		return nil, memoryPathError(op, name, fs.ErrNotExist)
+	}
+	return file, nil
+}
+
+// parentExists says if the directory a new file would go in is there
+func (wt *memoryWorktree) parentExists(op, name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return memoryPathError(op, name, fs.ErrInvalid)
+	}
+	parent, err := wt.lookup(op, path.Dir(name))
+	if err != nil {
+		return memoryPathError(op, name, fs.ErrNotExist)
+	}
+	if !parent.mode.IsDir() {
+		return memoryPathError(op, name, fs.ErrInvalid)
+	}
+	return nil
+}
+
+func (wt *memoryWorktree) Open(name string) (fs.File, error) {
+	wt.mu.RLock()
+	defer wt.mu.RUnlock()
+
+	resolved := name
+	file, err := wt.lookup("open", resolved)
+	for hops := 0; err == nil && file.mode&fs.ModeSymlink != 0; hops++ {
+		if hops == maxMemorySymlinks || path.IsAbs(string(file.data)) {
+			return nil, memoryPathError("open", name, fs.ErrNotExist)
+		}
+		resolved = path.Join(path.Dir(resolved), string(file.data))
+		file, err = wt.lookup("open", resolved)
+	}
+	if err != nil {
+		return nil, memoryPathError("open", name, fs.ErrNotExist)
+	}
+
+	info := &memoryFileInfo{path.Base(name), file}
+	if !file.mode.IsDir() {
+		return &openMemoryFile{info, bytes.NewReader(file.data)}, nil
+	}
+
+	var entries []fs.DirEntry
+	prefix := resolved + "/"
+	if resolved == "." {
+		prefix = ""
+	}
+	for child, childFile := range wt.files {
+		rest, ok := strings.CutPrefix(child, prefix)
+		if ok && rest != "" && !strings.Contains(rest, "/") {
+			entries = append(entries, &memoryFileInfo{rest, childFile})
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return &openMemoryDir{info: info, entries: entries}, nil
+}
+
+func (wt *memoryWorktree) Lstat(name string) (fs.FileInfo, error) {
+	wt.mu.RLock()
+	defer wt.mu.RUnlock()
+	file, err := wt.lookup("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryFileInfo{path.Base(name), file}, nil
+}
+
+func (wt *memoryWorktree) ReadLink(name string) (string, error) {
+	wt.mu.RLock()
+	defer wt.mu.RUnlock()
+	file, err := wt.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if file.mode&fs.ModeSymlink == 0 {
+		return "", memoryPathError("readlink", name, fs.ErrInvalid)
+	}
+	return string(file.data), nil
+}
+
+// Create hands back a writer whose contents become the file when it's closed
+func (wt *memoryWorktree) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	wt.mu.RLock()
+	defer wt.mu.RUnlock()
+	if err := wt.parentExists("create", name); err != nil {
+		return nil, err
+	}
+	if file, ok := wt.files[name]; ok && file.mode.IsDir() {
+		return nil, memoryPathError("create", name, fs.ErrExist)
+	}
+	return &memoryFileWriter{wt: wt, name: name, perm: perm.Perm()}, nil
+}
+
+func (wt *memoryWorktree) Symlink(target, name string) error {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	if err := wt.parentExists("symlink", name); err != nil {
+		return err
+	}
+	if file, ok := wt.files[name]; ok && file.mode.IsDir() {
+		return memoryPathError("symlink", name, fs.ErrExist)
+	}
+	wt.files[name] = &memoryFile{[]byte(target), fs.ModeSymlink | 0o777, time.Now()}
+	return nil
+}
+
+func (wt *memoryWorktree) MkdirAll(name string, perm fs.FileMode) error {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	if !fs.ValidPath(name) {
+		return memoryPathError("mkdir", name, fs.ErrInvalid)
+	}
+
+	var dirs []string
+	for dir := name; dir != "."; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for _, dir := range slices.Backward(dirs) {
+		file, ok := wt.files[dir]
+		if !ok {
+			wt.files[dir] = &memoryFile{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()}
+		} else if !file.mode.IsDir() {
+			return memoryPathError("mkdir", dir, fs.ErrExist)
+		}
+	}
+	return nil
+}
+
+// Remove only takes a directory once it's empty, like os.Remove
+func (wt *memoryWorktree) Remove(name string) error {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	file, err := wt.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return memoryPathError("remove", name, fs.ErrInvalid)
+	}
+	if file.mode.IsDir() {
+		for child := range wt.files {
+			if strings.HasPrefix(child, name+"/") {
+				return memoryPathError("remove", name, fs.ErrExist)
+			}
+		}
+	}
+	delete(wt.files, name)
+	return nil
+}
+
+type memoryFileWriter struct {
+	wt     *memoryWorktree
+	name   string
+	perm   fs.FileMode
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (w *memoryFileWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, memoryPathError("write", w.name, fs.ErrClosed)
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryFileWriter) Close() error {
+	if w.closed {
+		return memoryPathError("close", w.name, fs.ErrClosed)
+	}
+	w.closed = true
+
+	w.wt.mu.Lock()
+	defer w.wt.mu.Unlock()
+	if err := w.wt.parentExists("close", w.name); err != nil {
+		return err
+	}
+	w.wt.files[w.name] = &memoryFile{w.buf.Bytes(), w.perm, time.Now()}
+	return nil
+}
+
+// memoryFileInfo is both the fs.FileInfo and the fs.DirEntry of a file
+type memoryFileInfo struct {
+	name string
+	file *memoryFile
+}
+
+func (info *memoryFileInfo) Name() string               { return info.name }
+func (info *memoryFileInfo) Size() int64                { return int64(len(info.file.data)) }
+func (info *memoryFileInfo) Mode() fs.FileMode          { return info.file.mode }
+func (info *memoryFileInfo) ModTime() time.Time         { return info.file.modTime }
+func (info *memoryFileInfo) IsDir() bool                { return info.file.mode.IsDir() }
+func (info *memoryFileInfo) Sys() any                   { return nil }
+func (info *memoryFileInfo) Type() fs.FileMode          { return info.file.mode.Type() }
+func (info *memoryFileInfo) Info() (fs.FileInfo, error) { return info, nil }
+
+type openMemoryFile struct {
+	info *memoryFileInfo
+	*bytes.Reader
+}
+
+func (f *openMemoryFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *openMemoryFile) Close() error               { return nil }
+
+type openMemoryDir struct {
+	info    *memoryFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *openMemoryDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *openMemoryDir) Close() error               { return nil }
+
+func (d *openMemoryDir) Read([]byte) (int, error) {
+	return 0, memoryPathError("read", d.info.name, fs.ErrInvalid)
+}
+
+// ReadDir works the way fs.ReadDirFile says it should
+func (d *openMemoryDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.offset += n
+	return rest[:n], nil
+}
+
+// OpenStorage sets up a repository kept wherever the given storage keeps things
+// without a work tree, files is nil and the repository is bare
+// the config is empty, since there's no config file to read
+func OpenStorage(objects ObjectStorage, refs RefStorage, index IndexStorage, files WorktreeFS, objectFormat string) (*Repository, error) {
+	format := formatSHA1
+	if objectFormat != "" {
+		var err error
+		if format, err = objectFormatNamed(objectFormat); err != nil {
+			return nil, err
+		}
+	}
+
+	conf := &Config{}
+	conf.set("core.bare", fmt.Sprint(files == nil), ScopeLocal, "storage")
+	if format != formatSHA1 {
+		conf.set("extensions.objectformat", format.name, ScopeLocal, "storage")
+	}
+	odb, err := newObjectDatabase(conf)
+	if err != nil {
+		return nil, err
+	}
+	repo := &Repository{
+		conf:      conf,
+		format:    format,
+		refStore:  &RefStore{},
+		odb:       odb,
+		objects:   objects,
+		refs:      refs,
+		indexFile: index,
+		files:     files,
+	}
+
+	if err = repo.findRefs(); err != nil {
+		return nil, err
+	}
+	if repo.index, err = repo.readIndex(); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// InitMemory creates an empty repository that's only ever kept in memory
+// with HEAD on the default branch and, unless it's bare, an empty work tree
+func InitMemory(bare bool, objectFormat string) (*Repository, error) {
+	refs := newMemoryRefs()
+	var files WorktreeFS
+	if !bare {
+		files = newMemoryWorktree()
+	}
+	repo, err := OpenStorage(newMemoryObjects(), refs, &memoryIndex{}, files, objectFormat)
+	if err != nil {
+		return nil, err
+	}
+	refs.refs["HEAD"] = "ref: refs/heads/" + repo.conf.DefaultBranch()
+	return repo, nil
+}
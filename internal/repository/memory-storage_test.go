@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMemoryRepositoryCheckoutAddAndRefs(t *testing.T) {
+	repo, err := InitMemory(false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.GitDir() != "" {
+		t.Errorf("memory repository has git dir %q", repo.GitDir())
+	}
+	if target, _ := repo.readSymref("HEAD"); target != "refs/heads/master" {
+		t.Errorf("HEAD points at %q", target)
+	}
+
+	blob := func(contents string) string {
+		sha, err := repo.WriteObject("blob", []byte(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sha
+	}
+	leaf := func(mode, name, sha string) *TreeLeaf {
+		leaf, err := NewTreeLeaf(mode, name, sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf
+	}
+	dir, err := repo.WriteTree([]*TreeLeaf{leaf("100644", "b", blob("nested\n"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := repo.WriteTree([]*TreeLeaf{
+		leaf("100644", "a", blob("a\n")),
+		leaf("40000", "dir", dir),
+		leaf("100755", "run", blob("#!/bin/sh\n")),
+		leaf("120000", "link", blob("dir/b")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.WriteCommit(tree, nil, testIdent, testIdent, "files\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetRef("refs/heads/master", commit); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Checkout(commit); err != nil {
+		t.Fatal(err)
+	}
+	files := repo.Worktree()
+	if err := fstest.TestFS(files, "a", "dir/b", "run", "link"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile(files, "link"); err != nil || string(data) != "nested\n" {
+		t.Errorf("link reads %q: %v", data, err)
+	}
+	if info, err := files.Lstat("run"); err != nil || info.Mode()&0o111 == 0 {
+		t.Errorf("run isn't executable: %v %v", info, err)
+	}
+	entries, err := repo.IndexEntries()
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("index has %d entries: %v", len(entries), err)
+	}
+
+	// a change in the work tree gets into the index by adding it
+	w, err := files.Create("a", 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("changed\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Add("a"); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = repo.IndexEntries()
+	for _, entry := range entries {
+		if entry.path == "a" && hex.EncodeToString(entry.sha) != blob("changed\n") {
+			t.Errorf("a is %x in the index after adding it", entry.sha)
+		}
+	}
+
+	// refs only move from where they were last read
+	stale := []refChange{{name: "refs/heads/master", old: tree, value: tree}}
+	if err := repo.changeRefs(stale); err == nil {
+		t.Error("moved a ref from a value it didn't hold")
+	}
+	if err := repo.changeRefs([]refChange{{name: "refs/heads/master", old: commit, value: ""}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.refs.ReadRef("refs/heads/master"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("deleted ref reads back with %v", err)
+	}
+	if _, _, err := repo.objects.ReadObject(repo.format.zero()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing object reads back with %v", err)
+	}
+}
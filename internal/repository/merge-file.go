@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+)
+
+/*
+ * a file changed on both sides is merged a line at a time, the way git's merge-file does it
+ *
+ * base is diffed against ours and against theirs, and the hunks of both are walked in base order
+ * hunks from the two sides that overlap or touch are one region, where touching means
+ * the second starts on the line right after the first ends, which is where xdiff draws the line too
+ *
+ * a region only one side changed takes that side, one both changed the same way takes it once
+ * anything else is a conflict, written out with markers after taking off the lines
+ * both sides begin and end with so only what really differs is between them
+ *
+ * <<<<<<< ours
+ * our lines
+ * =======
+ * their lines
+ * >>>>>>> theirs
+ */
+
+// how much of a file is looked at for a NUL to decide it's binary, same as git
+const binaryCheckSize = 8000
+
+func isBinary(data []byte) bool {
+	return bytes.IndexByte(data[:min(len(data), binaryCheckSize)], 0) != -1
+}
+
+// splitLines cuts data into lines that keep their newline, the last one might not have one
+func splitLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// mergeSide is how far through one side's hunks the merge is
+type mergeSide struct {
+	lines []string
+	hunks []diffHunk
+	next  int
+	// how many more lines this side has than base up to where the merge is
+	delta int
+}
+
+// mergeFile puts the changes ours and theirs made to base together
+// giving the merged contents and each conflicting region with the markers around it
+// labels name ours and theirs on the markers
+func mergeFile(base, ours, theirs []byte, labels [2]string) ([]byte, []string) {
+	baseLines := splitLines(base)
+	var sides [2]mergeSide
+	for i, data := range [][]byte{ours, theirs} {
+		lines := splitLines(data)
+		sides[i] = mergeSide{lines: lines, hunks: diffHunks(matchLines(baseLines, lines, false), len(baseLines))}
+	}
+
+	var merged strings.Builder
+	var conflicts []string
+	written := 0
+	for {
+		lo := -1
+		for _, side := range sides {
+			if side.next < len(side.hunks) && (lo == -1 || side.hunks[side.next].aStart < lo) {
+				lo = side.hunks[side.next].aStart
+			}
+		}
+		if lo == -1 {
+			break
+		}
+
+		// the region grows for as long as a hunk on either side reaches it
+		hi := lo
+		var starts [2]int
+		var changed [2]bool
+		for i := range sides {
+			starts[i] = lo + sides[i].delta
+		}
+		for grown := true; grown; {
+			grown = false
+			for i := range sides {
+				side := &sides[i]
+				for side.next < len(side.hunks) && side.hunks[side.next].aStart <= hi {
+					hunk := side.hunks[side.next]
+					hi = max(hi, hunk.aStart+hunk.aCount)
+					side.delta += hunk.bCount - hunk.aCount
+					side.next++
+					changed[i], grown = true, true
+				}
+			}
+		}
+
+		for _, line := range baseLines[written:lo] {
+			merged.WriteString(line)
+		}
+		written = hi
+		ourLines := sides[0].lines[starts[0] : hi+sides[0].delta]
+		theirLines := sides[1].lines[starts[1] : hi+sides[1].delta]
+
+		switch {
+		case !changed[1] || slices.Equal(ourLines, theirLines):
+			writeLines(&merged, ourLines)
+		case !changed[0]:
+			writeLines(&merged, theirLines)
+		default:
+			conflict := conflictMarkers(ourLines, theirLines, labels)
+			conflicts = append(conflicts, conflict)
+			merged.WriteString(conflict)
+		}
+	}
+	for _, line := range baseLines[written:] {
+		merged.WriteString(line)
+	}
+
+	return []byte(merged.String()), conflicts
+}
+
+func writeLines(w *strings.Builder, lines []string) {
+	for _, line := range lines {
+		w.WriteString(line)
+	}
+}
+
+// conflictMarkers writes out a conflict, with the lines both sides share at either end outside the markers
+func conflictMarkers(ours, theirs []string, labels [2]string) string {
+	prefix := 0
+	for prefix < len(ours) && prefix < len(theirs) && ours[prefix] == theirs[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(ours)-prefix && suffix < len(theirs)-prefix && ours[len(ours)-1-suffix] == theirs[len(theirs)-1-suffix] {
+		suffix++
+	}
+
+	var out strings.Builder
+	writeLines(&out, ours[:prefix])
+	// a side ending without a newline gets one so the marker after it is on a line of its own
+	side := func(lines []string) {
+		writeLines(&out, lines)
+		if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+			out.WriteString("\n")
+		}
+	}
+	out.WriteString("<<<<<<< " + labels[0] + "\n")
+	side(ours[prefix : len(ours)-suffix])
+	out.WriteString("=======\n")
+	side(theirs[prefix : len(theirs)-suffix])
+	out.WriteString(">>>>>>> " + labels[1] + "\n")
+	writeLines(&out, ours[len(ours)-suffix:])
+	return out.String()
+}
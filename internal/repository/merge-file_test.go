@@ -0,0 +1,139 @@
+package repository
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMergeFile(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\nfive\nsix\nseven\n"
+	labels := [2]string{"ours", "theirs"}
+
+	tests := []struct {
+		name         string
+		ours, theirs string
+		merged       string
+		conflicts    int
+	}{
+		{
+			name:   "changes apart",
+			ours:   "ONE\ntwo\nthree\nfour\nfive\nsix\nseven\n",
+			theirs: "one\ntwo\nthree\nfour\nfive\nsix\nSEVEN\n",
+			merged: "ONE\ntwo\nthree\nfour\nfive\nsix\nSEVEN\n",
+		},
+		{
+			name:   "one side inserts, the other deletes elsewhere",
+			ours:   "one\ntwo\nthree\nthree and a half\nfour\nfive\nsix\nseven\n",
+			theirs: "one\ntwo\nthree\nfour\nfive\nseven\n",
+			merged: "one\ntwo\nthree\nthree and a half\nfour\nfive\nseven\n",
+		},
+		{
+			name:   "same change on both sides",
+			ours:   "one\ntwo\nTHREE\nfour\nfive\nsix\nseven\n",
+			theirs: "one\ntwo\nTHREE\nfour\nfive\nsix\nSEVEN\n",
+			merged: "one\ntwo\nTHREE\nfour\nfive\nsix\nSEVEN\n",
+		},
+		{
+			name:      "same line changed differently",
+			ours:      "one\ntwo\nthree\nFOUR\nfive\nsix\nseven\n",
+			theirs:    "one\ntwo\nthree\nfour!\nfive\nsix\nseven\n",
+			merged:    "one\ntwo\nthree\n<<<<<<< ours\nFOUR\n=======\nfour!\n>>>>>>> theirs\nfive\nsix\nseven\n",
+			conflicts: 1,
+		},
+		{
+			name:      "changes on lines next to each other",
+			ours:      "one\ntwo\nTHREE\nfour\nfive\nsix\nseven\n",
+			theirs:    "one\ntwo\nthree\nFOUR\nfive\nsix\nseven\n",
+			merged:    "one\ntwo\n<<<<<<< ours\nTHREE\nfour\n=======\nthree\nFOUR\n>>>>>>> theirs\nfive\nsix\nseven\n",
+			conflicts: 1,
+		},
+		{
+			name:   "changes one line apart",
+			ours:   "one\ntwo\nTHREE\nfour\nfive\nsix\nseven\n",
+			theirs: "one\ntwo\nthree\nfour\nFIVE\nsix\nseven\n",
+			merged: "one\ntwo\nTHREE\nfour\nFIVE\nsix\nseven\n",
+		},
+		{
+			name:      "overlap keeps what both share outside the markers",
+			ours:      "one\ntwo\nshared\nmine\nshared too\nsix\nseven\n",
+			theirs:    "one\ntwo\nshared\nyours\nshared too\nsix\nseven\n",
+			merged:    "one\ntwo\nshared\n<<<<<<< ours\nmine\n=======\nyours\n>>>>>>> theirs\nshared too\nsix\nseven\n",
+			conflicts: 1,
+		},
+		{
+			name:      "two conflicts and a clean change between them",
+			ours:      "ONE\ntwo\nthree\nfour\nfive\nsix\nSEVEN\n",
+			theirs:    "1\ntwo\nthree\nFOUR\nfive\nsix\n7\n",
+			merged:    "<<<<<<< ours\nONE\n=======\n1\n>>>>>>> theirs\ntwo\nthree\nFOUR\nfive\nsix\n<<<<<<< ours\nSEVEN\n=======\n7\n>>>>>>> theirs\n",
+			conflicts: 2,
+		},
+		{
+			name:      "no newline at the end",
+			ours:      "one\ntwo\nthree\nfour\nfive\nsix\nseven, mine",
+			theirs:    "one\ntwo\nthree\nfour\nfive\nsix\nseven, yours",
+			merged:    "one\ntwo\nthree\nfour\nfive\nsix\n<<<<<<< ours\nseven, mine\n=======\nseven, yours\n>>>>>>> theirs\n",
+			conflicts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		merged, conflicts := mergeFile([]byte(base), []byte(tt.ours), []byte(tt.theirs), labels)
+		if string(merged) != tt.merged {
+			t.Errorf("%s: merged\n%s\nwant\n%s", tt.name, merged, tt.merged)
+		}
+		if len(conflicts) != tt.conflicts {
+			t.Errorf("%s: %d conflicts %q, want %d", tt.name, len(conflicts), conflicts, tt.conflicts)
+		}
+
+		// swapping the sides swaps them in the markers and nothing else
+		swapped, _ := mergeFile([]byte(base), []byte(tt.theirs), []byte(tt.ours), [2]string{"theirs", "ours"})
+		if tt.conflicts == 0 && string(swapped) != tt.merged {
+			t.Errorf("%s: swapped sides merged\n%s", tt.name, swapped)
+		}
+	}
+}
+
+func TestMergeTreesMergesLines(t *testing.T) {
+	repo := newTestRepo(t, true)
+	tree := func(files map[string]string) string {
+		return writeTestTree(t, repo, files)
+	}
+	base := tree(map[string]string{"a": "1\n2\n3\n4\n5\n", "b": "b\n", "bin": "\x00base"})
+	ours := tree(map[string]string{"a": "one\n2\n3\n4\n5\n", "b": "mine\n", "bin": "\x00ours", "new": "x\ny\n"})
+	theirs := tree(map[string]string{"a": "1\n2\n3\n4\nfive\n", "b": "yours\n", "bin": "\x00theirs", "new": "x\ny\n"})
+
+	merged, conflicts, err := repo.mergeTrees(base, ours, theirs, [2]string{"HEAD", "theirs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, conflict := range conflicts {
+		paths = append(paths, conflict.path)
+	}
+	if want := []string{"b", "bin"}; !slices.Equal(paths, want) {
+		t.Fatalf("conflicts in %q, want %q", paths, want)
+	}
+	if markers := strings.Join(conflicts[0].markers, ""); markers != "<<<<<<< HEAD\nmine\n=======\nyours\n>>>>>>> theirs\n" {
+		t.Errorf("conflict in b %q", markers)
+	}
+	if len(conflicts[1].markers) != 0 {
+		t.Errorf("binary file merged with markers %q", conflicts[1].markers)
+	}
+
+	entry, ok := merged["a"]
+	if !ok {
+		t.Fatal("a is missing from the merge")
+	}
+	_, contents, err := repo.readObject(entry.sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "one\n2\n3\n4\nfive\n" {
+		t.Errorf("a merged to %q", contents)
+	}
+	if _, ok := merged["new"]; !ok {
+		t.Error("a file both sides added the same is missing from the merge")
+	}
+}
@@ -0,0 +1,403 @@
+package repository
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// treeEntry is a file somewhere down a tree, keyed by its full path
+type treeEntry struct {
+	mode string
+	sha  string
+}
+
+// flattenTree lists every file under a tree by its path
+// an empty sha gives an empty tree, like the parent of a root commit
+// a tree with a path that can't be checked out is an error, see verifyPath
+func (repo *Repository) flattenTree(treeSha string) (map[string]treeEntry, error) {
+	entries := make(map[string]treeEntry)
+	if treeSha == "" {
+		return entries, nil
+	}
+	return entries, repo.flattenInto(entries, treeSha, "")
+}
+
+func (repo *Repository) flattenInto(entries map[string]treeEntry, treeSha, prefix string) error {
+	tree, err := repo.readTree(treeSha)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(tree.leaves))
+	for _, leaf := range tree.leaves {
+		// checked before it's joined, which would clean a .. away
+		if !validPathComponent(leaf.path) || seen[leaf.path] {
+			return fmt.Errorf("invalid path '%s'", prefix+"/"+leaf.path)
+		}
+		seen[leaf.path] = true
+		relPath := path.Join(prefix, leaf.path)
+		sha := hex.EncodeToString(leaf.sha)
+		if leaf.mode == "40000" {
+			if err := repo.flattenInto(entries, sha, relPath); err != nil {
+				return err
+			}
+			continue
+		}
+		entries[relPath] = treeEntry{leaf.mode, sha}
+	}
+	return nil
+}
+
+// writeFlatTree writes the tree objects for a set of files and gives the root tree
+func (repo *Repository) writeFlatTree(entries map[string]treeEntry) (string, error) {
+	var leaves []*TreeLeaf
+	subdirs := make(map[string]map[string]treeEntry)
+
+	for p, entry := range entries {
+		dir, rest, nested := strings.Cut(p, "/")
+		if !nested {
+			sha, err := hex.DecodeString(entry.sha)
+			if err != nil {
+				return "", err
+			}
+			leaves = append(leaves, &TreeLeaf{mode: entry.mode, path: p, sha: sha})
+			continue
+		}
+		if subdirs[dir] == nil {
+			subdirs[dir] = make(map[string]treeEntry)
+		}
+		subdirs[dir][rest] = entry
+	}
+
+	for dir, sub := range subdirs {
+		if _, clash := entries[dir]; clash {
+			return "", fmt.Errorf("%s is both a file and a directory", dir)
+		}
+		subSha, err := repo.writeFlatTree(sub)
+		if err != nil {
+			return "", err
+		}
+		sha, _ := hex.DecodeString(subSha)
+		leaves = append(leaves, &TreeLeaf{mode: "40000", path: dir, sha: sha})
+	}
+
+	return repo.writeObject(&Tree{leaves: leaves}, true)
+}
+
+// mergeConflict is a file the two sides of a merge changed in ways that don't go together
+type mergeConflict struct {
+	path string
+	// the overlapping regions with conflict markers around them
+	// none when the file can't be merged a line at a time, like a binary or a file one side deleted
+	markers []string
+}
+
+// mergeTrees does a three-way merge one file at a time
+// a file changed on only one side takes that change
+// a file both sides changed is merged a line at a time, a conflict only when their changes overlap
+// labels name our side and theirs on conflict markers
+func (repo *Repository) mergeTrees(base, ours, theirs string, labels [2]string) (map[string]treeEntry, []mergeConflict, error) {
+	var sides [3]map[string]treeEntry
+	for i, treeSha := range []string{base, ours, theirs} {
+		entries, err := repo.flattenTree(treeSha)
+		if err != nil {
+			return nil, nil, err
+		}
+		sides[i] = entries
+	}
+	baseEntries, ourEntries, theirEntries := sides[0], sides[1], sides[2]
+
+	paths := make(map[string]bool)
+	for _, entries := range sides {
+		for p := range entries {
+			paths[p] = true
+		}
+	}
+
+	merged := make(map[string]treeEntry)
+	var conflicts []mergeConflict
+	for p := range paths {
+		b, inBase := baseEntries[p]
+		o, inOurs := ourEntries[p]
+		t, inTheirs := theirEntries[p]
+
+		switch {
+		case inOurs == inTheirs && o == t:
+			// both sides agree, including both deleting it
+		case inTheirs == inBase && t == b:
+			// only we changed it
+		case inOurs == inBase && o == b:
+			o, inOurs = t, inTheirs
+		case !inOurs || !inTheirs:
+			// changed on one side and deleted on the other
+			conflicts = append(conflicts, mergeConflict{path: p})
+			continue
+		default:
+			entry, conflict, err := repo.mergeEntry(p, b, o, t, inBase, labels)
+			if err != nil {
+				return nil, nil, err
+			}
+			if conflict != nil {
+				conflicts = append(conflicts, *conflict)
+				continue
+			}
+			o = entry
+		}
+		if inOurs {
+			merged[p] = o
+		}
+	}
+
+	slices.SortFunc(conflicts, func(a, b mergeConflict) int {
+		return strings.Compare(a.path, b.path)
+	})
+	return merged, conflicts, nil
+}
+
+// mergeEntry merges a file both sides have and changed, an empty base when both added it
+// only regular files are merged, anything else both sides changed is a conflict
+func (repo *Repository) mergeEntry(p string, base, ours, theirs treeEntry, inBase bool, labels [2]string) (treeEntry, *mergeConflict, error) {
+	regular := func(mode string) bool {
+		return mode == "100644" || mode == "100755"
+	}
+	var mode string
+	switch {
+	case ours.mode == theirs.mode:
+		mode = ours.mode
+	case inBase && ours.mode == base.mode:
+		mode = theirs.mode
+	case inBase && theirs.mode == base.mode:
+		mode = ours.mode
+	default:
+		return treeEntry{}, &mergeConflict{path: p}, nil
+	}
+	if !regular(ours.mode) || !regular(theirs.mode) || (inBase && !regular(base.mode)) {
+		return treeEntry{}, &mergeConflict{path: p}, nil
+	}
+
+	var contents [3][]byte
+	for i, entry := range []treeEntry{base, ours, theirs} {
+		if i == 0 && !inBase {
+			continue
+		}
+		obj, err := repo.makeObject(entry.sha)
+		if err != nil {
+			return treeEntry{}, nil, err
+		}
+		blob, ok := obj.(*Blob)
+		if !ok {
+			return treeEntry{}, nil, fmt.Errorf("Object %s is not a blob", entry.sha)
+		}
+		if isBinary(blob.contents) {
+			return treeEntry{}, &mergeConflict{path: p}, nil
+		}
+		contents[i] = blob.contents
+	}
+
+	merged, markers := mergeFile(contents[0], contents[1], contents[2], labels)
+	if len(markers) > 0 {
+		return treeEntry{}, &mergeConflict{path: p, markers: markers}, nil
+	}
+	sha, err := repo.writeRawObject("blob", merged, true)
+	if err != nil {
+		return treeEntry{}, nil, err
+	}
+	return treeEntry{mode, sha}, nil, nil
+}
+
+// commitTree gives the root tree of a commit
+func (repo *Repository) commitTree(sha string) (string, error) {
+	_, commit, err := repo.peelToCommit(sha)
+	if err != nil {
+		return "", err
+	}
+	return commit.getField("tree")
+}
+
+// signature is the identity and current time that goes on author and committer lines
+func (repo *Repository) signature() string {
+	now := time.Now()
+	return fmt.Sprintf("%s <%s> %d %s", repo.conf.Username(), repo.conf.Email(), now.Unix(), now.Format("-0700"))
+}
+
+func (repo *Repository) writeCommit(treeSha string, parents []string, author, message string) (string, error) {
+	committer := repo.signature()
+	if author == "" {
+		author = committer
+	}
+	if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+
+	commit := &Commit{
+		metaKV: map[CommitField][]string{
+			TreeField:      {treeSha},
+			AuthorField:    {author},
+			CommitterField: {committer},
+		},
+		message: message,
+	}
+	if len(parents) > 0 {
+		commit.metaKV[ParentField] = parents
+	}
+	return repo.writeObject(commit, true)
+}
+
+// changedPaths lists the files that differ between two flattened trees
+func changedPaths(a, b map[string]treeEntry) map[string]bool {
+	changed := make(map[string]bool)
+	for p, entry := range a {
+		if other, ok := b[p]; !ok || other != entry {
+			changed[p] = true
+		}
+	}
+	for p := range b {
+		if _, ok := a[p]; !ok {
+			changed[p] = true
+		}
+	}
+	return changed
+}
+
+// localChanges lists files whose index entry or worktree copy
+// differs from the tree HEAD points at
+func (repo *Repository) localChanges(headTree map[string]treeEntry) ([]string, error) {
+	var changes []string
+	indexed := make(map[string]bool)
+
+	for _, entry := range repo.index.entries {
+		indexed[entry.path] = true
+		sha := hex.EncodeToString(entry.sha[:])
+		if head, ok := headTree[entry.path]; !ok || head.sha != sha {
+			changes = append(changes, entry.path)
+			continue
+		}
+
+		info, err := repo.files.Lstat(entry.path)
+		if err != nil {
+			changes = append(changes, entry.path)
+			continue
+		}
+		var contents []byte
+		if info.Mode()&fs.ModeSymlink != 0 {
+			target, err := repo.files.ReadLink(entry.path)
+			if err != nil {
+				return nil, err
+			}
+			contents = []byte(target)
+		} else if info.Mode().IsRegular() {
+			if contents, err = fs.ReadFile(repo.files, entry.path); err != nil {
+				return nil, err
+			}
+		} else {
+			continue
+		}
+		worktreeSha, err := repo.writeRawObject("blob", contents, false)
+		if err != nil {
+			return nil, err
+		}
+		if worktreeSha != sha {
+			changes = append(changes, entry.path)
+		}
+	}
+
+	for p := range headTree {
+		if !indexed[p] {
+			changes = append(changes, p)
+		}
+	}
+
+	sort.Strings(changes)
+	return changes, nil
+}
+
+// switchWorktree moves the worktree and index from one commit to another
+// refusing when that would throw away changes that haven't been committed
+func (repo *Repository) switchWorktree(from, to string) error {
+	var fromTree string
+	if from != "" {
+		var err error
+		if fromTree, err = repo.commitTree(from); err != nil {
+			return err
+		}
+	}
+	toTree, err := repo.commitTree(to)
+	if err != nil {
+		return err
+	}
+
+	oldEntries, err := repo.flattenTree(fromTree)
+	if err != nil {
+		return err
+	}
+	newEntries, err := repo.flattenTree(toTree)
+	if err != nil {
+		return err
+	}
+
+	changed := changedPaths(oldEntries, newEntries)
+	local, err := repo.localChanges(oldEntries)
+	if err != nil {
+		return err
+	}
+	var clobbered []string
+	for _, p := range local {
+		if changed[p] {
+			clobbered = append(clobbered, p)
+		}
+	}
+	if len(clobbered) > 0 {
+		return fmt.Errorf("error: Your local changes to the following files would be overwritten:\n\t%s\nPlease commit your changes or stash them before you merge.", strings.Join(clobbered, "\n\t"))
+	}
+
+	var untracked []string
+	for p := range changed {
+		if _, tracked := oldEntries[p]; tracked {
+			continue
+		}
+		if _, err := repo.files.Lstat(p); err == nil {
+			untracked = append(untracked, p)
+		}
+	}
+	if len(untracked) > 0 {
+		sort.Strings(untracked)
+		return fmt.Errorf("error: The following untracked working tree files would be overwritten:\n\t%s\nPlease move or remove them before you merge.", strings.Join(untracked, "\n\t"))
+	}
+
+	for p := range oldEntries {
+		if _, kept := newEntries[p]; kept {
+			continue
+		}
+		// clearing out directories that are empty now
+		if err := removeWithEmptyDirs(repo.files, p); err != nil {
+			return err
+		}
+	}
+
+	// staged changes to files the switch doesn't touch stay staged
+	index := emptyIndex(repo.format)
+	for _, entry := range repo.index.entries {
+		if !changed[entry.path] {
+			index.entries = append(index.entries, entry)
+		}
+	}
+	paths := make([]string, 0, len(changed))
+	for p := range changed {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if entry, ok := newEntries[p]; ok {
+			if err := repo.checkoutEntry(p, entry.mode, entry.sha, index); err != nil {
+				return err
+			}
+		}
+	}
+
+	return repo.writeIndex(index)
+}
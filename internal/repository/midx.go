@@ -0,0 +1,668 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+/*
+ * the multi-pack-index is one index over many packs
+ * so finding an object is a single binary search instead of one per .idx
+ *
+ *                      Multi-pack-index
+ * +------+---------+------+--------+-------+-------+-----------------+--------+----------+
+ * | MIDX | version | hash | chunks | bases | packs | chunk table     | chunks | sum      |
+ * |  4   |  1 (1)  |  1   |   1    | 1 (0) |   4   | (chunks+1) * 12 |        | 20 or 32 |
+ * +------+---------+------+--------+-------+-------+-----------------+--------+----------+
+ *
+ * chunk table entries are a 4 byte id and an 8 byte offset, ending with a zero id
+ *
+ * PNAM  names of the packs' .idx files, sorted, each ending in a zero byte
+ *       padded with zeros to a multiple of 4
+ * OIDF  fanout, 256 * 4, like a pack index
+ * OIDL  the object shas, sorted, N * 20
+ * OOFF  for each object, which pack it's in (4) and where in it (4)
+ *       an offset with the high bit set is a position in LOFF instead
+ * LOFF  offsets that don't fit in 31 bits, 8 bytes each
+ *
+ * with sha256 the hash is 2 and the shas and sum are 32 bytes instead of 20
+ *
+ * an object in more than one pack is only listed once, in the newest pack
+ * packs that came after the midx was written are still looked through one by one
+ */
+
+const midxLargeOffset = 0x80000000
+
+type multiPackIndex struct {
+	path     string
+	hashSize int
+	// .idx names of the packs it covers, in the order PNAM has them
+	packs  []string
+	fanout [256]uint32
+	shas   []byte
+	ooff   []byte
+	loff   []byte
+	sum    []byte
+	// packs that aren't in it
+	others []*packFile
+}
+
+// loadMidx reads the multi-pack-index once along with the packs it doesn't cover
+// without one, or with core.multiPackIndex off, every pack counts as not covered
+func (repo *Repository) loadMidx() (*multiPackIndex, error) {
+	repo.odb.midxMu.Lock()
+	defer repo.odb.midxMu.Unlock()
+	if repo.midx != nil {
+		return repo.midx, nil
+	}
+
+	useMidx, err := repo.conf.Bool("core.multiPackIndex", true)
+	if err != nil {
+		return nil, err
+	}
+	midx := &multiPackIndex{}
+	if useMidx {
+		read, err := readMidx(repo.makePath("objects", "pack", "multi-pack-index"), repo.format)
+		if err == nil {
+			err = read.checkPacks()
+		}
+		switch {
+		case err == nil:
+			midx = read
+		case !os.IsNotExist(err):
+			fmt.Fprintf(os.Stderr, "warning: ignoring multi-pack-index: %s\n", err)
+		}
+	}
+
+	idxPaths, err := filepath.Glob(repo.makePath("objects", "pack", "pack-*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	for _, idxPath := range idxPaths {
+		if midx.covers(filepath.Base(idxPath)) {
+			continue
+		}
+		pack, err := readPackIndex(idxPath, repo.format)
+		if err != nil {
+			return nil, err
+		}
+		midx.others = append(midx.others, pack)
+	}
+
+	repo.midx = midx
+	return midx, nil
+}
+
+func readMidx(path string, format *objectFormat) (*multiPackIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	size := format.size
+	if len(data) < 12+12+size || !bytes.Equal(data[:4], []byte("MIDX")) {
+		return nil, fmt.Errorf("multi-pack-index has a bad signature")
+	}
+	if data[4] != 1 {
+		return nil, fmt.Errorf("multi-pack-index has unsupported version %d", data[4])
+	}
+	if data[5] != format.id {
+		return nil, fmt.Errorf("multi-pack-index hash version %d does not match the repository's %s", data[5], format.name)
+	}
+	if data[7] != 0 {
+		return nil, fmt.Errorf("multi-pack-index has base files, which aren't supported")
+	}
+	chunkCount := int(data[6])
+	packCount := int(binary.BigEndian.Uint32(data[8:12]))
+
+	midx := &multiPackIndex{path: path, hashSize: size, sum: data[len(data)-size:]}
+	table := data[12:]
+	if len(table) < (chunkCount+1)*12 {
+		return nil, fmt.Errorf("multi-pack-index has a truncated chunk table")
+	}
+	chunks := make(map[string][]byte)
+	for i := 0; i < chunkCount; i++ {
+		entry := table[i*12:]
+		start := binary.BigEndian.Uint64(entry[4:])
+		end := binary.BigEndian.Uint64(entry[16:])
+		if start > end || end > uint64(len(data)-size) {
+			return nil, fmt.Errorf("multi-pack-index has a chunk out of bounds")
+		}
+		chunks[string(entry[:4])] = data[start:end]
+	}
+
+	names := chunks["PNAM"]
+	for len(midx.packs) < packCount {
+		name, rest, found := bytes.Cut(names, []byte{0})
+		if !found || len(name) == 0 {
+			return nil, fmt.Errorf("multi-pack-index has %d pack names but says there are %d", len(midx.packs), packCount)
+		}
+		if n := len(midx.packs); n > 0 && midx.packs[n-1] >= string(name) {
+			return nil, fmt.Errorf("multi-pack-index pack names out of order: '%s' before '%s'", midx.packs[n-1], name)
+		}
+		midx.packs = append(midx.packs, string(name))
+		names = rest
+	}
+
+	fanout := chunks["OIDF"]
+	if len(fanout) != 256*4 {
+		return nil, fmt.Errorf("multi-pack-index is missing its fanout")
+	}
+	for i := range midx.fanout {
+		midx.fanout[i] = binary.BigEndian.Uint32(fanout[i*4:])
+		if i > 0 && midx.fanout[i] < midx.fanout[i-1] {
+			return nil, fmt.Errorf("multi-pack-index has a fanout that goes backwards")
+		}
+	}
+	count := int(midx.fanout[255])
+	midx.shas, midx.ooff, midx.loff = chunks["OIDL"], chunks["OOFF"], chunks["LOFF"]
+	if len(midx.shas) != count*size || len(midx.ooff) != count*8 || len(midx.loff)%8 != 0 {
+		return nil, fmt.Errorf("multi-pack-index has chunks that don't match its %d objects", count)
+	}
+
+	// checked once here so lookups don't have to
+	for i := 0; i < count; i++ {
+		if pack := binary.BigEndian.Uint32(midx.ooff[i*8:]); int(pack) >= packCount {
+			return nil, fmt.Errorf("multi-pack-index has a bad pack-int-id %d", pack)
+		}
+		if off := binary.BigEndian.Uint32(midx.ooff[i*8+4:]); off&midxLargeOffset != 0 && len(midx.loff) > 0 {
+			if int(off&^midxLargeOffset) >= len(midx.loff)/8 {
+				return nil, fmt.Errorf("multi-pack-index has a bad large offset")
+			}
+		}
+	}
+	return midx, nil
+}
+
+// checkPacks makes sure every pack it names is still here
+// since a repack that doesn't know about the midx can take them away
+func (midx *multiPackIndex) checkPacks() error {
+	dir := filepath.Dir(midx.path)
+	for _, name := range midx.packs {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("pack %s is missing", name)
+		}
+	}
+	return nil
+}
+
+func (midx *multiPackIndex) count() int {
+	if midx.hashSize == 0 {
+		return 0
+	}
+	return len(midx.shas) / midx.hashSize
+}
+
+func (midx *multiPackIndex) shaAt(i int) []byte {
+	return midx.shas[i*midx.hashSize : (i+1)*midx.hashSize]
+}
+
+// covers says if the pack with this .idx name is in the midx
+func (midx *multiPackIndex) covers(name string) bool {
+	_, found := slices.BinarySearch(midx.packs, name)
+	return found
+}
+
+// find gives the position of an object in the midx or -1
+func (midx *multiPackIndex) find(sha []byte) int {
+	lo := 0
+	if sha[0] > 0 {
+		lo = int(midx.fanout[sha[0]-1])
+	}
+	hi := int(midx.fanout[sha[0]])
+
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(midx.shaAt(lo+i), sha) >= 0
+	})
+	if i < hi && bytes.Equal(midx.shaAt(i), sha) {
+		return i
+	}
+	return -1
+}
+
+// entry gives the pack-int-id of the pack an object is in and where it is in that pack
+func (midx *multiPackIndex) entry(i int) (int, uint64) {
+	pack := binary.BigEndian.Uint32(midx.ooff[i*8:])
+	off := binary.BigEndian.Uint32(midx.ooff[i*8+4:])
+	if off&midxLargeOffset != 0 && len(midx.loff) > 0 {
+		return int(pack), binary.BigEndian.Uint64(midx.loff[(off&^midxLargeOffset)*8:])
+	}
+	return int(pack), uint64(off)
+}
+
+// packPath is where the pack with this pack-int-id is
+func (midx *multiPackIndex) packPath(pack int) string {
+	return filepath.Join(filepath.Dir(midx.path), strings.TrimSuffix(midx.packs[pack], ".idx")+".pack")
+}
+
+// withPrefix lists every object in the midx whose hex sha starts with prefix
+func (midx *multiPackIndex) withPrefix(prefix string) []string {
+	if midx.count() == 0 {
+		return nil
+	}
+	first, err := hex.DecodeString(prefix[:2])
+	if err != nil {
+		return nil
+	}
+	lo := 0
+	if first[0] > 0 {
+		lo = int(midx.fanout[first[0]-1])
+	}
+	var matches []string
+	for i := lo; i < int(midx.fanout[first[0]]); i++ {
+		if sha := hex.EncodeToString(midx.shaAt(i)); strings.HasPrefix(sha, prefix) {
+			matches = append(matches, sha)
+		}
+	}
+	return matches
+}
+
+// findPacked says which pack an object is in and where
+// looking in the midx first and then in the packs it doesn't cover
+func (repo *Repository) findPacked(raw []byte) (string, uint64, error) {
+	midx, err := repo.loadMidx()
+	if err != nil {
+		return "", 0, err
+	}
+	if i := midx.find(raw); i != -1 {
+		pack, offset := midx.entry(i)
+		return midx.packPath(pack), offset, nil
+	}
+	for _, pack := range midx.others {
+		if i := pack.find(raw); i != -1 {
+			return pack.path, pack.offsets[i], nil
+		}
+	}
+	return "", 0, os.ErrNotExist
+}
+
+// forgetPacks drops everything loaded from objects/pack after packs come or go
+func (repo *Repository) forgetPacks() {
+	repo.odb.bitmapMu.Lock()
+	repo.odb.midxMu.Lock()
+	repo.odb.packsMu.Lock()
+	repo.packs = nil
+	repo.midx = nil
+	repo.bitmap = nil
+	repo.odb.packsMu.Unlock()
+	repo.odb.midxMu.Unlock()
+	repo.odb.bitmapMu.Unlock()
+	repo.odb.closePacks()
+}
+
+func (repo *Repository) multiPackIndexCmd(args []string) error {
+	usage := "usage: twine multi-pack-index (write [--preferred-pack=<pack>] | verify | expire | repack [--batch-size=<size>])"
+	if len(args) == 0 {
+		return fmt.Errorf("%s", usage)
+	}
+
+	switch args[0] {
+	case "write":
+		var preferred string
+		writeCmd := flag.NewFlagSet("multi-pack-index write", flag.ExitOnError)
+		writeCmd.StringVar(&preferred, "preferred-pack", "", "Pack whose copies of duplicated objects win")
+		if err := writeCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+		packs, err := repo.loadPacks()
+		if err != nil {
+			return err
+		}
+		if preferred != "" {
+			found := false
+			for _, pack := range packs {
+				found = found || midxPackName(pack) == strings.TrimSuffix(preferred, ".pack")+".idx"
+			}
+			if !found {
+				return fmt.Errorf("fatal: cannot select preferred pack %s", preferred)
+			}
+		}
+		return repo.writeMidx(packs, preferred)
+
+	case "verify":
+		return repo.verifyMidx()
+
+	case "expire":
+		return repo.expireMidx()
+
+	case "repack":
+		var batchSize string
+		repackCmd := flag.NewFlagSet("multi-pack-index repack", flag.ExitOnError)
+		repackCmd.StringVar(&batchSize, "batch-size", "0", "Combine packs smaller than this until they add up to it, 0 combines them all")
+		if err := repackCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+		size, err := parseConfigInt(batchSize)
+		if err != nil || size < 0 {
+			return fmt.Errorf("fatal: bad --batch-size '%s'", batchSize)
+		}
+		return repo.repackMidx(size)
+
+	default:
+		return fmt.Errorf("unknown subcommand: %s", args[0])
+	}
+}
+
+func midxPackName(pack *packFile) string {
+	return strings.TrimSuffix(filepath.Base(pack.path), ".pack") + ".idx"
+}
+
+// writeMidx writes a multi-pack-index covering packs
+// duplicated objects come from the preferred pack, or else the newest one
+func (repo *Repository) writeMidx(packs []*packFile, preferred string) error {
+	packs = slices.Clone(packs)
+	sort.Slice(packs, func(i, j int) bool { return midxPackName(packs[i]) < midxPackName(packs[j]) })
+	preferred = strings.TrimSuffix(preferred, ".pack")
+	preferred = strings.TrimSuffix(preferred, ".idx") + ".idx"
+
+	type candidate struct {
+		sha    []byte
+		pack   int
+		offset uint64
+	}
+	rank := make([]int64, len(packs))
+	var candidates []candidate
+	for id, pack := range packs {
+		if info, err := os.Stat(pack.path); err == nil {
+			rank[id] = info.ModTime().UnixNano()
+		}
+		if midxPackName(pack) == preferred {
+			rank[id] = 1<<63 - 1
+		}
+		for i := 0; i < pack.count(); i++ {
+			candidates = append(candidates, candidate{pack.shaAt(i), id, pack.offsets[i]})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if c := bytes.Compare(a.sha, b.sha); c != 0 {
+			return c < 0
+		}
+		if rank[a.pack] != rank[b.pack] {
+			return rank[a.pack] > rank[b.pack]
+		}
+		return a.pack < b.pack
+	})
+
+	var names, fanout, oids, ooff, loff bytes.Buffer
+	for _, pack := range packs {
+		names.WriteString(midxPackName(pack))
+		names.WriteByte(0)
+	}
+	for names.Len()%4 != 0 {
+		names.WriteByte(0)
+	}
+
+	var counts [256]uint32
+	for i, c := range candidates {
+		if i > 0 && bytes.Equal(candidates[i-1].sha, c.sha) {
+			continue
+		}
+		counts[c.sha[0]]++
+		oids.Write(c.sha)
+		binary.Write(&ooff, binary.BigEndian, uint32(c.pack))
+		if c.offset < midxLargeOffset {
+			binary.Write(&ooff, binary.BigEndian, uint32(c.offset))
+			continue
+		}
+		binary.Write(&ooff, binary.BigEndian, uint32(loff.Len()/8)|midxLargeOffset)
+		binary.Write(&loff, binary.BigEndian, c.offset)
+	}
+	for i := 1; i < 256; i++ {
+		counts[i] += counts[i-1]
+	}
+	binary.Write(&fanout, binary.BigEndian, counts)
+
+	type chunk struct {
+		id   string
+		data []byte
+	}
+	chunks := []chunk{{"PNAM", names.Bytes()}, {"OIDF", fanout.Bytes()}, {"OIDL", oids.Bytes()}, {"OOFF", ooff.Bytes()}}
+	if loff.Len() > 0 {
+		chunks = append(chunks, chunk{"LOFF", loff.Bytes()})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("MIDX")
+	buf.Write([]byte{1, repo.format.id, byte(len(chunks)), 0})
+	binary.Write(&buf, binary.BigEndian, uint32(len(packs)))
+	at := uint64(12 + (len(chunks)+1)*12)
+	for _, c := range chunks {
+		buf.WriteString(c.id)
+		binary.Write(&buf, binary.BigEndian, at)
+		at += uint64(len(c.data))
+	}
+	buf.Write([]byte{0, 0, 0, 0})
+	binary.Write(&buf, binary.BigEndian, at)
+	for _, c := range chunks {
+		buf.Write(c.data)
+	}
+	buf.Write(repo.format.sum(buf.Bytes()))
+
+	if err := repo.writeFileAtomic(repo.makePath("objects", "pack", "multi-pack-index"), buf.Bytes(), fsyncPackMetadata); err != nil {
+		return fmt.Errorf("Couldn't write multi-pack-index: %w", err)
+	}
+	repo.odb.midxMu.Lock()
+	repo.midx = nil
+	repo.odb.midxMu.Unlock()
+	return nil
+}
+
+// verifyMidx checks the checksum, the ordering and every object against the index of its pack
+func (repo *Repository) verifyMidx() error {
+	path := repo.makePath("objects", "pack", "multi-pack-index")
+	midx, err := readMidx(path, repo.format)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error: %s", err)
+	}
+
+	problems := 0
+	fail := func(format string, args ...any) {
+		problems++
+		fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if sum := repo.format.sum(data[:len(data)-midx.hashSize]); !bytes.Equal(sum, midx.sum) {
+		fail("incorrect checksum")
+	}
+
+	packs := make([]*packFile, len(midx.packs))
+	for id, name := range midx.packs {
+		if packs[id], err = readPackIndex(filepath.Join(filepath.Dir(path), name), repo.format); err != nil {
+			fail("failed to load pack in position %d: %s", id, err)
+		}
+	}
+
+	for i := 1; i < midx.count(); i++ {
+		if bytes.Compare(midx.shaAt(i-1), midx.shaAt(i)) >= 0 {
+			fail("oid lookup out of order: oid[%d] = %x >= %x = oid[%d]", i-1, midx.shaAt(i-1), midx.shaAt(i), i)
+		}
+	}
+	for i := 0; i < midx.count(); i++ {
+		id, offset := midx.entry(i)
+		pack := packs[id]
+		if pack == nil {
+			continue
+		}
+		j := pack.find(midx.shaAt(i))
+		if j == -1 {
+			fail("failed to load pack entry for oid[%d] = %x", i, midx.shaAt(i))
+			continue
+		}
+		if pack.offsets[j] != offset {
+			fail("incorrect object offset for oid[%d] = %x: %d != %d", i, midx.shaAt(i), offset, pack.offsets[j])
+		}
+	}
+	for _, pack := range packs {
+		if pack == nil {
+			continue
+		}
+		for j := 0; j < pack.count(); j++ {
+			if midx.find(pack.shaAt(j)) == -1 {
+				fail("object %x in %s is missing from the multi-pack-index", pack.shaAt(j), midxPackName(pack))
+			}
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("fatal: multi-pack-index verify found %d problems", problems)
+	}
+	return nil
+}
+
+// expireMidx removes the packs in the midx that it doesn't take a single object from
+// and writes it again without them
+func (repo *Repository) expireMidx() error {
+	midx, err := repo.loadMidx()
+	if err != nil {
+		return err
+	}
+	if len(midx.packs) == 0 {
+		return nil
+	}
+
+	used := make([]bool, len(midx.packs))
+	for i := 0; i < midx.count(); i++ {
+		pack, _ := midx.entry(i)
+		used[pack] = true
+	}
+
+	dir := filepath.Dir(midx.path)
+	var keep []*packFile
+	var expired []string
+	for id, name := range midx.packs {
+		base := filepath.Join(dir, strings.TrimSuffix(name, ".idx"))
+		if _, err := os.Stat(base + ".keep"); err != nil && !used[id] {
+			expired = append(expired, base)
+			continue
+		}
+		pack, err := readPackIndex(base+".idx", repo.format)
+		if err != nil {
+			return err
+		}
+		keep = append(keep, pack)
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	// the midx goes first so it never names a pack that's gone
+	if err := repo.writeMidx(append(keep, midx.others...), ""); err != nil {
+		return err
+	}
+	repo.forgetPacks()
+	for _, base := range expired {
+		files, _ := filepath.Glob(base + ".*")
+		sort.Slice(files, func(i, j int) bool { return strings.HasSuffix(files[i], ".idx") })
+		for _, file := range files {
+			if err := os.Remove(file); err != nil {
+				return fmt.Errorf("Couldn't remove expired pack: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// repackMidx puts the objects the midx takes from a batch of packs into a new pack
+// oldest packs first, skipping ones that are bigger than batchSize on their own,
+// until the batch adds up to batchSize. 0 puts every pack in the batch
+// the packs stay around for expire to remove since the midx no longer uses them
+func (repo *Repository) repackMidx(batchSize int64) error {
+	midx, err := repo.loadMidx()
+	if err != nil {
+		return err
+	}
+	if len(midx.packs) == 0 {
+		return nil
+	}
+
+	type candidate struct {
+		id    int
+		mtime int64
+		size  int64
+	}
+	objects := make([]int64, len(midx.packs))
+	for i := 0; i < midx.count(); i++ {
+		pack, _ := midx.entry(i)
+		objects[pack]++
+	}
+	var candidates []candidate
+	for id, name := range midx.packs {
+		base := filepath.Join(filepath.Dir(midx.path), strings.TrimSuffix(name, ".idx"))
+		info, err := os.Stat(base + ".pack")
+		if err != nil {
+			return err
+		}
+		_, keepErr := os.Stat(base + ".keep")
+		_, promisorErr := os.Stat(base + ".promisor")
+		if keepErr == nil || promisorErr == nil {
+			continue
+		}
+		pack, err := readPackIndex(base+".idx", repo.format)
+		if err != nil {
+			return err
+		}
+		// only the part of the pack the midx still uses will be copied
+		size := info.Size()
+		if pack.count() > 0 {
+			size = size * objects[id] / int64(pack.count())
+		}
+		candidates = append(candidates, candidate{id, info.ModTime().UnixNano(), size})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].mtime < candidates[j].mtime })
+
+	batch := make(map[int]bool)
+	if batchSize == 0 {
+		for _, c := range candidates {
+			batch[c.id] = true
+		}
+	} else {
+		var total int64
+		for _, c := range candidates {
+			if total >= batchSize {
+				break
+			}
+			if c.size >= batchSize {
+				continue
+			}
+			batch[c.id] = true
+			total += c.size
+		}
+		if total < batchSize {
+			return nil
+		}
+	}
+	if len(batch) < 2 {
+		return nil
+	}
+
+	var shas []string
+	for i := 0; i < midx.count(); i++ {
+		if pack, _ := midx.entry(i); batch[pack] {
+			shas = append(shas, hex.EncodeToString(midx.shaAt(i)))
+		}
+	}
+	if _, err := repo.writeRepack(shas); err != nil {
+		return err
+	}
+
+	repo.forgetPacks()
+	packs, err := repo.loadPacks()
+	if err != nil {
+		return err
+	}
+	return repo.writeMidx(packs, "")
+}
@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMidxWriteVerifyRepackAndExpire(t *testing.T) {
+	src := newTestRepo(t, true)
+	first := commitTestFiles(t, src, map[string]string{"shared": "in both packs\n", "first": "1\n"})
+	second := commitTestFiles(t, src, map[string]string{"shared": "in both packs\n", "second": "2\n"}, first)
+	shared, err := src.WriteObject("blob", []byte("in both packs\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := newTestRepo(t, true)
+	packTestObjects(t, repo, src, objectsOf(t, src, first))
+	packTestObjects(t, repo, src, []string{second, shared})
+	if err := repo.writeRef("refs/heads/main", second); err != nil {
+		t.Fatal(err)
+	}
+	packs, err := repo.loadPacks()
+	if err != nil || len(packs) != 2 {
+		t.Fatalf("want 2 packs, got %d: %v", len(packs), err)
+	}
+	// the blob is in both, and the preferred pack gets to keep it
+	preferred := packs[0]
+	if preferred.count() != 2 {
+		preferred = packs[1]
+	}
+
+	if err := repo.writeMidx(packs, midxPackName(preferred)); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.verifyMidx(); err != nil {
+		t.Fatal(err)
+	}
+	midx, err := repo.loadMidx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(midx.packs) != 2 || len(midx.others) != 0 {
+		t.Fatalf("midx covers %d packs and leaves %d, want 2 and 0", len(midx.packs), len(midx.others))
+	}
+	raw, _ := hex.DecodeString(shared)
+	if pack, _ := midx.entry(midx.find(raw)); midx.packs[pack] != midxPackName(preferred) {
+		t.Errorf("shared blob comes from %s, want the preferred %s", midx.packs[pack], midxPackName(preferred))
+	}
+	objects := append(objectsOf(t, src, first), second)
+	for _, sha := range objects {
+		raw, _ := hex.DecodeString(sha)
+		if midx.find(raw) == -1 {
+			t.Errorf("%s isn't in the midx", sha)
+		}
+	}
+
+	// everything goes into one new pack and the old ones aren't used anymore
+	if err := repo.repackMidx(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.expireMidx(); err != nil {
+		t.Fatal(err)
+	}
+	for _, pack := range packs {
+		if _, err := os.Stat(pack.path); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't expired: %v", filepath.Base(pack.path), err)
+		}
+	}
+	if err := repo.verifyMidx(); err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := Open(repo.gitDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sha := range objects {
+		if _, _, err := fresh.readObject(sha); err != nil {
+			t.Errorf("%s after expiring: %v", sha, err)
+		}
+	}
+
+	// a flipped byte is caught by the checksum
+	path := repo.makePath("objects", "pack", "multi-pack-index")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.verifyMidx(); err == nil {
+		t.Error("verify passed a multi-pack-index with a bad checksum")
+	}
+}
@@ -0,0 +1,154 @@
+package repository
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/joeldotdias/twine/pkg/iniparse"
+)
+
+/*
+ * a repository's objects are all named with one hash function, sha1 or sha256
+ * which extensions.objectFormat picks once the repository is created
+ * every sha in objects, trees, the index, packs and their indexes is as long as that hash
+ *
+ * the commit-graph, multi-pack-index and pack bitmaps say which one they were written with
+ * using 1 for sha1 and 2 for sha256
+ */
+
+type objectFormat struct {
+	name string
+	// length of a raw sha, twice that in hex
+	size int
+	// what files that record their hash call it
+	id      byte
+	newHash func() hash.Hash
+}
+
+var (
+	formatSHA1   = &objectFormat{name: "sha1", size: sha1.Size, id: 1, newHash: sha1.New}
+	formatSHA256 = &objectFormat{name: "sha256", size: sha256.Size, id: 2, newHash: sha256.New}
+)
+
+func objectFormatNamed(name string) (*objectFormat, error) {
+	switch strings.ToLower(name) {
+	case "sha1":
+		return formatSHA1, nil
+	case "sha256":
+		return formatSHA256, nil
+	default:
+		return nil, fmt.Errorf("unknown object format '%s'", name)
+	}
+}
+
+// formatFromConfig is the object format a repository was created with
+// extensions are only looked at from repositoryformatversion 1 on
+func formatFromConfig(conf *Config) (*objectFormat, error) {
+	version, err := conf.Int("core.repositoryformatversion", 0)
+	if err != nil {
+		return nil, fmt.Errorf("fatal: %s", err)
+	}
+	if version < 1 {
+		return formatSHA1, nil
+	}
+	format, err := objectFormatNamed(conf.Value("extensions.objectFormat", "sha1"))
+	if err != nil {
+		return nil, fmt.Errorf("fatal: %s", err)
+	}
+	return format, nil
+}
+
+func (format *objectFormat) hexSize() int {
+	return format.size * 2
+}
+
+func (format *objectFormat) sum(data []byte) []byte {
+	h := format.newHash()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// zero is the sha that stands for no object at all
+func (format *objectFormat) zero() string {
+	return strings.Repeat("0", format.hexSize())
+}
+
+// check makes sure sha is a full hex sha of this format
+func (format *objectFormat) check(sha string) error {
+	if len(sha) != format.hexSize() {
+		return fmt.Errorf("invalid object name %s", sha)
+	}
+	return validSha(sha)
+}
+
+// isZeroSha says if sha is the sha of no object in either format
+func isZeroSha(sha string) bool {
+	return validSha(sha) == nil && strings.Trim(sha, "0") == ""
+}
+
+// checkClientFormat makes sure a client names objects the way this repository does
+// a client that doesn't say is using sha1
+func (repo *Repository) checkClientFormat(caps capabilities) error {
+	name := formatSHA1.name
+	if caps.has("object-format") {
+		name = caps["object-format"]
+	}
+	if name != repo.format.name {
+		return fmt.Errorf("fatal: mismatched object format: client uses %s but this repository uses %s", name, repo.format.name)
+	}
+	return nil
+}
+
+// objectFormat is what the remote names objects with, sha1 if it doesn't say
+func (conn *remoteConn) objectFormat() (*objectFormat, error) {
+	if !conn.caps.has("object-format") {
+		return formatSHA1, nil
+	}
+	format, err := objectFormatNamed(conn.caps["object-format"])
+	if err != nil {
+		return nil, fmt.Errorf("fatal: remote uses an %s", err)
+	}
+	return format, nil
+}
+
+// checkFormat makes sure the remote names objects the way repo does
+// since nothing that comes from it could be stored otherwise
+func (conn *remoteConn) checkFormat(repo *Repository) error {
+	format, err := conn.objectFormat()
+	if err != nil {
+		return err
+	}
+	if format != repo.format {
+		return fmt.Errorf("fatal: mismatched object format: remote uses %s but this repository uses %s", format.name, repo.format.name)
+	}
+	return nil
+}
+
+// setObjectFormat switches a repository that's still empty over to format
+// which is how a clone takes on the format of where it's cloned from
+func (repo *Repository) setObjectFormat(format *objectFormat) error {
+	if format == repo.format {
+		return nil
+	}
+	path := repo.makePath("config")
+	doc, err := iniparse.ReadDocument(path)
+	if err != nil {
+		return err
+	}
+	if err := doc.Set("core", "", "repositoryformatversion", "1", nil); err != nil {
+		return err
+	}
+	if err := doc.Set("extensions", "", "objectformat", format.name, nil); err != nil {
+		return err
+	}
+	if err := doc.Write(path); err != nil {
+		return err
+	}
+	repo.conf = loadConfig(repo.gitDir)
+	repo.format = format
+	repo.index = emptyIndex(format)
+	return nil
+}
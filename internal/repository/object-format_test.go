@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestSha256ObjectsAndIndexRoundTrip(t *testing.T) {
+	repo := newTestRepoFormat(t, false, "sha256")
+	if repo.format != formatSHA256 {
+		t.Fatalf("repository is %s", repo.format.name)
+	}
+
+	// as git --object-format=sha256 names them
+	blob, err := repo.WriteObject("blob", []byte("hello\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2cf8d83d9ee29543b34a87727421fdecb7e3f3a183d337639025de576db9ebb4"; blob != want {
+		t.Errorf("blob is %s, want %s", blob, want)
+	}
+	commit := commitTestFiles(t, repo, map[string]string{"hello": "hello\n", "dir/nested": "nested\n"})
+	tree := writeTestTree(t, repo, map[string]string{"hello": "hello\n"})
+	if want := "ab39bc840914e6c219053910a617f89e6e0b561cfab5953c79f014c4302f8a01"; tree != want {
+		t.Errorf("tree is %s, want %s", tree, want)
+	}
+
+	objects := objectsOf(t, repo, commit)
+	for _, sha := range objects {
+		kind, contents, err := repo.readObject(sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := objectSha(repo.format, kind, contents); got != sha {
+			t.Errorf("%s %s reads back as %s", kind, sha, got)
+		}
+	}
+
+	// through a pack into another sha256 repository
+	other := newTestRepoFormat(t, true, "sha256")
+	packTestObjects(t, other, repo, objects)
+	for _, sha := range objects {
+		_, want, _ := repo.readObject(sha)
+		if _, got, err := other.readObject(sha); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s from the pack: %v", sha, err)
+		}
+	}
+
+	if err := repo.checkoutCommit(commit); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(repo.worktree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reopened.IndexEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"hello": blob}
+	want["dir/nested"], _ = repo.WriteObject("blob", []byte("nested\n"))
+	if len(entries) != len(want) {
+		t.Fatalf("index has %d entries, want %d", len(entries), len(want))
+	}
+	for _, entry := range entries {
+		if got := hex.EncodeToString(entry.sha); got != want[entry.path] {
+			t.Errorf("index has %s at %s, want %s", got, entry.path, want[entry.path])
+		}
+	}
+
+	index, err := reopened.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := index.serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reparsed, err := parseIndex(data, repo.format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := reparsed.serialize()
+	if err != nil || !bytes.Equal(again, data) {
+		t.Errorf("index changed going through parse and serialize: %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+ * blobs can be far bigger than what's sensible to hold in memory
+ * so anything that only passes an object along reads it through openObject
+ * which inflates it a bit at a time instead of all at once
+ *
+ * blobs are written the same way, whatever their size
+ * hashed while they're compressed into objects/tmp_obj_*
+ * which is renamed into place once the sha is known
+ * that goes for hash-object and for blobs that come in a pack stream
+ * a repository that isn't on disk gets them whole in memory all the same
+ *
+ * core.bigFileThreshold (512m unless set) is only about deltas
+ * nothing twine writes is deltified, so blobs are always stored whole
+ * and one over it isn't held on to as a delta base while a pack comes in
+ *
+ * deltified objects are still put together in memory
+ * since applying a delta needs the whole base
+ */
+
+const defaultBigFileThreshold = 512 << 20
+
+func (repo *Repository) bigFileThreshold() (int64, error) {
+	return repo.conf.Int("core.bigFileThreshold", defaultBigFileThreshold)
+}
+
+// objectReader hands out an object's contents and closes whatever they come from
+type objectReader struct {
+	r       io.Reader
+	closers []io.Closer
+	// counts what's been inflated
+	inflated *atomic.Int64
+}
+
+func (or *objectReader) Read(p []byte) (int, error) {
+	n, err := or.r.Read(p)
+	or.inflated.Add(int64(n))
+	return n, err
+}
+
+func (or *objectReader) Close() error {
+	var err error
+	for i := len(or.closers) - 1; i >= 0; i-- {
+		if closeErr := or.closers[i].Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// openObject gives the kind and size of an object along with a reader for its contents
+// loose objects and whole objects in packs are inflated as they're read
+func (repo *Repository) openObject(sha string) (string, int64, io.ReadCloser, error) {
+	objKind, size, r, err := repo.openObjectHere(sha)
+	if errors.Is(err, os.ErrNotExist) && repo.promisorRemote() != "" {
+		if fetchErr := repo.fetchPromised([]string{sha}); fetchErr != nil {
+			return "", 0, nil, fetchErr
+		}
+		objKind, size, r, err = repo.openObjectHere(sha)
+	}
+	return objKind, size, r, err
+}
+
+func (repo *Repository) openObjectHere(sha string) (string, int64, io.ReadCloser, error) {
+	if len(sha) < 2 {
+		return "", 0, nil, fmt.Errorf("Invalid object name %s", sha)
+	}
+	if objKind, contents, ok := repo.odb.cached(sha); ok {
+		return objKind, int64(len(contents)), io.NopCloser(bytes.NewReader(contents)), nil
+	}
+	if opener, ok := repo.objects.(objectOpener); ok {
+		return opener.OpenObject(sha)
+	}
+
+	objKind, contents, err := repo.readObject(sha)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return objKind, int64(len(contents)), io.NopCloser(bytes.NewReader(contents)), nil
+}
+
+// openObjectFile opens a loose object or failing that a packed one
+func (repo *Repository) openObjectFile(sha string) (string, int64, io.ReadCloser, error) {
+	objKind, size, r, err := repo.openLooseObject(repo.makePath("objects", sha[:2], sha[2:]))
+	if os.IsNotExist(err) {
+		return repo.openPacked(sha)
+	}
+	return objKind, size, r, err
+}
+
+// openLooseObject opens the loose object at path
+func (repo *Repository) openLooseObject(path string) (string, int64, io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	zr, err := zlib.NewReader(file)
+	if err != nil {
+		file.Close()
+		return "", 0, nil, err
+	}
+	r := bufio.NewReader(zr)
+
+	// the header is short, so there's no reading far for a null byte that isn't there
+	var header []byte
+	for len(header) < 32 {
+		b, err := r.ReadByte()
+		if err != nil {
+			zr.Close()
+			file.Close()
+			return "", 0, nil, fmt.Errorf("Couldn't read compressed data: %s", err)
+		}
+		if b == 0 {
+			break
+		}
+		header = append(header, b)
+	}
+	objKind, sizeStr, _ := strings.Cut(string(header), " ")
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil || len(header) == 32 {
+		zr.Close()
+		file.Close()
+		return "", 0, nil, fmt.Errorf("Malformed object: bad header")
+	}
+
+	return objKind, size, &objectReader{io.LimitReader(r, size), []io.Closer{file, zr}, &repo.odb.inflated}, nil
+}
+
+// openPacked opens an object in a pack
+// only deltas are read in full, the rest are inflated as they're read
+func (repo *Repository) openPacked(sha string) (string, int64, io.ReadCloser, error) {
+	raw, err := hex.DecodeString(sha)
+	if err != nil || len(raw) != repo.format.size {
+		return "", 0, nil, fmt.Errorf("Invalid object name %s", sha)
+	}
+	path, offset, err := repo.findPacked(raw)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("Didn't find object %s: %w", sha, err)
+	}
+
+	pack, err := repo.odb.packFile(path)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	r := bufio.NewReader(io.NewSectionReader(pack.file, int64(offset), 1<<62))
+	objType, size, err := readPackObjectHeader(r)
+	if err != nil {
+		pack.Close()
+		return "", 0, nil, err
+	}
+
+	switch objType {
+	case packObjCommit, packObjTree, packObjBlob, packObjTag:
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			pack.Close()
+			return "", 0, nil, err
+		}
+		// the pack is held open till the reader is closed
+		return packKinds[objType], int64(size), &objectReader{io.LimitReader(zr, int64(size)), []io.Closer{pack, zr}, &repo.odb.inflated}, nil
+	default:
+		objKind, contents, err := repo.readPackEntry(pack.file, offset)
+		pack.Close()
+		if err != nil {
+			return "", 0, nil, err
+		}
+		return objKind, int64(len(contents)), io.NopCloser(bytes.NewReader(contents)), nil
+	}
+}
+
+// writeObjectStream hashes size bytes from r as an object
+// storing it as a loose object as it goes if write is set
+func (repo *Repository) writeObjectStream(objKind string, r io.Reader, size int64, write bool) (string, error) {
+	sum := repo.format.newHash()
+	header := fmt.Sprintf("%s %d\x00", objKind, size)
+	sum.Write([]byte(header))
+
+	if !write {
+		n, err := io.Copy(sum, r)
+		if err != nil {
+			return "", fmt.Errorf("Couldn't read object: %w", err)
+		}
+		if n != size {
+			return "", fmt.Errorf("Expected %d bytes but read %d", size, n)
+		}
+		return hex.EncodeToString(sum.Sum(nil)), nil
+	}
+	// a store that isn't on disk only takes objects whole
+	dir, ok := repo.looseDir()
+	if !ok {
+		contents, err := io.ReadAll(io.LimitReader(r, size+1))
+		if err != nil {
+			return "", fmt.Errorf("Couldn't read object: %w", err)
+		}
+		if int64(len(contents)) != size {
+			return "", fmt.Errorf("Expected %d bytes but read %d", size, len(contents))
+		}
+		return repo.writeRawObject(objKind, contents, true)
+	}
+
+	tmp, err := os.CreateTemp(dir, "tmp_obj_")
+	if err != nil {
+		return "", fmt.Errorf("Couldn't create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	zw := zlib.NewWriter(tmp)
+	if _, err := zw.Write([]byte(header)); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("Couldn't write compressed data: %w", err)
+	}
+	n, err := io.Copy(io.MultiWriter(sum, zw), r)
+	if err == nil && n != size {
+		err = fmt.Errorf("Expected %d bytes but read %d", size, n)
+	}
+	if err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("Couldn't write compressed data: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("Couldn't close zlib writer: %w", err)
+	}
+
+	sha := hex.EncodeToString(sum.Sum(nil))
+	path := filepath.Join(dir, sha[:2], sha[2:])
+	if _, err := os.Stat(path); err == nil {
+		same, err := repo.checkExistingFrom(path, sha, tmp.Name())
+		if err != nil || same {
+			tmp.Close()
+			return sha, err
+		}
+	}
+	return sha, repo.finishObject(tmp, path)
+}
+
+// checkExistingFrom is checkExisting for an object that's only in the loose object file at tmp
+func (repo *Repository) checkExistingFrom(path, sha, tmp string) (bool, error) {
+	file, err := os.Open(tmp)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	zr, err := zlib.NewReader(file)
+	if err != nil {
+		return false, err
+	}
+	defer zr.Close()
+	return repo.checkExisting(path, sha, zr)
+}
+
+// inflateObject streams an object out of a zlib stream into writeObjectStream
+// reading the stream to its end so a pack lands on the next object
+// the contents are copied to tee as well when it isn't nil
+func (repo *Repository) inflateObject(r io.Reader, objKind string, size uint64, write bool, tee io.Writer) (string, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+
+	contents := io.LimitReader(zr, int64(size))
+	if tee != nil {
+		contents = io.TeeReader(contents, tee)
+	}
+	sha, err := repo.writeObjectStream(objKind, contents, int64(size), write)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't inflate pack object: %w", err)
+	}
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return "", fmt.Errorf("Couldn't inflate pack object: %w", err)
+	}
+	return sha, nil
+}
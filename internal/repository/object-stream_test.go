@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// deltaPack is a pack holding base as a whole blob and target as a ref delta against it
+func deltaPack(t *testing.T, repo *Repository, base, target []byte) []byte {
+	t.Helper()
+	var pack bytes.Buffer
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], 2)
+	pack.Write(header)
+
+	compressed := func(data []byte) {
+		zw := zlib.NewWriter(&pack)
+		zw.Write(data)
+		zw.Close()
+	}
+	pack.Write(packObjectHeader(packObjBlob, len(base)))
+	compressed(base)
+
+	// copy all of base, then insert whatever target has past it
+	var delta []byte
+	delta = binary.AppendUvarint(delta, uint64(len(base)))
+	delta = binary.AppendUvarint(delta, uint64(len(target)))
+	delta = append(delta, 0x80|0x10|0x20, byte(len(base)), byte(len(base)>>8))
+	rest := target[len(base):]
+	delta = append(delta, byte(len(rest)))
+	delta = append(delta, rest...)
+	pack.Write(packObjectHeader(packObjRefDelta, len(delta)))
+	raw, _ := hex.DecodeString(objectSha(repo.format, "blob", base))
+	pack.Write(raw)
+	compressed(delta)
+
+	pack.Write(repo.format.sum(pack.Bytes()))
+	return pack.Bytes()
+}
+
+func TestPackStreamResolvesDeltasAgainstStreamedBlobs(t *testing.T) {
+	base := bytes.Repeat([]byte("streamed blob\n"), 300)
+	target := append(bytes.Clone(base), "and a bit more\n"...)
+
+	for _, threshold := range []string{"", "1k"} {
+		for _, keep := range []bool{false, true} {
+			repo := newTestRepo(t, true)
+			if threshold != "" {
+				repo.conf.set("core.bigFileThreshold", threshold, ScopeLocal, "test")
+			}
+			pack := bytes.NewReader(deltaPack(t, repo, base, target))
+			var shas []string
+			var err error
+			if keep {
+				shas, err = repo.keepPack(pack, false)
+			} else {
+				shas, err = repo.unpackObjects(pack)
+			}
+			if err != nil {
+				t.Fatalf("threshold %q, keep %v: %v", threshold, keep, err)
+			}
+			want := []string{objectSha(repo.format, "blob", base), objectSha(repo.format, "blob", target)}
+			if strings.Join(shas, " ") != strings.Join(want, " ") {
+				t.Fatalf("threshold %q, keep %v: got %v, want %v", threshold, keep, shas, want)
+			}
+			for i, contents := range [][]byte{base, target} {
+				if _, data, err := repo.readObject(want[i]); err != nil || !bytes.Equal(data, contents) {
+					t.Errorf("threshold %q, keep %v: %s reads back wrong: %v", threshold, keep, want[i], err)
+				}
+			}
+		}
+	}
+}
@@ -3,12 +3,14 @@ package repository
 import (
 	"bytes"
 	"compress/zlib"
-	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/joeldotdias/twine/internal/helpers"
 )
@@ -25,31 +27,104 @@ import (
 type Object interface {
 	Kind() string
 	Serialize() []byte
-	Deserialize(raw []byte)
+	Deserialize(raw []byte) error
 }
 
 func (repo *Repository) makeObject(sha string) (Object, error) {
-	path := repo.makePath("objects", sha[:2], sha[2:])
+	objKind, contents, err := repo.readObject(sha)
+	if errors.Is(err, os.ErrNotExist) && repo.promisorRemote() != "" {
+		// a partial clone left it out for the remote to hand over when needed
+		if fetchErr := repo.fetchPromised([]string{sha}); fetchErr != nil {
+			return nil, fetchErr
+		}
+		objKind, contents, err = repo.readObject(sha)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := newObject(objKind, repo.format)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := obj.Deserialize(contents); err != nil {
+		return nil, fmt.Errorf("Malformed %s %s: %w", objKind, sha, err)
+	}
+	return obj, nil
+}
+
+func newObject(objKind string, format *objectFormat) (Object, error) {
+	switch objKind {
+	case "commit":
+		return &Commit{metaKV: make(map[CommitField][]string)}, nil
+	case "tree":
+		return &Tree{leaves: []*TreeLeaf{}, hashSize: format.size}, nil
+	case "blob":
+		return &Blob{}, nil
+	case "tag":
+		return &Tag{metaKV: make(map[TagField][]string)}, nil
+	default:
+		return nil, fmt.Errorf("Unknown object type: %s", objKind)
+	}
+}
+
+// readObject gives the kind and raw contents of an object
+// looking in the cache first, then at loose objects and then at packs
+// the contents may be shared with other readers and mustn't be changed
+func (repo *Repository) readObject(sha string) (string, []byte, error) {
+	if len(sha) < 2 {
+		return "", nil, fmt.Errorf("Invalid object name %s", sha)
+	}
+	if objKind, contents, ok := repo.odb.cached(sha); ok {
+		return objKind, contents, nil
+	}
+
+	objKind, contents, err := repo.objects.ReadObject(sha)
+	if err == nil {
+		repo.odb.cache.add(sha, objKind, contents)
+	}
+	return objKind, contents, err
+}
+
+func (repo *Repository) readObjectFile(sha string) (string, []byte, error) {
+	objKind, contents, err := repo.readLooseObject(repo.makePath("objects", sha[:2], sha[2:]))
+	if err == nil || !os.IsNotExist(err) {
+		return objKind, contents, err
+	}
+	objKind, contents, packErr := repo.readPacked(sha)
+	if packErr == nil {
+		return objKind, contents, nil
+	}
+	if !os.IsNotExist(packErr) {
+		return "", nil, packErr
+	}
+	return "", nil, fmt.Errorf("Didn't find file with sha %s: %w", sha, err)
+}
+
+// readLooseObject reads the loose object at path
+func (repo *Repository) readLooseObject(path string) (string, []byte, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("Didn't find file with sha %s: %s", sha, err)
+		return "", nil, err
 	}
 	defer file.Close()
 
 	zr, err := zlib.NewReader(file)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 	defer zr.Close()
 
 	data, err := io.ReadAll(zr)
+	repo.odb.inflated.Add(int64(len(data)))
 	if err != nil {
-		return nil, fmt.Errorf("Couldn't read compressed data: %s", err)
+		return "", nil, fmt.Errorf("Couldn't read compressed data: %s", err)
 	}
 
 	nullByte := bytes.IndexByte(data, 0)
 	if nullByte == -1 {
-		return nil, fmt.Errorf("Malformed object: Didn't find null byte")
+		return "", nil, fmt.Errorf("Malformed object: Didn't find null byte")
 	}
 
 	header := string(data[:nullByte])
@@ -59,61 +134,154 @@ func (repo *Repository) makeObject(sha string) (Object, error) {
 	var size int
 	_, err = fmt.Sscanf(header, "%s %d", &objKind, &size)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
-	var obj Object
-	switch objKind {
-	case "commit":
-		obj = &Commit{metaKV: make(map[CommitField][]string)}
-	case "tree":
-		obj = &Tree{leaves: []*TreeLeaf{}}
-	case "blob":
-		obj = &Blob{}
-	case "tag":
-		obj = &Tag{metaKV: make(map[TagField][]string)}
-	default:
-		return nil, fmt.Errorf("Unknown object type: %s", objKind)
-	}
+	return objKind, contents, nil
+}
 
-	obj.Deserialize(contents)
-	return obj, nil
+// hasObject says if an object is here without reading it
+func (repo *Repository) hasObject(sha string) bool {
+	return len(sha) >= 2 && repo.objects.HasObject(sha)
+}
+
+// hasObjectFile says if an object is loose or packed
+func (repo *Repository) hasObjectFile(sha string) bool {
+	if _, err := os.Stat(repo.makePath("objects", sha[:2], sha[2:])); err == nil {
+		return true
+	}
+	raw, err := hex.DecodeString(sha)
+	if err != nil || len(raw) != repo.format.size {
+		return false
+	}
+	_, _, err = repo.findPacked(raw)
+	return err == nil
 }
 
 func (repo *Repository) writeObject(obj Object, write bool) (string, error) {
-	raw := obj.Serialize()
+	return repo.writeRawObject(obj.Kind(), obj.Serialize(), write)
+}
+
+// writeRawObject stores contents exactly as given
+// which is what copying objects between repositories needs
+func (repo *Repository) writeRawObject(objKind string, raw []byte, write bool) (string, error) {
+	sum := repo.format.newHash()
+	fmt.Fprintf(sum, "%s %d\x00", objKind, len(raw))
+	sum.Write(raw)
+	sha := hex.EncodeToString(sum.Sum(nil))
+	if !write {
+		return sha, nil
+	}
+	return sha, repo.objects.WriteObject(sha, objKind, raw)
+}
+
+// writeObjectFile stores an object as a loose object, unless it's there already
+func (repo *Repository) writeObjectFile(sha, objKind string, raw []byte) error {
+	return repo.writeLooseObject(repo.makePath("objects", sha[:2], sha[2:]), sha, objKind, raw)
+}
 
-	header := fmt.Sprintf("%s %d\x00", obj.Kind(), len(raw))
+// writeLooseObject writes an object out loose at path
+func (repo *Repository) writeLooseObject(path, sha, objKind string, raw []byte) error {
+	header := fmt.Sprintf("%s %d\x00", objKind, len(raw))
 	data := append([]byte(header), raw...)
-	hash := sha1.Sum(data)
-	sha := hex.EncodeToString(hash[:])
-
-	if write {
-		path := repo.makePath("objects", sha[:2], sha[2:])
-		dir := filepath.Dir(path)
-		if err := os.MkdirAll(dir, 0o755); err != nil {
-			return "", fmt.Errorf("Couldn't create directories: %w", err)
-		}
 
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			file, err := os.Create(path)
-			if err != nil {
-				return "", fmt.Errorf("Couldn't create file: %w", err)
-			}
-			defer file.Close()
-
-			zw := zlib.NewWriter(file)
-			if _, err = zw.Write(data); err != nil {
-				return "", fmt.Errorf("Couldn't write compressed data: %w", err)
-			}
-
-			if err = zw.Close(); err != nil {
-				return "", fmt.Errorf("Couldn't close zlib writer: %w", err)
-			}
+	if _, err := os.Stat(path); err == nil {
+		same, err := repo.checkExisting(path, sha, bytes.NewReader(data))
+		if err != nil || same {
+			return err
 		}
 	}
 
-	return sha, nil
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("Couldn't create directories: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, "tmp_obj_")
+	if err != nil {
+		return fmt.Errorf("Couldn't create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	zw := zlib.NewWriter(tmp)
+	if _, err = zw.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Couldn't write compressed data: %w", err)
+	}
+	if err = zw.Close(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Couldn't close zlib writer: %w", err)
+	}
+
+	return repo.finishObject(tmp, path)
+}
+
+// finishObject renames a loose object written to tmp into place at path
+// an object is never written where it goes, so one that's there is always whole
+func (repo *Repository) finishObject(tmp *os.File, path string) error {
+	if err := repo.syncFile(tmp, fsyncLooseObject); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o444); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("Couldn't create directories: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Couldn't store object: %w", err)
+	}
+	return nil
+}
+
+// checkExisting compares the loose object at path with what r has for it, header and all
+// true means it's the same object, so there's nothing to write
+// false means it doesn't hash to sha, which happens when whatever wrote it was cut short
+// and it should be replaced
+// the same sha with other contents is a collision, which is an error
+func (repo *Repository) checkExisting(path, sha string, r io.Reader) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, nil
+	}
+	defer file.Close()
+	zr, err := zlib.NewReader(file)
+	if err != nil {
+		return false, nil
+	}
+	defer zr.Close()
+
+	sum := repo.format.newHash()
+	same := true
+	existing := make([]byte, 32*1024)
+	incoming := make([]byte, 32*1024)
+	for {
+		n, readErr := io.ReadFull(zr, existing)
+		sum.Write(existing[:n])
+		if same {
+			m, _ := io.ReadFull(r, incoming[:n])
+			same = m == n && bytes.Equal(existing[:n], incoming[:n])
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return false, nil
+		}
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != sha {
+		return false, nil
+	}
+	if extra, _ := r.Read(incoming[:1]); extra > 0 {
+		same = false
+	}
+	if !same {
+		return false, fmt.Errorf("fatal: %s collision found with %s", repo.format.name, sha)
+	}
+	return true, nil
 }
 
 func (repo *Repository) makeObjectHash(file io.Reader, objKind string, write bool) (string, error) {
@@ -129,14 +297,20 @@ func (repo *Repository) makeObjectHash(file io.Reader, objKind string, write boo
 			contents,
 		}
 	case "tree":
+		leaves, err := treeParseEntirety(contents, repo.format.size)
+		if err != nil {
+			return "", err
+		}
 		obj = &Tree{
-			leaves: treeParseEntirety(contents),
+			leaves: leaves,
 		}
 	case "commit":
 		commit := &Commit{
 			metaKV: make(map[CommitField][]string),
 		}
-		commit.Deserialize(contents)
+		if err := commit.Deserialize(contents); err != nil {
+			return "", err
+		}
 		obj = commit
 	default:
 		return "", fmt.Errorf("Unexpected object type: %s", err)
@@ -147,43 +321,53 @@ func (repo *Repository) makeObjectHash(file io.Reader, objKind string, write boo
 
 func (repo *Repository) findObject(ref string) (string, error) {
 	// full SHA-1 hash
-	if len(ref) == 40 && helpers.IsHex(ref) {
+	if len(ref) == repo.format.hexSize() && helpers.IsHex(ref) {
 		return ref, nil
 	}
 
-	// ref to HEAD
-	if ref == "HEAD" {
-		headPath := repo.makePath("refs", "heads", repo.conf.defaultBranch)
-		contents, err := os.ReadFile(headPath)
-		if err != nil {
-			return "", fmt.Errorf("Didn't find reference to head: %s", err)
-		}
-		return string(contents[:len(contents)-1]), nil
+	// HEAD, branches, tags and remote refs
+	if sha, err := repo.resolveRef(ref); err == nil {
+		return sha, nil
 	}
 
-	// any other ref
-	path := repo.makePath("refs", ref)
-	if _, err := os.Stat(path); err == nil {
-		contents, err := os.ReadFile(path)
-		if err != nil {
-			return "", fmt.Errorf("Couldn't read ref file: %s", err)
-		}
-		return string(contents[:len(contents)-1]), nil
+	// partial object hashes
+	if len(ref) < 4 || !helpers.IsHex(ref+strings.Repeat("0", len(ref)%2)) {
+		return "", fmt.Errorf("Didn't find object: %s", ref)
 	}
 
-	// partial object hashes
+	matches, err := repo.objects.ObjectsWithPrefix(ref)
+	if err != nil {
+		return "", err
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("Didn't find object: %s", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("Found multiple objects with prefix: %s. Be more specific", ref)
+	}
+}
+
+// objectFilesWithPrefix lists loose and packed objects whose sha starts with ref
+func (repo *Repository) objectFilesWithPrefix(ref string) ([]string, error) {
+	var matches []string
 	prefix := ref[:2]
-	path = repo.makePath("objects", prefix)
-	if matches, err := filepath.Glob(filepath.Join(path, ref[2:]+"*")); err == nil && len(matches) > 0 {
-		if len(matches) > 1 {
-			return "", fmt.Errorf("Found multiple objects with prefix: %s. Be more specific", ref)
+	path := repo.makePath("objects", prefix)
+	if loose, err := filepath.Glob(filepath.Join(path, ref[2:]+"*")); err == nil {
+		for _, match := range loose {
+			matches = append(matches, prefix+filepath.Base(match))
 		}
-
-		// fmt.Println(matches[0], filepath.Base(matches[0]))
-
-		// return prefix + filepath.Base(prefix+matches[0]), nil
-		return prefix + filepath.Base(matches[0]), nil
 	}
-
-	return "", fmt.Errorf("Didn't find object: %s", ref)
+	midx, err := repo.loadMidx()
+	if err != nil {
+		return nil, err
+	}
+	matches = append(matches, midx.withPrefix(ref)...)
+	for _, pack := range midx.others {
+		matches = append(matches, pack.withPrefix(ref)...)
+	}
+	// an object can be both loose and packed
+	slices.Sort(matches)
+	return slices.Compact(matches), nil
 }
@@ -0,0 +1,223 @@
+package repository
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * the object database is the part of a repository that reads objects
+ * it's safe for any number of goroutines to read through it at once
+ *
+ *   what's loaded from objects/pack on first use is loaded under a lock
+ *   so are .git/shallow, the commit-graph and core.fsync, and whatever drops them takes the same lock
+ *   packs are opened once and read with ReadAt, which doesn't move a shared offset
+ *     a pack stays open till the last read of it is done, even when it's been dropped meanwhile
+ *   objects and delta bases that have been inflated are kept in an LRU cache
+ *     objects by sha and delta bases by pack and offset
+ *     both count against core.deltaBaseCacheLimit (96m unless set)
+ *     anything bigger than the whole limit isn't kept
+ *
+ * what comes out of the cache is shared, so nothing may change it
+ * writing isn't covered, gc and friends still want the repository to themselves
+ */
+
+const defaultObjectCacheLimit = 96 << 20
+
+type objectDatabase struct {
+	// guard repo.packs, repo.midx and repo.bitmap
+	// a bitmap loads packs, so bitmapMu is always taken before packsMu
+	packsMu  sync.Mutex
+	midxMu   sync.Mutex
+	bitmapMu sync.Mutex
+	// guard repo.shallow, repo.graph and repo.fsync
+	// the bitmap and the commit-graph look at the shallow commits, so shallowMu is taken last
+	shallowMu sync.Mutex
+	graphMu   sync.Mutex
+	fsyncMu   sync.Mutex
+	// held while a partial clone fetches objects it left out
+	promisedMu sync.Mutex
+
+	filesMu sync.Mutex
+	files   map[string]*packHandle
+
+	cache *objectCache
+
+	hits     atomic.Int64
+	misses   atomic.Int64
+	inflated atomic.Int64
+}
+
+// ObjectStats is how the object database has done since the repository was opened
+type ObjectStats struct {
+	// reads the cache had an answer for
+	Hits int64
+	// reads that had to go to disk
+	Misses int64
+	// bytes zlib handed back, loose objects, pack entries and deltas alike
+	BytesInflated int64
+	// what's in the cache right now
+	CachedObjects int
+	CachedBytes   int64
+}
+
+func newObjectDatabase(conf *Config) (*objectDatabase, error) {
+	limit, err := conf.Int("core.deltaBaseCacheLimit", defaultObjectCacheLimit)
+	if err != nil {
+		return nil, err
+	}
+	return &objectDatabase{
+		files: make(map[string]*packHandle),
+		cache: newObjectCache(limit),
+	}, nil
+}
+
+// ObjectStats reports the object database's counters
+func (repo *Repository) ObjectStats() ObjectStats {
+	objects, size := repo.odb.cache.usage()
+	return ObjectStats{
+		Hits:          repo.odb.hits.Load(),
+		Misses:        repo.odb.misses.Load(),
+		BytesInflated: repo.odb.inflated.Load(),
+		CachedObjects: objects,
+		CachedBytes:   size,
+	}
+}
+
+// cached looks for something already inflated, counting a hit or a miss
+func (odb *objectDatabase) cached(key string) (string, []byte, bool) {
+	kind, data, ok := odb.cache.get(key)
+	if ok {
+		odb.hits.Add(1)
+	} else {
+		odb.misses.Add(1)
+	}
+	return kind, data, ok
+}
+
+// packHandle is an open pack shared by everyone reading it
+// it's closed once it's been dropped from the database and the last of them is done with it
+type packHandle struct {
+	odb  *objectDatabase
+	file *os.File
+	// readers holding it, plus one while it's in odb.files, guarded by filesMu
+	users int
+}
+
+// Close lets go of a handle packFile gave out
+func (pack *packHandle) Close() error {
+	pack.odb.filesMu.Lock()
+	defer pack.odb.filesMu.Unlock()
+	return pack.release()
+}
+
+func (pack *packHandle) release() error {
+	pack.users--
+	if pack.users == 0 {
+		return pack.file.Close()
+	}
+	return nil
+}
+
+// packFile gives a handle on the pack at path, opening it the first time
+// whoever gets one has to Close it when they're done reading
+func (odb *objectDatabase) packFile(path string) (*packHandle, error) {
+	odb.filesMu.Lock()
+	defer odb.filesMu.Unlock()
+	if pack, ok := odb.files[path]; ok {
+		pack.users++
+		return pack, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't open pack: %w", err)
+	}
+	pack := &packHandle{odb: odb, file: file, users: 2}
+	odb.files[path] = pack
+	return pack, nil
+}
+
+// closePacks drops every open pack, which has to happen before they can be deleted on some systems
+// the ones still being read are closed when their readers are done
+func (odb *objectDatabase) closePacks() {
+	odb.filesMu.Lock()
+	defer odb.filesMu.Unlock()
+	for path, pack := range odb.files {
+		pack.release()
+		delete(odb.files, path)
+	}
+}
+
+// objectCache is an LRU of inflated objects that holds at most limit bytes
+type objectCache struct {
+	mu    sync.Mutex
+	limit int64
+	size  int64
+	// most recently used at the front
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cachedObject struct {
+	key  string
+	kind string
+	data []byte
+}
+
+func newObjectCache(limit int64) *objectCache {
+	return &objectCache{
+		limit:   limit,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (cache *objectCache) get(key string) (string, []byte, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	elem, ok := cache.entries[key]
+	if !ok {
+		return "", nil, false
+	}
+	cache.order.MoveToFront(elem)
+	obj := elem.Value.(*cachedObject)
+	return obj.kind, obj.data, true
+}
+
+func (cache *objectCache) add(key, kind string, data []byte) {
+	size := int64(len(data))
+	if size > cache.limit {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if _, ok := cache.entries[key]; ok {
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(&cachedObject{key, kind, data})
+	cache.size += size
+	for cache.size > cache.limit {
+		oldest := cache.order.Back()
+		obj := cache.order.Remove(oldest).(*cachedObject)
+		delete(cache.entries, obj.key)
+		cache.size -= int64(len(obj.data))
+	}
+}
+
+func (cache *objectCache) usage() (int, int64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return len(cache.entries), cache.size
+}
+
+func (cache *objectCache) clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.order.Init()
+	clear(cache.entries)
+	cache.size = 0
+}
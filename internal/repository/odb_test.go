@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// packTestObjects moves objects from src into a pack of repo's own
+func packTestObjects(t *testing.T, repo, src *Repository, objects []string) {
+	t.Helper()
+	var pack bytes.Buffer
+	if err := src.writePack(&pack, objects); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.keepPack(&pack, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentReadsWhilePacksAndMetadataReload(t *testing.T) {
+	src := newTestRepo(t, true)
+	files := make(map[string]string)
+	for i := range 20 {
+		files[fmt.Sprintf("f%d", i)] = fmt.Sprintf("%d\n", i) + string(bytes.Repeat([]byte{'x'}, 4096))
+	}
+	commit := commitTestFiles(t, src, files)
+	objects := objectsOf(t, src, commit)
+
+	repo := newTestRepo(t, true)
+	// nothing is cached, so every read goes to a pack
+	repo.conf.set("core.deltaBaseCacheLimit", "0", ScopeLocal, "test")
+	odb, err := newObjectDatabase(repo.conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.odb = odb
+	packTestObjects(t, repo, src, objects)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	stop := make(chan struct{})
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				sha := objects[i%len(objects)]
+				if _, _, err := repo.readObject(sha); err != nil {
+					errs <- err
+					return
+				}
+				_, _, r, err := repo.openObject(sha)
+				if err == nil {
+					_, err = io.Copy(io.Discard, r)
+					r.Close()
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				repo.isShallow(sha)
+				repo.loadCommitGraph()
+				repo.fsyncs(fsyncReference)
+			}
+		}()
+	}
+
+	for start := time.Now(); time.Since(start) < 200*time.Millisecond; {
+		repo.forgetPacks()
+		repo.forgetCommitGraph()
+		if err := repo.writeShallow(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestConcurrentLazyFetchesWaitForEachOther(t *testing.T) {
+	server := newTestRepo(t, true)
+	files := make(map[string]string)
+	for i := range 16 {
+		files[fmt.Sprintf("f%d", i)] = fmt.Sprintf("blob %d\n", i)
+	}
+	commit := commitTestFiles(t, server, files)
+	if err := server.writeRef("refs/heads/main", commit); err != nil {
+		t.Fatal(err)
+	}
+	objects := objectsOf(t, server, commit)
+
+	// a partial clone with the commit and its tree but none of the blobs
+	repo := newTestRepo(t, true)
+	repo.conf.set("extensions.partialClone", "origin", ScopeLocal, "test")
+	repo.conf.set("remote.origin.url", server.gitDir, ScopeLocal, "test")
+	repo.conf.set("remote.origin.promisor", "true", ScopeLocal, "test")
+	packTestObjects(t, repo, server, objects[:2])
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(objects))
+	for _, blob := range objects[2:] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := repo.makeObject(blob); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
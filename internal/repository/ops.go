@@ -4,16 +4,42 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/joeldotdias/twine/pkg/iniparse"
 )
 
-func (repo *Repository) init() error {
+func (repo *Repository) init(args []string) error {
+	var formatName string
+	initCmd := flag.NewFlagSet("init", flag.ExitOnError)
+	initCmd.StringVar(&formatName, "object-format", os.Getenv("GIT_DEFAULT_HASH"), "Hash objects are named with, sha1 or sha256")
+	if err := initCmd.Parse(args); err != nil {
+		return err
+	}
+	if formatName != "" {
+		format, err := objectFormatNamed(formatName)
+		if err != nil {
+			return fmt.Errorf("fatal: %s", err)
+		}
+		repo.format = format
+	}
+
+	if err := repo.createLayout(false); err != nil {
+		return err
+	}
+
+	fmt.Println("Initialized Twine repository")
+	return nil
+}
+
+// createLayout lays out an empty .git directory
+func (repo *Repository) createLayout(bare bool) error {
 	dirs := map[string][]string{
 		"objects":  {"info", "pack"},
 		"refs":     {"heads", "tags"},
@@ -40,7 +66,7 @@ func (repo *Repository) init() error {
 	}
 
 	toWrite := map[string]string{
-		"HEAD":        "ref: refs/heads/" + repo.conf.defaultBranch + "\n",
+		"HEAD":        "ref: refs/heads/" + repo.conf.DefaultBranch() + "\n",
 		"description": "Unnamed repository; edit this file 'description' to name the repository.\n",
 		"info/exclude": "# git ls-files --others --exclude-from=.git/info/exclude\n" +
 			"# Lines that start with '#' are comments.\n" +
@@ -60,19 +86,25 @@ func (repo *Repository) init() error {
 	defaultConfig := map[string]string{
 		"repositoryformatversion": "0",
 		"filemode":                "true",
-		"bare":                    "false",
+		"bare":                    strconv.FormatBool(bare),
+	}
+	// extensions only mean something from format version 1 on
+	if repo.format != formatSHA1 {
+		defaultConfig["repositoryformatversion"] = "1"
 	}
 	coreSec := configContents.NewSection("core")
 	for k, v := range defaultConfig {
 		coreSec.NewKV(k, v)
 	}
+	if repo.format != formatSHA1 {
+		configContents.NewSection("extensions").NewKV("objectformat", repo.format.name)
+	}
 
 	err := configContents.Write(repo.makePath("config"))
 	if err != nil {
 		return fmt.Errorf("Couldn't write config file: %v\n", err)
 	}
 
-	fmt.Println("Initialized Twine repository")
 	return nil
 }
 
@@ -105,23 +137,33 @@ func (repo *Repository) catFile(args []string) error {
 		return err
 	}
 
-	obj, err := repo.makeObject(sha)
+	kind, size, r, err := repo.openObject(sha)
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
 	switch {
 	case *typeFlag:
-		fmt.Println(obj.Kind())
+		fmt.Println(kind)
 
 	case *sizeFlag:
-		fmt.Println(len(obj.Serialize()))
+		fmt.Println(size)
 
 	case *prettyFlag || objKind != "":
-		if objKind != "" && objKind != obj.Kind() {
-			return fmt.Errorf("object %s is a %s, not a %s", hash, obj.Kind(), objKind)
+		if objKind != "" && objKind != kind {
+			return fmt.Errorf("object %s is a %s, not a %s", hash, kind, objKind)
+		}
+		// blobs are copied out as they're read since they can be huge
+		if kind == "blob" {
+			_, err := io.Copy(os.Stdout, r)
+			return err
 		}
 
+		obj, err := repo.makeObject(sha)
+		if err != nil {
+			return err
+		}
 		fmt.Print(string(obj.Serialize()))
 
 	default:
@@ -138,7 +180,15 @@ func (repo *Repository) hashObject(write bool, objKind string, path string) erro
 	}
 	defer file.Close()
 
-	sha, err := repo.makeObjectHash(file, objKind, write)
+	var sha string
+	if objKind == "blob" {
+		var info os.FileInfo
+		if info, err = file.Stat(); err == nil {
+			sha, err = repo.writeObjectStream(objKind, file, info.Size(), write)
+		}
+	} else {
+		sha, err = repo.makeObjectHash(file, objKind, write)
+	}
 	if err != nil {
 		return fmt.Errorf("Couldn't hash object: %v", err)
 	}
@@ -221,48 +271,84 @@ func (repo *Repository) walkTree(ref string, recursive bool, prefix string) erro
 }
 
 func (repo *Repository) log() error {
-	_, err := repo.makeCommitLog("HEAD")
+	sha, err := repo.findObject("HEAD")
 	if err != nil {
 		return fmt.Errorf("Couldn't parse commit log: %s", err)
 	}
 
-	return nil
-}
+	// same walk as the library's Log, so shallow commits end the history here too
+	first := true
+	var logErr error
+	err = repo.walkHistory([]string{sha}, func(sha string) bool {
+		obj, err := repo.makeObject(sha)
+		if err != nil {
+			logErr = fmt.Errorf("Couldn't parse commit log: %s", err)
+			return false
+		}
+		commit, ok := obj.(*Commit)
+		if !ok {
+			return false
+		}
 
-func (repo *Repository) makeCommitLog(ref string) (*Commit, error) {
-	sha, err := repo.findObject(ref)
-	if err != nil {
-		fmt.Fprint(os.Stderr, err.Error())
-		return nil, err
-	}
-	obj, err := repo.makeObject(sha)
+		isFirst := first
+		first = false
+		commitLog, _, err := commit.parseCommitLog(sha, func() (string, bool) {
+			refName := repo.isRef(sha)
+			if repo.isShallow(sha) {
+				// the history stops here as far as this repository knows
+				refName = strings.TrimPrefix(refName+", grafted", ", ")
+			}
+			return refName, isFirst
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't parse commit log: %s", err)
+		}
+		fmt.Print(commitLog)
+		return true
+	})
 	if err != nil {
-		fmt.Fprint(os.Stderr, err.Error())
-		return nil, err
+		return fmt.Errorf("Couldn't parse commit log: %s", err)
 	}
+	return logErr
+}
 
-	commit, ok := obj.(*Commit)
-	if !ok {
-		return nil, nil
+// mergeBaseCmd prints the best common ancestor of two commits
+func (repo *Repository) mergeBaseCmd(args []string) error {
+	var isAncestor bool
+	mergeBaseCmd := flag.NewFlagSet("merge-base", flag.ExitOnError)
+	mergeBaseCmd.BoolVar(&isAncestor, "is-ancestor", false, "Check if the first commit is an ancestor of the second")
+	if err := mergeBaseCmd.Parse(args); err != nil {
+		return err
 	}
-
-	commitLog, parent, err := commit.parseCommitLog(sha, func() (string, bool) {
-		return repo.isRef(sha), ref == "HEAD"
-	})
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Couldn't parse commit log: %s", err)
+	if mergeBaseCmd.NArg() != 2 {
+		return fmt.Errorf("usage: twine merge-base [--is-ancestor] <commit> <commit>")
 	}
 
-	fmt.Print(commitLog)
-
-	if len(parent) > 0 {
-		commit, err = repo.makeCommitLog(parent)
+	var shas [2]string
+	for i, ref := range mergeBaseCmd.Args() {
+		sha, err := repo.findObject(ref)
 		if err != nil {
-			fmt.Fprint(os.Stderr, err.Error())
+			return fmt.Errorf("fatal: Not a valid object name %s", ref)
 		}
+		commitSha, _, err := repo.peelToCommit(sha)
+		if err != nil {
+			return fmt.Errorf("fatal: Not a valid commit name %s", ref)
+		}
+		shas[i] = commitSha
 	}
 
-	return commit, nil
+	if isAncestor {
+		if !repo.isAncestor(shas[0], shas[1]) {
+			return fmt.Errorf("%s is not an ancestor of %s", mergeBaseCmd.Arg(0), mergeBaseCmd.Arg(1))
+		}
+		return nil
+	}
+	base, ok := repo.mergeBase(shas[0], shas[1])
+	if !ok {
+		return fmt.Errorf("No merge base found")
+	}
+	fmt.Println(base)
+	return nil
 }
 
 func (repo *Repository) showRef(kind string) error {
@@ -302,19 +388,42 @@ func (repo *Repository) showRef(kind string) error {
 	return nil
 }
 
-func (repo *Repository) listTags() error {
-	tagsPath := repo.makePath("refs", "tags")
-	files, err := os.ReadDir(tagsPath)
+// listTags prints every tag, or only the ones whose history has the contains commit
+func (repo *Repository) listTags(contains string) error {
+	refs, err := repo.readRefs()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		} else {
-			return fmt.Errorf("Couldn't read tags: %s", err)
+		return fmt.Errorf("Couldn't read tags: %s", err)
+	}
+
+	var target string
+	if contains != "" {
+		sha, err := repo.findObject(contains)
+		if err != nil {
+			return fmt.Errorf("error: malformed object name %s", contains)
+		}
+		if target, _, err = repo.peelToCommit(sha); err != nil {
+			return fmt.Errorf("error: %s is not a commit", contains)
 		}
 	}
 
-	for _, file := range files {
-		fmt.Println(file.Name())
+	var names []string
+	for name, sha := range refs {
+		tag, ok := strings.CutPrefix(name, "refs/tags/")
+		if !ok {
+			continue
+		}
+		if target != "" {
+			commitSha, _, err := repo.peelToCommit(sha)
+			if err != nil || !repo.isAncestor(target, commitSha) {
+				continue
+			}
+		}
+		names = append(names, tag)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Println(name)
 	}
 
 	return nil
@@ -366,7 +475,7 @@ func (repo *Repository) createAnnotatedTag(name, ref, message string) error {
 		return fmt.Errorf("Tags can only be created on commits but %s is a %s", ref, obj.Kind())
 	}
 
-	tagger := fmt.Sprintf("%s <%s> %d +0000", repo.conf.username, repo.conf.email, time.Now().Unix())
+	tagger := fmt.Sprintf("%s <%s> %d +0000", repo.conf.Username(), repo.conf.Email(), time.Now().Unix())
 
 	tag := &Tag{
 		metaKV: map[TagField][]string{
@@ -383,7 +492,7 @@ func (repo *Repository) createAnnotatedTag(name, ref, message string) error {
 		return fmt.Errorf("Couldn't write tag object: %s", err)
 	}
 
-	return os.WriteFile(repo.makePath("refs", "tags", name), []byte(tagSha), 0o644)
+	return repo.writeRef("refs/tags/"+name, tagSha)
 }
 
 func (repo *Repository) createLightweightTag(name, ref string) error {
@@ -393,16 +502,16 @@ func (repo *Repository) createLightweightTag(name, ref string) error {
 		return err
 	}
 
-	return os.WriteFile(repo.makePath("refs", "tags", name), []byte(sha), 0o644)
+	return repo.writeRef("refs/tags/"+name, sha)
 }
 
 func (repo *Repository) deleteTag(name string) error {
-	err := os.Remove(repo.makePath("refs", "tags", name))
-	if err != nil {
+	ref := "refs/tags/" + name
+	if _, err := repo.refs.ReadRef(ref); err != nil {
 		return fmt.Errorf("Couldn't delete tag %s: %w", name, err)
 	}
 
-	return nil
+	return repo.deleteRef(ref)
 }
 
 func (repo *Repository) lsFiles(args []string) error {
@@ -0,0 +1,372 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/*
+ *                       Pack stream
+ * +------+---------+-------+---------------------+----------+
+ * | PACK | version | count | objects...          | sha1 sum |
+ * |  4   |  4 (2)  |   4   | header + zlib data  |    20    |
+ * +------+---------+-------+---------------------+----------+
+ *
+ * object header: 1tttssss [1sssssss]... type in bits 4-6, size varint
+ * the sum is sha256 and 32 bytes in a sha256 repository, as are ref delta bases
+ */
+
+// writePack streams the given objects as a pack without any deltas
+func (repo *Repository) writePack(w io.Writer, shas []string) error {
+	_, _, err := repo.writeIndexedPack(w, shas)
+	return err
+}
+
+// writeIndexedPack writes a pack like writePack
+// giving back where each object went and the trailer so the pack can be indexed
+func (repo *Repository) writeIndexedPack(w io.Writer, shas []string) ([]packIndexEntry, []byte, error) {
+	sum := repo.format.newHash()
+	crc := crc32.NewIEEE()
+	counter := &countingWriter{w: io.MultiWriter(w, sum, crc)}
+
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(shas)))
+	if _, err := counter.Write(header); err != nil {
+		return nil, nil, err
+	}
+
+	packTypes := map[string]byte{
+		"commit": packObjCommit,
+		"tree":   packObjTree,
+		"blob":   packObjBlob,
+		"tag":    packObjTag,
+	}
+
+	entries := make([]packIndexEntry, 0, len(shas))
+	for _, sha := range shas {
+		// objects are compressed as they're read so big blobs never sit in memory
+		objKind, size, r, err := repo.openObject(sha)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		offset := counter.n
+		crc.Reset()
+		if _, err := counter.Write(packObjectHeader(packTypes[objKind], int(size))); err != nil {
+			r.Close()
+			return nil, nil, err
+		}
+		zw := zlib.NewWriter(counter)
+		n, err := io.Copy(zw, r)
+		r.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if n != size {
+			return nil, nil, fmt.Errorf("object %s is %d bytes but only %d could be read", sha, size, n)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, nil, err
+		}
+
+		raw, _ := hex.DecodeString(sha)
+		entries = append(entries, packIndexEntry{raw, offset, crc.Sum32()})
+	}
+
+	trailer := sum.Sum(nil)
+	if _, err := w.Write(trailer); err != nil {
+		return nil, nil, err
+	}
+	return entries, trailer, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += uint64(n)
+	return n, err
+}
+
+func packObjectHeader(objType byte, size int) []byte {
+	b := objType<<4 | byte(size&0x0f)
+	size >>= 4
+
+	var header []byte
+	for size > 0 {
+		header = append(header, b|0x80)
+		b = byte(size & 0x7f)
+		size >>= 7
+	}
+	return append(header, b)
+}
+
+// packReader keeps count of how far into the pack it is
+// and hashes everything it hands out so the trailer can be checked
+// zlib only reads exactly what it needs when given a ByteReader
+type packReader struct {
+	r   *bufio.Reader
+	off uint64
+	sum hash.Hash
+	// checksum of the entry being read, which a kept pack's index needs
+	crc hash.Hash32
+	// gets the hashes and whatever else wants a copy of the pack
+	out io.Writer
+}
+
+func (pr *packReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.off += uint64(n)
+	pr.out.Write(p[:n])
+	return n, err
+}
+
+func (pr *packReader) ReadByte() (byte, error) {
+	b, err := pr.r.ReadByte()
+	if err == nil {
+		pr.off++
+		pr.out.Write([]byte{b})
+	}
+	return b, err
+}
+
+type packedObject struct {
+	kind string
+	data []byte
+	// set for blobs, which are streamed to where they're going as they're read
+	// data is left out for ones over core.bigFileThreshold
+	sha    string
+	offset uint64
+}
+
+// receivedPack is what reading a pack stream turned up
+type receivedPack struct {
+	shas    []string
+	entries []packIndexEntry
+	// the trailer, which also names the pack
+	sum []byte
+}
+
+// unpackObjects reads a pack stream and writes every object in it as a loose object
+// ref deltas may point at objects that are already in the repository (thin packs)
+func (repo *Repository) unpackObjects(r io.Reader) ([]string, error) {
+	received, err := repo.readPackStream(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return received.shas, nil
+}
+
+// keepPack stores a pack stream as it is along with an index for it
+// instead of writing out loose objects
+// packs from a promisor remote get a .promisor file next to them
+func (repo *Repository) keepPack(r io.Reader, promisor bool) ([]string, error) {
+	dir := repo.makePath("objects", "pack")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("Couldn't create directories: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, "tmp_pack_")
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create pack: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	received, err := repo.readPackStream(r, tmp)
+	if err == nil {
+		err = repo.syncFile(tmp, fsyncPack)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || len(received.shas) == 0 {
+		return nil, err
+	}
+
+	// the index goes last since that's what makes the pack show up
+	name := filepath.Join(dir, "pack-"+hex.EncodeToString(received.sum))
+	if err := os.Chmod(tmp.Name(), 0o444); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), name+".pack"); err != nil {
+		return nil, fmt.Errorf("Couldn't store pack: %w", err)
+	}
+	if promisor {
+		if err := os.WriteFile(name+".promisor", nil, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	if err := repo.writePackIndex(name+".idx", received.entries, received.sum); err != nil {
+		return nil, fmt.Errorf("Couldn't write pack index: %w", err)
+	}
+
+	repo.forgetPacks()
+	return received.shas, nil
+}
+
+// readPackStream checks and resolves every object in a pack stream
+// writing them out as loose objects unless keep is there to take a copy of the pack
+func (repo *Repository) readPackStream(r io.Reader, keep *os.File) (*receivedPack, error) {
+	pr := &packReader{r: bufio.NewReader(r), sum: repo.format.newHash(), crc: crc32.NewIEEE()}
+	pr.out = io.MultiWriter(pr.sum, pr.crc)
+	if keep != nil {
+		pr.out = io.MultiWriter(pr.sum, pr.crc, keep)
+	}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(pr, header); err != nil {
+		return nil, fmt.Errorf("Couldn't read pack header: %w", err)
+	}
+	if !bytes.Equal(header[:4], []byte("PACK")) {
+		return nil, fmt.Errorf("Malformed pack: bad signature")
+	}
+	if version := binary.BigEndian.Uint32(header[4:]); version != 2 && version != 3 {
+		return nil, fmt.Errorf("Unsupported pack version %d", version)
+	}
+	count := binary.BigEndian.Uint32(header[8:])
+
+	// deltas refer back to earlier objects by offset or by sha
+	byOffset := make(map[uint64]packedObject)
+	bySha := make(map[string]packedObject)
+	received := &receivedPack{shas: make([]string, 0, count)}
+
+	for i := uint32(0); i < count; i++ {
+		offset := pr.off
+		pr.crc.Reset()
+		obj, err := repo.readStreamEntry(pr, offset, byOffset, bySha, keep)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't unpack object %d: %w", i+1, err)
+		}
+
+		sha := obj.sha
+		if sha == "" {
+			if sha, err = repo.writeRawObject(obj.kind, obj.data, keep == nil); err != nil {
+				return nil, err
+			}
+		}
+		byOffset[offset] = obj
+		bySha[sha] = obj
+		received.shas = append(received.shas, sha)
+		if keep != nil {
+			raw, _ := hex.DecodeString(sha)
+			received.entries = append(received.entries, packIndexEntry{raw, offset, pr.crc.Sum32()})
+		}
+	}
+
+	expected := pr.sum.Sum(nil)
+	trailer := make([]byte, repo.format.size)
+	if _, err := io.ReadFull(pr.r, trailer); err != nil {
+		return nil, fmt.Errorf("Couldn't read pack trailer: %w", err)
+	}
+	if !bytes.Equal(expected, trailer) {
+		return nil, fmt.Errorf("Malformed pack: checksum mismatch")
+	}
+	if keep != nil {
+		if _, err := keep.Write(trailer); err != nil {
+			return nil, err
+		}
+	}
+
+	received.sum = trailer
+	return received, nil
+}
+
+func (repo *Repository) readStreamEntry(pr *packReader, offset uint64, byOffset map[uint64]packedObject, bySha map[string]packedObject, keep *os.File) (packedObject, error) {
+	objType, size, err := readPackObjectHeader(pr)
+	if err != nil {
+		return packedObject{}, err
+	}
+
+	threshold, err := repo.bigFileThreshold()
+	if err != nil {
+		return packedObject{}, err
+	}
+
+	var base packedObject
+	switch objType {
+	case packObjCommit, packObjTree, packObjBlob, packObjTag:
+		if objType == packObjBlob {
+			// small blobs are kept too, in case a delta comes along that needs one
+			var kept bytes.Buffer
+			var tee io.Writer
+			if int64(size) <= threshold {
+				kept.Grow(int(size))
+				tee = &kept
+			}
+			sha, err := repo.inflateObject(pr, "blob", size, keep == nil, tee)
+			obj := packedObject{kind: "blob", sha: sha, offset: offset}
+			if tee != nil {
+				obj.data = kept.Bytes()
+			}
+			return obj, err
+		}
+		data, err := inflate(pr, size)
+		return packedObject{kind: packKinds[objType], data: data}, err
+
+	case packObjOfsDelta:
+		b, err := pr.ReadByte()
+		if err != nil {
+			return packedObject{}, err
+		}
+		rel := uint64(b & 0x7f)
+		for b&0x80 != 0 {
+			if b, err = pr.ReadByte(); err != nil {
+				return packedObject{}, err
+			}
+			rel = ((rel + 1) << 7) | uint64(b&0x7f)
+		}
+		var ok bool
+		if base, ok = byOffset[offset-rel]; !ok {
+			return packedObject{}, fmt.Errorf("delta base at offset %d is missing", offset-rel)
+		}
+
+	case packObjRefDelta:
+		raw := make([]byte, repo.format.size)
+		if _, err := io.ReadFull(pr, raw); err != nil {
+			return packedObject{}, err
+		}
+		baseSha := hex.EncodeToString(raw)
+		var ok bool
+		if base, ok = bySha[baseSha]; !ok {
+			kind, data, err := repo.readObject(baseSha)
+			if err != nil {
+				return packedObject{}, fmt.Errorf("delta base %s is missing", baseSha)
+			}
+			base = packedObject{kind: kind, data: data}
+		}
+
+	default:
+		return packedObject{}, fmt.Errorf("Unknown pack object type %d", objType)
+	}
+
+	delta, err := inflate(pr, size)
+	if err != nil {
+		return packedObject{}, err
+	}
+	if base.data == nil {
+		// a big blob the sender deltified anyway has to be read back in
+		if keep != nil {
+			_, base.data, err = repo.readPackEntry(keep, base.offset)
+		} else {
+			_, base.data, err = repo.readObject(base.sha)
+		}
+		if err != nil {
+			return packedObject{}, fmt.Errorf("Couldn't read delta base %s: %w", base.sha, err)
+		}
+	}
+	data, err := applyDelta(base.data, delta)
+	return packedObject{kind: base.kind, data: data}, err
+}
@@ -0,0 +1,420 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+ *                     Pack index (v2)
+ * +-------+---------+--------+--------+--------+--------------+
+ * | magic | version | fanout | shas   | crc32s | offsets      |
+ * | \377tOc | 2     | 256*4  | N*20   | N*4    | N*4 (+ N*8)  |
+ * +-------+---------+--------+--------+--------+--------------+
+ *
+ * fanout[i] is the number of objects whose first byte is <= i
+ * offsets with the high bit set point into a table of 8 byte offsets
+ * it ends with the pack's trailer and its own sum
+ * shas and sums are 32 bytes instead of 20 in a sha256 repository
+ */
+
+const (
+	packObjCommit   = 1
+	packObjTree     = 2
+	packObjBlob     = 3
+	packObjTag      = 4
+	packObjOfsDelta = 6
+	packObjRefDelta = 7
+)
+
+var packKinds = map[byte]string{
+	packObjCommit: "commit",
+	packObjTree:   "tree",
+	packObjBlob:   "blob",
+	packObjTag:    "tag",
+}
+
+type packFile struct {
+	path     string
+	hashSize int
+	fanout   [256]uint32
+	shas     []byte
+	offsets  []uint64
+	// the pack's trailer, which names it
+	sum []byte
+	// came from a partial clone's remote, which has whatever it leaves out
+	promisor bool
+}
+
+// loadPacks reads every .idx under objects/pack once
+func (repo *Repository) loadPacks() ([]*packFile, error) {
+	repo.odb.packsMu.Lock()
+	defer repo.odb.packsMu.Unlock()
+	if repo.packs != nil {
+		return repo.packs, nil
+	}
+
+	idxPaths, err := filepath.Glob(repo.makePath("objects", "pack", "pack-*.idx"))
+	if err != nil {
+		return nil, err
+	}
+
+	packs := []*packFile{}
+	for _, idxPath := range idxPaths {
+		pack, err := readPackIndex(idxPath, repo.format)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(strings.TrimSuffix(idxPath, ".idx") + ".promisor"); err == nil {
+			pack.promisor = true
+		}
+		packs = append(packs, pack)
+	}
+
+	repo.packs = packs
+	return packs, nil
+}
+
+func readPackIndex(idxPath string, format *objectFormat) (*packFile, error) {
+	data, err := os.ReadFile(idxPath)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read pack index: %w", err)
+	}
+	if len(data) < 8+256*4 || !bytes.Equal(data[:4], []byte{0xff, 't', 'O', 'c'}) {
+		return nil, fmt.Errorf("Malformed pack index %s: bad signature", idxPath)
+	}
+	if version := binary.BigEndian.Uint32(data[4:8]); version != 2 {
+		return nil, fmt.Errorf("Unsupported pack index version %d", version)
+	}
+
+	pack := &packFile{
+		path:     strings.TrimSuffix(idxPath, ".idx") + ".pack",
+		hashSize: format.size,
+	}
+	for i := range pack.fanout {
+		pack.fanout[i] = binary.BigEndian.Uint32(data[8+i*4:])
+	}
+
+	n := int(pack.fanout[255])
+	size := format.size
+	shaStart := 8 + 256*4
+	offStart := shaStart + n*size + n*4
+	bigStart := offStart + n*4
+	if len(data) < bigStart+2*size {
+		return nil, fmt.Errorf("Malformed pack index %s: truncated", idxPath)
+	}
+
+	pack.shas = data[shaStart : shaStart+n*size]
+	pack.sum = data[len(data)-2*size : len(data)-size]
+	pack.offsets = make([]uint64, n)
+	for i := 0; i < n; i++ {
+		off := binary.BigEndian.Uint32(data[offStart+i*4:])
+		if off&0x80000000 == 0 {
+			pack.offsets[i] = uint64(off)
+			continue
+		}
+		big := bigStart + int(off&0x7fffffff)*8
+		if big+8 > len(data) {
+			return nil, fmt.Errorf("Malformed pack index %s: bad large offset", idxPath)
+		}
+		pack.offsets[i] = binary.BigEndian.Uint64(data[big:])
+	}
+
+	return pack, nil
+}
+
+// packIndexEntry is where an object sits in a pack being indexed
+type packIndexEntry struct {
+	sha    []byte
+	offset uint64
+	crc    uint32
+}
+
+// writePackIndex writes a v2 index for a pack whose trailer is packSum
+func (repo *Repository) writePackIndex(idxPath string, entries []packIndexEntry, packSum []byte) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].sha, entries[j].sha) < 0
+	})
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, 't', 'O', 'c'})
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+
+	var fanout [256]uint32
+	for _, entry := range entries {
+		fanout[entry.sha[0]]++
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(&buf, binary.BigEndian, fanout)
+
+	for _, entry := range entries {
+		buf.Write(entry.sha)
+	}
+	for _, entry := range entries {
+		binary.Write(&buf, binary.BigEndian, entry.crc)
+	}
+	// offsets that don't fit in 31 bits go in a table of their own
+	var large []uint64
+	for _, entry := range entries {
+		if entry.offset < 0x80000000 {
+			binary.Write(&buf, binary.BigEndian, uint32(entry.offset))
+			continue
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(len(large))|0x80000000)
+		large = append(large, entry.offset)
+	}
+	for _, offset := range large {
+		binary.Write(&buf, binary.BigEndian, offset)
+	}
+
+	buf.Write(packSum)
+	buf.Write(repo.format.sum(buf.Bytes()))
+	return repo.writeFileAtomic(idxPath, buf.Bytes(), fsyncPackMetadata)
+}
+
+func (pack *packFile) count() int {
+	return len(pack.offsets)
+}
+
+func (pack *packFile) shaAt(i int) []byte {
+	return pack.shas[i*pack.hashSize : (i+1)*pack.hashSize]
+}
+
+// find gives the position of an object in the index or -1
+func (pack *packFile) find(sha []byte) int {
+	lo := 0
+	if sha[0] > 0 {
+		lo = int(pack.fanout[sha[0]-1])
+	}
+	hi := int(pack.fanout[sha[0]])
+
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(pack.shaAt(lo+i), sha) >= 0
+	})
+	if i < hi && bytes.Equal(pack.shaAt(i), sha) {
+		return i
+	}
+	return -1
+}
+
+// withPrefix lists every object in the pack whose hex sha starts with prefix
+func (pack *packFile) withPrefix(prefix string) []string {
+	var matches []string
+	for i := 0; i < pack.count(); i++ {
+		sha := hex.EncodeToString(pack.shaAt(i))
+		if strings.HasPrefix(sha, prefix) {
+			matches = append(matches, sha)
+		}
+	}
+	return matches
+}
+
+// readPacked looks for an object in the packs, returning its kind and contents
+func (repo *Repository) readPacked(sha string) (string, []byte, error) {
+	raw, err := hex.DecodeString(sha)
+	if err != nil || len(raw) != repo.format.size {
+		return "", nil, fmt.Errorf("Invalid object name %s", sha)
+	}
+
+	path, offset, err := repo.findPacked(raw)
+	if err != nil {
+		return "", nil, err
+	}
+
+	pack, err := repo.odb.packFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer pack.Close()
+	return repo.readPackEntry(pack.file, offset)
+}
+
+func (repo *Repository) readPackEntry(file *os.File, offset uint64) (string, []byte, error) {
+	r := bufio.NewReader(io.NewSectionReader(file, int64(offset), 1<<62))
+
+	objType, size, err := readPackObjectHeader(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch objType {
+	case packObjCommit, packObjTree, packObjBlob, packObjTag:
+		data, err := inflate(r, size)
+		repo.odb.inflated.Add(int64(len(data)))
+		return packKinds[objType], data, err
+
+	case packObjOfsDelta:
+		// the base sits at a negative offset encoded big endian
+		// with one added to every byte but the last
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", nil, err
+		}
+		rel := uint64(b & 0x7f)
+		for b&0x80 != 0 {
+			if b, err = r.ReadByte(); err != nil {
+				return "", nil, err
+			}
+			rel = ((rel + 1) << 7) | uint64(b&0x7f)
+		}
+		delta, err := inflate(r, size)
+		if err != nil {
+			return "", nil, err
+		}
+		repo.odb.inflated.Add(int64(len(delta)))
+		kind, base, err := repo.readDeltaBase(file, offset-rel)
+		if err != nil {
+			return "", nil, err
+		}
+		data, err := applyDelta(base, delta)
+		return kind, data, err
+
+	case packObjRefDelta:
+		baseSha := make([]byte, repo.format.size)
+		if _, err := io.ReadFull(r, baseSha); err != nil {
+			return "", nil, err
+		}
+		delta, err := inflate(r, size)
+		if err != nil {
+			return "", nil, err
+		}
+		repo.odb.inflated.Add(int64(len(delta)))
+		kind, base, err := repo.readObject(hex.EncodeToString(baseSha))
+		if err != nil {
+			return "", nil, err
+		}
+		data, err := applyDelta(base, delta)
+		return kind, data, err
+
+	default:
+		return "", nil, fmt.Errorf("Unknown pack object type %d", objType)
+	}
+}
+
+// readDeltaBase reads the object at offset that a delta is against
+// going through the cache since chains of deltas share their bases
+func (repo *Repository) readDeltaBase(file *os.File, offset uint64) (string, []byte, error) {
+	key := fmt.Sprintf("%s@%d", file.Name(), offset)
+	if kind, data, ok := repo.odb.cached(key); ok {
+		return kind, data, nil
+	}
+	kind, data, err := repo.readPackEntry(file, offset)
+	if err == nil {
+		repo.odb.cache.add(key, kind, data)
+	}
+	return kind, data, err
+}
+
+// readPackObjectHeader reads the type and size an object in a pack starts with
+func readPackObjectHeader(r io.ByteReader) (byte, uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	objType := (b >> 4) & 0x7
+	size := uint64(b & 0x0f)
+	shift := 4
+	for b&0x80 != 0 {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		size |= uint64(b&0x7f) << shift
+		shift += 7
+	}
+	return objType, size, nil
+}
+
+func inflate(r io.Reader, size uint64) ([]byte, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, fmt.Errorf("Couldn't inflate pack object: %w", err)
+	}
+	// reading till the end makes zlib consume its checksum
+	// which streamed packs need to land on the next object
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return nil, fmt.Errorf("Couldn't inflate pack object: %w", err)
+	}
+	return data, nil
+}
+
+/*
+ * A delta is the size of the base and the result followed by instructions
+ * copy:   1xxxxxxx [offset bytes] [size bytes]  copy a slice of the base
+ * insert: 0xxxxxxx <x bytes>                    insert the next x bytes
+ */
+func applyDelta(base, delta []byte) ([]byte, error) {
+	pos := 0
+	varint := func() uint64 {
+		var n uint64
+		shift := 0
+		for pos < len(delta) {
+			b := delta[pos]
+			pos++
+			n |= uint64(b&0x7f) << shift
+			shift += 7
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		return n
+	}
+
+	if baseSize := varint(); baseSize != uint64(len(base)) {
+		return nil, fmt.Errorf("Malformed delta: base size %d doesn't match %d", baseSize, len(base))
+	}
+	result := make([]byte, 0, varint())
+
+	for pos < len(delta) {
+		op := delta[pos]
+		pos++
+
+		if op&0x80 == 0 {
+			if op == 0 || pos+int(op) > len(delta) {
+				return nil, fmt.Errorf("Malformed delta: bad insert")
+			}
+			result = append(result, delta[pos:pos+int(op)]...)
+			pos += int(op)
+			continue
+		}
+
+		var off, n uint64
+		for i := 0; i < 4; i++ {
+			if op&(1<<i) != 0 && pos < len(delta) {
+				off |= uint64(delta[pos]) << (8 * i)
+				pos++
+			}
+		}
+		for i := 0; i < 3; i++ {
+			if op&(1<<(4+i)) != 0 && pos < len(delta) {
+				n |= uint64(delta[pos]) << (8 * i)
+				pos++
+			}
+		}
+		if n == 0 {
+			n = 0x10000
+		}
+		if off+n > uint64(len(base)) {
+			return nil, fmt.Errorf("Malformed delta: copy out of bounds")
+		}
+		result = append(result, base[off:off+n]...)
+	}
+
+	return result, nil
+}
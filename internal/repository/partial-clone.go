@@ -0,0 +1,164 @@
+package repository
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/*
+ * a partial clone asks upload-pack to leave objects out of the pack
+ *
+ * blob:none         no blobs at all
+ * blob:limit=<n>    no blobs of n bytes or more, n can end in k, m or g
+ * tree:<depth>      no trees or blobs depth or more trees below a commit
+ *
+ * v0 sends "filter <spec>" after the wants, v2 sends it as a fetch argument
+ * objects that were asked for by name always come along
+ *
+ * the packs that come back are kept with a .promisor file next to them
+ * and anything missing is fetched from the remote in extensions.partialClone when needed
+ */
+
+type objectFilter struct {
+	// blob:none, blob:limit or tree
+	kind  string
+	limit int64
+	// the filter as it was given, which is what goes over the wire and in config
+	spec string
+}
+
+func parseObjectFilter(spec string) (*objectFilter, error) {
+	filter := &objectFilter{spec: spec}
+	switch {
+	case spec == "blob:none":
+		filter.kind = "blob:none"
+	case strings.HasPrefix(spec, "blob:limit="):
+		limit, err := parseConfigInt(strings.TrimPrefix(spec, "blob:limit="))
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid filter-spec '%s'", spec)
+		}
+		filter.kind, filter.limit = "blob:limit", limit
+	case strings.HasPrefix(spec, "tree:"):
+		depth, err := strconv.ParseInt(strings.TrimPrefix(spec, "tree:"), 10, 64)
+		if err != nil || depth < 0 {
+			return nil, fmt.Errorf("expected 'tree:<depth>'")
+		}
+		filter.kind, filter.limit = "tree", depth
+	default:
+		return nil, fmt.Errorf("invalid filter-spec '%s'", spec)
+	}
+	return filter, nil
+}
+
+func (filter *objectFilter) String() string {
+	return filter.spec
+}
+
+// omitsTree says if a tree depth trees below a commit gets left out
+// the commit's own tree is at depth 0
+func (filter *objectFilter) omitsTree(depth int) bool {
+	return filter != nil && filter.kind == "tree" && int64(depth) >= filter.limit
+}
+
+// omitsBlob says if a blob depth trees below a commit gets left out
+// only looking the blob up when its size matters
+func (filter *objectFilter) omitsBlob(repo *Repository, sha string, depth int) bool {
+	if filter == nil {
+		return false
+	}
+	switch filter.kind {
+	case "blob:none":
+		return true
+	case "tree":
+		return int64(depth) >= filter.limit
+	case "blob:limit":
+		_, contents, err := repo.readObject(sha)
+		return err == nil && int64(len(contents)) >= filter.limit
+	}
+	return false
+}
+
+// promisorRemote is the remote a partial clone gets its missing objects from
+func (repo *Repository) promisorRemote() string {
+	remote, _ := repo.conf.Get("extensions.partialClone")
+	return remote
+}
+
+// remoteFilter is the filter fetches from a promisor remote keep using
+func (repo *Repository) remoteFilter(remote string) (*objectFilter, error) {
+	spec, ok := repo.conf.Get("remote." + remote + ".partialCloneFilter")
+	if !ok {
+		return nil, nil
+	}
+	return parseObjectFilter(spec)
+}
+
+// fetchPromised gets objects a partial clone left out from the promisor remote
+// blobs under any trees that come along stay behind until they're needed too
+//
+// readers missing objects at the same time take turns, each looking again once it's their turn
+// so what the fetch before them brought in isn't fetched twice
+// a fetch only ever reads objects with readObject, which never fetches, so it can't end up waiting on itself
+func (repo *Repository) fetchPromised(shas []string) error {
+	remote := repo.promisorRemote()
+	if remote == "" {
+		return fmt.Errorf("not a partial clone")
+	}
+	repo.odb.promisedMu.Lock()
+	defer repo.odb.promisedMu.Unlock()
+	shas = slices.DeleteFunc(slices.Clone(shas), repo.hasObject)
+	if len(shas) == 0 {
+		return nil
+	}
+
+	conn, err := repo.connectUploadPack(repo.remoteURL(remote), repo.conf.Value("remote."+remote+".uploadpack", ""))
+	if err != nil {
+		return fmt.Errorf("Couldn't fetch missing objects from %s: %w", remote, err)
+	}
+	conn.promisor = true
+	conn.filter = &objectFilter{kind: "blob:none", spec: "blob:none"}
+	if _, _, err := conn.fetch(repo, shas, nil, shallowRequest{}); err != nil {
+		conn.close()
+		return fmt.Errorf("Couldn't fetch missing objects from %s: %w", remote, err)
+	}
+	return conn.close()
+}
+
+// prefetchTree gets every blob missing from under a tree in one fetch
+// instead of a fetch for each file that gets checked out
+func (repo *Repository) prefetchTree(treeSha string) error {
+	var missing []string
+	var walk func(sha string) error
+	walk = func(sha string) error {
+		tree, err := repo.readTree(sha)
+		if err != nil {
+			return err
+		}
+		for _, leaf := range tree.leaves {
+			sha := hex.EncodeToString(leaf.sha)
+			switch leaf.mode {
+			case "40000":
+				if err := walk(sha); err != nil {
+					return err
+				}
+			case "160000":
+			default:
+				if !repo.hasObject(sha) {
+					missing = append(missing, sha)
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(treeSha); err != nil {
+		return err
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+	return repo.fetchPromised(missing)
+}
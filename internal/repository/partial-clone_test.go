@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPartialCloneFiltersAndLazyFetches(t *testing.T) {
+	for _, version := range []int{0, 2} {
+		remote := newTestRepo(t, true)
+		big := strings.Repeat("big\n", 1024)
+		first := commitTestFiles(t, remote, map[string]string{"big": big, "small": "small\n", "dir/nested": "old\n"})
+		tip := commitTestFiles(t, remote, map[string]string{"big": big + "more\n", "small": "small\n", "dir/nested": "new\n"}, first)
+		if err := remote.writeRef("refs/heads/master", tip); err != nil {
+			t.Fatal(err)
+		}
+		global := fmt.Sprintf("[protocol]\n\tversion = %d\n", version)
+		if err := os.WriteFile(filepath.Join(os.Getenv("HOME"), ".gitconfig"), []byte(global), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sha := func(kind, contents string) string {
+			return objectSha(remote.format, kind, []byte(contents))
+		}
+		tipTree, err := remote.commitTree(tip)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		clone := func(filter string, bare bool) *Repository {
+			t.Helper()
+			dest := filepath.Join(t.TempDir(), "clone")
+			args := []string{"--filter", filter, "file://" + remote.gitDir, dest}
+			if bare {
+				args = append([]string{"--bare"}, args...)
+			}
+			if err := remote.clone(args); err != nil {
+				t.Fatalf("v%d %s: %v", version, filter, err)
+			}
+			repo, err := Open(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := repo.promisorRemote(); got != "origin" {
+				t.Errorf("v%d %s: promisor remote is %q", version, filter, got)
+			}
+			if got, _ := repo.conf.Get("remote.origin.partialCloneFilter"); got != filter {
+				t.Errorf("v%d %s: remote.origin.partialCloneFilter is %q", version, filter, got)
+			}
+			return repo
+		}
+		has := func(repo *Repository, how string, want bool, shas ...string) {
+			t.Helper()
+			for _, sha := range shas {
+				if got := repo.hasObject(sha); got != want {
+					t.Errorf("v%d %s: has %s is %v, want %v", version, how, sha, got, want)
+				}
+			}
+		}
+
+		// the checkout brings the tip's blobs and nothing older
+		repo := clone("blob:none", false)
+		if data, err := os.ReadFile(filepath.Join(repo.worktree, "dir", "nested")); err != nil || string(data) != "new\n" {
+			t.Errorf("v%d: checked out %q: %v", version, data, err)
+		}
+		has(repo, "blob:none", true, first, tip, sha("blob", big+"more\n"))
+		has(repo, "blob:none", false, sha("blob", big), sha("blob", "old\n"))
+		if packs, _ := filepath.Glob(repo.makePath("objects", "pack", "pack-*.promisor")); len(packs) == 0 {
+			t.Errorf("v%d: no promisor pack", version)
+		}
+		if _, err := repo.makeObject(sha("blob", "old\n")); err != nil {
+			t.Errorf("v%d: lazy fetch: %v", version, err)
+		}
+		has(repo, "after a lazy fetch", true, sha("blob", "old\n"))
+		has(repo, "after a lazy fetch", false, sha("blob", big))
+
+		repo = clone("blob:limit=1k", true)
+		has(repo, "blob:limit=1k", true, sha("blob", "small\n"), sha("blob", "old\n"), sha("blob", "new\n"))
+		has(repo, "blob:limit=1k", false, sha("blob", big), sha("blob", big+"more\n"))
+
+		// a tree fetched later comes without the blobs under it
+		repo = clone("tree:0", true)
+		has(repo, "tree:0", true, first, tip)
+		has(repo, "tree:0", false, tipTree, sha("blob", "small\n"))
+		if _, err := repo.makeObject(tipTree); err != nil {
+			t.Errorf("v%d: lazy fetch: %v", version, err)
+		}
+		has(repo, "tree:0 after a lazy fetch", true, tipTree)
+		has(repo, "tree:0 after a lazy fetch", false, sha("blob", "small\n"))
+	}
+}
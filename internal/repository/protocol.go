@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const agent = "twine"
+
+type advertisedRef struct {
+	name string
+	sha  string
+	// commit an annotated tag points at
+	peeled string
+	// target of a symbolic ref like HEAD
+	symref string
+}
+
+// advertisedRefs lists HEAD followed by every ref sorted by name
+// the way upload-pack and receive-pack show them
+func (repo *Repository) advertisedRefs() ([]advertisedRef, error) {
+	refs, err := repo.readRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var advertised []advertisedRef
+	if sha, err := repo.readRef("HEAD"); err == nil {
+		target, _ := repo.readSymref("HEAD")
+		advertised = append(advertised, advertisedRef{name: "HEAD", sha: sha, symref: target})
+	}
+
+	for _, name := range names {
+		ref := advertisedRef{name: name, sha: refs[name]}
+		if target, _ := repo.readSymref(name); target != "" {
+			ref.symref = target
+		}
+		if strings.HasPrefix(name, "refs/tags/") {
+			if peeled, err := repo.peelTag(ref.sha); err == nil && peeled != ref.sha {
+				ref.peeled = peeled
+			}
+		}
+		advertised = append(advertised, ref)
+	}
+
+	return advertised, nil
+}
+
+// peelTag follows annotated tags down to the object they finally point at
+func (repo *Repository) peelTag(sha string) (string, error) {
+	for depth := 0; ; depth++ {
+		obj, err := repo.makeObject(sha)
+		if err != nil {
+			return "", err
+		}
+		tag, ok := obj.(*Tag)
+		if !ok {
+			return sha, nil
+		}
+		if depth > maxSymrefDepth {
+			return "", fmt.Errorf("Too many levels of tags peeling %s", sha)
+		}
+		if sha, err = tag.getField("object"); err != nil {
+			return "", err
+		}
+	}
+}
+
+// capabilities is the parsed form of a "cap cap=value ..." list
+type capabilities map[string]string
+
+func parseCapabilities(list string) capabilities {
+	caps := make(capabilities)
+	for _, field := range strings.Fields(list) {
+		k, v, _ := strings.Cut(field, "=")
+		// symref shows up once per symbolic ref
+		if existing, ok := caps[k]; ok && k == "symref" {
+			v = existing + " " + v
+		}
+		caps[k] = v
+	}
+	return caps
+}
+
+func (caps capabilities) has(name string) bool {
+	_, ok := caps[name]
+	return ok
+}
+
+// protocolVersion is the version a server should speak
+// git passes it down in GIT_PROTOCOL as version=<n>
+func protocolVersion() int {
+	return parseProtocolVersion(os.Getenv("GIT_PROTOCOL"))
+}
+
+// parseProtocolVersion reads the version out of a GIT_PROTOCOL value
+// or the Git-Protocol header, which carry the same thing
+func parseProtocolVersion(value string) int {
+	for _, field := range strings.Split(value, ":") {
+		if field == "version=2" {
+			return 2
+		}
+	}
+	return 0
+}
+
+// validSha makes sure sha is a full hex sha of either object format
+func validSha(sha string) error {
+	if len(sha) != formatSHA1.hexSize() && len(sha) != formatSHA256.hexSize() {
+		return fmt.Errorf("invalid object name %s", sha)
+	}
+	for _, ch := range sha {
+		if !('0' <= ch && ch <= '9' || 'a' <= ch && ch <= 'f') {
+			return fmt.Errorf("invalid object name %s", sha)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package repository
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type pullOptions struct {
+	rebase   bool
+	noRebase bool
+	ffOnly   bool
+}
+
+func (repo *Repository) pull(args []string) error {
+	var opts pullOptions
+	var fetchOpts fetchOptions
+	pullCmd := flag.NewFlagSet("pull", flag.ExitOnError)
+	pullCmd.BoolVar(&opts.rebase, "r", false, "Rebase local commits onto what was fetched")
+	pullCmd.BoolVar(&opts.rebase, "rebase", false, "Rebase local commits onto what was fetched")
+	pullCmd.BoolVar(&opts.noRebase, "no-rebase", false, "Merge what was fetched, even if pull.rebase is set")
+	pullCmd.BoolVar(&opts.ffOnly, "ff-only", false, "Refuse anything but a fast-forward")
+	pullCmd.BoolVar(&fetchOpts.quiet, "q", false, "Don't report progress")
+	pullCmd.BoolVar(&fetchOpts.quiet, "quiet", false, "Don't report progress")
+	pullCmd.BoolVar(&fetchOpts.tags, "tags", false, "Fetch all tags")
+	pullCmd.StringVar(&fetchOpts.uploadPack, "upload-pack", "", "Path to upload-pack on the remote end")
+	if err := pullCmd.Parse(args); err != nil {
+		return err
+	}
+
+	branch := currentBranch(repo.gitDir)
+	if branch == "" {
+		return fmt.Errorf("You are not currently on a branch.")
+	}
+	if !opts.rebase && !opts.noRebase {
+		rebase, err := repo.conf.Bool("pull.rebase", false)
+		if err != nil {
+			return err
+		}
+		if opts.rebase, err = repo.conf.Bool("branch."+branch+".rebase", rebase); err != nil {
+			return err
+		}
+	}
+	if !opts.ffOnly {
+		opts.ffOnly = repo.conf.Value("pull.ff", "") == "only"
+	}
+
+	remote := repo.defaultRemote()
+	specs := pullCmd.Args()
+	if len(specs) > 0 {
+		remote, specs = specs[0], specs[1:]
+	}
+
+	fetched, err := repo.fetchRemote(remote, specs, fetchOpts)
+	if err != nil {
+		return err
+	}
+
+	var merge *fetchedRef
+	for i := range fetched {
+		if fetched[i].merge {
+			merge = &fetched[i]
+			break
+		}
+	}
+	if merge == nil {
+		return fmt.Errorf("There is no tracking information for the current branch.\nPlease specify which branch you want to merge with.")
+	}
+
+	theirs, _, err := repo.peelToCommit(merge.sha)
+	if err != nil {
+		return err
+	}
+	ref := "refs/heads/" + branch
+	ours, err := repo.readRef(ref)
+	if err != nil {
+		// nothing committed yet, just take what was fetched
+		return repo.moveBranch(ref, "", theirs)
+	}
+
+	switch {
+	case repo.isAncestor(theirs, ours):
+		fmt.Println("Already up to date.")
+		return nil
+
+	case repo.isAncestor(ours, theirs):
+		fmt.Printf("Updating %s..%s\nFast-forward\n", ours[:7], theirs[:7])
+		return repo.moveBranch(ref, ours, theirs)
+
+	case opts.ffOnly:
+		return fmt.Errorf("fatal: Not possible to fast-forward, aborting.")
+
+	case opts.rebase:
+		return repo.rebaseOnto(ref, ours, theirs)
+
+	default:
+		message := "Merge " + fetchHeadDescription(merge.remote, anonymizeURL(repo.remoteURL(remote)))
+		if branch != "main" && branch != "master" {
+			message += " into " + branch
+		}
+		return repo.mergeInto(ref, ours, theirs, message)
+	}
+}
+
+// mergeInto records a merge commit of theirs on top of ours
+func (repo *Repository) mergeInto(ref, ours, theirs, message string) error {
+	base, ok := repo.mergeBase(ours, theirs)
+	if !ok {
+		return fmt.Errorf("fatal: refusing to merge unrelated histories")
+	}
+
+	var trees [3]string
+	for i, sha := range []string{base, ours, theirs} {
+		tree, err := repo.commitTree(sha)
+		if err != nil {
+			return err
+		}
+		trees[i] = tree
+	}
+
+	merged, conflicts, err := repo.mergeTrees(trees[0], trees[1], trees[2], [2]string{"HEAD", theirs[:7]})
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return conflictError(conflicts, "merge")
+	}
+
+	tree, err := repo.writeFlatTree(merged)
+	if err != nil {
+		return err
+	}
+	commit, err := repo.writeCommit(tree, []string{ours, theirs}, "", message)
+	if err != nil {
+		return err
+	}
+	if err := repo.moveBranch(ref, ours, commit); err != nil {
+		return err
+	}
+
+	fmt.Println("Merge made by the 'twine' strategy.")
+	return nil
+}
+
+// rebaseOnto replays the commits on ours that upstream doesn't have on top of upstream
+// dropping merges and commits whose changes are already there
+func (repo *Repository) rebaseOnto(ref, ours, upstream string) error {
+	inUpstream := make(map[string]bool)
+	for _, sha := range repo.reachableCommits([]string{upstream}) {
+		inUpstream[sha] = true
+	}
+
+	// first parent history back to where it meets upstream, oldest first
+	var todo []*Commit
+	var todoShas []string
+	for sha := ours; sha != "" && !inUpstream[sha]; {
+		_, commit, err := repo.peelToCommit(sha)
+		if err != nil {
+			return err
+		}
+		parents := commit.parents()
+		if len(parents) < 2 {
+			todo = append([]*Commit{commit}, todo...)
+			todoShas = append([]string{sha}, todoShas...)
+		}
+		sha = ""
+		if len(parents) > 0 {
+			sha = parents[0]
+		}
+	}
+
+	onto := upstream
+	for i, commit := range todo {
+		var parentTree string
+		if parents := commit.parents(); len(parents) > 0 {
+			var err error
+			if parentTree, err = repo.commitTree(parents[0]); err != nil {
+				return err
+			}
+		}
+		commitTree, err := commit.getField("tree")
+		if err != nil {
+			return err
+		}
+		ontoTree, err := repo.commitTree(onto)
+		if err != nil {
+			return err
+		}
+
+		// named the way git rebase names them, what's being applied goes by its subject
+		subject, _, _ := strings.Cut(commit.message, "\n")
+		labels := [2]string{onto[:7], todoShas[i][:7] + " (" + subject + ")"}
+		merged, conflicts, err := repo.mergeTrees(parentTree, ontoTree, commitTree, labels)
+		if err != nil {
+			return err
+		}
+		if len(conflicts) > 0 {
+			return conflictError(conflicts, "rebase")
+		}
+		tree, err := repo.writeFlatTree(merged)
+		if err != nil {
+			return err
+		}
+		if tree == ontoTree {
+			// already upstream
+			continue
+		}
+
+		author, _ := commit.getField("author")
+		if onto, err = repo.writeCommit(tree, []string{onto}, author, commit.message); err != nil {
+			return err
+		}
+	}
+
+	if err := repo.moveBranch(ref, ours, onto); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Successfully rebased and updated %s.\n", ref)
+	return nil
+}
+
+// moveBranch moves the branch checked out from ours to sha, as long as nothing else moved it since it was read
+// and then the work tree along with it, putting the branch back if the work tree can't be moved
+func (repo *Repository) moveBranch(ref, ours, sha string) error {
+	change := refChange{name: ref, old: ours, value: sha}
+	if err := repo.changeRefs([]refChange{change}); err != nil {
+		return err
+	}
+	if err := repo.switchWorktree(ours, sha); err != nil {
+		repo.changeRefs([]refChange{undoRefChange(change)})
+		return err
+	}
+	return nil
+}
+
+func conflictError(conflicts []mergeConflict, action string) error {
+	var msg strings.Builder
+	for _, conflict := range conflicts {
+		if len(conflict.markers) == 0 {
+			fmt.Fprintf(&msg, "CONFLICT: %s was changed on both sides\n", conflict.path)
+			continue
+		}
+		fmt.Fprintf(&msg, "CONFLICT (content): Merge conflict in %s\n", conflict.path)
+		for _, markers := range conflict.markers {
+			msg.WriteString(markers)
+		}
+	}
+	fmt.Fprintf(&msg, "error: twine can't leave a %s with conflicts to be resolved yet, the %s was not started", action, action)
+	return fmt.Errorf("%s", msg.String())
+}
+
+// fetchHeadDescription names a fetched ref the way FETCH_HEAD and merge messages do
+func fetchHeadDescription(name, url string) string {
+	switch kind := refKind(name); {
+	case name == "HEAD":
+		return url
+	case kind == "ref":
+		return fmt.Sprintf("'%s' of %s", name, url)
+	default:
+		return fmt.Sprintf("%s '%s' of %s", kind, shortRefName(name), url)
+	}
+}
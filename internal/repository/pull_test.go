@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPullMovesBranchBeforeWorktree(t *testing.T) {
+	repo := newTestRepo(t, false)
+	base := commitTestFiles(t, repo, map[string]string{"a": "a\n", "b": "b\n"})
+	ours := commitTestFiles(t, repo, map[string]string{"a": "ours\n", "b": "b\n"}, base)
+	theirs := commitTestFiles(t, repo, map[string]string{"a": "a\n", "b": "theirs\n"}, base)
+	elsewhere := commitTestFiles(t, repo, map[string]string{"a": "elsewhere\n", "b": "b\n"}, base)
+	ref := "refs/heads/" + currentBranch(repo.gitDir)
+	if err := repo.checkoutCommit(ours); err != nil {
+		t.Fatal(err)
+	}
+
+	file := func(name string) string {
+		data, _ := os.ReadFile(filepath.Join(repo.worktree, name))
+		return string(data)
+	}
+
+	// a branch that moved since it was read is left where it is, work tree and all
+	if err := repo.writeRef(ref, elsewhere); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.mergeInto(ref, ours, theirs, "merge\n"); err == nil || !strings.Contains(err.Error(), "expected") {
+		t.Fatalf("merge into a branch that moved gave %v", err)
+	}
+	if sha, _ := repo.readRef(ref); sha != elsewhere {
+		t.Fatalf("%s moved to %s", ref, sha)
+	}
+	if file("b") != "b\n" {
+		t.Fatalf("work tree moved for a branch that didn't, b is %q", file("b"))
+	}
+
+	// a work tree that can't be moved puts the branch back
+	if err := repo.writeRef(ref, ours); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo.worktree, "b"), []byte("local\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.rebaseOnto(ref, ours, theirs); err == nil || !strings.Contains(err.Error(), "local changes") {
+		t.Fatalf("rebase over local changes gave %v", err)
+	}
+	if sha, _ := repo.readRef(ref); sha != ours {
+		t.Fatalf("%s is at %s after a rebase that didn't happen", ref, sha)
+	}
+
+	if err := os.WriteFile(filepath.Join(repo.worktree, "b"), []byte("b\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.mergeInto(ref, ours, theirs, "merge\n"); err != nil {
+		t.Fatal(err)
+	}
+	merged, _ := repo.readRef(ref)
+	if _, commit, err := repo.peelToCommit(merged); err != nil || len(commit.parents()) != 2 {
+		t.Fatalf("%s is at %s after the merge", ref, merged)
+	}
+	if file("a") != "ours\n" || file("b") != "theirs\n" {
+		t.Fatalf("work tree has a %q, b %q after the merge", file("a"), file("b"))
+	}
+}
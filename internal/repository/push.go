@@ -0,0 +1,541 @@
+package repository
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/joeldotdias/twine/pkg/pktline"
+)
+
+type pushOptions struct {
+	force  bool
+	delete bool
+	atomic bool
+	tags   bool
+	quiet  bool
+	// each --force-with-lease, either empty for every ref, or ref[:expect] for that ref alone
+	leases []string
+	// receive-pack to run instead of serving a local path in process
+	receivePack string
+}
+
+// pushUpdate is one remote ref being moved by a push
+type pushUpdate struct {
+	src    string
+	dst    string
+	oldSha string
+	newSha string
+	force  bool
+	// set once a non-fast-forward was let through
+	forced bool
+	// flag and summary for the report line
+	status byte
+	reason string
+	remote string
+}
+
+func (repo *Repository) push(args []string) error {
+	var opts pushOptions
+	pushCmd := flag.NewFlagSet("push", flag.ExitOnError)
+	pushCmd.BoolVar(&opts.force, "f", false, "Allow updates that aren't fast-forwards")
+	pushCmd.BoolVar(&opts.force, "force", false, "Allow updates that aren't fast-forwards")
+	pushCmd.BoolVar(&opts.delete, "d", false, "Delete the named refs on the remote")
+	pushCmd.BoolVar(&opts.delete, "delete", false, "Delete the named refs on the remote")
+	pushCmd.BoolVar(&opts.atomic, "atomic", false, "Update either every ref or none of them")
+	pushCmd.BoolVar(&opts.tags, "tags", false, "Push every tag")
+	pushCmd.BoolVar(&opts.quiet, "q", false, "Only report errors")
+	pushCmd.BoolVar(&opts.quiet, "quiet", false, "Only report errors")
+	pushCmd.StringVar(&opts.receivePack, "receive-pack", "", "Path to receive-pack on the remote end")
+	pushCmd.Func("force-with-lease", "Only force when the remote is still at <expect>", func(v string) error {
+		opts.leases = append(opts.leases, v)
+		return nil
+	})
+	// --force-with-lease is allowed to come without a value
+	for i, arg := range args {
+		if arg == "--force-with-lease" || arg == "-force-with-lease" {
+			args[i] = "--force-with-lease="
+		}
+	}
+	if err := pushCmd.Parse(args); err != nil {
+		return err
+	}
+
+	remote := repo.defaultRemote()
+	specArgs := pushCmd.Args()
+	if len(specArgs) > 0 {
+		remote, specArgs = specArgs[0], specArgs[1:]
+	}
+	if opts.delete {
+		if len(specArgs) == 0 {
+			return fmt.Errorf("fatal: --delete doesn't make sense without any refs")
+		}
+		for i, spec := range specArgs {
+			specArgs[i] = ":" + spec
+		}
+	}
+	if opts.receivePack == "" {
+		opts.receivePack = repo.conf.Value("remote."+remote+".receivepack", "")
+	}
+
+	return repo.pushRemote(remote, specArgs, opts)
+}
+
+func (repo *Repository) pushRemote(remote string, specArgs []string, opts pushOptions) error {
+	url := repo.remoteURL(remote)
+	if len(specArgs) == 0 {
+		specArgs = repo.conf.GetAll("remote." + remote + ".push")
+	}
+	if len(specArgs) == 0 && !opts.tags {
+		spec, err := repo.defaultPushSpec(remote)
+		if err != nil {
+			return err
+		}
+		specArgs = []string{spec}
+	}
+	if opts.tags {
+		specArgs = append(specArgs, "refs/tags/*:refs/tags/*")
+	}
+
+	conn, err := repo.connectReceivePack(url, opts.receivePack)
+	if err != nil {
+		return err
+	}
+	if err := conn.checkFormat(repo); err != nil {
+		conn.close()
+		return err
+	}
+	remoteRefs := make(map[string]string)
+	for _, ref := range conn.refs {
+		remoteRefs[ref.name] = ref.sha
+	}
+
+	updates, err := repo.mapPushRefs(remote, specArgs, remoteRefs, opts)
+	if err != nil {
+		conn.close()
+		return err
+	}
+	repo.checkPushUpdates(updates, opts)
+
+	var pending []*pushUpdate
+	for _, update := range updates {
+		if update.status == 0 {
+			pending = append(pending, update)
+		}
+	}
+	if opts.atomic && len(pending) != len(updates) {
+		for _, update := range pending {
+			update.status, update.reason = '!', "atomic push failed"
+		}
+		pending = nil
+	}
+
+	if len(pending) > 0 {
+		if opts.atomic && !conn.caps.has("atomic") {
+			conn.close()
+			return fmt.Errorf("fatal: the receiving end does not support --atomic push")
+		}
+		err = repo.sendPush(conn, pending, remoteRefs, opts)
+	}
+	if closeErr := conn.close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return repo.reportPush(anonymizeURL(url), remote, updates, opts)
+}
+
+// defaultPushSpec pushes the current branch to the branch it tracks
+// or to one of the same name, like push.default=simple
+func (repo *Repository) defaultPushSpec(remote string) (string, error) {
+	branch := currentBranch(repo.gitDir)
+	if branch == "" {
+		return "", fmt.Errorf("fatal: You are not currently on a branch.")
+	}
+	dst := "refs/heads/" + branch
+	if repo.conf.Value("branch."+branch+".remote", "") == remote {
+		if merge, ok := repo.conf.Get("branch." + branch + ".merge"); ok {
+			dst = merge
+		}
+	}
+	return "refs/heads/" + branch + ":" + dst, nil
+}
+
+// mapPushRefs works out which local refs go where on the remote
+func (repo *Repository) mapPushRefs(remote string, specArgs []string, remoteRefs map[string]string, opts pushOptions) ([]*pushUpdate, error) {
+	localRefs, err := repo.readRefs()
+	if err != nil {
+		return nil, err
+	}
+	localNames := make([]string, 0, len(localRefs))
+	for name := range localRefs {
+		localNames = append(localNames, name)
+	}
+	sort.Strings(localNames)
+
+	var updates []*pushUpdate
+	seen := make(map[string]bool)
+	add := func(src, dst string, force bool) {
+		if seen[dst] {
+			return
+		}
+		seen[dst] = true
+
+		update := &pushUpdate{src: src, dst: dst, force: force || opts.force, remote: remote}
+		update.oldSha = remoteRefs[dst]
+		if update.oldSha == "" {
+			update.oldSha = repo.format.zero()
+		}
+		update.newSha = repo.format.zero()
+		if src != "" {
+			update.newSha = localRefs[src]
+		}
+		updates = append(updates, update)
+	}
+
+	for _, arg := range specArgs {
+		spec, err := parseRefspec(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		if spec.isGlob() {
+			for _, name := range localNames {
+				if dst, ok := spec.match(name); ok {
+					add(name, dst, spec.force)
+				}
+			}
+			continue
+		}
+
+		if spec.src == "" {
+			// :dst deletes dst
+			dst := expandRemoteName(spec.dst, remoteRefs)
+			if _, ok := remoteRefs[dst]; !ok {
+				return nil, fmt.Errorf("error: unable to delete '%s': remote ref does not exist", spec.dst)
+			}
+			add("", dst, spec.force)
+			continue
+		}
+
+		src, sha, err := repo.expandLocalName(spec.src)
+		if err != nil {
+			return nil, err
+		}
+		dst := spec.dst
+		if dst == "" {
+			if !strings.HasPrefix(src, "refs/") {
+				return nil, fmt.Errorf("error: The destination you provided is not a full refname for %s", spec.src)
+			}
+			dst = src
+		}
+		if !strings.HasPrefix(dst, "refs/") {
+			if expanded := expandRemoteName(dst, remoteRefs); expanded != dst {
+				dst = expanded
+			} else if strings.HasPrefix(src, "refs/tags/") {
+				dst = "refs/tags/" + dst
+			} else {
+				dst = "refs/heads/" + dst
+			}
+		}
+		if !strings.HasPrefix(src, "refs/") {
+			// HEAD or a bare sha
+			localRefs[src] = sha
+		}
+		add(src, dst, spec.force)
+	}
+
+	return updates, nil
+}
+
+// expandLocalName finds the full name of a local ref given on the command line
+func (repo *Repository) expandLocalName(name string) (string, string, error) {
+	for _, candidate := range []string{name, "refs/" + name, "refs/heads/" + name, "refs/tags/" + name, "refs/remotes/" + name} {
+		if !strings.HasPrefix(candidate, "refs/") && candidate != "HEAD" {
+			continue
+		}
+		if sha, err := repo.readRef(candidate); err == nil {
+			if candidate == "HEAD" {
+				if target, _ := repo.readSymref("HEAD"); target != "" {
+					return target, sha, nil
+				}
+			}
+			return candidate, sha, nil
+		}
+	}
+	if sha, err := repo.findObject(name); err == nil {
+		return name, sha, nil
+	}
+	return "", "", fmt.Errorf("error: src refspec %s does not match any", name)
+}
+
+func expandRemoteName(name string, remoteRefs map[string]string) string {
+	for _, candidate := range []string{name, "refs/heads/" + name, "refs/tags/" + name} {
+		if _, ok := remoteRefs[candidate]; ok {
+			return candidate
+		}
+	}
+	return name
+}
+
+// checkPushUpdates rejects what the remote would lose history from
+// before anything is sent, the same checks git does on its side
+func (repo *Repository) checkPushUpdates(updates []*pushUpdate, opts pushOptions) {
+	for _, update := range updates {
+		if update.oldSha == update.newSha {
+			update.status = '='
+			continue
+		}
+
+		if expect, leased, ok := repo.leaseFor(update, opts.leases); leased {
+			if !ok || expect != update.oldSha {
+				update.status, update.reason = '!', "stale info"
+				continue
+			}
+			update.force = true
+		}
+
+		if isZeroSha(update.oldSha) || isZeroSha(update.newSha) {
+			continue
+		}
+		if update.force {
+			update.forced = !repo.hasObject(update.oldSha) || !repo.isAncestor(update.oldSha, update.newSha)
+			continue
+		}
+		switch {
+		case strings.HasPrefix(update.dst, "refs/tags/"):
+			update.status, update.reason = '!', "already exists"
+		case !repo.hasObject(update.oldSha):
+			update.status, update.reason = '!', "fetch first"
+		case !repo.isAncestor(update.oldSha, update.newSha):
+			update.status, update.reason = '!', "non-fast-forward"
+		}
+	}
+}
+
+// leaseFor gives the value the remote ref is expected to still have
+// taken from --force-with-lease=ref:expect or from the remote-tracking ref
+// leased is false for a ref no lease names when there's no bare --force-with-lease to cover every ref
+func (repo *Repository) leaseFor(update *pushUpdate, leases []string) (expect string, leased, ok bool) {
+	fromTracking := false
+	for _, lease := range leases {
+		for _, entry := range strings.Split(lease, ",") {
+			if entry == "" {
+				fromTracking = true
+				continue
+			}
+			ref, expect, hasExpect := strings.Cut(entry, ":")
+			if ref != update.dst && "refs/heads/"+ref != update.dst && "refs/tags/"+ref != update.dst {
+				continue
+			}
+			if !hasExpect {
+				fromTracking = true
+				continue
+			}
+			if expect == "" {
+				return repo.format.zero(), true, true
+			}
+			sha, err := repo.findObject(expect)
+			return sha, true, err == nil
+		}
+	}
+	if !fromTracking {
+		return "", false, false
+	}
+
+	tracking, ok := repo.trackingRef(update.remote, update.dst)
+	if !ok {
+		return "", true, false
+	}
+	sha, err := repo.readRef(tracking)
+	if err != nil {
+		return repo.format.zero(), true, true
+	}
+	return sha, true, true
+}
+
+// trackingRef maps a ref on the remote onto the local ref that tracks it
+func (repo *Repository) trackingRef(remote, name string) (string, bool) {
+	for _, arg := range repo.conf.GetAll("remote." + remote + ".fetch") {
+		spec, err := parseRefspec(arg)
+		if err != nil {
+			continue
+		}
+		if local, ok := spec.match(name); ok && local != "" {
+			return local, true
+		}
+	}
+	return "", false
+}
+
+// sendPush sends the ref updates and the pack they need, then reads back the report
+func (repo *Repository) sendPush(conn *remoteConn, updates []*pushUpdate, remoteRefs map[string]string, opts pushOptions) error {
+	caps := []string{"report-status", "agent=" + agent}
+	sideband := conn.caps.has("side-band-64k")
+	if sideband {
+		caps = append(caps, "side-band-64k")
+	}
+	if opts.atomic {
+		caps = append(caps, "atomic")
+	}
+	if opts.quiet && conn.caps.has("quiet") {
+		caps = append(caps, "quiet")
+	}
+	if conn.caps.has("object-format") {
+		caps = append(caps, "object-format="+conn.caps["object-format"])
+	}
+
+	var wants []string
+	for i, update := range updates {
+		var err error
+		if i == 0 {
+			err = conn.enc.Encodef("%s %s %s\x00%s\n", update.oldSha, update.newSha, update.dst, strings.Join(caps, " "))
+		} else {
+			err = conn.enc.Encodef("%s %s %s\n", update.oldSha, update.newSha, update.dst)
+		}
+		if err != nil {
+			return err
+		}
+		if !isZeroSha(update.newSha) {
+			wants = append(wants, update.newSha)
+		}
+	}
+	if err := conn.enc.Flush(); err != nil {
+		return err
+	}
+	conn.sent = true
+
+	if len(wants) > 0 {
+		var haves []string
+		for _, sha := range remoteRefs {
+			if repo.hasObject(sha) {
+				haves = append(haves, sha)
+			}
+		}
+		objects, err := repo.objectsToSend(wants, haves, nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := repo.writePack(conn.enc.Raw(), objects); err != nil {
+			return err
+		}
+	}
+
+	var report io.Reader = conn.dec.Raw()
+	if sideband {
+		report = pktline.NewDemuxer(conn.dec, &remoteProgress{w: os.Stderr})
+	}
+	return readPushReport(pktline.NewDecoder(report), updates)
+}
+
+func readPushReport(dec *pktline.Decoder, updates []*pushUpdate) error {
+	byName := make(map[string]*pushUpdate)
+	for _, update := range updates {
+		byName[update.dst] = update
+	}
+
+	unpack, err := dec.DecodeText()
+	if err != nil {
+		return fmt.Errorf("Couldn't read push status: %w", err)
+	}
+	if unpack != "unpack ok" {
+		fmt.Fprintf(os.Stderr, "error: remote %s\n", strings.TrimPrefix(unpack, "unpack "))
+	}
+
+	for {
+		packet, err := dec.Decode()
+		if err != nil {
+			return fmt.Errorf("Couldn't read push status: %w", err)
+		}
+		if packet.IsFlush() {
+			return nil
+		}
+
+		line := packet.Text()
+		if name, ok := strings.CutPrefix(line, "ok "); ok {
+			if update := byName[name]; update != nil {
+				update.status = 'o'
+			}
+		} else if rest, ok := strings.CutPrefix(line, "ng "); ok {
+			name, reason, _ := strings.Cut(rest, " ")
+			if update := byName[name]; update != nil {
+				update.status, update.reason = 'r', reason
+			}
+		}
+	}
+}
+
+// reportPush prints the per ref summary the way git does
+// and moves remote-tracking refs along with whatever went through
+func (repo *Repository) reportPush(url, remote string, updates []*pushUpdate, opts pushOptions) error {
+	failed := false
+	allUpToDate := true
+	var lines []string
+
+	for _, update := range updates {
+		from := shortRefName(update.src)
+		to := shortRefName(update.dst)
+		var line string
+
+		switch update.status {
+		case '=':
+			continue
+		case '!':
+			line = fmt.Sprintf(" ! %-17s %s -> %s (%s)", "[rejected]", from, to, update.reason)
+		case 'r':
+			line = fmt.Sprintf(" ! %-17s %s -> %s (%s)", "[remote rejected]", from, to, update.reason)
+		case 'o':
+			if tracking, ok := repo.trackingRef(remote, update.dst); ok {
+				if isZeroSha(update.newSha) {
+					repo.deleteRef(tracking)
+				} else {
+					repo.writeRef(tracking, update.newSha)
+				}
+			}
+			line = pushSummary(update, from, to)
+		default:
+			line = fmt.Sprintf(" ! %-17s %s -> %s (%s)", "[rejected]", from, to, "no status from remote")
+			update.status = '!'
+		}
+
+		allUpToDate = false
+		if update.status != 'o' {
+			failed = true
+		}
+		if !opts.quiet || update.status != 'o' {
+			lines = append(lines, line)
+		}
+	}
+
+	if allUpToDate {
+		if !opts.quiet {
+			fmt.Fprintln(os.Stderr, "Everything up-to-date")
+		}
+		return nil
+	}
+	if len(lines) > 0 {
+		fmt.Fprintf(os.Stderr, "To %s\n%s\n", url, strings.Join(lines, "\n"))
+	}
+	if failed {
+		return fmt.Errorf("error: failed to push some refs to '%s'", url)
+	}
+	return nil
+}
+
+func pushSummary(update *pushUpdate, from, to string) string {
+	switch {
+	case isZeroSha(update.newSha):
+		return fmt.Sprintf(" - %-17s %s", "[deleted]", to)
+	case isZeroSha(update.oldSha):
+		return fmt.Sprintf(" * %-17s %s -> %s", "[new "+refKind(update.dst)+"]", from, to)
+	case update.forced:
+		return fmt.Sprintf(" + %-17s %s -> %s (forced update)", update.oldSha[:7]+"..."+update.newSha[:7], from, to)
+	default:
+		return fmt.Sprintf("   %-17s %s -> %s", update.oldSha[:7]+".."+update.newSha[:7], from, to)
+	}
+}
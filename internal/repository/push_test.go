@@ -0,0 +1,49 @@
+package repository
+
+import "testing"
+
+func TestPushLeaseOnlyCoversNamedRefs(t *testing.T) {
+	repo := newTestRepo(t, true)
+	base := commitTestFiles(t, repo, map[string]string{"a": "a\n"})
+	theirs := commitTestFiles(t, repo, map[string]string{"a": "theirs\n"}, base)
+	ours := commitTestFiles(t, repo, map[string]string{"a": "ours\n"}, base)
+	repo.conf.set("remote.origin.fetch", "+refs/heads/*:refs/remotes/origin/*", ScopeLocal, "test")
+	if err := repo.writeRef("refs/remotes/origin/a", theirs); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.writeRef("refs/remotes/origin/b", base); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		leases []string
+		// status and reason for refs/heads/a then refs/heads/b, both rewinding theirs to ours
+		want [2]string
+	}{
+		{nil, [2]string{"! non-fast-forward", "! non-fast-forward"}},
+		{[]string{"a:" + theirs}, [2]string{"forced", "! non-fast-forward"}},
+		{[]string{"refs/heads/a"}, [2]string{"forced", "! non-fast-forward"}},
+		{[]string{"b"}, [2]string{"! non-fast-forward", "! stale info"}},
+		{[]string{"a:" + base}, [2]string{"! stale info", "! non-fast-forward"}},
+		{[]string{""}, [2]string{"forced", "! stale info"}},
+		{[]string{"", "b:" + theirs}, [2]string{"forced", "forced"}},
+	}
+	for _, tt := range tests {
+		updates := []*pushUpdate{
+			{dst: "refs/heads/a", oldSha: theirs, newSha: ours, remote: "origin"},
+			{dst: "refs/heads/b", oldSha: theirs, newSha: ours, remote: "origin"},
+		}
+		repo.checkPushUpdates(updates, pushOptions{leases: tt.leases})
+		for i, update := range updates {
+			got := "forced"
+			if update.status != 0 {
+				got = string(update.status) + " " + update.reason
+			} else if !update.forced {
+				got = "fast-forward"
+			}
+			if got != tt.want[i] {
+				t.Errorf("leases %q: %s is %q, want %q", tt.leases, update.dst, got, tt.want[i])
+			}
+		}
+	}
+}
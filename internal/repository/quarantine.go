@@ -0,0 +1,154 @@
+package repository
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+/*
+ * the objects a push brings in are kept apart until its ref updates are known to be wanted
+ * the same as git's tmp_objdir, so a refused push leaves nothing behind for gc to find
+ *
+ * they're written loose to objects/incoming-XXXXXX and read from there before the rest
+ * once the checks pass they're moved into objects/, otherwise the directory is thrown away
+ * the quarantine isn't a place objects are looked for by anything else, so nothing can come to depend on them
+ */
+
+type quarantineObjects struct {
+	repo *Repository
+	dir  string
+	base ObjectStorage
+}
+
+func (q *quarantineObjects) path(sha string) string {
+	return filepath.Join(q.dir, sha[:2], sha[2:])
+}
+
+func (q *quarantineObjects) ReadObject(sha string) (string, []byte, error) {
+	objKind, contents, err := q.repo.readLooseObject(q.path(sha))
+	if os.IsNotExist(err) {
+		return q.base.ReadObject(sha)
+	}
+	return objKind, contents, err
+}
+
+func (q *quarantineObjects) OpenObject(sha string) (string, int64, io.ReadCloser, error) {
+	objKind, size, r, err := q.repo.openLooseObject(q.path(sha))
+	if !os.IsNotExist(err) {
+		return objKind, size, r, err
+	}
+	if opener, ok := q.base.(objectOpener); ok {
+		return opener.OpenObject(sha)
+	}
+	objKind, contents, err := q.base.ReadObject(sha)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return objKind, int64(len(contents)), io.NopCloser(bytes.NewReader(contents)), nil
+}
+
+func (q *quarantineObjects) HasObject(sha string) bool {
+	if _, err := os.Stat(q.path(sha)); err == nil {
+		return true
+	}
+	return q.base.HasObject(sha)
+}
+
+// WriteObject leaves out what's already stored outside the quarantine
+func (q *quarantineObjects) WriteObject(sha, kind string, contents []byte) error {
+	if q.base.HasObject(sha) {
+		return nil
+	}
+	return q.repo.writeLooseObject(q.path(sha), sha, kind, contents)
+}
+
+func (q *quarantineObjects) ObjectsWithPrefix(prefix string) ([]string, error) {
+	matches, err := q.base.ObjectsWithPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	loose, _ := filepath.Glob(filepath.Join(q.dir, prefix[:2], prefix[2:]+"*"))
+	for _, match := range loose {
+		matches = append(matches, prefix[:2]+filepath.Base(match))
+	}
+	slices.Sort(matches)
+	return slices.Compact(matches), nil
+}
+
+// looseDir is where loose objects are written, when the store keeps them on disk
+func (repo *Repository) looseDir() (string, bool) {
+	switch store := repo.objects.(type) {
+	case *diskObjects:
+		return repo.makePath("objects"), true
+	case *quarantineObjects:
+		return store.dir, true
+	}
+	return "", false
+}
+
+// quarantine has objects written from now on go to a directory of their own
+// a store that isn't on disk has nowhere for one, and takes objects as it always does
+func (repo *Repository) quarantine() error {
+	if _, ok := repo.objects.(*diskObjects); !ok {
+		return nil
+	}
+	dir, err := os.MkdirTemp(repo.makePath("objects"), "incoming-")
+	if err != nil {
+		return fmt.Errorf("Couldn't create quarantine: %w", err)
+	}
+	repo.objects = &quarantineObjects{repo: repo, dir: dir, base: repo.objects}
+	return nil
+}
+
+// endQuarantine moves what's in the quarantine in with the rest of the objects when keep is set
+// and throws it away otherwise
+func (repo *Repository) endQuarantine(keep bool) error {
+	q, ok := repo.objects.(*quarantineObjects)
+	if !ok {
+		return nil
+	}
+	repo.objects = q.base
+	defer os.RemoveAll(q.dir)
+	if !keep {
+		// objects read while they were quarantined mustn't still be found in the cache
+		repo.odb.cache.clear()
+		return nil
+	}
+
+	dirs, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(q.dir, dir.Name()))
+		if err != nil {
+			return err
+		}
+		dst := repo.makePath("objects", dir.Name())
+		if err := os.MkdirAll(dst, 0o755); err != nil {
+			return fmt.Errorf("Couldn't create directories: %w", err)
+		}
+		for _, file := range files {
+			if strings.HasPrefix(file.Name(), "tmp_obj_") {
+				continue
+			}
+			// an object that turned up meanwhile is the same object, so it's left as it is
+			path := filepath.Join(dst, file.Name())
+			if _, err := os.Stat(path); err == nil {
+				continue
+			}
+			if err := os.Rename(filepath.Join(q.dir, dir.Name(), file.Name()), path); err != nil {
+				return fmt.Errorf("Couldn't move object out of quarantine: %w", err)
+			}
+		}
+	}
+	return nil
+}
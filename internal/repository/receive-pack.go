@@ -0,0 +1,398 @@
+package repository
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/joeldotdias/twine/pkg/pktline"
+)
+
+/*
+ * receive-pack is the side of a push that takes the objects
+ *
+ * server: refs with capabilities on the first line, flush
+ * client: <old-sha> <new-sha> <ref>... flush, then a pack unless every command is a delete
+ * server: unpack ok, then ok <ref> or ng <ref> <reason> for each command
+ */
+
+type refUpdate struct {
+	oldSha string
+	newSha string
+	name   string
+	// why the update was refused, empty when it went through
+	err string
+}
+
+func (repo *Repository) receivePack(args []string) error {
+	opts, dir, err := parseServiceArgs("receive-pack", args)
+	if err != nil {
+		return err
+	}
+
+	dst, err := openLocalRemote(dir)
+	if err != nil {
+		return err
+	}
+
+	return dst.serveReceivePack(os.Stdin, os.Stdout, opts)
+}
+
+func (repo *Repository) serveReceivePack(r io.Reader, w io.Writer, opts serviceOptions) error {
+	enc := pktline.NewEncoder(w)
+	dec := pktline.NewDecoder(r)
+
+	if !opts.statelessRPC || opts.advertiseRefs {
+		refs, err := repo.advertisedRefs()
+		if err != nil {
+			return err
+		}
+		// HEAD isn't something that can be pushed to
+		if len(refs) > 0 && refs[0].name == "HEAD" {
+			refs = refs[1:]
+		}
+		for i := range refs {
+			refs[i].peeled = ""
+		}
+		caps := []string{"report-status", "delete-refs", "side-band-64k", "quiet", "atomic", "ofs-delta", "object-format=" + repo.format.name, "agent=" + agent}
+		if err := advertiseRefs(enc, repo.format, refs, caps); err != nil {
+			return err
+		}
+	}
+	if opts.advertiseRefs {
+		return nil
+	}
+
+	updates, clientCaps, err := readRefUpdates(dec)
+	if err != nil {
+		return err
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	if err := repo.checkClientFormat(clientCaps); err != nil {
+		return err
+	}
+
+	unpackErr := error(nil)
+	for _, update := range updates {
+		if !isZeroSha(update.newSha) {
+			if unpackErr = repo.quarantine(); unpackErr == nil {
+				_, unpackErr = repo.unpackObjects(dec.Raw())
+			}
+			break
+		}
+	}
+
+	atomic := clientCaps.has("atomic")
+	if unpackErr == nil {
+		repo.checkRefUpdates(updates, atomic)
+	}
+	// the objects pushed are only let in once some ref is going to point at them
+	accepted := unpackErr == nil && slices.ContainsFunc(updates, func(update *refUpdate) bool { return update.err == "" })
+	if err := repo.endQuarantine(accepted); err != nil && unpackErr == nil {
+		unpackErr = err
+	}
+
+	if unpackErr != nil {
+		for _, update := range updates {
+			update.err = "unpacker error"
+		}
+	} else {
+		repo.updateRefs(updates, atomic)
+	}
+
+	if !clientCaps.has("report-status") {
+		return unpackErr
+	}
+	return reportStatus(enc, updates, unpackErr, clientCaps.has("side-band-64k"))
+}
+
+func readRefUpdates(dec *pktline.Decoder) ([]*refUpdate, capabilities, error) {
+	var updates []*refUpdate
+	caps := make(capabilities)
+
+	for {
+		packet, err := dec.Decode()
+		if err == io.EOF && len(updates) == 0 {
+			return nil, caps, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if packet.IsFlush() {
+			return updates, caps, nil
+		}
+
+		line := packet.Text()
+		if len(updates) == 0 {
+			var list string
+			line, list, _ = strings.Cut(line, "\x00")
+			caps = parseCapabilities(list)
+		}
+
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, nil, fmt.Errorf("protocol error: expected old/new/ref, got '%s'", line)
+		}
+		for _, sha := range fields[:2] {
+			if err := validSha(sha); err != nil {
+				return nil, nil, err
+			}
+		}
+		updates = append(updates, &refUpdate{oldSha: fields[0], newSha: fields[1], name: fields[2]})
+	}
+}
+
+// checkRefUpdates checks every update against the current refs before touching any of them
+// so an atomic push either goes through completely or not at all
+func (repo *Repository) checkRefUpdates(updates []*refUpdate, atomic bool) {
+	for _, update := range updates {
+		update.err = repo.checkRefUpdate(update)
+	}
+	repo.checkConnected(updates)
+
+	if atomic {
+		failed := false
+		for _, update := range updates {
+			failed = failed || update.err != ""
+		}
+		if failed {
+			for _, update := range updates {
+				if update.err == "" {
+					update.err = "atomic transaction failed"
+				}
+			}
+		}
+	}
+}
+
+// updateRefs makes the updates that checkRefUpdates let through
+func (repo *Repository) updateRefs(updates []*refUpdate, atomic bool) {
+	// the checks are done again with the refs locked, so a push that got in meanwhile isn't lost
+	var changes []refChange
+	var changed []*refUpdate
+	for _, update := range updates {
+		if update.err != "" {
+			continue
+		}
+		change := refChange{name: update.name}
+		if !isZeroSha(update.oldSha) {
+			change.old = update.oldSha
+		}
+		if !isZeroSha(update.newSha) {
+			change.value = update.newSha
+		}
+
+		if atomic {
+			changes = append(changes, change)
+			changed = append(changed, update)
+			continue
+		}
+		if err := repo.changeRefs([]refChange{change}); err != nil {
+			update.err = "failed to update ref"
+		} else if !repo.updateInstead(update) {
+			repo.changeRefs([]refChange{undoRefChange(change)})
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	if err := repo.changeRefs(changes); err != nil {
+		for _, update := range changed {
+			update.err = "failed to update ref"
+		}
+		return
+	}
+	for _, update := range changed {
+		if repo.updateInstead(update) {
+			continue
+		}
+		undo := make([]refChange, len(changes))
+		for i, change := range changes {
+			undo[i] = undoRefChange(change)
+		}
+		repo.changeRefs(undo)
+		for _, other := range changed {
+			if other.err == "" {
+				other.err = "atomic transaction failed"
+			}
+		}
+		return
+	}
+}
+
+// updateInstead moves the work tree along with the branch checked out in it
+// which is only done once the ref has moved, so a ref that couldn't be moved leaves the files alone
+// false means the work tree couldn't be moved and the ref should go back to where it was
+func (repo *Repository) updateInstead(update *refUpdate) bool {
+	if isZeroSha(update.newSha) || !repo.isCheckedOut(update.name) || repo.conf.Value("receive.denyCurrentBranch", "refuse") != "updateInstead" {
+		return true
+	}
+	if err := repo.switchWorktree(update.oldSha, update.newSha); err != nil {
+		update.err = "Working directory has unstaged changes"
+		return false
+	}
+	return true
+}
+
+func (repo *Repository) isCheckedOut(name string) bool {
+	return repo.worktree != "" && name == "refs/heads/"+currentBranch(repo.gitDir)
+}
+
+// worktreeClean says if nothing was changed since commit was checked out
+func (repo *Repository) worktreeClean(commit string) bool {
+	index, err := repo.readIndex()
+	if err != nil {
+		return false
+	}
+	repo.index = index
+
+	tree, err := repo.commitTree(commit)
+	if err != nil {
+		return false
+	}
+	entries, err := repo.flattenTree(tree)
+	if err != nil {
+		return false
+	}
+	changes, err := repo.localChanges(entries)
+	return err == nil && len(changes) == 0
+}
+
+func (repo *Repository) checkRefUpdate(update *refUpdate) string {
+	if rest, ok := strings.CutPrefix(update.name, "refs/"); !ok || !validRefname(rest) {
+		return "funny refname"
+	}
+
+	current, err := repo.readRef(update.name)
+	if err != nil {
+		current = repo.format.zero()
+	}
+	if isZeroSha(update.newSha) && isZeroSha(current) {
+		return "deletion of a nonexistent ref"
+	}
+	if current != update.oldSha {
+		return "stale info"
+	}
+	if !isZeroSha(update.newSha) {
+		if _, _, err := repo.readObject(update.newSha); err != nil {
+			return "bad pack"
+		}
+	}
+
+	denyDeletes, err := repo.conf.Bool("receive.denyDeletes", false)
+	if err != nil {
+		return err.Error()
+	}
+	denyNonFastForwards, err := repo.conf.Bool("receive.denyNonFastForwards", false)
+	if err != nil {
+		return err.Error()
+	}
+
+	checkedOut := repo.isCheckedOut(update.name)
+	switch {
+	case isZeroSha(update.newSha) && checkedOut && repo.conf.Value("receive.denyDeleteCurrent", "refuse") != "ignore":
+		return "deletion of the current branch prohibited"
+	case isZeroSha(update.newSha) && denyDeletes:
+		return "deletion prohibited"
+	case isZeroSha(update.newSha) || isZeroSha(current):
+	case denyNonFastForwards && !repo.isAncestor(current, update.newSha):
+		return "non-fast-forward"
+	}
+
+	if checkedOut && !isZeroSha(update.newSha) {
+		switch repo.conf.Value("receive.denyCurrentBranch", "refuse") {
+		case "ignore", "false", "warn":
+		case "updateInstead":
+			// the worktree is moved along later on, as long as it's clean
+			if !repo.worktreeClean(current) {
+				return "Working directory has unstaged changes"
+			}
+		default:
+			return "branch is currently checked out"
+		}
+	}
+	return ""
+}
+
+// checkConnected refuses updates whose new objects don't lead all the way back to what the refs have
+// a pack can hold a commit without its tree, and a ref pointing at that would leave the repository broken
+// all the tips are walked together, and one at a time only when that finds something missing
+func (repo *Repository) checkConnected(updates []*refUpdate) {
+	var tips []string
+	for _, update := range updates {
+		if update.err == "" && !isZeroSha(update.newSha) {
+			tips = append(tips, update.newSha)
+		}
+	}
+	if len(tips) == 0 || repo.isConnected(tips) {
+		return
+	}
+	for _, update := range updates {
+		if update.err == "" && !isZeroSha(update.newSha) && !repo.isConnected([]string{update.newSha}) {
+			update.err = "missing necessary objects"
+		}
+	}
+}
+
+// isConnected says if everything the tips reach is here
+// short of what the refs already reach, which is taken to be complete
+func (repo *Repository) isConnected(tips []string) bool {
+	refs, err := repo.readRefs()
+	if err != nil {
+		return false
+	}
+	walk := repo.newRevWalk()
+	for _, sha := range refs {
+		// a ref that can't be walked hides less, which only makes the check slower
+		walk.hide(sha)
+	}
+
+	for _, tip := range tips {
+		if err := walk.add(tip); err != nil {
+			return false
+		}
+	}
+	// blobs are listed without being read
+	for _, sha := range walk.objects {
+		if !repo.hasObject(sha) {
+			return false
+		}
+	}
+	return true
+}
+
+// reportStatus tells the client how each ref update went
+// wrapping the whole report in sideband when it was asked for
+func reportStatus(enc *pktline.Encoder, updates []*refUpdate, unpackErr error, sideband bool) error {
+	var buf bytes.Buffer
+	report := pktline.NewEncoder(&buf)
+
+	if unpackErr != nil {
+		report.Encodef("unpack %s\n", unpackErr)
+	} else {
+		report.Encodef("unpack ok\n")
+	}
+	for _, update := range updates {
+		if update.err != "" {
+			report.Encodef("ng %s %s\n", update.name, update.err)
+		} else {
+			report.Encodef("ok %s\n", update.name)
+		}
+	}
+	report.Flush()
+
+	if !sideband {
+		_, err := enc.Raw().Write(buf.Bytes())
+		return err
+	}
+	data := pktline.NewSidebandWriter(enc, pktline.BandData, pktline.LargeSideband)
+	if _, err := data.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
@@ -0,0 +1,252 @@
+package repository
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/joeldotdias/twine/pkg/pktline"
+)
+
+// receiveRequest is a push of commands along with a pack of objects from src
+func receiveRequest(t *testing.T, src *Repository, commands []string, objects []string) *bytes.Buffer {
+	t.Helper()
+	var request bytes.Buffer
+	enc := pktline.NewEncoder(&request)
+	for i, command := range commands {
+		if i == 0 {
+			command += "\x00report-status"
+		}
+		enc.Encodef("%s\n", command)
+	}
+	enc.Flush()
+	if len(objects) > 0 {
+		if err := src.writePack(&request, objects); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &request
+}
+
+// receive sends commands and a pack of objects from src to repo's receive-pack, giving back its report
+func receive(t *testing.T, repo, src *Repository, commands []string, objects []string) []string {
+	t.Helper()
+	var response bytes.Buffer
+	request := receiveRequest(t, src, commands, objects)
+	if err := repo.serveReceivePack(request, &response, serviceOptions{statelessRPC: true}); err != nil {
+		t.Fatal(err)
+	}
+	return readReport(t, &response)
+}
+
+func readReport(t *testing.T, r *bytes.Buffer) []string {
+	t.Helper()
+	var report []string
+	dec := pktline.NewDecoder(r)
+	for {
+		packet, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.IsFlush() {
+			return report
+		}
+		report = append(report, packet.Text())
+	}
+}
+
+// objectsOf lists a commit, its tree and the tree's blobs, assuming the tree is flat
+func objectsOf(t *testing.T, repo *Repository, commit string) []string {
+	t.Helper()
+	tree, err := repo.commitTree(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := []string{commit, tree}
+	leaves, err := repo.readTree(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leaf := range leaves.leaves {
+		objects = append(objects, fmt.Sprintf("%x", leaf.sha))
+	}
+	return objects
+}
+
+func TestReceivePackRefusesMissingObjects(t *testing.T) {
+	src := newTestRepo(t, true)
+	commit := commitTestFiles(t, src, map[string]string{"a": "a\n"})
+	repo := newTestRepo(t, true)
+	zero := repo.format.zero()
+
+	report := receive(t, repo, src, []string{zero + " " + commit + " refs/heads/main"}, []string{commit})
+	want := []string{"unpack ok", "ng refs/heads/main missing necessary objects"}
+	if !slices.Equal(report, want) {
+		t.Fatalf("commit without its tree: report %q, want %q", report, want)
+	}
+	if _, err := repo.readRef("refs/heads/main"); err == nil {
+		t.Fatal("refs/heads/main points at a commit without its tree")
+	}
+
+	report = receive(t, repo, src, []string{zero + " " + commit + " refs/heads/main"}, objectsOf(t, src, commit))
+	want = []string{"unpack ok", "ok refs/heads/main"}
+	if !slices.Equal(report, want) {
+		t.Fatalf("whole commit: report %q, want %q", report, want)
+	}
+
+	// a commit on top of what's there needs only what's new
+	next := commitTestFiles(t, src, map[string]string{"a": "a\n", "b": "b\n"}, commit)
+	report = receive(t, repo, src, []string{commit + " " + next + " refs/heads/main"}, objectsOf(t, src, next)[:2])
+	want = []string{"unpack ok", "ng refs/heads/main missing necessary objects"}
+	if !slices.Equal(report, want) {
+		t.Fatalf("commit without a new blob: report %q, want %q", report, want)
+	}
+}
+
+func TestReceivePackRefusesFunnyRefnames(t *testing.T) {
+	src := newTestRepo(t, true)
+	commit := commitTestFiles(t, src, map[string]string{"a": "a\n"})
+	repo := newTestRepo(t, true)
+	zero := repo.format.zero()
+
+	names := []string{
+		"refs/heads/a.lock",
+		"refs/heads//a",
+		"refs/heads/.a",
+		"refs/heads/a/",
+		"refs/heads/a.",
+		"refs/heads/a..b",
+		"refs/heads/a@{1}",
+		"refs/heads/a\x01",
+		"refs/heads/a\x7f",
+		"refs/heads/a b",
+		"HEAD",
+		"refs/",
+	}
+	for _, c := range "~^:?*[\\" {
+		names = append(names, "refs/heads/a"+string(c)+"b")
+	}
+
+	var commands []string
+	want := []string{"unpack ok"}
+	for _, name := range names {
+		commands = append(commands, zero+" "+commit+" "+name)
+		want = append(want, "ng "+name+" funny refname")
+	}
+	commands = append(commands, zero+" "+commit+" refs/heads/fine-name/v1.0")
+	want = append(want, "ok refs/heads/fine-name/v1.0")
+
+	report := receive(t, repo, src, commands, objectsOf(t, src, commit))
+	if !slices.Equal(report, want) {
+		t.Errorf("report %q\nwant %q", report, want)
+	}
+}
+
+func TestReceivePackUpdateInsteadMovesWorktreeAfterRef(t *testing.T) {
+	src := newTestRepo(t, true)
+	repo := newTestRepo(t, false)
+	commit := commitTestFiles(t, src, map[string]string{"a": "one\n"})
+	next := commitTestFiles(t, src, map[string]string{"a": "two\n", "b": "b\n"}, commit)
+	if sha := commitTestFiles(t, repo, map[string]string{"a": "one\n"}); sha != commit {
+		t.Fatalf("same commit came out as %s and %s", commit, sha)
+	}
+	branch := "refs/heads/" + currentBranch(repo.gitDir)
+	if err := repo.writeRef(branch, commit); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.checkoutCommit(commit); err != nil {
+		t.Fatal(err)
+	}
+	repo.conf.set("receive.denyCurrentBranch", "updateInstead", ScopeLocal, "test")
+
+	file := func(name string) string {
+		data, _ := os.ReadFile(filepath.Join(repo.worktree, name))
+		return string(data)
+	}
+	push := func(want ...string) {
+		t.Helper()
+		report := receive(t, repo, src, []string{commit + " " + next + " " + branch}, objectsOf(t, src, next))
+		if want = append([]string{"unpack ok"}, want...); !slices.Equal(report, want) {
+			t.Fatalf("report %q, want %q", report, want)
+		}
+	}
+
+	// a ref that can't be moved leaves the work tree where it was
+	lock := filepath.Join(repo.gitDir, filepath.FromSlash(branch)+".lock")
+	if err := os.WriteFile(lock, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	push("ng " + branch + " failed to update ref")
+	if got := file("a"); got != "one\n" {
+		t.Fatalf("work tree moved to %q for a ref that didn't", got)
+	}
+	os.Remove(lock)
+
+	// and a work tree that can't be moved puts the ref back
+	if err := os.WriteFile(filepath.Join(repo.worktree, "b"), []byte("untracked\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	push("ng " + branch + " Working directory has unstaged changes")
+	if sha, _ := repo.readRef(branch); sha != commit {
+		t.Fatalf("%s is at %s for a work tree that didn't move", branch, sha)
+	}
+	os.Remove(filepath.Join(repo.worktree, "b"))
+
+	push("ok " + branch)
+	if sha, _ := repo.readRef(branch); sha != next {
+		t.Fatalf("%s is at %s after the push", branch, sha)
+	}
+	if file("a") != "two\n" || file("b") != "b\n" {
+		t.Fatalf("work tree has a %q, b %q after the push", file("a"), file("b"))
+	}
+}
+
+func TestReceivePackQuarantinesRefusedPushes(t *testing.T) {
+	src := newTestRepo(t, true)
+	commit := commitTestFiles(t, src, map[string]string{"a": "a\n", "big": strings.Repeat("big\n", 1<<10)})
+	repo := newTestRepo(t, true)
+	repo.conf.set("core.bigFileThreshold", "1k", ScopeLocal, "test")
+	zero := repo.format.zero()
+	objects := objectsOf(t, src, commit)
+
+	leftovers := func() []string {
+		t.Helper()
+		var found []string
+		for _, sha := range objects {
+			if repo.hasObject(sha) {
+				found = append(found, sha)
+			}
+		}
+		incoming, _ := filepath.Glob(filepath.Join(repo.gitDir, "objects", "incoming-*"))
+		return append(found, incoming...)
+	}
+
+	report := receive(t, repo, src, []string{zero + " " + commit + " refs/heads/bad..name"}, objects)
+	if want := []string{"unpack ok", "ng refs/heads/bad..name funny refname"}; !slices.Equal(report, want) {
+		t.Fatalf("report %q, want %q", report, want)
+	}
+	if left := leftovers(); len(left) > 0 {
+		t.Fatalf("a refused push left %q behind", left)
+	}
+
+	// a pack that's cut short leaves nothing either
+	request := receiveRequest(t, src, []string{zero + " " + commit + " refs/heads/main"}, objects)
+	request.Truncate(request.Len() - 30)
+	var response bytes.Buffer
+	repo.serveReceivePack(request, &response, serviceOptions{statelessRPC: true})
+	if left := leftovers(); len(left) > 0 {
+		t.Fatalf("a broken pack left %q behind", left)
+	}
+
+	report = receive(t, repo, src, []string{zero + " " + commit + " refs/heads/main"}, objects)
+	if want := []string{"unpack ok", "ok refs/heads/main"}; !slices.Equal(report, want) {
+		t.Fatalf("report %q, want %q", report, want)
+	}
+	if left := leftovers(); len(left) != len(objects) {
+		t.Fatalf("an accepted push has %q of %q", left, objects)
+	}
+}
@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * reflogs live under logs/ with the same names as the refs they follow
+ * each update of the ref adds a line
+ *
+ * <old sha> <new sha> Name <email> <unix time> <+hhmm>\t<message>
+ */
+
+type reflogEntry struct {
+	old string
+	new string
+	// when the ref was updated, 0 if the line doesn't say
+	timestamp int64
+	// the line as it was, which is what gets written back
+	line string
+}
+
+// reflogNames lists every reflog, named like the ref it belongs to
+func (repo *Repository) reflogNames() ([]string, error) {
+	var names []string
+	logsDir := repo.makePath("logs")
+	err := filepath.WalkDir(logsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(logsDir, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (repo *Repository) readReflog(name string) ([]reflogEntry, error) {
+	file, err := os.Open(repo.makePath("logs", filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []reflogEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		entry := reflogEntry{old: fields[0], new: fields[1], line: line}
+		ident, _, _ := strings.Cut(line, "\t")
+		if end := strings.LastIndexByte(ident, '>'); end != -1 {
+			if when := strings.Fields(ident[end+1:]); len(when) > 0 {
+				entry.timestamp, _ = strconv.ParseInt(when[0], 10, 64)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// writeReflog replaces a reflog with the given entries
+func (repo *Repository) writeReflog(name string, entries []reflogEntry) error {
+	var sb strings.Builder
+	for _, entry := range entries {
+		sb.WriteString(entry.line)
+		sb.WriteByte('\n')
+	}
+
+	path := repo.makePath("logs", filepath.FromSlash(name))
+	lock, err := lockPath(path)
+	if err != nil {
+		return err
+	}
+	if err := lock.commit([]byte(sb.String())); err != nil {
+		return fmt.Errorf("Couldn't update reflog for %s: %w", name, err)
+	}
+	return nil
+}
+
+// expireReflogs drops entries older than expire from every reflog
+// and entries older than expireUnreachable whose commit the ref can no longer reach
+func (repo *Repository) expireReflogs(expire, expireUnreachable int64) error {
+	names, err := repo.reflogNames()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		entries, err := repo.readReflog(name)
+		if err != nil {
+			return err
+		}
+
+		// what the ref points at now decides what's still reachable
+		var reachable map[string]bool
+		if tip, err := repo.readRef(name); err == nil && expireUnreachable > expire {
+			reachable = make(map[string]bool)
+			for _, sha := range repo.reachableCommits([]string{tip}) {
+				reachable[sha] = true
+			}
+		}
+
+		kept := entries[:0]
+		for _, entry := range entries {
+			if entry.timestamp < expire {
+				continue
+			}
+			if entry.timestamp < expireUnreachable && !reachable[entry.new] {
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		if len(kept) == len(entries) {
+			continue
+		}
+		if err := repo.writeReflog(name, kept); err != nil {
+			return err
+		}
+	}
+	return nil
+}
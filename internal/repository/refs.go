@@ -0,0 +1,392 @@
+package repository
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// symrefs pointing at symrefs are followed this many times at most
+const maxSymrefDepth = 5
+
+// readRefs lists every ref under refs/ mapped to the sha it points at
+func (repo *Repository) readRefs() (map[string]string, error) {
+	values, err := repo.refs.ListRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]string, len(values))
+	for name, value := range values {
+		sha := value
+		if target, ok := strings.CutPrefix(value, "ref: "); ok {
+			if sha, err = repo.readRef(target); err != nil {
+				// dangling symrefs like refs/remotes/origin/HEAD
+				// pointing at a branch that's gone
+				continue
+			}
+		}
+		refs[name] = sha
+	}
+
+	return refs, nil
+}
+
+/*
+ * packed-refs is a list of "<sha> <refname>" lines
+ * a line starting with ^ holds the peeled commit of the annotated tag above it
+ */
+func readPackedRefs(gitDir string) (map[string]string, error) {
+	refs := make(map[string]string)
+
+	file, err := os.Open(filepath.Join(gitDir, "packed-refs"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return refs, nil
+		}
+		return nil, fmt.Errorf("Couldn't read packed-refs: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		sha, name, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("Malformed packed-refs line: %s", line)
+		}
+		refs[name] = sha
+	}
+
+	return refs, scanner.Err()
+}
+
+// readSymref gives the ref a symbolic ref like HEAD points at
+// or an empty string if it holds a sha
+func (repo *Repository) readSymref(name string) (string, error) {
+	value, err := repo.refs.ReadRef(name)
+	if err != nil {
+		return "", err
+	}
+	target, ok := strings.CutPrefix(value, "ref: ")
+	if !ok {
+		return "", nil
+	}
+	return target, nil
+}
+
+// readRef resolves a full ref name like HEAD or refs/heads/main to a sha
+func (repo *Repository) readRef(name string) (string, error) {
+	for depth := 0; depth < maxSymrefDepth; depth++ {
+		value, err := repo.refs.ReadRef(name)
+		if err != nil {
+			return "", err
+		}
+		target, ok := strings.CutPrefix(value, "ref: ")
+		if !ok {
+			return value, nil
+		}
+		name = target
+	}
+
+	return "", fmt.Errorf("Too many levels of symbolic refs resolving %s", name)
+}
+
+// resolveRef expands a short name the way git does
+// trying it as is and then under refs/, tags, heads and remotes
+func (repo *Repository) resolveRef(ref string) (string, error) {
+	candidates := []string{
+		ref,
+		"refs/" + ref,
+		"refs/tags/" + ref,
+		"refs/heads/" + ref,
+		"refs/remotes/" + ref,
+		"refs/remotes/" + ref + "/HEAD",
+	}
+
+	for _, name := range candidates {
+		// only HEAD-like names are allowed to live outside refs/
+		if !strings.HasPrefix(name, "refs/") && strings.ToUpper(name) != name {
+			continue
+		}
+		sha, err := repo.readRef(name)
+		if err == nil {
+			return sha, nil
+		}
+	}
+
+	return "", fmt.Errorf("Didn't find ref %s", ref)
+}
+
+// validRefname follows git's check-ref-format rules
+// slash separated components that aren't empty, don't start with a dot or end in .lock,
+// and no "..", "@{", control characters, spaces or any of ~^:?*[\ anywhere
+func validRefname(name string) bool {
+	if name == "" || name == "@" || strings.HasSuffix(name, ".") ||
+		strings.Contains(name, "..") || strings.Contains(name, "@{") {
+		return false
+	}
+	for _, c := range []byte(name) {
+		if c < 0x20 || c == 0x7f || strings.IndexByte(" ~^:?*[\\", c) >= 0 {
+			return false
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || component[0] == '.' || strings.HasSuffix(component, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+// writeRef points a ref at a sha
+func (repo *Repository) writeRef(name, sha string) error {
+	return repo.refs.WriteRef(name, sha)
+}
+
+func (repo *Repository) writeSymref(name, target string) error {
+	return repo.refs.WriteRef(name, "ref: "+target)
+}
+
+func (repo *Repository) deleteRef(name string) error {
+	return repo.refs.DeleteRef(name)
+}
+
+// changeRefs moves refs as long as none of them moved since they were last read
+// a store that can't hold them still while it checks gets them checked and then written
+func (repo *Repository) changeRefs(changes []refChange) error {
+	if changer, ok := repo.refs.(refChanger); ok {
+		return changer.changeRefs(changes)
+	}
+
+	for _, change := range changes {
+		current, err := repo.refs.ReadRef(change.name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if current != change.old {
+			return fmt.Errorf("cannot lock ref '%s': is at %s but expected %s", change.name, orNothing(current), orNothing(change.old))
+		}
+	}
+	for _, change := range changes {
+		var err error
+		if change.value == "" {
+			err = repo.refs.DeleteRef(change.name)
+		} else {
+			err = repo.refs.WriteRef(change.name, change.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * a file is changed by writing <file>.lock next to it and renaming it into place
+ * the lock is created only if it isn't there already, so whoever made it has the file to themselves
+ * and anything read from the file while holding its lock stays true till the rename
+ */
+type lockFile struct {
+	path string
+	file *os.File
+}
+
+func lockPath(path string) (*lockFile, error) {
+	file, err := os.OpenFile(path+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("Unable to create '%s.lock': File exists", path)
+		}
+		return nil, fmt.Errorf("Unable to create '%s.lock': %w", path, err)
+	}
+	return &lockFile{path: path, file: file}, nil
+}
+
+// commit replaces the locked file with contents, letting go of the lock
+func (lock *lockFile) commit(contents []byte) error {
+	_, err := lock.file.Write(contents)
+	if closeErr := lock.file.Close(); err == nil {
+		err = closeErr
+	}
+	lock.file = nil
+	if err == nil {
+		err = os.Rename(lock.path+".lock", lock.path)
+	}
+	if err != nil {
+		os.Remove(lock.path + ".lock")
+		return err
+	}
+	return nil
+}
+
+// release lets go of the lock leaving the file as it was, it's a no-op after commit
+func (lock *lockFile) release() {
+	if lock.file == nil {
+		return
+	}
+	lock.file.Close()
+	lock.file = nil
+	os.Remove(lock.path + ".lock")
+}
+
+// refChange moves a ref from old to value
+// an empty old is a ref that mustn't exist yet and an empty value deletes the ref
+type refChange struct {
+	name  string
+	old   string
+	value string
+}
+
+// undoRefChange is the change that puts a ref back the way it was before change
+func undoRefChange(change refChange) refChange {
+	return refChange{name: change.name, old: change.value, value: change.old}
+}
+
+// writeRefFile writes a ref file in the git directory, going through a lock file
+func writeRefFile(gitDir, name, contents string) error {
+	path := filepath.Join(gitDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("Couldn't create directories for %s: %w", name, err)
+	}
+
+	lock, err := lockPath(path)
+	if err != nil {
+		return err
+	}
+	if err := lock.commit([]byte(contents)); err != nil {
+		return fmt.Errorf("Couldn't update ref %s: %w", name, err)
+	}
+	return nil
+}
+
+// deleteRefFile removes a ref both as a loose file and from packed-refs
+func deleteRefFile(gitDir, name string) error {
+	lock, err := lockPath(filepath.Join(gitDir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	return removeRefFiles(gitDir, []string{name})
+}
+
+// updateRefFiles makes every change or none of them
+// each ref is locked and checked for still holding its old value before any is touched
+func updateRefFiles(gitDir string, changes []refChange) error {
+	var deleted []string
+	for _, change := range changes {
+		path := filepath.Join(gitDir, filepath.FromSlash(change.name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("Couldn't create directories for %s: %w", change.name, err)
+		}
+		if change.value == "" {
+			deleted = append(deleted, change.name)
+		}
+	}
+
+	locks := make([]*lockFile, 0, len(changes))
+	defer func() {
+		for _, lock := range locks {
+			lock.release()
+		}
+	}()
+	refs := &diskRefs{gitDir}
+	for _, change := range changes {
+		lock, err := lockPath(filepath.Join(gitDir, filepath.FromSlash(change.name)))
+		if err != nil {
+			return fmt.Errorf("cannot lock ref '%s': %w", change.name, err)
+		}
+		locks = append(locks, lock)
+
+		current, err := refs.ReadRef(change.name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if current != change.old {
+			return fmt.Errorf("cannot lock ref '%s': is at %s but expected %s", change.name, orNothing(current), orNothing(change.old))
+		}
+	}
+
+	if len(deleted) > 0 {
+		if err := removeRefFiles(gitDir, deleted); err != nil {
+			return err
+		}
+	}
+	for i, change := range changes {
+		if change.value == "" {
+			continue
+		}
+		if err := locks[i].commit([]byte(change.value + "\n")); err != nil {
+			return fmt.Errorf("Couldn't update ref %s: %w", change.name, err)
+		}
+	}
+	return nil
+}
+
+func orNothing(value string) string {
+	if value == "" {
+		return "nothing"
+	}
+	return value
+}
+
+// removeRefFiles deletes refs that are already locked, loose files first and then from packed-refs
+func removeRefFiles(gitDir string, names []string) error {
+	for _, name := range names {
+		err := os.Remove(filepath.Join(gitDir, filepath.FromSlash(name)))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Couldn't delete ref %s: %w", name, err)
+		}
+	}
+
+	packedPath := filepath.Join(gitDir, "packed-refs")
+	if _, err := os.Stat(packedPath); os.IsNotExist(err) {
+		return nil
+	}
+	lock, err := lockPath(packedPath)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	// read only once it's locked, so no other change to it can get lost
+	contents, err := os.ReadFile(packedPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Couldn't read packed-refs: %w", err)
+	}
+
+	var kept []string
+	removed, changed := false, false
+	for _, line := range strings.SplitAfter(string(contents), "\n") {
+		// the peeled line belongs to the ref above it
+		if removed && strings.HasPrefix(line, "^") {
+			continue
+		}
+		_, name, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		removed = !strings.HasPrefix(line, "#") && slices.Contains(names, name)
+		if removed {
+			changed = true
+		} else {
+			kept = append(kept, line)
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	if err := lock.commit([]byte(strings.Join(kept, ""))); err != nil {
+		return fmt.Errorf("Couldn't update packed-refs: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteRefFailsWhileLocked(t *testing.T) {
+	repo := newTestRepo(t, true)
+	commit := commitTestFiles(t, repo, map[string]string{"a": "a\n"})
+
+	lock := repo.makePath("refs", "heads", "main.lock")
+	if err := os.WriteFile(lock, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := repo.writeRef("refs/heads/main", commit)
+	if err == nil || !strings.Contains(err.Error(), "Unable to create '"+lock+"': File exists") {
+		t.Fatalf("writeRef with the ref locked = %v", err)
+	}
+	if _, err := os.Stat(lock); err != nil {
+		t.Errorf("someone else's lock was removed: %v", err)
+	}
+}
+
+func TestChangeRefsChecksOldValue(t *testing.T) {
+	repo := newTestRepo(t, true)
+	first := commitTestFiles(t, repo, map[string]string{"a": "a\n"})
+	second := commitTestFiles(t, repo, map[string]string{"a": "b\n"}, first)
+	if err := repo.writeRef("refs/heads/main", first); err != nil {
+		t.Fatal(err)
+	}
+
+	// a stale old value in an atomic change leaves every ref alone
+	err := repo.changeRefs([]refChange{
+		{name: "refs/heads/other", value: second},
+		{name: "refs/heads/main", old: second, value: first},
+	})
+	if err == nil {
+		t.Fatal("a stale change went through")
+	}
+	if _, err := repo.readRef("refs/heads/other"); err == nil {
+		t.Error("refs/heads/other was created by a failed change")
+	}
+
+	if err := repo.changeRefs([]refChange{{name: "refs/heads/main", old: first, value: second}}); err != nil {
+		t.Fatal(err)
+	}
+	if sha, _ := repo.readRef("refs/heads/main"); sha != second {
+		t.Errorf("refs/heads/main = %s, want %s", sha, second)
+	}
+}
+
+func TestChangeRefsDeletesPackedRef(t *testing.T) {
+	repo := newTestRepo(t, true)
+	commit := commitTestFiles(t, repo, map[string]string{"a": "a\n"})
+	for _, name := range []string{"refs/heads/main", "refs/heads/keep"} {
+		if err := repo.writeRef(name, commit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.packRefs(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.changeRefs([]refChange{{name: "refs/heads/main", old: commit}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.readRef("refs/heads/main"); err == nil {
+		t.Error("refs/heads/main is still there")
+	}
+	if sha, _ := repo.readRef("refs/heads/keep"); sha != commit {
+		t.Errorf("refs/heads/keep = %q, want %s", sha, commit)
+	}
+}
+
+func TestConcurrentChangeRefsLoseNothing(t *testing.T) {
+	for _, memory := range []bool{false, true} {
+		repo := newTestRepo(t, true)
+		if memory {
+			repo.refs = newMemoryRefs()
+		}
+		base := commitTestFiles(t, repo, map[string]string{"a": "a\n"})
+		if err := repo.writeRef("refs/heads/main", base); err != nil {
+			t.Fatal(err)
+		}
+
+		const pushers = 8
+		commits := make([]string, pushers)
+		for i := range commits {
+			commits[i] = commitTestFiles(t, repo, map[string]string{"a": strings.Repeat("b", i+1)}, base)
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var won []string
+		for _, commit := range commits {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if repo.changeRefs([]refChange{{name: "refs/heads/main", old: base, value: commit}}) == nil {
+					mu.Lock()
+					won = append(won, commit)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(won) != 1 {
+			t.Fatalf("memory %v: %d of %d concurrent updates from the same old value went through", memory, len(won), pushers)
+		}
+		if sha, _ := repo.readRef("refs/heads/main"); sha != won[0] {
+			t.Errorf("memory %v: refs/heads/main = %s, want %s", memory, sha, won[0])
+		}
+	}
+}
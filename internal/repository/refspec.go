@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+ * A refspec maps remote refs onto local ones
+ * [+]<src>[:<dst>]
+ * + lets the update through even when it isn't a fast-forward
+ * src and dst may each hold one * which matches the same text on both sides
+ */
+type refspec struct {
+	force bool
+	src   string
+	dst   string
+}
+
+func parseRefspec(spec string) (refspec, error) {
+	var rs refspec
+	spec, rs.force = strings.CutPrefix(spec, "+")
+	rs.src, rs.dst, _ = strings.Cut(spec, ":")
+
+	srcGlob := strings.Count(rs.src, "*")
+	dstGlob := strings.Count(rs.dst, "*")
+	if srcGlob > 1 || dstGlob > 1 || (rs.dst != "" && srcGlob != dstGlob) {
+		return refspec{}, fmt.Errorf("Invalid refspec '%s'", spec)
+	}
+	return rs, nil
+}
+
+func (rs refspec) isGlob() bool {
+	return strings.Contains(rs.src, "*")
+}
+
+// match maps a remote ref through the refspec
+// giving the local ref it lands on, which is empty when the refspec has no destination
+func (rs refspec) match(name string) (string, bool) {
+	if !rs.isGlob() {
+		if name != rs.src {
+			return "", false
+		}
+		return rs.dst, true
+	}
+
+	prefix, suffix, _ := strings.Cut(rs.src, "*")
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) || len(name) < len(prefix)+len(suffix) {
+		return "", false
+	}
+	matched := name[len(prefix) : len(name)-len(suffix)]
+	return strings.Replace(rs.dst, "*", matched, 1), true
+}
+
+// reverse maps a local ref back to the remote ref it would have come from
+func (rs refspec) reverse(name string) (string, bool) {
+	if rs.dst == "" {
+		return "", false
+	}
+	return refspec{src: rs.dst, dst: rs.src}.match(name)
+}
+
+// expandSrc turns a short name given on the command line into a full remote ref
+// the same way resolveRef looks for local ones
+func (rs refspec) expandSrc(remoteRefs map[string]string) refspec {
+	if rs.isGlob() || rs.src == "HEAD" || strings.HasPrefix(rs.src, "refs/") {
+		return rs
+	}
+	for _, candidate := range []string{"refs/" + rs.src, "refs/tags/" + rs.src, "refs/heads/" + rs.src, "refs/remotes/" + rs.src} {
+		if _, ok := remoteRefs[candidate]; ok {
+			rs.src = candidate
+			return rs
+		}
+	}
+	return rs
+}
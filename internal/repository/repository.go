@@ -3,7 +3,6 @@ package repository
 import (
 	"flag"
 	"fmt"
-	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -14,9 +13,32 @@ import (
 type Repository struct {
 	worktree string
 	gitDir   string
-	conf     Config
+	conf     *Config
+	// sha1 or sha256, whichever every object here is named with
+	format   *objectFormat
 	refStore *RefStore
 	index    *Index
+	// loaded the first time an object isn't found loose
+	packs []*packFile
+	// the multi-pack-index and the packs it doesn't cover, loaded on first use
+	midx *multiPackIndex
+	// commits listed in .git/shallow, loaded on first use
+	shallow map[string]bool
+	// the commit-graph, loaded on first use
+	graph *commitGraph
+	// reachability bitmaps of a pack, loaded on first use
+	bitmap *packBitmap
+	// what core.fsync asks to be flushed, worked out on first use
+	fsync *fsyncComponent
+	// shared by everything reading objects, from any goroutine
+	odb *objectDatabase
+	// where objects, refs, the index and checked out files are kept
+	// the .git directory and work tree unless it's a repository in memory
+	objects   ObjectStorage
+	refs      RefStorage
+	indexFile IndexStorage
+	// nil for a bare repository
+	files WorktreeFS
 }
 
 type RefStore struct {
@@ -27,11 +49,21 @@ type RefStore struct {
 func Repo(cmd string) (*Repository, error) {
 	var worktree string
 	var err error
-	isInit := cmd == "init"
+	isInit := cmd == "init" || cmd == "clone"
+	// config --global and friends work outside of a repository
+	// as do the commands pointed at some other repository
+	outside := false
 
-	if isInit {
+	switch cmd {
+	case "init", "clone":
 		worktree, err = os.Getwd()
-	} else {
+	case "config", "ls-remote", "upload-pack", "receive-pack", "serve":
+		worktree, err = helpers.SearchRoot(".")
+		if err != nil {
+			outside = true
+			worktree, err = os.Getwd()
+		}
+	default:
 		worktree, err = helpers.SearchRoot(".")
 	}
 	if err != nil {
@@ -39,24 +71,37 @@ func Repo(cmd string) (*Repository, error) {
 	}
 
 	gitDir := filepath.Join(worktree, ".git")
-	conf := makeCfg()
+	conf := loadConfig(gitDir)
+	format := formatSHA1
+	if !isInit && !outside {
+		if format, err = formatFromConfig(conf); err != nil {
+			return nil, err
+		}
+	}
 	refStore := &RefStore{}
-	index := &Index{}
+	index := emptyIndex(format)
+	odb, err := newObjectDatabase(conf)
+	if err != nil {
+		return nil, err
+	}
 
 	repo := &Repository{
-		worktree,
-		gitDir,
-		conf,
-		refStore,
-		index,
+		worktree: worktree,
+		gitDir:   gitDir,
+		conf:     conf,
+		format:   format,
+		refStore: refStore,
+		index:    index,
+		odb:      odb,
 	}
+	repo.storeOnDisk()
 
-	if !isInit {
+	if !isInit && !outside {
 		err = repo.findRefs()
 		if err != nil {
 			return nil, err
 		}
-		repo.index, err = parseIndex(repo.makePath("index"))
+		repo.index, err = repo.readIndex()
 		if err != nil {
 			return nil, err
 		}
@@ -65,6 +110,32 @@ func Repo(cmd string) (*Repository, error) {
 	return repo, nil
 }
 
+// openAt sets up a repository whose location is already known
+// without looking at refs or the index
+// one whose object format isn't known is treated as sha1
+func openAt(worktree, gitDir string) (*Repository, error) {
+	conf := loadConfig(gitDir)
+	format, err := formatFromConfig(conf)
+	if err != nil {
+		format = formatSHA1
+	}
+	odb, err := newObjectDatabase(conf)
+	if err != nil {
+		return nil, err
+	}
+	repo := &Repository{
+		worktree: worktree,
+		gitDir:   gitDir,
+		conf:     conf,
+		format:   format,
+		refStore: &RefStore{},
+		index:    emptyIndex(format),
+		odb:      odb,
+	}
+	repo.storeOnDisk()
+	return repo, nil
+}
+
 func (repo *Repository) makePath(paths ...string) string {
 	parts := append([]string{repo.gitDir}, paths...)
 	return filepath.Join(parts...)
@@ -76,38 +147,16 @@ func (repo *Repository) findRefs() error {
 	repo.refStore.heads = make(map[string]string)
 	repo.refStore.tags = make(map[string]string)
 
-	paths := []struct {
-		path    string
-		refType string
-	}{
-		{repo.makePath("refs", "heads"), "heads"},
-		{repo.makePath("refs", "tags"), "tags"},
+	refs, err := repo.readRefs()
+	if err != nil {
+		return err
 	}
 
-	for _, p := range paths {
-		err := filepath.WalkDir(p.path, func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			if !d.IsDir() {
-				contents, err := os.ReadFile(path)
-				if err != nil {
-					return err
-				}
-
-				ref := strings.TrimSpace(string(contents))
-				name := filepath.Base(path)
-				switch p.refType {
-				case "heads":
-					repo.refStore.heads[ref] = name
-				case "tags":
-					repo.refStore.tags[ref] = name
-				}
-			}
-			return nil
-		})
-		if err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("error walking %s: %w", p.path, err)
+	for name, sha := range refs {
+		if branch, ok := strings.CutPrefix(name, "refs/heads/"); ok {
+			repo.refStore.heads[sha] = branch
+		} else if tag, ok := strings.CutPrefix(name, "refs/tags/"); ok {
+			repo.refStore.tags[sha] = tag
 		}
 	}
 
@@ -119,7 +168,7 @@ func (repo *Repository) Run(args []string) error {
 
 	switch cmd {
 	case "init":
-		return repo.init()
+		return repo.init(args[1:])
 
 	case "cat-file":
 		return repo.catFile(args[1:])
@@ -168,14 +217,73 @@ func (repo *Repository) Run(args []string) error {
 
 	case "tag":
 		if len(args) == 1 {
-			return repo.listTags()
+			return repo.listTags("")
+		} else if args[1] == "--contains" && len(args) == 3 {
+			return repo.listTags(args[2])
 		} else {
 			return repo.createTag(args[1:])
 		}
 
+	case "config":
+		return repo.config(args[1:])
+
+	case "clone":
+		return repo.clone(args[1:])
+
+	case "fetch":
+		return repo.fetch(args[1:])
+
+	case "pull":
+		return repo.pull(args[1:])
+
+	case "push":
+		return repo.push(args[1:])
+
+	case "ls-remote":
+		return repo.lsRemote(args[1:])
+
+	case "upload-pack":
+		return repo.uploadPack(args[1:])
+
+	case "receive-pack":
+		return repo.receivePack(args[1:])
+
+	case "serve":
+		return repo.serve(args[1:])
+
 	case "ls-files":
 		return repo.lsFiles(args[1:])
 
+	case "archive":
+		return repo.archive(args[1:])
+
+	case "blame":
+		return repo.blame(args[1:])
+
+	case "fsck":
+		return repo.fsck(args[1:])
+
+	case "commit-graph":
+		return repo.commitGraphCmd(args[1:])
+
+	case "merge-base":
+		return repo.mergeBaseCmd(args[1:])
+
+	case "rev-list":
+		return repo.revList(args[1:])
+
+	case "multi-pack-index":
+		return repo.multiPackIndexCmd(args[1:])
+
+	case "count-objects":
+		return repo.countObjects(args[1:])
+
+	case "gc":
+		return repo.gc(args[1:])
+
+	case "prune":
+		return repo.prune(args[1:])
+
 	case "dbg":
 		repo.dbg()
 		return nil
@@ -189,3 +297,17 @@ func (repo *Repository) isRef(sha string) string {
 	ref := repo.refStore.heads[sha]
 	return ref
 }
+
+// currentBranch gives the branch HEAD points to
+// or an empty string if HEAD is detached or missing
+func currentBranch(gitDir string) string {
+	contents, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	branch, ok := strings.CutPrefix(strings.TrimSpace(string(contents)), "ref: refs/heads/")
+	if !ok {
+		return ""
+	}
+	return branch
+}
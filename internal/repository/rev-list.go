@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// revList lists the commits, and with --objects everything else,
+// reachable from the given commits but not from the ones starting with ^
+func (repo *Repository) revList(args []string) error {
+	var count, objects, useBitmaps, all bool
+	revListCmd := flag.NewFlagSet("rev-list", flag.ExitOnError)
+	revListCmd.BoolVar(&count, "count", false, "Print how many there are instead of listing them")
+	revListCmd.BoolVar(&objects, "objects", false, "List trees, blobs and tags along with commits")
+	revListCmd.BoolVar(&useBitmaps, "use-bitmap-index", false, "Use reachability bitmaps if there are any")
+	revListCmd.BoolVar(&all, "all", false, "Start from every ref and HEAD")
+	if err := revListCmd.Parse(args); err != nil {
+		return err
+	}
+
+	var include, exclude []string
+	if all {
+		tips, err := repo.refTips()
+		if err != nil {
+			return err
+		}
+		include = append(include, tips...)
+	}
+	for _, arg := range revListCmd.Args() {
+		name, negated := strings.CutPrefix(arg, "^")
+		sha, err := repo.findObject(name)
+		if err != nil {
+			return fmt.Errorf("fatal: bad revision '%s'", arg)
+		}
+		if negated {
+			exclude = append(exclude, sha)
+		} else {
+			include = append(include, sha)
+		}
+	}
+	if len(include) == 0 {
+		return fmt.Errorf("usage: twine rev-list [--count] [--objects] [--use-bitmap-index] [--all] <commit>... [^<commit>...]")
+	}
+
+	var listed []string
+	var err error
+	if useBitmaps {
+		listed, err = repo.bitmapRevList(include, exclude, objects)
+	}
+	if listed == nil && err == nil {
+		listed, err = repo.walkRevList(include, exclude, objects)
+	}
+	if err != nil {
+		return err
+	}
+
+	if count {
+		fmt.Println(len(listed))
+		return nil
+	}
+	for _, sha := range listed {
+		fmt.Println(sha)
+	}
+	return nil
+}
+
+// walkRevList works out what rev-list lists by walking everything
+func (repo *Repository) walkRevList(include, exclude []string, objects bool) ([]string, error) {
+	if !objects {
+		hidden := make(map[string]bool)
+		for _, sha := range repo.reachableCommits(exclude) {
+			hidden[sha] = true
+		}
+		listed := []string{}
+		for _, sha := range repo.reachableCommits(include) {
+			if !hidden[sha] {
+				listed = append(listed, sha)
+			}
+		}
+		return listed, nil
+	}
+
+	excluded, err := repo.reachableObjects(exclude)
+	if err != nil {
+		return nil, err
+	}
+	hidden := make(map[string]bool, len(excluded))
+	for _, sha := range excluded {
+		hidden[sha] = true
+	}
+	included, err := repo.reachableObjects(include)
+	if err != nil {
+		return nil, err
+	}
+	listed := []string{}
+	for _, sha := range included {
+		if !hidden[sha] {
+			listed = append(listed, sha)
+		}
+	}
+	return listed, nil
+}
+
+// bitmapRevList works out what rev-list lists from bitmaps
+// giving back nothing when there aren't any to use
+func (repo *Repository) bitmapRevList(include, exclude []string, objects bool) ([]string, error) {
+	bm := repo.loadBitmap()
+	if bm.pack == nil {
+		return nil, nil
+	}
+	excluded, excludedExtra, err := bm.reachableFrom(repo, exclude)
+	if err != nil {
+		return nil, err
+	}
+	included, includedExtra, err := bm.reachableFrom(repo, include)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := included.andNot(excluded)
+	if !objects {
+		wanted = wanted.and(bm.commits)
+	}
+	listed := []string{}
+	wanted.each(func(bit int) {
+		listed = append(listed, bm.shaAt(bit))
+	})
+	for sha := range includedExtra {
+		if excludedExtra[sha] {
+			continue
+		}
+		if !objects {
+			if kind, _, err := repo.readObject(sha); err != nil || kind != "commit" {
+				continue
+			}
+		}
+		listed = append(listed, sha)
+	}
+	return listed, nil
+}
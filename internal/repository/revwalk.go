@@ -0,0 +1,443 @@
+package repository
+
+import (
+	"container/heap"
+	"encoding/hex"
+	"fmt"
+)
+
+// revWalk collects everything reachable from a set of tips
+// stopping at whatever was marked uninteresting
+type revWalk struct {
+	repo *Repository
+	// commits reachable from the haves
+	uninteresting map[string]bool
+	seen          map[string]bool
+	objects       []string
+	// the other side's shallow commits, hiding doesn't go past them
+	theirShallow map[string]bool
+	// commits whose parents stay out of the walk
+	boundary map[string]bool
+	// objects a partial clone leaves out
+	filter *objectFilter
+	// objects that aren't here are passed over instead of fetched or failed on
+	skipMissing bool
+}
+
+func (repo *Repository) newRevWalk() *revWalk {
+	return &revWalk{
+		repo:          repo,
+		uninteresting: make(map[string]bool),
+		seen:          make(map[string]bool),
+	}
+}
+
+// hide marks a commit and all its ancestors as already present
+// along with the tree of the commit itself
+func (walk *revWalk) hide(sha string) error {
+	commitSha, commit, err := walk.repo.peelToCommit(sha)
+	if err != nil {
+		// tags of trees and blobs only hide themselves
+		walk.seen[sha] = true
+		return nil
+	}
+
+	queue := []string{commitSha}
+	for len(queue) > 0 {
+		sha := queue[0]
+		queue = queue[1:]
+		if walk.uninteresting[sha] {
+			continue
+		}
+		walk.uninteresting[sha] = true
+		if walk.theirShallow[sha] || walk.repo.isShallow(sha) {
+			continue
+		}
+
+		obj, err := walk.repo.makeObject(sha)
+		if err != nil {
+			// history past this point just isn't here, e.g. a shallow clone
+			continue
+		}
+		if c, ok := obj.(*Commit); ok {
+			queue = append(queue, c.parents()...)
+		}
+	}
+
+	treeSha, err := commit.getField("tree")
+	if err != nil {
+		return err
+	}
+	return walk.markTreeSeen(treeSha)
+}
+
+func (walk *revWalk) markTreeSeen(treeSha string) error {
+	if walk.seen[treeSha] {
+		return nil
+	}
+	walk.seen[treeSha] = true
+
+	tree, err := walk.repo.readTree(treeSha)
+	if err != nil {
+		return err
+	}
+	for _, leaf := range tree.leaves {
+		sha := hex.EncodeToString(leaf.sha)
+		switch leaf.mode {
+		case "40000":
+			if err := walk.markTreeSeen(sha); err != nil {
+				return err
+			}
+		case "160000":
+		default:
+			walk.seen[sha] = true
+		}
+	}
+	return nil
+}
+
+// add walks a tip, collecting every commit, tree, blob and tag
+// that hasn't been hidden
+func (walk *revWalk) add(sha string) error {
+	for {
+		if walk.seen[sha] || walk.uninteresting[sha] {
+			return nil
+		}
+		if walk.skipMissing && !walk.repo.hasObject(sha) {
+			return nil
+		}
+
+		obj, err := walk.repo.makeObject(sha)
+		if err != nil {
+			return err
+		}
+		tag, ok := obj.(*Tag)
+		if !ok {
+			break
+		}
+		walk.seen[sha] = true
+		walk.objects = append(walk.objects, sha)
+		if sha, err = tag.getField("object"); err != nil {
+			return err
+		}
+	}
+
+	queue := []string{sha}
+	for len(queue) > 0 {
+		sha := queue[0]
+		queue = queue[1:]
+		if walk.seen[sha] || walk.uninteresting[sha] {
+			continue
+		}
+		if walk.skipMissing && !walk.repo.hasObject(sha) {
+			continue
+		}
+
+		obj, err := walk.repo.makeObject(sha)
+		if err != nil {
+			return err
+		}
+
+		switch o := obj.(type) {
+		case *Tree:
+			// trees that were asked for by name go out whatever the filter says
+			if err := walk.addTree(sha, 0, true); err != nil {
+				return err
+			}
+		case *Commit:
+			walk.seen[sha] = true
+			walk.objects = append(walk.objects, sha)
+			treeSha, err := o.getField("tree")
+			if err != nil {
+				return err
+			}
+			if err := walk.addTree(treeSha, 0, false); err != nil {
+				return err
+			}
+			if !walk.repo.isShallow(sha) && !walk.boundary[sha] {
+				queue = append(queue, o.parents()...)
+			}
+		default:
+			walk.seen[sha] = true
+			walk.objects = append(walk.objects, sha)
+		}
+	}
+
+	return nil
+}
+
+// addTree collects a tree depth trees below a commit along with what's in it
+func (walk *revWalk) addTree(treeSha string, depth int, wanted bool) error {
+	if walk.seen[treeSha] || !wanted && walk.filter.omitsTree(depth) {
+		return nil
+	}
+	walk.seen[treeSha] = true
+	if walk.skipMissing && !walk.repo.hasObject(treeSha) {
+		return nil
+	}
+	walk.objects = append(walk.objects, treeSha)
+
+	tree, err := walk.repo.readTree(treeSha)
+	if err != nil {
+		return err
+	}
+	for _, leaf := range tree.leaves {
+		sha := hex.EncodeToString(leaf.sha)
+		switch leaf.mode {
+		case "40000":
+			if err := walk.addTree(sha, depth+1, false); err != nil {
+				return err
+			}
+		case "160000":
+			// submodule commits live in another repository
+		default:
+			if !walk.seen[sha] && !walk.filter.omitsBlob(walk.repo, sha, depth+1) {
+				walk.seen[sha] = true
+				walk.objects = append(walk.objects, sha)
+			}
+		}
+	}
+	return nil
+}
+
+// objectsToSend lists what has to go in a pack so that
+// someone who has the haves ends up with everything reachable from the wants
+// a shallow update keeps the walk inside what the other side has and wants
+// and a filter leaves out what a partial clone doesn't want yet
+func (repo *Repository) objectsToSend(wants, haves []string, shallow *shallowUpdate, filter *objectFilter) ([]string, error) {
+	// bitmaps don't know where a shallow history is cut or what a filter leaves out
+	if shallow == nil && filter == nil {
+		if objects, ok := repo.bitmapObjectsToSend(wants, haves); ok {
+			return objects, nil
+		}
+	}
+
+	walk := repo.newRevWalk()
+	walk.filter = filter
+	if shallow != nil {
+		walk.theirShallow = shallow.theirs
+		walk.boundary = shallow.boundary
+		// history behind commits that are no longer shallow goes out as well
+		for _, sha := range shallow.unshallow {
+			_, commit, err := repo.peelToCommit(sha)
+			if err != nil {
+				return nil, err
+			}
+			wants = append(wants, commit.parents()...)
+		}
+	}
+	for _, have := range haves {
+		if _, _, err := repo.readObject(have); err != nil {
+			continue
+		}
+		if err := walk.hide(have); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, want := range wants {
+		if err := walk.add(want); err != nil {
+			return nil, err
+		}
+	}
+
+	return walk.objects, nil
+}
+
+// reachableObjects lists every object here that can be reached from the tips
+// anything missing, like what a partial clone left out, is skipped over
+func (repo *Repository) reachableObjects(tips []string) ([]string, error) {
+	walk := repo.newRevWalk()
+	walk.skipMissing = true
+	for _, tip := range tips {
+		if err := walk.add(tip); err != nil {
+			return nil, err
+		}
+	}
+
+	objects := walk.objects[:0]
+	for _, sha := range walk.objects {
+		// blobs are listed without being looked at
+		if repo.hasObject(sha) {
+			objects = append(objects, sha)
+		}
+	}
+	return objects, nil
+}
+
+func (repo *Repository) readTree(sha string) (*Tree, error) {
+	obj, err := repo.makeObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	tree, ok := obj.(*Tree)
+	if !ok {
+		return nil, fmt.Errorf("Object %s is a %s, not a tree", sha, obj.Kind())
+	}
+	return tree, nil
+}
+
+// reachableCommits lists every commit that can be reached from the tips
+// closest first, quietly stopping where history is missing
+func (repo *Repository) reachableCommits(tips []string) []string {
+	var commits []string
+	repo.walkCommits(tips, func(sha string) bool {
+		commits = append(commits, sha)
+		return true
+	})
+	return commits
+}
+
+// walkCommits calls fn for every commit that can be reached from the tips, closest first
+// quietly stopping where history is missing, and altogether once fn gives false
+func (repo *Repository) walkCommits(tips []string, fn func(sha string) bool) {
+	seen := make(map[string]bool)
+	queue := append([]string{}, tips...)
+	for len(queue) > 0 {
+		sha := queue[0]
+		queue = queue[1:]
+		if seen[sha] {
+			continue
+		}
+		seen[sha] = true
+
+		info, err := repo.commitInfo(sha)
+		if err != nil {
+			// tags carry on from the commit they point at
+			if commitSha, _, err := repo.peelToCommit(sha); err == nil && commitSha != sha {
+				queue = append(queue, commitSha)
+			}
+			continue
+		}
+		if !fn(sha) {
+			return
+		}
+		if !repo.isShallow(sha) {
+			queue = append(queue, info.parents...)
+		}
+	}
+}
+
+// walkHistory calls fn for every commit reachable from the tips the way git log lists them
+// newest first by committer date, each once, and in the order they were found when the dates are the same
+// parents come from the commit-graph when there is one, and a shallow commit has none
+// fn returning false stops the walk
+func (repo *Repository) walkHistory(tips []string, fn func(sha string) bool) error {
+	queue := &historyQueue{}
+	seen := make(map[string]bool)
+	push := func(sha string) error {
+		if seen[sha] {
+			return nil
+		}
+		seen[sha] = true
+		info, err := repo.commitInfo(sha)
+		if err != nil {
+			return err
+		}
+		heap.Push(queue, historyCommit{sha: sha, info: info, order: len(seen)})
+		return nil
+	}
+
+	for _, tip := range tips {
+		sha, _, err := repo.peelToCommit(tip)
+		if err != nil {
+			return err
+		}
+		if err := push(sha); err != nil {
+			return err
+		}
+	}
+	for queue.Len() > 0 {
+		commit := heap.Pop(queue).(historyCommit)
+		if !fn(commit.sha) {
+			return nil
+		}
+		if repo.isShallow(commit.sha) {
+			continue
+		}
+		for _, parent := range commit.info.parents {
+			if err := push(parent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type historyCommit struct {
+	sha   string
+	info  *graphCommit
+	order int
+}
+
+// historyQueue hands out the newest commit first
+type historyQueue []historyCommit
+
+func (q historyQueue) Len() int { return len(q) }
+func (q historyQueue) Less(i, j int) bool {
+	if q[i].info.time != q[j].info.time {
+		return q[i].info.time > q[j].info.time
+	}
+	return q[i].order < q[j].order
+}
+func (q historyQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *historyQueue) Push(x any)   { *q = append(*q, x.(historyCommit)) }
+func (q *historyQueue) Pop() any {
+	old := *q
+	commit := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return commit
+}
+
+// isAncestor says if ancestor can be reached by following parents from descendant
+// commits whose generation isn't above the ancestor's can't lead to it, so the walk stops there
+func (repo *Repository) isAncestor(ancestor, descendant string) bool {
+	if ancestor == descendant {
+		return true
+	}
+	minGeneration := uint32(0)
+	if info, err := repo.commitInfo(ancestor); err == nil && info.generation != generationInfinity {
+		minGeneration = info.generation
+	}
+
+	seen := make(map[string]bool)
+	queue := []string{descendant}
+	for len(queue) > 0 {
+		sha := queue[0]
+		queue = queue[1:]
+		if sha == ancestor {
+			return true
+		}
+		if seen[sha] {
+			continue
+		}
+		seen[sha] = true
+
+		info, err := repo.commitInfo(sha)
+		if err != nil {
+			if commitSha, _, err := repo.peelToCommit(sha); err == nil && commitSha != sha {
+				queue = append(queue, commitSha)
+			}
+			continue
+		}
+		if info.generation <= minGeneration || repo.isShallow(sha) {
+			continue
+		}
+		queue = append(queue, info.parents...)
+	}
+	return false
+}
+
+// mergeBase finds the closest commit both a and b descend from
+func (repo *Repository) mergeBase(a, b string) (string, bool) {
+	fromA := make(map[string]bool)
+	for _, sha := range repo.reachableCommits([]string{a}) {
+		fromA[sha] = true
+	}
+	for _, sha := range repo.reachableCommits([]string{b}) {
+		if fromA[sha] {
+			return sha, true
+		}
+	}
+	return "", false
+}
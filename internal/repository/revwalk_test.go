@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestWalkHistoryStopsAtShallowCommits(t *testing.T) {
+	repo := newTestRepo(t, false)
+	root := commitTestFiles(t, repo, map[string]string{"a": "1"})
+	mid := commitTestFiles(t, repo, map[string]string{"a": "2"}, root)
+	side := commitTestFiles(t, repo, map[string]string{"a": "2", "b": "1"}, root)
+	tip := commitTestFiles(t, repo, map[string]string{"a": "3", "b": "1", "c": "1"}, mid, side)
+
+	history := func() []string {
+		t.Helper()
+		var shas []string
+		err := repo.walkHistory([]string{tip}, func(sha string) bool {
+			shas = append(shas, sha)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return shas
+	}
+
+	if got, want := history(), []string{tip, mid, side, root}; !slices.Equal(got, want) {
+		t.Fatalf("full history is %v, want %v", got, want)
+	}
+
+	// a shallow commit is a root, its parents are never read
+	if err := repo.writeShallow([]string{mid, side}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := history(), []string{tip, mid, side}; !slices.Equal(got, want) {
+		t.Fatalf("shallow history is %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,219 @@
+package repository
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/joeldotdias/twine/pkg/pktline"
+)
+
+/*
+ * smart HTTP splits a conversation over several requests
+ *
+ * GET  <repo>/info/refs?service=git-upload-pack   advertisement, prefixed with "# service=..." for v0
+ * POST <repo>/git-upload-pack                     one round of negotiation, ending in a pack once done
+ * POST <repo>/git-receive-pack                    ref updates and the pack, answered with the status report
+ *
+ * the server keeps no state between requests so each POST is a --stateless-rpc run
+ * protocol v2 is asked for with a Git-Protocol: version=2 header
+ */
+
+// upload-pack requests are only wants and haves, so like git http-backend
+// anything past 10MiB is refused rather than read
+const maxUploadRequest = 10 << 20
+
+type smartHTTP struct {
+	// directory holding the repositories being served
+	root string
+	// allow pushes to repositories that don't set http.receivepack
+	receivePack bool
+}
+
+func (repo *Repository) serve(args []string) error {
+	var handler smartHTTP
+	var addr string
+	serveCmd := flag.NewFlagSet("serve", flag.ExitOnError)
+	serveCmd.StringVar(&addr, "l", ":8080", "Address to listen on")
+	serveCmd.StringVar(&addr, "listen", ":8080", "Address to listen on")
+	serveCmd.BoolVar(&handler.receivePack, "receive-pack", false, "Accept pushes to every served repository")
+	if err := serveCmd.Parse(args); err != nil {
+		return err
+	}
+
+	handler.root = "."
+	switch serveCmd.NArg() {
+	case 0:
+	case 1:
+		handler.root = serveCmd.Arg(0)
+	default:
+		return fmt.Errorf("usage: serve [--listen <addr>] [--receive-pack] [<directory>]")
+	}
+	root, err := filepath.Abs(handler.root)
+	if err != nil {
+		return err
+	}
+	handler.root = root
+
+	fmt.Fprintf(os.Stderr, "Serving repositories under %s on %s\n", root, addr)
+	return http.ListenAndServe(addr, &handler)
+}
+
+func (h *smartHTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var repoPath, service string
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/info/refs") && r.Method == http.MethodGet:
+		repoPath = strings.TrimSuffix(r.URL.Path, "/info/refs")
+		service = r.URL.Query().Get("service")
+		if service == "" {
+			h.fail(w, r, http.StatusForbidden, "only the smart protocol is served")
+			return
+		}
+	case strings.HasSuffix(r.URL.Path, "/git-upload-pack") && r.Method == http.MethodPost:
+		repoPath = strings.TrimSuffix(r.URL.Path, "/git-upload-pack")
+		service = "git-upload-pack"
+	case strings.HasSuffix(r.URL.Path, "/git-receive-pack") && r.Method == http.MethodPost:
+		repoPath = strings.TrimSuffix(r.URL.Path, "/git-receive-pack")
+		service = "git-receive-pack"
+	default:
+		h.fail(w, r, http.StatusNotFound, "not found")
+		return
+	}
+
+	repo, err := h.openRepo(repoPath)
+	if err != nil {
+		h.fail(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+
+	switch service {
+	case "git-upload-pack":
+		if enabled, err := repo.conf.Bool("http.uploadpack", true); err != nil {
+			h.fail(w, r, http.StatusInternalServerError, err.Error())
+			return
+		} else if !enabled {
+			h.fail(w, r, http.StatusForbidden, "upload-pack is disabled")
+			return
+		}
+	case "git-receive-pack":
+		if enabled, err := repo.conf.Bool("http.receivepack", h.receivePack); err != nil {
+			h.fail(w, r, http.StatusInternalServerError, err.Error())
+			return
+		} else if !enabled {
+			h.fail(w, r, http.StatusForbidden, "receive-pack is disabled, set http.receivepack to allow pushes")
+			return
+		}
+	default:
+		h.fail(w, r, http.StatusForbidden, "unsupported service "+service)
+		return
+	}
+
+	opts := serviceOptions{statelessRPC: true}
+	if service == "git-upload-pack" {
+		opts.version = parseProtocolVersion(r.Header.Get("Git-Protocol"))
+	}
+
+	body, status, err := h.requestBody(w, r, repo, service)
+	if err != nil {
+		h.fail(w, r, status, err.Error())
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
+		opts.advertiseRefs = true
+		if opts.version != 2 {
+			enc := pktline.NewEncoder(w)
+			enc.Encodef("# service=%s\n", service)
+			enc.Flush()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-"+service+"-result")
+	}
+
+	if service == "git-upload-pack" {
+		err = repo.serveUploadPack(body, w, opts)
+	} else {
+		err = repo.serveReceivePack(body, w, opts)
+	}
+	if err != nil {
+		// the status line is already out so all that's left is to log it
+		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+		return
+	}
+	log.Printf("%s %s", r.Method, r.URL.RequestURI())
+}
+
+// requestBody caps the body a request can send, after gzip as well as before
+// so a small compressed body can't inflate without bound
+// upload-pack requests are read in full up front so an oversized one gets a 413
+// instead of a half written response, pushes are capped by receive.maxInputSize
+func (h *smartHTTP) requestBody(w http.ResponseWriter, r *http.Request, repo *Repository, service string) (io.Reader, int, error) {
+	limit := int64(maxUploadRequest)
+	if service == "git-receive-pack" {
+		var err error
+		if limit, err = repo.conf.Int("receive.maxInputSize", 0); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+	body := r.Body
+	if limit > 0 {
+		body = http.MaxBytesReader(w, body, limit)
+	}
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, requestBodyStatus(err), err
+		}
+		body = gz
+		if limit > 0 {
+			body = http.MaxBytesReader(w, gz, limit)
+		}
+	}
+	if service == "git-receive-pack" || r.Method != http.MethodPost {
+		return body, 0, nil
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, requestBodyStatus(err), err
+	}
+	return bytes.NewReader(data), 0, nil
+}
+
+func requestBodyStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// openRepo finds the repository a request is for
+// the path can't climb out of the root, and a trailing .git can be left off
+func (h *smartHTTP) openRepo(repoPath string) (*Repository, error) {
+	dir := filepath.Join(h.root, filepath.FromSlash(path.Clean("/"+repoPath)))
+	repo, err := openLocalRemote(dir)
+	if err != nil && !strings.HasSuffix(dir, ".git") {
+		repo, err = openLocalRemote(dir + ".git")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("repository '%s' not found", repoPath)
+	}
+	return repo, nil
+}
+
+func (h *smartHTTP) fail(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	log.Printf("%s %s: %d %s", r.Method, r.URL.RequestURI(), status, msg)
+	http.Error(w, msg, status)
+}
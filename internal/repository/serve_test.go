@@ -0,0 +1,281 @@
+package repository
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/joeldotdias/twine/pkg/pktline"
+)
+
+// serveTestRepo serves a bare repository over smart HTTP, giving back the repository and its url
+func serveTestRepo(t *testing.T, receivePack bool) (*Repository, string) {
+	t.Helper()
+	repo := newTestRepo(t, true)
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	server := httptest.NewServer(&smartHTTP{root: filepath.Dir(repo.gitDir), receivePack: receivePack})
+	t.Cleanup(server.Close)
+	return repo, server.URL + "/" + filepath.Base(repo.gitDir)
+}
+
+// post sends a request body to one of the services, giving back the whole response body
+func post(t *testing.T, url, service string, header http.Header, body io.Reader) (*http.Response, *bytes.Buffer) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url+"/"+service, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Content-Type", "application/x-"+service+"-request")
+	return roundTrip(t, req)
+}
+
+func roundTrip(t *testing.T, req *http.Request) (*http.Response, *bytes.Buffer) {
+	t.Helper()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var body bytes.Buffer
+	if _, err := io.Copy(&body, res.Body); err != nil {
+		t.Fatal(err)
+	}
+	return res, &body
+}
+
+func TestServeInfoRefs(t *testing.T) {
+	repo, url := serveTestRepo(t, false)
+	commit := commitTestFiles(t, repo, map[string]string{"a": "a\n"})
+	if err := repo.writeRef("refs/heads/main", commit); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(service string, header http.Header) (*http.Response, []string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, url+"/info/refs?service="+service, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != nil {
+			req.Header = header
+		}
+		res, body := roundTrip(t, req)
+		var lines []string
+		dec := pktline.NewDecoder(body)
+		for res.StatusCode == http.StatusOK {
+			packet, err := dec.Decode()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if packet.IsFlush() {
+				lines = append(lines, "0000")
+				continue
+			}
+			lines = append(lines, packet.Text())
+		}
+		return res, lines
+	}
+
+	res, lines := get("git-upload-pack", nil)
+	if got := res.Header.Get("Content-Type"); got != "application/x-git-upload-pack-advertisement" {
+		t.Errorf("v0 content type %q", got)
+	}
+	if len(lines) < 3 || lines[0] != "# service=git-upload-pack" || lines[1] != "0000" {
+		t.Fatalf("v0 advertisement %q doesn't start with the service line", lines)
+	}
+	if !slices.ContainsFunc(lines, func(line string) bool { return strings.HasPrefix(line, commit+" refs/heads/main") }) {
+		t.Errorf("v0 advertisement %q is missing refs/heads/main", lines)
+	}
+
+	res, lines = get("git-upload-pack", http.Header{"Git-Protocol": {"version=2"}})
+	if res.StatusCode != http.StatusOK || len(lines) == 0 || lines[0] != "version 2" {
+		t.Fatalf("v2 advertisement %d %q", res.StatusCode, lines)
+	}
+	if !slices.Contains(lines, "ls-refs=unborn") {
+		t.Errorf("v2 advertisement %q is missing ls-refs", lines)
+	}
+
+	if res, _ := get("git-receive-pack", nil); res.StatusCode != http.StatusForbidden {
+		t.Errorf("receive-pack advertised with pushes off: %d", res.StatusCode)
+	}
+	if res, _ := get("git-frobnicate", nil); res.StatusCode != http.StatusForbidden {
+		t.Errorf("unknown service: %d", res.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, url+"/info/refs", nil)
+	if res, _ := roundTrip(t, req); res.StatusCode != http.StatusForbidden {
+		t.Errorf("dumb protocol request: %d", res.StatusCode)
+	}
+	req, _ = http.NewRequest(http.MethodGet, url+"/../../info/refs?service=git-upload-pack", nil)
+	if res, _ := roundTrip(t, req); res.StatusCode != http.StatusNotFound {
+		t.Errorf("path outside the root: %d", res.StatusCode)
+	}
+}
+
+func TestServeUploadPack(t *testing.T) {
+	repo, url := serveTestRepo(t, false)
+	commit := commitTestFiles(t, repo, map[string]string{"a": "a\n"})
+	if err := repo.writeRef("refs/heads/main", commit); err != nil {
+		t.Fatal(err)
+	}
+	orphan := commitTestFiles(t, repo, map[string]string{"a": "orphan\n"})
+
+	for _, version := range []int{0, 2} {
+		header := http.Header{}
+		if version == 2 {
+			header.Set("Git-Protocol", "version=2")
+		}
+
+		res, body := post(t, url, "git-upload-pack", header, uploadRequest(version, commit))
+		if got := res.Header.Get("Content-Type"); got != "application/x-git-upload-pack-result" {
+			t.Errorf("v%d content type %q", version, got)
+		}
+		if !bytes.Contains(body.Bytes(), []byte("PACK")) {
+			t.Errorf("v%d fetch of refs/heads/main sent no pack: %q", version, body)
+		}
+		if version == 2 && !bytes.Contains(body.Bytes(), []byte("packfile\n")) {
+			t.Errorf("v2 fetch has no packfile section: %q", body)
+		}
+
+		_, body = post(t, url, "git-upload-pack", header, uploadRequest(version, orphan))
+		notOurs := fmt.Sprintf("ERR upload-pack: not our ref %s\n", orphan)
+		if !strings.Contains(body.String(), notOurs) || bytes.Contains(body.Bytes(), []byte("PACK")) {
+			t.Errorf("v%d fetch of an unreachable commit: %q", version, body)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(repo.gitDir, "config"), []byte("[http]\n\tuploadpack = false\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := post(t, url, "git-upload-pack", nil, uploadRequest(0, commit)); res.StatusCode != http.StatusForbidden {
+		t.Errorf("upload-pack with http.uploadpack off: %d", res.StatusCode)
+	}
+}
+
+func TestServeReceivePack(t *testing.T) {
+	src := newTestRepo(t, true)
+	commit := commitTestFiles(t, src, map[string]string{"a": "a\n"})
+	next := commitTestFiles(t, src, map[string]string{"a": "a\n", "b": "b\n"}, commit)
+	repo, url := serveTestRepo(t, true)
+	zero := repo.format.zero()
+
+	push := func(header http.Header, body io.Reader) []string {
+		t.Helper()
+		res, response := post(t, url, "git-receive-pack", header, body)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("push: %d %q", res.StatusCode, response)
+		}
+		if got := res.Header.Get("Content-Type"); got != "application/x-git-receive-pack-result" {
+			t.Errorf("content type %q", got)
+		}
+		return readReport(t, response)
+	}
+
+	request := receiveRequest(t, src, []string{zero + " " + commit + " refs/heads/main"}, objectsOf(t, src, commit))
+	report := push(nil, request)
+	if want := []string{"unpack ok", "ok refs/heads/main"}; !slices.Equal(report, want) {
+		t.Fatalf("push: report %q, want %q", report, want)
+	}
+	if sha, err := repo.readRef("refs/heads/main"); err != nil || sha != commit {
+		t.Fatalf("refs/heads/main is %s, %v after the push", sha, err)
+	}
+
+	// git gzips bodies it thinks are worth it
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	io.Copy(gz, receiveRequest(t, src, []string{commit + " " + next + " refs/heads/main"}, objectsOf(t, src, next)))
+	gz.Close()
+	report = push(http.Header{"Content-Encoding": {"gzip"}}, &gzipped)
+	if want := []string{"unpack ok", "ok refs/heads/main"}; !slices.Equal(report, want) {
+		t.Fatalf("gzipped push: report %q, want %q", report, want)
+	}
+
+	orphan := commitTestFiles(t, src, map[string]string{"c": "c\n"})
+	request = receiveRequest(t, src, []string{
+		zero + " " + orphan + " refs/heads/orphan",
+		zero + " " + next + " refs/heads/bad..name",
+	}, []string{orphan})
+	report = push(nil, request)
+	want := []string{"unpack ok", "ng refs/heads/orphan missing necessary objects", "ng refs/heads/bad..name funny refname"}
+	if !slices.Equal(report, want) {
+		t.Fatalf("refused push: report %q, want %q", report, want)
+	}
+	for _, name := range []string{"refs/heads/orphan", "refs/heads/bad..name"} {
+		if _, err := repo.readRef(name); err == nil {
+			t.Errorf("%s was created by a refused push", name)
+		}
+	}
+
+	_, url = serveTestRepo(t, false)
+	request = receiveRequest(t, src, []string{zero + " " + commit + " refs/heads/main"}, objectsOf(t, src, commit))
+	if res, _ := post(t, url, "git-receive-pack", nil, request); res.StatusCode != http.StatusForbidden {
+		t.Errorf("push with pushes off: %d", res.StatusCode)
+	}
+}
+
+func TestServeLimitsRequestBodies(t *testing.T) {
+	repo, url := serveTestRepo(t, true)
+	commit := commitTestFiles(t, repo, map[string]string{"a": "a\n"})
+	if err := repo.writeRef("refs/heads/main", commit); err != nil {
+		t.Fatal(err)
+	}
+
+	huge := bytes.Repeat([]byte("0000"), maxUploadRequest/4+1)
+	if res, _ := post(t, url, "git-upload-pack", nil, bytes.NewReader(huge)); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized upload-pack request: %d", res.StatusCode)
+	}
+	// a few kilobytes of gzip that inflate past the limit
+	var bomb bytes.Buffer
+	gz := gzip.NewWriter(&bomb)
+	gz.Write(huge)
+	gz.Close()
+	res, _ := post(t, url, "git-upload-pack", http.Header{"Content-Encoding": {"gzip"}}, &bomb)
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload-pack request inflating past the limit: %d", res.StatusCode)
+	}
+	if res, body := post(t, url, "git-upload-pack", nil, uploadRequest(0, commit)); !bytes.Contains(body.Bytes(), []byte("PACK")) {
+		t.Errorf("upload-pack request under the limit: %d %q", res.StatusCode, body)
+	}
+
+	src := newTestRepo(t, true)
+	// random enough that neither the pack nor gzip can squeeze it under the limit
+	blob := make([]byte, 4096)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range blob {
+		blob[i] = byte(rng.Uint32())
+	}
+	pushed := commitTestFiles(t, src, map[string]string{"big": string(blob)})
+	if err := os.WriteFile(filepath.Join(repo.gitDir, "config"), []byte("[receive]\n\tmaxInputSize = 1k\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var gzipped bytes.Buffer
+	gz = gzip.NewWriter(&gzipped)
+	io.Copy(gz, receiveRequest(t, src, []string{repo.format.zero() + " " + pushed + " refs/heads/big"}, objectsOf(t, src, pushed)))
+	gz.Close()
+	_, body := post(t, url, "git-receive-pack", http.Header{"Content-Encoding": {"gzip"}}, &gzipped)
+	if report := readReport(t, body); len(report) == 0 || report[0] == "unpack ok" {
+		t.Errorf("push past receive.maxInputSize: report %q", report)
+	}
+	if _, err := repo.readRef("refs/heads/big"); err == nil {
+		t.Error("refs/heads/big was created by a push past receive.maxInputSize")
+	}
+}
@@ -0,0 +1,369 @@
+package repository
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joeldotdias/twine/pkg/pktline"
+)
+
+/*
+ * a shallow repository is missing the parents of the commits listed in .git/shallow
+ *
+ * client: want lines, shallow <sha> for each commit it's missing the parents of,
+ *         then deepen <n> or deepen-since <unix time> and a flush
+ * server: shallow <sha> for each commit the history gets cut at
+ *         unshallow <sha> for each commit the client is about to get the parents of, flush
+ *
+ * v2 sends the same lines as fetch arguments and gets them back in a shallow-info section
+ */
+
+// unshallowing asks for everything with a depth this large, same as git
+const infiniteDepth = 0x7fffffff
+
+// shallowRequest is what a client says about its shallow history and how deep it wants to go
+type shallowRequest struct {
+	// commits the client has without their parents
+	shallow []string
+	depth   int
+	// depth counts from the client's shallow commits instead of the wants
+	relative bool
+	// only commits made after this unix time
+	since int64
+}
+
+func (req *shallowRequest) deepen() bool {
+	return req.depth > 0 || req.since > 0
+}
+
+// parseLine picks up the shallow and deepen lines of a fetch request
+// reporting whether line was one of them
+func (req *shallowRequest) parseLine(line string) (bool, error) {
+	keyword, value, _ := strings.Cut(line, " ")
+	switch keyword {
+	case "shallow":
+		if err := validSha(value); err != nil {
+			return true, err
+		}
+		req.shallow = append(req.shallow, value)
+	case "deepen":
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth <= 0 {
+			return true, fmt.Errorf("protocol error: bad depth '%s'", value)
+		}
+		req.depth = depth
+	case "deepen-relative":
+		req.relative = true
+	case "deepen-since":
+		since, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return true, fmt.Errorf("protocol error: bad deepen-since '%s'", value)
+		}
+		req.since = since
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// deepenRequest turns --depth, --deepen, --shallow-since and --unshallow into a request
+func (repo *Repository) deepenRequest(depth, relative int, since string, unshallow bool) (shallowRequest, error) {
+	var req shallowRequest
+	if depth < 0 {
+		return req, fmt.Errorf("depth %d is not a positive number", depth)
+	}
+	if relative < 0 {
+		return req, fmt.Errorf("depth %d is not a positive number", relative)
+	}
+	if depth > 0 && relative > 0 {
+		return req, fmt.Errorf("fatal: --deepen and --depth are mutually exclusive")
+	}
+	req.depth = depth
+	if relative > 0 {
+		req.depth, req.relative = relative, true
+	}
+	if since != "" {
+		ts, err := parseApproxDate(since)
+		if err != nil {
+			return req, err
+		}
+		req.since = ts
+	}
+
+	if unshallow {
+		if req.deepen() {
+			return req, fmt.Errorf("fatal: --depth and --unshallow cannot be used together")
+		}
+		if len(repo.shallowCommits()) == 0 {
+			return req, fmt.Errorf("fatal: --unshallow on a complete repository does not make sense")
+		}
+		req.depth = infiniteDepth
+	}
+	return req, nil
+}
+
+// lines are the request lines for the shallow part of a fetch
+func (req *shallowRequest) lines() []string {
+	var lines []string
+	for _, sha := range req.shallow {
+		lines = append(lines, "shallow "+sha)
+	}
+	if req.depth > 0 {
+		lines = append(lines, fmt.Sprintf("deepen %d", req.depth))
+	}
+	if req.relative {
+		lines = append(lines, "deepen-relative")
+	}
+	if req.since > 0 {
+		lines = append(lines, fmt.Sprintf("deepen-since %d", req.since))
+	}
+	return lines
+}
+
+// shallowUpdate is how the client's shallow boundary moves with a fetch
+type shallowUpdate struct {
+	shallow   []string
+	unshallow []string
+	// the client's shallow commits from before the fetch
+	// which is as far as anything it has can be walked
+	theirs map[string]bool
+	// commits the pack doesn't go past, including ones the client already had as shallow
+	boundary map[string]bool
+}
+
+// computeShallow works out where history gets cut for a client
+// walking down from the wants until the depth or date runs out
+func (repo *Repository) computeShallow(wants []string, req shallowRequest) (*shallowUpdate, error) {
+	update := &shallowUpdate{
+		theirs:   make(map[string]bool),
+		boundary: make(map[string]bool),
+	}
+	for _, sha := range req.shallow {
+		update.theirs[sha] = true
+	}
+	if !req.deepen() {
+		return update, nil
+	}
+
+	reached := make(map[string]bool)
+	var level []string
+	depth := req.depth
+	starts := wants
+	if req.relative {
+		// going depth more commits past where the client's history stops
+		starts = req.shallow
+		depth++
+	}
+	for _, want := range starts {
+		sha, commit, err := repo.peelToCommit(want)
+		if err != nil {
+			// wants that aren't commits have no history to cut
+			continue
+		}
+		if req.since > 0 && commit.commitTime() < req.since {
+			return nil, fmt.Errorf("no commits selected for shallow requests")
+		}
+		level = append(level, sha)
+	}
+
+	for d := 1; len(level) > 0; d++ {
+		var next []string
+		for _, sha := range level {
+			if reached[sha] {
+				continue
+			}
+			reached[sha] = true
+
+			_, commit, err := repo.peelToCommit(sha)
+			if err != nil {
+				return nil, err
+			}
+			parents := commit.parents()
+			cut := len(parents) > 0 && (repo.isShallow(sha) || depth > 0 && d >= depth)
+			for _, parent := range parents {
+				if cut || req.since == 0 {
+					break
+				}
+				_, p, err := repo.peelToCommit(parent)
+				cut = err != nil || p.commitTime() < req.since
+			}
+
+			if cut {
+				update.boundary[sha] = true
+				continue
+			}
+			next = append(next, parents...)
+		}
+		level = next
+	}
+
+	for sha := range update.boundary {
+		if !update.theirs[sha] {
+			update.shallow = append(update.shallow, sha)
+		}
+	}
+	for sha := range update.theirs {
+		if reached[sha] && !update.boundary[sha] {
+			update.unshallow = append(update.unshallow, sha)
+		}
+	}
+	sort.Strings(update.shallow)
+	sort.Strings(update.unshallow)
+	return update, nil
+}
+
+func writeShallowInfo(enc *pktline.Encoder, update *shallowUpdate) error {
+	for _, sha := range update.shallow {
+		if err := enc.Encodef("shallow %s\n", sha); err != nil {
+			return err
+		}
+	}
+	for _, sha := range update.unshallow {
+		if err := enc.Encodef("unshallow %s\n", sha); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readShallowInfo reads shallow and unshallow lines up to a flush or delim
+func readShallowInfo(dec *pktline.Decoder) (*shallowUpdate, error) {
+	update := &shallowUpdate{}
+	for {
+		packet, err := dec.Decode()
+		if err != nil {
+			return nil, err
+		}
+		if packet.IsFlush() || packet.IsDelim() {
+			return update, nil
+		}
+
+		keyword, sha, _ := strings.Cut(packet.Text(), " ")
+		if err := validSha(sha); err != nil {
+			return nil, err
+		}
+		switch keyword {
+		case "shallow":
+			update.shallow = append(update.shallow, sha)
+		case "unshallow":
+			update.unshallow = append(update.unshallow, sha)
+		default:
+			return nil, fmt.Errorf("protocol error: expected shallow/unshallow, got '%s'", packet.Text())
+		}
+	}
+}
+
+// shallowCommits lists what's in .git/shallow
+func (repo *Repository) shallowCommits() []string {
+	shallow := repo.shallowSet()
+	shas := make([]string, 0, len(shallow))
+	for sha := range shallow {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+	return shas
+}
+
+// applyShallow moves .git/shallow along with what the server said
+func (repo *Repository) applyShallow(update *shallowUpdate) error {
+	if update == nil || len(update.shallow) == 0 && len(update.unshallow) == 0 {
+		return nil
+	}
+
+	shallow := make(map[string]bool)
+	for _, sha := range repo.shallowCommits() {
+		shallow[sha] = true
+	}
+	for _, sha := range update.shallow {
+		shallow[sha] = true
+	}
+	for _, sha := range update.unshallow {
+		delete(shallow, sha)
+	}
+
+	shas := make([]string, 0, len(shallow))
+	for sha := range shallow {
+		shas = append(shas, sha)
+	}
+	return repo.writeShallow(shas)
+}
+
+// writeShallow records the commits whose parents aren't in the repository
+func (repo *Repository) writeShallow(shas []string) error {
+	repo.odb.shallowMu.Lock()
+	defer repo.odb.shallowMu.Unlock()
+	path := repo.makePath("shallow")
+	repo.shallow = nil
+	if len(shas) == 0 {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	sort.Strings(shas)
+	return os.WriteFile(path, []byte(strings.Join(shas, "\n")+"\n"), 0o644)
+}
+
+// isShallow says if a commit's parents were cut off by a shallow clone
+func (repo *Repository) isShallow(sha string) bool {
+	return repo.shallowSet()[sha]
+}
+
+// shallowSet gives the commits in .git/shallow, reading it the first time
+// the set is replaced rather than changed, so it's safe to keep reading one that was handed out
+func (repo *Repository) shallowSet() map[string]bool {
+	repo.odb.shallowMu.Lock()
+	defer repo.odb.shallowMu.Unlock()
+	if repo.shallow == nil {
+		repo.shallow = make(map[string]bool)
+		contents, err := os.ReadFile(repo.makePath("shallow"))
+		if err == nil {
+			for _, line := range strings.Fields(string(contents)) {
+				repo.shallow[line] = true
+			}
+		}
+	}
+	return repo.shallow
+}
+
+// parseApproxDate reads the dates --shallow-since takes
+// a unix time, an ISO 8601 date or time, or "<n> <unit>s ago"
+func parseApproxDate(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if ts, err := strconv.ParseInt(strings.TrimPrefix(value, "@"), 10, 64); err == nil {
+		return ts, nil
+	}
+
+	layouts := []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05 -0700", "2006-01-02 15:04:05", "2006-01-02"}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+
+	// 2 weeks ago, 2.weeks.ago and friends
+	fields := strings.Fields(strings.ReplaceAll(value, ".", " "))
+	if len(fields) == 3 && fields[2] == "ago" {
+		n, err := strconv.Atoi(fields[0])
+		units := map[string]time.Duration{
+			"second": time.Second,
+			"minute": time.Minute,
+			"hour":   time.Hour,
+			"day":    24 * time.Hour,
+			"week":   7 * 24 * time.Hour,
+			"month":  30 * 24 * time.Hour,
+			"year":   365 * 24 * time.Hour,
+		}
+		if unit, ok := units[strings.TrimSuffix(fields[1], "s")]; ok && err == nil {
+			return time.Now().Add(-time.Duration(n) * unit).Unix(), nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid date '%s'", value)
+}
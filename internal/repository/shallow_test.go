@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestShallowCloneDeepenAndUnshallow(t *testing.T) {
+	for _, version := range []int{0, 2} {
+		remote := newTestRepo(t, true)
+		var chain []string
+		for i := range 10 {
+			chain = append(chain, commitTestFiles(t, remote, map[string]string{"file": fmt.Sprintf("%d\n", i)}, chain[max(i-1, 0):]...))
+		}
+		if err := remote.writeRef("refs/heads/master", chain[9]); err != nil {
+			t.Fatal(err)
+		}
+		global := fmt.Sprintf("[protocol]\n\tversion = %d\n", version)
+		if err := os.WriteFile(filepath.Join(os.Getenv("HOME"), ".gitconfig"), []byte(global), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		dest := filepath.Join(t.TempDir(), "clone")
+		if err := remote.clone([]string{"--depth", "2", "file://" + remote.gitDir, dest}); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		repo, err := Open(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// history should end at have, with nothing before it
+		check := func(how, have string, shallow []string) {
+			t.Helper()
+			if got := repo.shallowCommits(); !slices.Equal(got, shallow) {
+				t.Errorf("v%d %s: shallow commits are %v, want %v", version, how, got, shallow)
+			}
+			var walked []string
+			if err := repo.WalkHistory("HEAD", func(sha string) bool {
+				walked = append(walked, sha)
+				return true
+			}); err != nil {
+				t.Fatalf("v%d %s: %v", version, how, err)
+			}
+			first := slices.Index(chain, have)
+			if want := len(chain) - first; len(walked) != want {
+				t.Errorf("v%d %s: walked %d commits, want %d", version, how, len(walked), want)
+			}
+			for i, sha := range chain {
+				if got := repo.hasObject(sha); got != (i >= first) {
+					t.Errorf("v%d %s: has commit %d is %v", version, how, i, got)
+				}
+			}
+		}
+		check("--depth 2", chain[8], []string{chain[8]})
+		if data, err := os.ReadFile(filepath.Join(dest, "file")); err != nil || string(data) != "9\n" {
+			t.Errorf("v%d: checked out %q: %v", version, data, err)
+		}
+
+		if err := repo.fetch([]string{"-q", "--deepen", "3"}); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		check("--deepen 3", chain[5], []string{chain[5]})
+
+		if err := repo.fetch([]string{"-q", "--unshallow"}); err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		check("--unshallow", chain[0], nil)
+		if _, err := os.Stat(repo.makePath("shallow")); !os.IsNotExist(err) {
+			t.Errorf("v%d: shallow file is still there: %v", version, err)
+		}
+	}
+}
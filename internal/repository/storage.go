@@ -0,0 +1,306 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * a repository keeps what it has in four places
+ *
+ *   objects   every object by sha, kind and contents
+ *   refs      refs/*, HEAD and the like, each a sha or "ref: <name>" for a symbolic one
+ *   index     the index file, parsed and serialized here so a store only keeps the bytes
+ *   worktree  the files checked out, slash separated paths from the top like io/fs has them
+ *
+ * each is an interface with the .git directory on disk as one implementation
+ * and maps in memory as the other, which is handy for tests of whatever uses twine
+ *
+ * only reading and writing objects, refs, the index and checked out files goes through them
+ * packs, the commit-graph, reflogs, gc and the transports are all about the .git directory
+ * so they still go straight to disk and make no sense for a repository in memory
+ */
+
+type ObjectStorage interface {
+	// ReadObject gives the kind and contents of an object
+	// an error wrapping fs.ErrNotExist means it isn't stored
+	ReadObject(sha string) (string, []byte, error)
+	HasObject(sha string) bool
+	// WriteObject stores an object under the sha its header and contents hash to
+	WriteObject(sha, kind string, contents []byte) error
+	// ObjectsWithPrefix lists the shas that start with an abbreviated one
+	ObjectsWithPrefix(prefix string) ([]string, error)
+}
+
+// objectOpener is an ObjectStorage that can hand out objects without reading them in full
+type objectOpener interface {
+	OpenObject(sha string) (string, int64, io.ReadCloser, error)
+}
+
+type RefStorage interface {
+	// ReadRef gives what a ref holds, a sha or "ref: <name>"
+	// an error wrapping fs.ErrNotExist means there's no such ref
+	ReadRef(name string) (string, error)
+	WriteRef(name, value string) error
+	DeleteRef(name string) error
+	// ListRefs gives every ref under refs/ with what it holds
+	ListRefs() (map[string]string, error)
+}
+
+// refChanger is a RefStorage that can move refs only while they still hold what they're expected to
+type refChanger interface {
+	// changeRefs makes every change or none of them, failing if a ref doesn't hold its old value
+	changeRefs(changes []refChange) error
+}
+
+type IndexStorage interface {
+	// ReadIndex gives the index as it's serialized
+	// an error wrapping fs.ErrNotExist means there's no index yet
+	ReadIndex() ([]byte, error)
+	WriteIndex(data []byte) error
+}
+
+type WorktreeFS interface {
+	fs.FS
+	// Lstat doesn't follow a symlink
+	Lstat(name string) (fs.FileInfo, error)
+	ReadLink(name string) (string, error)
+	// Create makes a file or truncates the one that's there
+	Create(name string, perm fs.FileMode) (io.WriteCloser, error)
+	Symlink(target, name string) error
+	MkdirAll(name string, perm fs.FileMode) error
+	Remove(name string) error
+}
+
+// storeOnDisk points the repository at its .git directory and work tree
+func (repo *Repository) storeOnDisk() {
+	repo.objects = &diskObjects{repo}
+	repo.refs = &diskRefs{repo.gitDir}
+	repo.indexFile = &diskIndex{repo}
+	repo.files = nil
+	if repo.worktree != "" {
+		repo.files = &diskWorktree{repo.worktree}
+	}
+}
+
+// diskObjects keeps objects loose in objects/xx and in packs
+type diskObjects struct {
+	repo *Repository
+}
+
+func (objects *diskObjects) ReadObject(sha string) (string, []byte, error) {
+	return objects.repo.readObjectFile(sha)
+}
+
+func (objects *diskObjects) OpenObject(sha string) (string, int64, io.ReadCloser, error) {
+	return objects.repo.openObjectFile(sha)
+}
+
+func (objects *diskObjects) HasObject(sha string) bool {
+	return objects.repo.hasObjectFile(sha)
+}
+
+func (objects *diskObjects) WriteObject(sha, kind string, contents []byte) error {
+	return objects.repo.writeObjectFile(sha, kind, contents)
+}
+
+func (objects *diskObjects) ObjectsWithPrefix(prefix string) ([]string, error) {
+	return objects.repo.objectFilesWithPrefix(prefix)
+}
+
+// diskRefs keeps refs as files under the git directory and in packed-refs
+type diskRefs struct {
+	gitDir string
+}
+
+func (refs *diskRefs) ReadRef(name string) (string, error) {
+	contents, err := os.ReadFile(filepath.Join(refs.gitDir, filepath.FromSlash(name)))
+	if err == nil {
+		return strings.TrimSpace(string(contents)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	packed, err := readPackedRefs(refs.gitDir)
+	if err != nil {
+		return "", err
+	}
+	sha, ok := packed[name]
+	if !ok {
+		return "", fmt.Errorf("Didn't find ref %s: %w", name, fs.ErrNotExist)
+	}
+	return sha, nil
+}
+
+func (refs *diskRefs) WriteRef(name, value string) error {
+	return writeRefFile(refs.gitDir, name, value+"\n")
+}
+
+func (refs *diskRefs) DeleteRef(name string) error {
+	return deleteRefFile(refs.gitDir, name)
+}
+
+func (refs *diskRefs) changeRefs(changes []refChange) error {
+	return updateRefFiles(refs.gitDir, changes)
+}
+
+// ListRefs has loose refs win over the ones in packed-refs
+func (refs *diskRefs) ListRefs() (map[string]string, error) {
+	values, err := readPackedRefs(refs.gitDir)
+	if err != nil {
+		return nil, err
+	}
+
+	refsDir := filepath.Join(refs.gitDir, "refs")
+	err = filepath.WalkDir(refsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(refs.gitDir, path)
+		if err != nil {
+			return err
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		values[filepath.ToSlash(rel)] = strings.TrimSpace(string(contents))
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error walking %s: %w", refsDir, err)
+	}
+
+	return values, nil
+}
+
+// diskIndex is the index file in the git directory
+type diskIndex struct {
+	repo *Repository
+}
+
+func (index *diskIndex) ReadIndex() ([]byte, error) {
+	return os.ReadFile(index.repo.makePath("index"))
+}
+
+// WriteIndex goes through a lock file, flushing it first if core.fsync asks for that
+func (index *diskIndex) WriteIndex(data []byte) error {
+	lock, err := lockPath(index.repo.makePath("index"))
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	if _, err := lock.file.Write(data); err != nil {
+		return err
+	}
+	if err := index.repo.syncFile(lock.file, fsyncIndex); err != nil {
+		return err
+	}
+	return lock.commit(nil)
+}
+
+// diskWorktree is a directory on disk
+type diskWorktree struct {
+	root string
+}
+
+func (wt *diskWorktree) path(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(wt.root, filepath.FromSlash(name)), nil
+}
+
+// writePath is path for something about to be written, which can't be anywhere in .git
+func (wt *diskWorktree) writePath(name string) (string, error) {
+	if name != "." {
+		if err := verifyPath(name); err != nil {
+			return "", &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+		}
+	}
+	return wt.path(name)
+}
+
+func (wt *diskWorktree) Open(name string) (fs.File, error) {
+	full, err := wt.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(full)
+}
+
+func (wt *diskWorktree) Lstat(name string) (fs.FileInfo, error) {
+	full, err := wt.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(full)
+}
+
+func (wt *diskWorktree) ReadLink(name string) (string, error) {
+	full, err := wt.path(name)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(full)
+}
+
+// Create replaces whatever's there, so a symlink is never written through
+func (wt *diskWorktree) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	full, err := wt.writePath(name)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(full)
+	return os.OpenFile(full, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+func (wt *diskWorktree) Symlink(target, name string) error {
+	full, err := wt.writePath(name)
+	if err != nil {
+		return err
+	}
+	os.Remove(full)
+	return os.Symlink(target, full)
+}
+
+func (wt *diskWorktree) MkdirAll(name string, perm fs.FileMode) error {
+	full, err := wt.writePath(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(full, perm)
+}
+
+func (wt *diskWorktree) Remove(name string) error {
+	full, err := wt.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(full)
+}
+
+// removeWithEmptyDirs removes a file from the work tree along with the directories it leaves empty
+func removeWithEmptyDirs(files WorktreeFS, name string) error {
+	if err := files.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if files.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
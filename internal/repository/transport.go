@@ -0,0 +1,611 @@
+package repository
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/joeldotdias/twine/pkg/pktline"
+)
+
+// remoteConn is the client end of an upload-pack or receive-pack conversation
+// either with a process or with a repository served in process
+type remoteConn struct {
+	enc     *pktline.Encoder
+	dec     *pktline.Decoder
+	version int
+	// v2 capabilities or the ones on the first v0 ref
+	caps capabilities
+	// only filled in by a v0 advertisement, v2 asks for them with ls-refs
+	refs []advertisedRef
+	// progress sent by the server ends up here
+	progress io.Writer
+	// the server is waiting on us until a fetch or push is sent
+	sent bool
+	// asked for with the fetch so a partial clone stays partial
+	filter *objectFilter
+	// packs from a promisor remote are kept as they are
+	promisor bool
+	// the server forgets everything between requests, like it does over smart HTTP
+	stateless bool
+	wait      func() error
+}
+
+// connectUploadPack talks to upload-pack at url
+// local paths are served in process unless a program was given
+// and http(s) urls go over smart HTTP
+func (repo *Repository) connectUploadPack(url, program string) (*remoteConn, error) {
+	protocol, err := repo.conf.Int("protocol.version", 2)
+	if err != nil {
+		return nil, err
+	}
+	version := 2
+	if protocol < 2 {
+		version = 0
+	}
+	if isHTTPURL(url) {
+		return repo.connectHTTP(url, "git-upload-pack", version)
+	}
+	return repo.connect(url, program, version, func(src *Repository, r io.Reader, w io.Writer) error {
+		return src.serveUploadPack(r, w, serviceOptions{version: version})
+	})
+}
+
+// connectReceivePack talks to receive-pack at url
+// pushing has no v2 so this is always v0
+func (repo *Repository) connectReceivePack(url, program string) (*remoteConn, error) {
+	if isHTTPURL(url) {
+		return repo.connectHTTP(url, "git-receive-pack", 0)
+	}
+	return repo.connect(url, program, 0, func(dst *Repository, r io.Reader, w io.Writer) error {
+		return dst.serveReceivePack(r, w, serviceOptions{})
+	})
+}
+
+func (repo *Repository) connect(url, program string, version int, serve func(*Repository, io.Reader, io.Writer) error) (*remoteConn, error) {
+	path := strings.TrimPrefix(url, "file://")
+
+	var r io.Reader
+	var w io.WriteCloser
+	var wait func() error
+
+	if program == "" {
+		remote, err := openLocalRemote(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// os pipes buffer like a real process would
+		// so the server can ACK while we're still sending haves
+		clientR, serverW, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		serverR, clientW, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		errc := make(chan error, 1)
+		go func() {
+			err := serve(remote, serverR, serverW)
+			serverW.Close()
+			serverR.Close()
+			errc <- err
+		}()
+		r, w = clientR, clientW
+		wait = func() error {
+			err := <-errc
+			clientR.Close()
+			return err
+		}
+	} else {
+		// the program may come with arguments of its own, same as git
+		cmd := exec.Command("sh", "-c", program+` "$@"`, program, path)
+		cmd.Stderr = os.Stderr
+		cmd.Env = os.Environ()
+		if version == 2 {
+			cmd.Env = append(cmd.Env, "GIT_PROTOCOL=version=2")
+		}
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("Couldn't start %s: %w", program, err)
+		}
+		r, w, wait = stdout, stdin, cmd.Wait
+	}
+
+	conn := &remoteConn{
+		enc:      pktline.NewEncoder(w),
+		dec:      pktline.NewDecoder(r),
+		progress: io.Discard,
+		wait: func() error {
+			w.Close()
+			return wait()
+		},
+	}
+	if err := conn.readAdvertisement(); err != nil {
+		conn.wait()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (conn *remoteConn) readAdvertisement() error {
+	first := true
+	for {
+		packet, err := conn.dec.Decode()
+		if err != nil {
+			return fmt.Errorf("Couldn't read ref advertisement: %w", err)
+		}
+		if packet.IsFlush() {
+			return nil
+		}
+
+		line := packet.Text()
+		if first {
+			first = false
+			switch line {
+			case "version 2":
+				conn.version = 2
+				conn.caps = make(capabilities)
+				continue
+			case "version 1":
+				continue
+			}
+		}
+
+		if conn.version == 2 {
+			k, v, _ := strings.Cut(line, "=")
+			conn.caps[k] = v
+			continue
+		}
+
+		if conn.caps == nil {
+			var list string
+			line, list, _ = strings.Cut(line, "\x00")
+			conn.caps = parseCapabilities(list)
+		}
+		sha, name, ok := strings.Cut(line, " ")
+		if !ok {
+			return fmt.Errorf("protocol error: bad ref line '%s'", line)
+		}
+		switch {
+		case name == "capabilities^{}":
+		case strings.HasSuffix(name, "^{}"):
+			if n := len(conn.refs); n > 0 && conn.refs[n-1].name+"^{}" == name {
+				conn.refs[n-1].peeled = sha
+			}
+		default:
+			conn.refs = append(conn.refs, advertisedRef{name: name, sha: sha})
+		}
+	}
+}
+
+// listRefs gives the remote's refs that start with any of the prefixes
+func (conn *remoteConn) listRefs(prefixes []string) ([]advertisedRef, error) {
+	if conn.version != 2 {
+		for _, symref := range strings.Fields(conn.caps["symref"]) {
+			from, to, _ := strings.Cut(symref, ":")
+			for i := range conn.refs {
+				if conn.refs[i].name == from {
+					conn.refs[i].symref = to
+				}
+			}
+		}
+		var refs []advertisedRef
+		for _, ref := range conn.refs {
+			if matchesPrefix(ref.name, prefixes) {
+				refs = append(refs, ref)
+			}
+		}
+		return refs, nil
+	}
+
+	args := []string{"symrefs", "peel"}
+	if strings.Contains(conn.caps["ls-refs"], "unborn") {
+		args = append(args, "unborn")
+	}
+	for _, prefix := range prefixes {
+		args = append(args, "ref-prefix "+prefix)
+	}
+	if err := conn.command("ls-refs", args); err != nil {
+		return nil, err
+	}
+
+	var refs []advertisedRef
+	for {
+		packet, err := conn.dec.Decode()
+		if err != nil {
+			return nil, err
+		}
+		if packet.IsFlush() {
+			return refs, nil
+		}
+
+		fields := strings.Fields(packet.Text())
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("protocol error: bad ls-refs line '%s'", packet.Text())
+		}
+		ref := advertisedRef{sha: fields[0], name: fields[1]}
+		if ref.sha == "unborn" {
+			ref.sha = ""
+		}
+		for _, attr := range fields[2:] {
+			if target, ok := strings.CutPrefix(attr, "symref-target:"); ok {
+				ref.symref = target
+			} else if peeled, ok := strings.CutPrefix(attr, "peeled:"); ok {
+				ref.peeled = peeled
+			}
+		}
+		refs = append(refs, ref)
+	}
+}
+
+// command sends a v2 request
+func (conn *remoteConn) command(name string, args []string) error {
+	lines := []string{"command=" + name, "agent=" + agent}
+	if conn.caps.has("object-format") {
+		lines = append(lines, "object-format="+conn.caps["object-format"])
+	}
+	for _, line := range lines {
+		if err := conn.enc.Encodef("%s\n", line); err != nil {
+			return err
+		}
+	}
+	if err := conn.enc.Delim(); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := conn.enc.Encodef("%s\n", arg); err != nil {
+			return err
+		}
+	}
+	return conn.enc.Flush()
+}
+
+// haves go in rounds of this many, newest first, until the server has one of them
+// git gives up on finding anything in common after this many
+const (
+	haveBatchSize = 32
+	maxHaves      = 256
+)
+
+// fetch asks for the wants, telling the remote about the haves a round at a time
+// and unpacks whatever pack comes back into repo
+// along with how the shallow boundary moved when there is one
+func (conn *remoteConn) fetch(repo *Repository, wants, haves []string, shallow shallowRequest) ([]string, *shallowUpdate, error) {
+	conn.sent = true
+	if err := conn.checkFormat(repo); err != nil {
+		return nil, nil, err
+	}
+	if conn.version == 2 {
+		if len(shallow.shallow) > 0 || shallow.deepen() {
+			if !strings.Contains(" "+conn.caps["fetch"]+" ", " shallow ") {
+				return nil, nil, fmt.Errorf("Server does not support shallow clients")
+			}
+		}
+		return conn.fetchV2(repo, wants, haves, shallow)
+	}
+
+	if (len(shallow.shallow) > 0 || shallow.deepen()) && !conn.caps.has("shallow") {
+		return nil, nil, fmt.Errorf("Server does not support shallow clients")
+	}
+	if shallow.since > 0 && !conn.caps.has("deepen-since") {
+		return nil, nil, fmt.Errorf("Server does not support --shallow-since")
+	}
+	if shallow.relative && !conn.caps.has("deepen-relative") {
+		return nil, nil, fmt.Errorf("Server does not support --deepen")
+	}
+	filter := conn.filter
+	if filter != nil && !conn.caps.has("filter") {
+		fmt.Fprintln(os.Stderr, "warning: filtering not recognized by server, ignoring")
+		filter = nil
+	}
+
+	var caps []string
+	for _, c := range []string{"side-band-64k", "ofs-delta", "include-tag", "shallow", "deepen-since", "deepen-relative"} {
+		if conn.caps.has(c) {
+			caps = append(caps, c)
+		}
+	}
+	if !conn.caps.has("side-band-64k") && conn.caps.has("side-band") {
+		caps = append(caps, "side-band")
+	}
+	if conn.progress == io.Discard && conn.caps.has("no-progress") {
+		caps = append(caps, "no-progress")
+	}
+	if filter != nil {
+		caps = append(caps, "filter")
+	}
+	if conn.caps.has("object-format") {
+		caps = append(caps, "object-format="+conn.caps["object-format"])
+	}
+	caps = append(caps, "agent="+agent)
+
+	// the wants go again with every round when the server forgets everything between them
+	sendWants := func() error {
+		for i, want := range wants {
+			var err error
+			if i == 0 {
+				err = conn.enc.Encodef("want %s %s\n", want, strings.Join(caps, " "))
+			} else {
+				err = conn.enc.Encodef("want %s\n", want)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, line := range shallow.lines() {
+			if err := conn.enc.Encodef("%s\n", line); err != nil {
+				return err
+			}
+		}
+		if filter != nil {
+			if err := conn.enc.Encodef("filter %s\n", filter); err != nil {
+				return err
+			}
+		}
+		return conn.enc.Flush()
+	}
+	// the shallow info comes back before any negotiation, once for every round
+	var update *shallowUpdate
+	readShallow := func() error {
+		if !shallow.deepen() {
+			return nil
+		}
+		var err error
+		update, err = readShallowInfo(conn.dec)
+		return err
+	}
+	// without multi_ack the server sends a NAK for each flush before it finds a common have
+	// git ACKs the first common have, and then every other have it already knew was common
+	readReply := func() (string, error) {
+		reply, err := conn.dec.DecodeText()
+		if err != nil {
+			return "", err
+		}
+		if reply != "NAK" && !strings.HasPrefix(reply, "ACK ") {
+			return "", fmt.Errorf("protocol error: expected ACK/NAK, got '%s'", reply)
+		}
+		return strings.TrimPrefix(reply, "ACK "), nil
+	}
+
+	if !conn.stateless {
+		if err := sendWants(); err != nil {
+			return nil, nil, err
+		}
+		if err := readShallow(); err != nil {
+			return nil, nil, err
+		}
+	}
+	common := ""
+	for start := 0; start < len(haves) && common == ""; start += haveBatchSize {
+		if conn.stateless {
+			if err := sendWants(); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, have := range haves[start:min(start+haveBatchSize, len(haves))] {
+			if err := conn.enc.Encodef("have %s\n", have); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := conn.enc.Flush(); err != nil {
+			return nil, nil, err
+		}
+		if conn.stateless {
+			if err := readShallow(); err != nil {
+				return nil, nil, err
+			}
+		}
+		// a server that forgets everything ends each round, so the whole of it is read
+		for {
+			reply, err := readReply()
+			if err == io.EOF && conn.stateless {
+				break
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			if reply != "NAK" && common == "" {
+				common = reply
+			}
+			if !conn.stateless {
+				break
+			}
+		}
+	}
+
+	// a server that forgot the round the ACK came in is told about the common commit again
+	if conn.stateless {
+		if err := sendWants(); err != nil {
+			return nil, nil, err
+		}
+		if common != "" {
+			if err := conn.enc.Encodef("have %s\n", common); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err := conn.enc.Encodef("done\n"); err != nil {
+		return nil, nil, err
+	}
+	if conn.stateless {
+		if err := readShallow(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if common == "" || conn.stateless {
+		if _, err := readReply(); err != nil {
+			return nil, nil, err
+		}
+	}
+	// whatever else was acknowledged comes before the pack
+	for {
+		next, err := conn.dec.Peek(8)
+		if err != nil || string(next[4:]) != "ACK " {
+			break
+		}
+		if _, err := readReply(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var shas []string
+	var err error
+	if conn.caps.has("side-band-64k") || conn.caps.has("side-band") {
+		shas, err = conn.receivePack(repo, pktline.NewDemuxer(conn.dec, conn.progress))
+	} else {
+		shas, err = conn.receivePack(repo, conn.dec.Raw())
+	}
+	return shas, update, err
+}
+
+// receivePack stores the pack a fetch gets back
+// as loose objects, or as a promisor pack when it's from a partial clone's remote
+func (conn *remoteConn) receivePack(repo *Repository, r io.Reader) ([]string, error) {
+	if conn.promisor {
+		return repo.keepPack(r, true)
+	}
+	return repo.unpackObjects(r)
+}
+
+func (conn *remoteConn) fetchV2(repo *Repository, wants, haves []string, shallow shallowRequest) ([]string, *shallowUpdate, error) {
+	args := []string{"ofs-delta", "include-tag"}
+	if conn.progress == io.Discard {
+		args = append(args, "no-progress")
+	}
+	for _, want := range wants {
+		args = append(args, "want "+want)
+	}
+	args = append(args, shallow.lines()...)
+	if conn.filter != nil {
+		if strings.Contains(" "+conn.caps["fetch"]+" ", " filter ") {
+			args = append(args, "filter "+conn.filter.String())
+		} else {
+			fmt.Fprintln(os.Stderr, "warning: filtering not recognized by server, ignoring")
+		}
+	}
+
+	// each round is a request of its own, so it carries the wants and whatever was found in common so far
+	var common []string
+	known := make(map[string]bool)
+	for start := 0; ; start += haveBatchSize {
+		end := min(start+haveBatchSize, len(haves))
+		round := slices.Clone(args)
+		for _, have := range append(slices.Clone(common), haves[start:end]...) {
+			round = append(round, "have "+have)
+		}
+		done := end == len(haves)
+		if done {
+			round = append(round, "done")
+		}
+		if err := conn.command("fetch", round); err != nil {
+			return nil, nil, err
+		}
+
+		shas, update, acked, ready, err := conn.readFetchResponse(repo)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ready {
+			return shas, update, nil
+		}
+		if done {
+			return nil, nil, fmt.Errorf("protocol error: no packfile in the fetch response")
+		}
+		// git acknowledges what it already knew was common again
+		for _, sha := range acked {
+			if !known[sha] {
+				known[sha] = true
+				common = append(common, sha)
+			}
+		}
+	}
+}
+
+// readFetchResponse reads what a v2 fetch sent back, the pack if the server was ready to send one
+// and the haves it acknowledged if it wasn't
+func (conn *remoteConn) readFetchResponse(repo *Repository) ([]string, *shallowUpdate, []string, bool, error) {
+	var update *shallowUpdate
+	var acked []string
+	for {
+		section, err := conn.dec.DecodeText()
+		if err != nil {
+			return nil, nil, nil, false, err
+		}
+		switch section {
+		case "packfile":
+			shas, err := conn.receivePack(repo, pktline.NewDemuxer(conn.dec, conn.progress))
+			return shas, update, acked, true, err
+		case "shallow-info":
+			if update, err = readShallowInfo(conn.dec); err != nil {
+				return nil, nil, nil, false, err
+			}
+			continue
+		}
+
+		// anything else, like wanted-refs, isn't used
+		// a flush ends the response, which is how acknowledgments end when the server wants more haves
+		for {
+			packet, err := conn.dec.Decode()
+			if err != nil {
+				return nil, nil, nil, false, err
+			}
+			if packet.IsFlush() {
+				if section != "acknowledgments" {
+					return nil, nil, nil, false, fmt.Errorf("protocol error: no packfile in the fetch response")
+				}
+				return nil, nil, acked, false, nil
+			}
+			if packet.IsDelim() {
+				break
+			}
+			if sha, ok := strings.CutPrefix(packet.Text(), "ACK "); ok && section == "acknowledgments" {
+				acked = append(acked, sha)
+			}
+		}
+	}
+}
+
+// close hangs up and waits for the other end to finish
+func (conn *remoteConn) close() error {
+	if !conn.sent || conn.version == 2 {
+		// a flush instead of wants or a command means nothing more is wanted
+		conn.enc.Flush()
+	}
+	return conn.wait()
+}
+
+// remoteProgress puts "remote: " in front of each line the server sends
+type remoteProgress struct {
+	w       io.Writer
+	midLine bool
+}
+
+func (p *remoteProgress) Write(data []byte) (int, error) {
+	var out []byte
+	for _, b := range data {
+		if !p.midLine {
+			out = append(out, "remote: "...)
+			p.midLine = true
+		}
+		out = append(out, b)
+		if b == '\n' || b == '\r' {
+			p.midLine = false
+		}
+	}
+	if _, err := p.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
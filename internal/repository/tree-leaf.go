@@ -12,7 +12,7 @@ type TreeLeaf struct {
 	sha  []byte
 }
 
-func treeParseOne(raw []byte, start int) (*TreeLeaf, int, error) {
+func treeParseOne(raw []byte, start, hashSize int) (*TreeLeaf, int, error) {
 	// helper so i don't have to write the same thing thrice
 	parseErr := func(msg string) (*TreeLeaf, int, error) {
 		return nil, -1, fmt.Errorf("Malformed tree entry: %s", msg)
@@ -42,19 +42,19 @@ func treeParseOne(raw []byte, start int) (*TreeLeaf, int, error) {
 	path := string(raw[pathStart : pathStart+nullIdx])
 
 	shaStart := pathStart + nullIdx + 1
-	if shaStart+20 > end {
+	if shaStart+hashSize > end {
 		return parseErr("Didn't get enough bytes for SHA")
 	}
-	sha := raw[shaStart : shaStart+20]
+	sha := raw[shaStart : shaStart+hashSize]
 
 	return &TreeLeaf{
 		mode,
 		path,
 		sha,
-	}, shaStart + 20, nil
+	}, shaStart + hashSize, nil
 }
 
-func treeParseEntirety(raw []byte) []*TreeLeaf {
+func treeParseEntirety(raw []byte, hashSize int) ([]*TreeLeaf, error) {
 	pos := 0
 	max := len(raw)
 	parsed := []*TreeLeaf{}
@@ -62,21 +62,21 @@ func treeParseEntirety(raw []byte) []*TreeLeaf {
 	for pos < max {
 		var leaf *TreeLeaf
 		var err error
-		leaf, pos, err = treeParseOne(raw, pos)
+		leaf, pos, err = treeParseOne(raw, pos, hashSize)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		parsed = append(parsed, leaf)
 	}
 
-	return parsed
+	return parsed, nil
 }
 
+// sortLeafByKey is what git sorts tree entries by
+// directories compare as if their name ended in a separator
 func sortLeafByKey(leaf *TreeLeaf) string {
 	if strings.HasPrefix(leaf.mode, "40") {
-		return leaf.path
+		return leaf.path + "/"
 	}
-
-	// if not a dir, append separator
-	return leaf.path + "/"
+	return leaf.path
 }
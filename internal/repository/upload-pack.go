@@ -0,0 +1,679 @@
+package repository
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/joeldotdias/twine/pkg/pktline"
+)
+
+/*
+ * upload-pack is the side of a fetch that has the objects
+ *
+ * v0: refs with capabilities on the first line, flush
+ *     client: want <sha> [caps]... flush, have <sha>... done
+ *     server: ACK <sha> for the first common have or NAK, then the pack
+ *
+ * v2: capability advertisement, flush
+ *     client: command=<cmd>, capabilities, delim, arguments, flush
+ *     which repeats until the client hangs up
+ */
+
+// serviceOptions covers the ways upload-pack and receive-pack get run
+// smart HTTP splits a conversation into one request per round
+type serviceOptions struct {
+	version int
+	// only advertise refs (or capabilities) and stop
+	advertiseRefs bool
+	// the advertisement is left to a separate --advertise-refs run
+	// and the server answers one round of requests before returning
+	statelessRPC bool
+}
+
+func (repo *Repository) uploadPack(args []string) error {
+	opts, dir, err := parseServiceArgs("upload-pack", args)
+	if err != nil {
+		return err
+	}
+
+	src, err := openLocalRemote(dir)
+	if err != nil {
+		return err
+	}
+
+	return src.serveUploadPack(os.Stdin, os.Stdout, opts)
+}
+
+func parseServiceArgs(service string, args []string) (serviceOptions, string, error) {
+	opts := serviceOptions{version: protocolVersion()}
+	serviceCmd := flag.NewFlagSet(service, flag.ExitOnError)
+	serviceCmd.BoolVar(&opts.statelessRPC, "stateless-rpc", false, "Answer a single round of requests")
+	serviceCmd.BoolVar(&opts.advertiseRefs, "advertise-refs", false, "Only advertise refs and exit")
+	serviceCmd.BoolVar(&opts.advertiseRefs, "http-backend-info-refs", false, "Only advertise refs and exit")
+	if err := serviceCmd.Parse(args); err != nil {
+		return opts, "", err
+	}
+	if serviceCmd.NArg() != 1 {
+		return opts, "", fmt.Errorf("usage: %s [--stateless-rpc] [--advertise-refs] <directory>", service)
+	}
+	return opts, serviceCmd.Arg(0), nil
+}
+
+func (repo *Repository) serveUploadPack(r io.Reader, w io.Writer, opts serviceOptions) error {
+	enc := pktline.NewEncoder(w)
+	dec := pktline.NewDecoder(r)
+
+	if opts.version == 2 {
+		return repo.serveUploadPackV2(enc, dec, opts)
+	}
+
+	if !opts.statelessRPC || opts.advertiseRefs {
+		refs, err := repo.advertisedRefs()
+		if err != nil {
+			return err
+		}
+		caps := []string{"side-band", "side-band-64k", "shallow", "deepen-since", "deepen-relative", "no-progress", "include-tag", "object-format=" + repo.format.name}
+		// anything a ref reaches can be asked for, which is what lazy fetches need
+		caps = append(caps, "allow-tip-sha1-in-want", "allow-reachable-sha1-in-want")
+		allowFilter, err := repo.conf.Bool("uploadpack.allowFilter", true)
+		if err != nil {
+			return err
+		}
+		if allowFilter {
+			caps = append(caps, "filter")
+		}
+		for _, ref := range refs {
+			if ref.name == "HEAD" && ref.symref != "" {
+				caps = append(caps, "symref=HEAD:"+ref.symref)
+			}
+		}
+		caps = append(caps, "agent="+agent)
+		if err := advertiseRefs(enc, repo.format, refs, caps); err != nil {
+			return err
+		}
+	}
+	if opts.advertiseRefs {
+		return nil
+	}
+
+	wants, shallowReq, filter, clientCaps, err := readWants(dec)
+	if err != nil {
+		return err
+	}
+	if len(wants) == 0 {
+		// the client only wanted to look at the refs
+		return nil
+	}
+	if err := repo.checkClientFormat(clientCaps); err != nil {
+		return err
+	}
+	if err := repo.checkWants(wants); err != nil {
+		enc.Encodef("ERR %s\n", err)
+		return err
+	}
+
+	var shallow *shallowUpdate
+	if shallowReq.deepen() || len(shallowReq.shallow) > 0 {
+		if shallow, err = repo.computeShallow(wants, shallowReq); err != nil {
+			return err
+		}
+	}
+	// shallow info only goes back when the client asked to deepen
+	if shallowReq.deepen() {
+		if err := writeShallowInfo(enc, shallow); err != nil {
+			return err
+		}
+		if err := enc.Flush(); err != nil {
+			return err
+		}
+	}
+
+	haves, done, err := repo.negotiateV0(enc, dec, opts.statelessRPC)
+	if err != nil || !done {
+		return err
+	}
+
+	return repo.sendPack(enc, wants, haves, clientCaps, shallow, filter)
+}
+
+// advertiseRefs writes one line per ref with the capabilities hidden
+// after a NUL on the first one
+func advertiseRefs(enc *pktline.Encoder, format *objectFormat, refs []advertisedRef, caps []string) error {
+	capList := strings.Join(caps, " ")
+	if len(refs) == 0 {
+		if err := enc.Encodef("%s capabilities^{}\x00%s\n", format.zero(), capList); err != nil {
+			return err
+		}
+		return enc.Flush()
+	}
+
+	for i, ref := range refs {
+		var err error
+		if i == 0 {
+			err = enc.Encodef("%s %s\x00%s\n", ref.sha, ref.name, capList)
+		} else {
+			err = enc.Encodef("%s %s\n", ref.sha, ref.name)
+		}
+		if err != nil {
+			return err
+		}
+		if ref.peeled != "" {
+			if err := enc.Encodef("%s %s^{}\n", ref.peeled, ref.name); err != nil {
+				return err
+			}
+		}
+	}
+	return enc.Flush()
+}
+
+// readWants reads the wants along with the shallow and filter lines that follow them
+func readWants(dec *pktline.Decoder) ([]string, shallowRequest, *objectFilter, capabilities, error) {
+	var wants []string
+	var shallow shallowRequest
+	var filter *objectFilter
+	caps := make(capabilities)
+
+	for {
+		packet, err := dec.Decode()
+		if err == io.EOF && len(wants) == 0 {
+			return nil, shallow, nil, caps, nil
+		}
+		if err != nil {
+			return nil, shallow, nil, nil, err
+		}
+		if packet.IsFlush() {
+			return wants, shallow, filter, caps, nil
+		}
+
+		line := packet.Text()
+		if ok, err := shallow.parseLine(line); ok || err != nil {
+			if err != nil {
+				return nil, shallow, nil, nil, err
+			}
+			continue
+		}
+		if spec, ok := strings.CutPrefix(line, "filter "); ok {
+			if filter, err = parseObjectFilter(spec); err != nil {
+				return nil, shallow, nil, nil, err
+			}
+			continue
+		}
+		sha, ok := strings.CutPrefix(line, "want ")
+		if !ok {
+			return nil, shallow, nil, nil, fmt.Errorf("protocol error: expected want, got '%s'", line)
+		}
+		if len(wants) == 0 {
+			// capabilities ride along on the first want
+			var list string
+			sha, list, _ = strings.Cut(sha, " ")
+			caps = parseCapabilities(list)
+		}
+		if err := validSha(sha); err != nil {
+			return nil, shallow, nil, nil, err
+		}
+		wants = append(wants, sha)
+	}
+}
+
+// checkWants makes sure every want is the tip of a ref or can be reached from one
+// so nothing that was never pushed or has since been dropped from history gets out
+// uploadpack.allowAnySHA1InWant lets any object that's here be asked for
+func (repo *Repository) checkWants(wants []string) error {
+	if anySha, err := repo.conf.Bool("uploadpack.allowAnySHA1InWant", false); anySha || err != nil {
+		return err
+	}
+	refs, err := repo.advertisedRefs()
+	if err != nil {
+		return err
+	}
+	ours := make(map[string]bool)
+	var tips []string
+	for _, ref := range refs {
+		ours[ref.sha] = true
+		tips = append(tips, ref.sha)
+		if ref.peeled != "" {
+			ours[ref.peeled] = true
+		}
+	}
+
+	pending := make(map[string]bool)
+	for _, sha := range wants {
+		if !ours[sha] {
+			pending[sha] = true
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	notOurs := func(sha string) error {
+		return fmt.Errorf("upload-pack: not our ref %s", sha)
+	}
+	for _, sha := range wants {
+		if pending[sha] && !repo.hasObject(sha) {
+			return notOurs(sha)
+		}
+	}
+
+	// everything the refs reach is one walk, which a bitmap mostly does without reading anything
+	if bm := repo.loadBitmap(); bm.pack != nil {
+		if bits, extra, err := bm.reachableFrom(repo, tips); err == nil {
+			for _, sha := range wants {
+				bit, packed := bm.position(sha)
+				if pending[sha] && !(packed && bits.has(bit)) && !extra[sha] {
+					return notOurs(sha)
+				}
+			}
+			return nil
+		}
+	}
+
+	// history is cheaper to walk than every tree in it, so trees and blobs are only looked for when asked for
+	// commits come from the commit-graph when there is one, and the walk stops once they've all turned up
+	commits := true
+	for sha := range pending {
+		if _, err := repo.commitInfo(sha); err != nil {
+			commits = false
+			break
+		}
+	}
+	if commits {
+		repo.walkCommits(tips, func(sha string) bool {
+			delete(pending, sha)
+			return len(pending) > 0
+		})
+	} else {
+		objects, err := repo.reachableObjects(tips)
+		if err != nil {
+			return err
+		}
+		for _, sha := range objects {
+			delete(pending, sha)
+		}
+	}
+
+	for _, sha := range wants {
+		if pending[sha] {
+			return notOurs(sha)
+		}
+	}
+	return nil
+}
+
+// negotiateV0 reads haves without multi_ack
+// only the first common commit is acknowledged
+// a stateless round ends at the first flush without a pack being sent
+func (repo *Repository) negotiateV0(enc *pktline.Encoder, dec *pktline.Decoder, stateless bool) ([]string, bool, error) {
+	var common []string
+
+	for {
+		packet, err := dec.Decode()
+		if err == io.EOF && stateless {
+			// a deepening client hangs up once it has the shallow info
+			return common, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		if packet.IsFlush() {
+			if len(common) == 0 {
+				if err := enc.Encodef("NAK\n"); err != nil {
+					return nil, false, err
+				}
+			}
+			if stateless {
+				return common, false, nil
+			}
+			continue
+		}
+
+		line := packet.Text()
+		if line == "done" {
+			if len(common) == 0 {
+				if err := enc.Encodef("NAK\n"); err != nil {
+					return nil, false, err
+				}
+			}
+			return common, true, nil
+		}
+
+		sha, ok := strings.CutPrefix(line, "have ")
+		if !ok {
+			return nil, false, fmt.Errorf("protocol error: expected have, got '%s'", line)
+		}
+		if _, _, err := repo.readObject(sha); err != nil {
+			continue
+		}
+		common = append(common, sha)
+		if len(common) == 1 {
+			if err := enc.Encodef("ACK %s\n", sha); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+}
+
+// sendPack writes a pack of everything reachable from the wants but not the haves
+// over sideband when the client asked for it
+func (repo *Repository) sendPack(enc *pktline.Encoder, wants, haves []string, caps capabilities, shallow *shallowUpdate, filter *objectFilter) error {
+	objects, err := repo.objectsToSend(wants, haves, shallow, filter)
+	if err != nil {
+		return err
+	}
+	if caps.has("include-tag") {
+		if objects, err = repo.includeTags(objects); err != nil {
+			return err
+		}
+	}
+
+	var max int
+	switch {
+	case caps.has("side-band-64k"):
+		max = pktline.LargeSideband
+	case caps.has("side-band"):
+		max = pktline.SmallSideband
+	default:
+		return repo.writePack(enc.Raw(), objects)
+	}
+
+	if !caps.has("no-progress") {
+		progress := pktline.NewSidebandWriter(enc, pktline.BandProgress, max)
+		fmt.Fprintf(progress, "Total %d (delta 0), reused 0 (delta 0)\n", len(objects))
+	}
+	data := pktline.NewSidebandWriter(enc, pktline.BandData, max)
+	if err := repo.writePack(data, objects); err != nil {
+		errors := pktline.NewSidebandWriter(enc, pktline.BandError, max)
+		fmt.Fprintf(errors, "%s\n", err)
+		return err
+	}
+	return enc.Flush()
+}
+
+// includeTags adds annotated tags whose target is already going out
+func (repo *Repository) includeTags(objects []string) ([]string, error) {
+	sending := make(map[string]bool, len(objects))
+	for _, sha := range objects {
+		sending[sha] = true
+	}
+
+	refs, err := repo.readRefs()
+	if err != nil {
+		return nil, err
+	}
+	for name, sha := range refs {
+		if !strings.HasPrefix(name, "refs/tags/") || sending[sha] {
+			continue
+		}
+		obj, err := repo.makeObject(sha)
+		if err != nil {
+			continue
+		}
+		tag, ok := obj.(*Tag)
+		if !ok {
+			continue
+		}
+		target, err := tag.getField("object")
+		if err != nil || !sending[target] {
+			continue
+		}
+		sending[sha] = true
+		objects = append(objects, sha)
+	}
+
+	return objects, nil
+}
+
+func (repo *Repository) serveUploadPackV2(enc *pktline.Encoder, dec *pktline.Decoder, opts serviceOptions) error {
+	if !opts.statelessRPC || opts.advertiseRefs {
+		fetch := "fetch=shallow"
+		allowFilter, err := repo.conf.Bool("uploadpack.allowFilter", true)
+		if err != nil {
+			return err
+		}
+		if allowFilter {
+			fetch += " filter"
+		}
+		advertisement := []string{
+			"version 2",
+			"agent=" + agent,
+			"ls-refs=unborn",
+			fetch,
+			"server-option",
+			"object-format=" + repo.format.name,
+		}
+		for _, line := range advertisement {
+			if err := enc.Encodef("%s\n", line); err != nil {
+				return err
+			}
+		}
+		if err := enc.Flush(); err != nil {
+			return err
+		}
+	}
+	if opts.advertiseRefs {
+		return nil
+	}
+
+	for {
+		command, caps, args, err := readCommand(dec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if command != "" {
+			if err := repo.checkClientFormat(caps); err != nil {
+				return err
+			}
+		}
+
+		switch command {
+		case "":
+			// a flush where a command should be means the client is done
+			return nil
+		case "ls-refs":
+			err = repo.lsRefsV2(enc, args)
+		case "fetch":
+			err = repo.fetchV2(enc, args)
+		default:
+			err = fmt.Errorf("unknown command '%s'", command)
+		}
+		if err != nil || opts.statelessRPC {
+			return err
+		}
+	}
+}
+
+// readCommand reads a v2 request
+// along with the capabilities that come before the delim
+func readCommand(dec *pktline.Decoder) (string, capabilities, []string, error) {
+	packet, err := dec.Decode()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if packet.IsFlush() {
+		return "", nil, nil, nil
+	}
+	command, ok := strings.CutPrefix(packet.Text(), "command=")
+	if !ok {
+		return "", nil, nil, fmt.Errorf("protocol error: expected command, got '%s'", packet.Text())
+	}
+
+	caps := make(capabilities)
+	var args []string
+	inArgs := false
+	for {
+		packet, err := dec.Decode()
+		if err != nil {
+			return "", nil, nil, err
+		}
+		switch {
+		case packet.IsFlush():
+			return command, caps, args, nil
+		case packet.IsDelim():
+			inArgs = true
+		case inArgs:
+			args = append(args, packet.Text())
+		default:
+			k, v, _ := strings.Cut(packet.Text(), "=")
+			caps[k] = v
+		}
+	}
+}
+
+func (repo *Repository) lsRefsV2(enc *pktline.Encoder, args []string) error {
+	var symrefs, peel, unborn bool
+	var prefixes []string
+	for _, arg := range args {
+		switch {
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "peel":
+			peel = true
+		case arg == "unborn":
+			unborn = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		}
+	}
+
+	refs, err := repo.advertisedRefs()
+	if err != nil {
+		return err
+	}
+
+	// HEAD pointing at a branch with no commits yet
+	if unborn && (len(refs) == 0 || refs[0].name != "HEAD") && matchesPrefix("HEAD", prefixes) {
+		if target, err := repo.readSymref("HEAD"); err == nil && target != "" {
+			if err := enc.Encodef("unborn HEAD symref-target:%s\n", target); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ref := range refs {
+		if !matchesPrefix(ref.name, prefixes) {
+			continue
+		}
+		line := ref.sha + " " + ref.name
+		if symrefs && ref.symref != "" {
+			line += " symref-target:" + ref.symref
+		}
+		if peel && ref.peeled != "" {
+			line += " peeled:" + ref.peeled
+		}
+		if err := enc.Encodef("%s\n", line); err != nil {
+			return err
+		}
+	}
+	return enc.Flush()
+}
+
+func matchesPrefix(name string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (repo *Repository) fetchV2(enc *pktline.Encoder, args []string) error {
+	var wants, haves []string
+	var shallowReq shallowRequest
+	var filter *objectFilter
+	done := false
+	caps := capabilities{"side-band-64k": ""}
+	for _, arg := range args {
+		if ok, err := shallowReq.parseLine(arg); ok || err != nil {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(arg, "want "):
+			wants = append(wants, strings.TrimPrefix(arg, "want "))
+		case strings.HasPrefix(arg, "have "):
+			haves = append(haves, strings.TrimPrefix(arg, "have "))
+		case strings.HasPrefix(arg, "filter "):
+			var err error
+			if filter, err = parseObjectFilter(strings.TrimPrefix(arg, "filter ")); err != nil {
+				return err
+			}
+		case arg == "done":
+			done = true
+		case arg == "no-progress", arg == "include-tag":
+			caps[arg] = ""
+		}
+	}
+	for _, sha := range append(wants, haves...) {
+		if err := validSha(sha); err != nil {
+			return err
+		}
+	}
+	if err := repo.checkWants(wants); err != nil {
+		enc.Encodef("ERR %s\n", err)
+		return err
+	}
+
+	var common []string
+	for _, have := range haves {
+		if _, _, err := repo.readObject(have); err == nil {
+			common = append(common, have)
+		}
+	}
+
+	if !done {
+		if err := enc.Encodef("acknowledgments\n"); err != nil {
+			return err
+		}
+		for _, sha := range common {
+			if err := enc.Encodef("ACK %s\n", sha); err != nil {
+				return err
+			}
+		}
+		if len(common) == 0 {
+			if err := enc.Encodef("NAK\n"); err != nil {
+				return err
+			}
+			// the client keeps going with more haves
+			return enc.Flush()
+		}
+		if err := enc.Encodef("ready\n"); err != nil {
+			return err
+		}
+		if err := enc.Delim(); err != nil {
+			return err
+		}
+	}
+
+	var shallow *shallowUpdate
+	if shallowReq.deepen() || len(shallowReq.shallow) > 0 {
+		var err error
+		if shallow, err = repo.computeShallow(wants, shallowReq); err != nil {
+			return err
+		}
+		if err := enc.Encodef("shallow-info\n"); err != nil {
+			return err
+		}
+		if err := writeShallowInfo(enc, shallow); err != nil {
+			return err
+		}
+		if err := enc.Delim(); err != nil {
+			return err
+		}
+	}
+
+	if err := enc.Encodef("packfile\n"); err != nil {
+		return err
+	}
+	return repo.sendPack(enc, wants, common, caps, shallow, filter)
+}
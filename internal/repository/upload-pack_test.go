@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/joeldotdias/twine/pkg/pktline"
+)
+
+// uploadRequest is one stateless round of upload-pack wanting a single object
+func uploadRequest(version int, want string) *bytes.Buffer {
+	var request bytes.Buffer
+	enc := pktline.NewEncoder(&request)
+	if version == 2 {
+		enc.Encodef("command=fetch\n")
+		enc.Delim()
+		enc.Encodef("want %s\n", want)
+		enc.Encodef("done\n")
+		enc.Flush()
+	} else {
+		enc.Encodef("want %s no-progress\n", want)
+		enc.Flush()
+		enc.Encodef("done\n")
+	}
+	return &request
+}
+
+// upload runs one stateless round of upload-pack for a want, giving back the raw response
+func upload(t *testing.T, repo *Repository, version int, want string) (string, error) {
+	t.Helper()
+	var response bytes.Buffer
+	err := repo.serveUploadPack(uploadRequest(version, want), &response, serviceOptions{version: version, statelessRPC: true})
+	return response.String(), err
+}
+
+func TestUploadPackOnlySendsReachableObjects(t *testing.T) {
+	repo := newTestRepo(t, true)
+	commit := commitTestFiles(t, repo, map[string]string{"a": "a\n"})
+	if err := repo.writeRef("refs/heads/main", commit); err != nil {
+		t.Fatal(err)
+	}
+	orphan := commitTestFiles(t, repo, map[string]string{"a": "orphan\n"})
+	unreachable, err := repo.WriteObject("blob", []byte("secret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := objectsOf(t, repo, commit)
+	next := commitTestFiles(t, repo, map[string]string{"a": "a\n", "b": "b\n"}, commit)
+	if err := repo.writeRef("refs/heads/main", next); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(how string) {
+		t.Helper()
+		for _, version := range []int{0, 2} {
+			for _, want := range []string{commit, objects[1], objects[2]} {
+				response, err := upload(t, repo, version, want)
+				if err != nil || !strings.Contains(response, "PACK") {
+					t.Errorf("%s v%d want %s reachable from a ref: %v, %q", how, version, want, err, response)
+				}
+			}
+			for _, want := range []string{orphan, unreachable} {
+				response, err := upload(t, repo, version, want)
+				notOurs := fmt.Sprintf("ERR upload-pack: not our ref %s\n", want)
+				if err == nil || !strings.Contains(response, notOurs) || strings.Contains(response, "PACK") {
+					t.Errorf("%s v%d want %s reachable from no ref: %v, %q", how, version, want, err, response)
+				}
+			}
+		}
+	}
+	check("walked")
+
+	// the same answers come from a bitmap
+	if err := repo.repack(0); err != nil {
+		t.Fatal(err)
+	}
+	if repo.loadBitmap().pack == nil {
+		t.Fatal("repack wrote no bitmap")
+	}
+	check("with a bitmap")
+
+	repo.conf.set("uploadpack.allowAnySHA1InWant", "true", ScopeLocal, "test")
+	for _, version := range []int{0, 2} {
+		if response, err := upload(t, repo, version, unreachable); err != nil || !strings.Contains(response, "PACK") {
+			t.Errorf("v%d with uploadpack.allowAnySHA1InWant: %v, %q", version, err, response)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package iniparse
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+/*
+ * Ini throws away everything that isn't a key or a section
+ * which is fine for reading but wrecks a file when it's written back
+ * Document keeps every line as it was and only rewrites
+ * the ones that are actually edited
+ */
+
+type lineKind int
+
+const (
+	// blank lines and comments
+	otherLine lineKind = iota
+	sectionLine
+	kvLine
+)
+
+type line struct {
+	kind lineKind
+	// exactly what was in the file, continuations included
+	raw string
+	// for kv lines this is the section the key lives in
+	section    string
+	subsection string
+	key        string
+	value      string
+	// the section header a key shares its line with, as it was written
+	header string
+}
+
+type Document struct {
+	lines []*line
+}
+
+func NewDocument() *Document {
+	return &Document{}
+}
+
+func ReadDocument(path string) (*Document, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := ParseDocument(contents)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return doc, nil
+}
+
+func ParseDocument(contents []byte) (*Document, error) {
+	doc := &Document{}
+	var section, subsection string
+
+	rawLines := strings.SplitAfter(string(contents), "\n")
+	for i := 0; i < len(rawLines); i++ {
+		raw := rawLines[i]
+		if raw == "" {
+			continue
+		}
+		// a trailing backslash carries the value over to the next line
+		for continues(raw) && i+1 < len(rawLines) {
+			i++
+			raw += rawLines[i]
+		}
+		raw = strings.TrimSuffix(raw, "\n")
+
+		ini, err := Parse([]byte(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		l := &line{raw: raw}
+		switch {
+		case len(ini.entries) > 0:
+			kv := ini.entries[len(ini.entries)-1]
+			if kv.section != "default" {
+				// [section] key = value on a single line
+				section, subsection = ini.sections[ini.order[0]].title, kv.subsection
+				l.header = inlineHeader(raw)
+			}
+			l.kind = kvLine
+			l.section = section
+			l.subsection = subsection
+			l.key = kv.key
+			l.value = kv.value
+		case len(ini.order) > 0:
+			s := ini.sections[ini.order[0]]
+			section, subsection = s.title, s.subsection
+			l.kind = sectionLine
+			l.section = section
+			l.subsection = subsection
+		}
+		doc.lines = append(doc.lines, l)
+	}
+
+	return doc, nil
+}
+
+// inlineHeader gives the part of a line up to the ']' that closes its section header
+func inlineHeader(raw string) string {
+	inQuotes := false
+	for i := 0; i < len(raw); i++ {
+		switch raw[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case '\\':
+			i++
+		case ']':
+			if !inQuotes {
+				return raw[:i+1]
+			}
+		}
+	}
+	return raw
+}
+
+// continues reports whether a line ends in a backslash that carries it over to the next one
+// an escaped backslash doesn't, and neither does one in a comment
+func continues(raw string) bool {
+	raw = strings.TrimRight(raw, "\r\n")
+	inQuotes := false
+	for i := 0; i < len(raw); i++ {
+		switch raw[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case '#', ';':
+			if !inQuotes {
+				return false
+			}
+		case '\\':
+			if i == len(raw)-1 {
+				return true
+			}
+			// whatever it escapes, an earlier line's newline included
+			i++
+		}
+	}
+	return false
+}
+
+func (l *line) inSection(section, subsection string) bool {
+	return strings.EqualFold(l.section, section) && l.subsection == subsection
+}
+
+func (l *line) isKey(section, subsection, key string) bool {
+	return l.kind == kvLine && l.inSection(section, subsection) && strings.EqualFold(l.key, key)
+}
+
+// indent returns the whitespace a line starts with
+func (l *line) indent() string {
+	return l.raw[:len(l.raw)-len(strings.TrimLeft(l.raw, " \t"))]
+}
+
+// ownLines moves the headers of the given key lines onto lines of their own
+// so editing or dropping a key leaves its section alone, giving back where the keys ended up
+func (d *Document) ownLines(idxs []int) []int {
+	for n := len(idxs) - 1; n >= 0; n-- {
+		l := d.lines[idxs[n]]
+		if l.header == "" {
+			continue
+		}
+		header := &line{
+			kind:       sectionLine,
+			raw:        l.header,
+			section:    l.section,
+			subsection: l.subsection,
+		}
+		l.raw = "\t" + strings.TrimLeft(l.raw[len(l.header):], " \t")
+		l.header = ""
+		d.lines = slices.Insert(d.lines, idxs[n], header)
+		for m := n; m < len(idxs); m++ {
+			idxs[m]++
+		}
+	}
+	return idxs
+}
+
+func (d *Document) matching(section, subsection, key string, match func(string) bool) []int {
+	var idxs []int
+	for i, l := range d.lines {
+		if l.isKey(section, subsection, key) && (match == nil || match(l.value)) {
+			idxs = append(idxs, i)
+		}
+	}
+	return idxs
+}
+
+// Set gives a key a single value, rewriting the line in place if the key exists
+// match narrows down which existing values may be replaced, nil matches all
+func (d *Document) Set(section, subsection, key, value string, match func(string) bool) error {
+	idxs := d.matching(section, subsection, key, match)
+	switch len(idxs) {
+	case 0:
+		d.Add(section, subsection, key, value)
+	case 1:
+		idxs = d.ownLines(idxs)
+		old := d.lines[idxs[0]]
+		d.lines[idxs[0]] = kvLineFor(old.indent(), old.section, old.subsection, key, value)
+	default:
+		return fmt.Errorf("cannot overwrite multiple values with a single value")
+	}
+
+	return nil
+}
+
+// Add appends another value for a key after the last line of its section
+// creating the section at the end of the document if there isn't one
+func (d *Document) Add(section, subsection, key, value string) {
+	at := -1
+	indent := "\t"
+	for i, l := range d.lines {
+		if l.kind == otherLine || !l.inSection(section, subsection) {
+			continue
+		}
+		at = i
+		if l.kind == kvLine && l.header == "" {
+			indent = l.indent()
+		}
+	}
+
+	if at == -1 {
+		header := &line{
+			kind:       sectionLine,
+			raw:        sectionHeader(section, subsection),
+			section:    section,
+			subsection: subsection,
+		}
+		d.lines = append(d.lines, header)
+		at = len(d.lines) - 1
+	}
+
+	kv := kvLineFor(indent, section, subsection, key, value)
+	d.lines = append(d.lines[:at+1], append([]*line{kv}, d.lines[at+1:]...)...)
+}
+
+// Unset removes the values of a key that match, returning how many went
+// unless all is set it refuses to remove more than one
+func (d *Document) Unset(section, subsection, key string, all bool, match func(string) bool) (int, error) {
+	idxs := d.matching(section, subsection, key, match)
+	if len(idxs) > 1 && !all {
+		name := KV{section: strings.ToLower(section), subsection: subsection, key: strings.ToLower(key)}.Name()
+		return 0, fmt.Errorf("%s has multiple values", name)
+	}
+
+	d.remove(d.ownLines(idxs))
+	return len(idxs), nil
+}
+
+// RenameSection rewrites every header of a section, keeping its keys
+func (d *Document) RenameSection(section, subsection, newSection, newSubsection string) int {
+	var inline []int
+	for i, l := range d.lines {
+		if l.header != "" && l.inSection(section, subsection) {
+			inline = append(inline, i)
+		}
+	}
+	d.ownLines(inline)
+
+	renamed := 0
+	for _, l := range d.lines {
+		if l.kind == otherLine || !l.inSection(section, subsection) {
+			continue
+		}
+		if l.kind == sectionLine {
+			l.raw = sectionHeader(newSection, newSubsection)
+			renamed++
+		}
+		l.section = newSection
+		l.subsection = newSubsection
+	}
+	return renamed
+}
+
+// RemoveSection drops every header of a section along with its keys
+func (d *Document) RemoveSection(section, subsection string) int {
+	var idxs []int
+	removed := 0
+	inside := false
+	for i, l := range d.lines {
+		if l.kind == sectionLine || l.header != "" {
+			inside = l.inSection(section, subsection)
+			if inside {
+				removed++
+			}
+		}
+		if inside {
+			idxs = append(idxs, i)
+		}
+	}
+
+	d.remove(idxs)
+	return removed
+}
+
+func (d *Document) remove(idxs []int) {
+	if len(idxs) == 0 {
+		return
+	}
+
+	kept := d.lines[:0]
+	next := 0
+	for i, l := range d.lines {
+		if next < len(idxs) && idxs[next] == i {
+			next++
+			continue
+		}
+		kept = append(kept, l)
+	}
+	d.lines = kept
+}
+
+func (d *Document) Bytes() []byte {
+	var sb strings.Builder
+	for _, l := range d.lines {
+		sb.WriteString(l.raw)
+		sb.WriteByte('\n')
+	}
+	return []byte(sb.String())
+}
+
+// Write goes through a lock file so that a reader never sees half a file
+func (d *Document) Write(path string) error {
+	lock := path + ".lock"
+	file, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("Couldn't lock %s: %w", path, err)
+	}
+
+	if _, err = file.Write(d.Bytes()); err != nil {
+		file.Close()
+		os.Remove(lock)
+		return fmt.Errorf("Failed to write to file %s: %w", path, err)
+	}
+	if err = file.Close(); err != nil {
+		os.Remove(lock)
+		return err
+	}
+
+	return os.Rename(lock, path)
+}
+
+func kvLineFor(indent, section, subsection, key, value string) *line {
+	return &line{
+		kind:       kvLine,
+		raw:        indent + key + " = " + QuoteValue(value),
+		section:    section,
+		subsection: subsection,
+		key:        strings.ToLower(key),
+		value:      value,
+	}
+}
+
+func sectionHeader(section, subsection string) string {
+	s := &Section{title: section, subsection: subsection}
+	return s.header()
+}
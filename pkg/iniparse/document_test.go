@@ -0,0 +1,92 @@
+package iniparse
+
+import "testing"
+
+func TestParseDocumentContinuations(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]string
+	}{
+		{"continued", "[a]\n\tk = v\\\n w\n\tj = x\n", map[string]string{"k": "v w", "j": "x"}},
+		{"escaped backslash", "[a]\n\tk = v\\\\\n\tj = w\n", map[string]string{"k": `v\`, "j": "w"}},
+		{"comment line", "[a]\n# c \\\n\tj = w\n", map[string]string{"j": "w"}},
+		{"backslash in comment", "[a]\n\tk = v ; c\\\n\tj = w\n", map[string]string{"k": "v", "j": "w"}},
+		{"quoted comment char", "[a]\n\tk = \"x;\\\n y\"\n\tj = w\n", map[string]string{"k": "x; y", "j": "w"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := ParseDocument([]byte(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, l := range doc.lines {
+				if l.kind == kvLine {
+					got[l.key] = l.value
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("%s = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestDocumentEditsKeysSharingAHeaderLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		edit  func(d *Document) error
+		want  string
+	}{
+		{"set", "[sec] key = v\n\tother = x\n", func(d *Document) error {
+			return d.Set("sec", "", "key", "w", nil)
+		}, "[sec]\n\tkey = w\n\tother = x\n"},
+		{"unset", "[sec] key = v\n\tother = x\n", func(d *Document) error {
+			_, err := d.Unset("sec", "", "key", false, nil)
+			return err
+		}, "[sec]\n\tother = x\n"},
+		{"unset all", "[a] k = 1\n\tj = 2\n[b] k = 3\n[a] k = 4\n", func(d *Document) error {
+			_, err := d.Unset("a", "", "k", true, nil)
+			return err
+		}, "[a]\n\tj = 2\n[b] k = 3\n[a]\n"},
+		{"add", "[sec] key = v\n", func(d *Document) error {
+			d.Add("sec", "", "new", "y")
+			return nil
+		}, "[sec] key = v\n\tnew = y\n"},
+		{"rename", "[sec \"x\"] key = v\n", func(d *Document) error {
+			if d.RenameSection("sec", "x", "other", "") != 1 {
+				t.Error("header wasn't renamed")
+			}
+			return nil
+		}, "[other]\n\tkey = v\n"},
+		{"remove", "[a] k = 1\n\tj = 2\n[b] k = 3\n", func(d *Document) error {
+			if d.RemoveSection("a", "") != 1 {
+				t.Error("section wasn't removed")
+			}
+			return nil
+		}, "[b] k = 3\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := ParseDocument([]byte(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.edit(doc); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(doc.Bytes()); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
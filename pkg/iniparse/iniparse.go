@@ -3,20 +3,37 @@ package iniparse
 import (
 	"fmt"
 	"os"
+	"strings"
 )
 
 type Ini struct {
-	sections map[string]Section
+	sections map[string]*Section
+	// section keys in the order they were first seen
+	order []string
+	// every key value pair in the order it was read
+	entries []KV
 }
 
 type Section struct {
-	title  string
-	lookup map[string]string
+	ini        *Ini
+	title      string
+	subsection string
+	// key names as they were written, in the order they were first seen
+	keys   []string
+	lookup map[string][]string
+}
+
+// KV is a single key value pair along with where it lives
+type KV struct {
+	section    string
+	subsection string
+	key        string
+	value      string
 }
 
 func New() *Ini {
 	return &Ini{
-		sections: make(map[string]Section),
+		sections: make(map[string]*Section),
 	}
 }
 
@@ -25,40 +42,93 @@ func Read(path string) (*Ini, error) {
 	if err != nil {
 		return nil, err
 	}
-	l := NewLexer(file)
+
+	ini, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return ini, nil
+}
+
+func Parse(contents []byte) (*Ini, error) {
+	l := NewLexer(contents)
 	p := NewParser(l)
-	p.Parse()
+	if err := p.Parse(); err != nil {
+		return nil, err
+	}
 
-	return &Ini{sections: p.Sections()}, nil
+	return p.Ini(), nil
+}
+
+// SectionKey gives the lookup key for a section
+// section names are case insensitive, subsection names are not
+func SectionKey(name, subsection string) string {
+	key := strings.ToLower(name)
+	if subsection != "" {
+		key += "." + subsection
+	}
+	return key
 }
 
 func (i *Ini) NewSection(name string) *Section {
+	return i.NewSubsection(name, "")
+}
+
+// NewSubsection returns the section with the given name and subsection
+// creating it if it doesn't exist yet
+func (i *Ini) NewSubsection(name, subsection string) *Section {
+	key := SectionKey(name, subsection)
+	if s, ok := i.sections[key]; ok {
+		return s
+	}
+
 	s := &Section{
-		title:  name,
-		lookup: make(map[string]string),
+		ini:        i,
+		title:      name,
+		subsection: subsection,
+		lookup:     make(map[string][]string),
 	}
-	i.sections[name] = *s
+	i.sections[key] = s
+	i.order = append(i.order, key)
 
 	return s
 }
 
 func (s *Section) NewKV(k string, v string) {
-	s.lookup[k] = v
+	lower := strings.ToLower(k)
+	if _, ok := s.lookup[lower]; !ok {
+		s.keys = append(s.keys, k)
+	}
+	s.lookup[lower] = append(s.lookup[lower], v)
+
+	if s.ini != nil {
+		s.ini.entries = append(s.ini.entries, KV{
+			section:    strings.ToLower(s.title),
+			subsection: s.subsection,
+			key:        lower,
+			value:      v,
+		})
+	}
 }
 
 func (i *Ini) Write(path string) error {
 	var tw string
-	for _, s := range i.sections {
+	for _, s := range i.Sections() {
 		var sw string
 		if s.title != "default" {
-			header := "[" + s.title + "]"
-			sw += header + "\n"
+			sw += s.header() + "\n"
 		}
-		for k, v := range s.lookup {
-			sw += "\t" + k + " = " + v + "\n"
+		for _, k := range s.keys {
+			for _, v := range s.lookup[strings.ToLower(k)] {
+				sw += "\t" + k + " = " + QuoteValue(v) + "\n"
+			}
 		}
 		tw += sw + "\n"
 	}
+	if len(tw) == 0 {
+		tw = "\n"
+	}
 
 	// skip the last newline
 	err := os.WriteFile(path, []byte(tw[:len(tw)-1]), 0o644)
@@ -69,23 +139,115 @@ func (i *Ini) Write(path string) error {
 	return nil
 }
 
+// Section looks up a section by its key as given by SectionKey
+// a missing section behaves like an empty one
 func (i *Ini) Section(key string) *Section {
-	s := i.sections[key]
-	return &s
+	if s, ok := i.sections[key]; ok {
+		return s
+	}
+	return &Section{lookup: make(map[string][]string)}
+}
+
+// Sections returns all the sections in the order they were first seen
+func (i *Ini) Sections() []*Section {
+	sections := make([]*Section, 0, len(i.order))
+	for _, key := range i.order {
+		sections = append(sections, i.sections[key])
+	}
+	return sections
+}
+
+// Entries returns every key value pair in the order it was read
+func (i *Ini) Entries() []KV {
+	return i.entries
+}
+
+func (s *Section) Name() string {
+	return s.title
+}
+
+func (s *Section) Subsection() string {
+	return s.subsection
 }
 
+// Lookups maps every key to the last value it was given
 func (s *Section) Lookups() map[string]string {
-	return s.lookup
+	lookups := make(map[string]string, len(s.lookup))
+	for k, vs := range s.lookup {
+		lookups[k] = vs[len(vs)-1]
+	}
+	return lookups
 }
 
 func (s *Section) Key(key string) string {
-	return s.lookup[key]
+	values := s.lookup[strings.ToLower(key)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+func (s *Section) Values(key string) []string {
+	return s.lookup[strings.ToLower(key)]
+}
+
+func (s *Section) header() string {
+	if s.subsection == "" {
+		return "[" + s.title + "]"
+	}
+	sub := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s.subsection)
+	return "[" + s.title + " \"" + sub + "\"]"
 }
 
 func (s *Section) String() string {
-	str := fmt.Sprintf("[%s]\n", s.title)
-	for k, v := range s.lookup {
-		str += fmt.Sprintf("%s = %s\n", k, v)
+	str := s.header() + "\n"
+	for _, k := range s.keys {
+		for _, v := range s.lookup[strings.ToLower(k)] {
+			str += fmt.Sprintf("%s = %s\n", k, v)
+		}
 	}
 	return str
 }
+
+func (kv KV) Section() string {
+	return kv.section
+}
+
+func (kv KV) Subsection() string {
+	return kv.subsection
+}
+
+func (kv KV) Key() string {
+	return kv.key
+}
+
+func (kv KV) Value() string {
+	return kv.value
+}
+
+// Name gives the dotted name git uses for a key
+// e.g. remote.origin.url
+func (kv KV) Name() string {
+	if kv.subsection == "" {
+		return kv.section + "." + kv.key
+	}
+	return kv.section + "." + kv.subsection + "." + kv.key
+}
+
+// QuoteValue escapes a value so that it reads back the same
+func QuoteValue(v string) string {
+	needsQuotes := strings.HasPrefix(v, " ") || strings.HasSuffix(v, " ") ||
+		strings.ContainsAny(v, "#;")
+
+	escaped := strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		"\t", `\t`,
+	).Replace(v)
+
+	if needsQuotes {
+		return `"` + escaped + `"`
+	}
+	return escaped
+}
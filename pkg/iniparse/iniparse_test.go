@@ -0,0 +1,35 @@
+package iniparse
+
+import "testing"
+
+func TestParseKeyNames(t *testing.T) {
+	tests := []struct {
+		input string
+		// the dotted name of the only key, empty when the input has to be refused
+		want string
+	}{
+		{"[core]\n\tbare = false\n", "core.bare"},
+		{"[remote \"origin\"]\n\turl = u\n", "remote.origin.url"},
+		{"[branch.Main]\n\tremote = origin\n", "branch.main.remote"},
+		{"[core]\n\tkey name = v\n", ""},
+		{"[core]\n\tkey.name = v\n", ""},
+		{"[core]\n\tflag\n", "core.flag"},
+	}
+
+	for _, tt := range tests {
+		ini, err := Parse([]byte(tt.input))
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q was parsed as %v", tt.input, ini.Entries())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.input, err)
+			continue
+		}
+		if entries := ini.Entries(); len(entries) != 1 || entries[0].Name() != tt.want {
+			t.Errorf("%q was parsed as %v, want %s", tt.input, entries, tt.want)
+		}
+	}
+}
@@ -1,12 +1,17 @@
 package iniparse
 
-import "strconv"
+import (
+	"strconv"
+	"strings"
+)
 
 type Lexer struct {
 	input   []byte
 	currCh  byte
 	pos     int
 	readPos int
+	// between '[' and ']', where a '.' can be part of a name
+	inHeader bool
 }
 
 func NewLexer(input []byte) *Lexer {
@@ -27,6 +32,13 @@ func (l *Lexer) readByte() {
 	l.readPos += 1
 }
 
+func (l *Lexer) peekByte() byte {
+	if l.readPos >= len(l.input) {
+		return 0
+	}
+	return l.input[l.readPos]
+}
+
 func (l *Lexer) NextToken() Token {
 	var kind Kind
 	var value byte
@@ -35,12 +47,22 @@ func (l *Lexer) NextToken() Token {
 	switch l.currCh {
 	case '[':
 		kind = LBracket
+		l.inHeader = true
 	case ']':
 		kind = RBracket
+		l.inHeader = false
 	case '=':
 		kind = Assign
-	case '#':
-		kind = Octothorpe
+	case '\n':
+		kind = Newline
+		l.inHeader = false
+	case '#', ';':
+		// comments run till the end of the line
+		// and never make it to the parser
+		l.skipComment()
+		return l.NextToken()
+	case '"':
+		return Token{String, l.readQuoted()}
 	case 0:
 		kind = EOF
 	default:
@@ -63,14 +85,104 @@ func (l *Lexer) NextToken() Token {
 
 func (l *Lexer) readLiteral() []byte {
 	pos := l.pos
-	for isLetter(l.currCh) || isDigit(l.currCh) {
+	// only the deprecated [section.subsection] has a '.' in a name
+	for isLetter(l.currCh) || isDigit(l.currCh) || (l.inHeader && l.currCh == '.') {
 		l.readByte()
 	}
 	return l.input[pos:l.pos]
 }
 
+// reads a quoted subsection name like the origin in [remote "origin"]
+// only \" and \\ are valid escapes here
+func (l *Lexer) readQuoted() string {
+	var sb strings.Builder
+	l.readByte() // opening quote
+	for l.currCh != '"' && l.currCh != '\n' && l.currCh != 0 {
+		if l.currCh == '\\' && (l.peekByte() == '"' || l.peekByte() == '\\') {
+			l.readByte()
+		}
+		sb.WriteByte(l.currCh)
+		l.readByte()
+	}
+	if l.currCh == '"' {
+		l.readByte()
+	}
+	return sb.String()
+}
+
+// readValue reads everything after an '=' till the end of the line
+// the way git does: quotes are stripped, escapes are expanded,
+// a trailing backslash continues the value on the next line and
+// an unquoted '#' or ';' starts a comment
+// the terminating newline is left for NextToken
+func (l *Lexer) readValue() string {
+	l.skipWhitespace()
+
+	var sb strings.Builder
+	inQuotes := false
+	// length of the value without trailing unquoted whitespace
+	trimmed := 0
+	for l.currCh != 0 {
+		ch := l.currCh
+		if ch == '\n' {
+			break
+		}
+		if !inQuotes && (ch == '#' || ch == ';') {
+			l.skipComment()
+			break
+		}
+
+		switch ch {
+		case '"':
+			inQuotes = !inQuotes
+			l.readByte()
+			trimmed = sb.Len()
+			continue
+		case '\\':
+			l.readByte()
+			switch l.currCh {
+			case '\n':
+				// line continuation
+				l.readByte()
+				continue
+			case '\r':
+				if l.peekByte() == '\n' {
+					l.readByte()
+					l.readByte()
+					continue
+				}
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'b':
+				sb.WriteByte('\b')
+			default:
+				sb.WriteByte(l.currCh)
+			}
+			l.readByte()
+			trimmed = sb.Len()
+			continue
+		}
+
+		sb.WriteByte(ch)
+		if inQuotes || (ch != ' ' && ch != '\t' && ch != '\r') {
+			trimmed = sb.Len()
+		}
+		l.readByte()
+	}
+
+	return sb.String()[:trimmed]
+}
+
+func (l *Lexer) skipComment() {
+	for l.currCh != '\n' && l.currCh != 0 {
+		l.readByte()
+	}
+}
+
 func (l *Lexer) skipWhitespace() {
-	for l.currCh == ' ' || l.currCh == '\t' || l.currCh == '\n' || l.currCh == '\r' {
+	for l.currCh == ' ' || l.currCh == '\t' || l.currCh == '\r' {
 		l.readByte()
 	}
 }
@@ -80,7 +192,7 @@ func (l *Lexer) ReachedEof() bool {
 }
 
 func isLetter(ch byte) bool {
-	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '-' || ch == '_' || ch == ' ' || ch == '@' || ch == '.'
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '-' || ch == '_' || ch == '@'
 }
 
 func isDigit(ch byte) bool {
@@ -9,7 +9,7 @@ type Parser struct {
 	lexer       *Lexer
 	currToken   Token
 	peekedToken Token
-	sections    map[string]Section
+	ini         *Ini
 }
 
 func NewParser(l *Lexer) *Parser {
@@ -17,7 +17,7 @@ func NewParser(l *Lexer) *Parser {
 		lexer:       l,
 		currToken:   MakeToken(EOF),
 		peekedToken: MakeToken(EOF),
-		sections:    make(map[string]Section),
+		ini:         New(),
 	}
 
 	p.nextToken()
@@ -27,69 +27,97 @@ func NewParser(l *Lexer) *Parser {
 }
 
 func (p *Parser) ShowSections() {
-	for _, s := range p.sections {
+	for _, s := range p.ini.Sections() {
 		fmt.Println(s.String())
 	}
 }
 
-func (p *Parser) Sections() map[string]Section {
-	return p.sections
+func (p *Parser) Sections() map[string]*Section {
+	return p.ini.sections
 }
 
-func (p *Parser) Parse() {
-	for !p.lexer.ReachedEof() {
-		if p.currToken.Kind() == LBracket {
-			s := p.parseSection(false)
-			p.sections[s.title] = s
-		} else if p.currToken.Kind() == Literal {
-			s := p.parseSection(true)
-			p.sections[s.title] = s
-		} else {
-			panic("Encountered illegal token " + p.currToken.String())
-		}
-	}
+func (p *Parser) Ini() *Ini {
+	return p.ini
 }
 
-func (p *Parser) parseSection(isDefault bool) Section {
-	var header string
-	if isDefault {
-		header = "default"
-	} else {
-		header = p.parseHeader()
-	}
-	section := Section{
-		title:  header,
-		lookup: make(map[string]string),
+func (p *Parser) Parse() error {
+	var section *Section
+	for p.currToken.Kind() != EOF {
+		switch p.currToken.Kind() {
+		case Newline:
+			p.nextToken()
+
+		case LBracket:
+			name, subsection, err := p.parseHeader()
+			if err != nil {
+				return err
+			}
+			section = p.ini.NewSubsection(name, subsection)
+
+		case Literal:
+			if section == nil {
+				section = p.ini.NewSection("default")
+			}
+			if err := p.parseKV(section); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("Encountered illegal token %s", p.currToken.String())
+		}
 	}
-	section.lookup = p.parseSectionLookup()
 
-	return section
+	return nil
 }
 
-func (p *Parser) parseSectionLookup() map[string]string {
-	lookup := make(map[string]string)
-	for p.currToken.Kind() != LBracket && !p.lexer.ReachedEof() {
-		k := strings.TrimSuffix(p.currToken.Value(), " ")
-		if p.peekedToken.Kind() != Assign {
-			panic("Malformed .ini file")
-		}
-		p.nextToken()
-		p.nextToken()
-		v := p.currToken.Value()
+func (p *Parser) parseKV(section *Section) error {
+	k := p.currToken.Value()
+
+	switch p.peekedToken.Kind() {
+	case Assign:
+		// the lexer is sitting right after the '='
+		// so the raw value can be read off it directly
+		v := p.lexer.readValue()
+		p.currToken = p.lexer.NextToken()
+		p.peekedToken = p.lexer.NextToken()
+		section.NewKV(k, v)
+
+	case Newline, EOF:
+		// a key on its own is a boolean set to true
 		p.nextToken()
-		lookup[k] = v
+		section.NewKV(k, "true")
+
+	default:
+		return fmt.Errorf("Malformed .ini file: expected '=' after %s", k)
 	}
 
-	return lookup
+	return nil
 }
 
-func (p *Parser) parseHeader() string {
-	p.lexer.NextToken()
-	// p.nextToken()
+func (p *Parser) parseHeader() (string, string, error) {
 	p.nextToken()
-	header := p.currToken.Value()
+	if p.currToken.Kind() != Literal {
+		return "", "", fmt.Errorf("Malformed section header: %s", p.currToken.String())
+	}
+	name := p.currToken.Value()
+	p.nextToken()
+
+	var subsection string
+	if p.currToken.Kind() == String {
+		subsection = p.currToken.Value()
+		p.nextToken()
+	} else if dot := strings.IndexByte(name, '.'); dot != -1 {
+		// deprecated [section.subsection] syntax
+		subsection = strings.ToLower(name[dot+1:])
+		name = name[:dot]
+	}
+
+	if p.currToken.Kind() != RBracket {
+		return "", "", fmt.Errorf("Malformed section header: expected ']' after %s", name)
+	}
 	p.nextToken()
-	return header
+
+	return name, subsection, nil
 }
 
 func (p *Parser) nextToken() {
@@ -6,10 +6,12 @@ type Kind string
 
 const (
 	Literal    = "Literal"
+	String     = "String"
 	Assign     = "Assign"
 	LBracket   = "LBracket"
 	RBracket   = "RBracket"
 	Octothorpe = "Octothorpe"
+	Newline    = "Newline"
 	EOF        = "EOF"
 	Illegal    = "Illegal"
 )
@@ -35,7 +37,7 @@ func (t *Token) Value() string {
 
 func (t *Token) String() string {
 	tStr := fmt.Sprintf("Kind :%s", t.kind)
-	if t.kind == Literal {
+	if t.kind == Literal || t.kind == String {
 		tStr += fmt.Sprintf(" | Value: %s", t.value)
 	}
 	return tStr
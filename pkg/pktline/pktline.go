@@ -0,0 +1,194 @@
+package pktline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+/*
+ *                    pkt-line
+ * +----------------------+--------------------+
+ * | 4 hex digit length   | payload            |
+ * +----------------------+--------------------+
+ *
+ * the length counts itself, so "0006a\n" carries "a\n"
+ * lengths below 4 are special packets with no payload
+ * 0000 => flush, 0001 => delim, 0002 => response end
+ */
+
+const (
+	// largest payload a single packet can carry
+	MaxPayload = 65516
+	headerLen  = 4
+)
+
+type Kind int
+
+const (
+	Data Kind = iota
+	Flush
+	Delim
+	ResponseEnd
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Data:
+		return "data"
+	case Flush:
+		return "flush"
+	case Delim:
+		return "delim"
+	case ResponseEnd:
+		return "response-end"
+	default:
+		return "unknown"
+	}
+}
+
+type Packet struct {
+	kind Kind
+	data []byte
+}
+
+func (p Packet) Kind() Kind {
+	return p.kind
+}
+
+func (p Packet) Data() []byte {
+	return p.data
+}
+
+// Text is the payload with the trailing newline most text packets have stripped
+func (p Packet) Text() string {
+	return string(bytes.TrimSuffix(p.data, []byte{'\n'}))
+}
+
+func (p Packet) IsFlush() bool {
+	return p.kind == Flush
+}
+
+func (p Packet) IsDelim() bool {
+	return p.kind == Delim
+}
+
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (e *Encoder) Encode(data []byte) error {
+	if len(data) > MaxPayload {
+		return fmt.Errorf("pkt-line payload of %d bytes is too long", len(data))
+	}
+
+	header := fmt.Sprintf("%04x", len(data)+headerLen)
+	if _, err := io.WriteString(e.w, header); err != nil {
+		return err
+	}
+	_, err := e.w.Write(data)
+	return err
+}
+
+// Encodef formats a text packet
+// the newline has to be part of the format, same as git
+func (e *Encoder) Encodef(format string, args ...any) error {
+	return e.Encode([]byte(fmt.Sprintf(format, args...)))
+}
+
+func (e *Encoder) Flush() error {
+	_, err := io.WriteString(e.w, "0000")
+	return err
+}
+
+func (e *Encoder) Delim() error {
+	_, err := io.WriteString(e.w, "0001")
+	return err
+}
+
+func (e *Encoder) ResponseEnd() error {
+	_, err := io.WriteString(e.w, "0002")
+	return err
+}
+
+// Raw hands out the writer underneath
+// for sending a pack without sideband
+func (e *Encoder) Raw() io.Writer {
+	return e.w
+}
+
+type Decoder struct {
+	r *bufio.Reader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &Decoder{r: br}
+	}
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+func (d *Decoder) Decode() (Packet, error) {
+	var header [headerLen]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return Packet{}, err
+	}
+
+	var size [2]byte
+	if _, err := hex.Decode(size[:], header[:]); err != nil {
+		return Packet{}, fmt.Errorf("Malformed pkt-line length %q", header)
+	}
+	n := int(size[0])<<8 | int(size[1])
+
+	switch n {
+	case 0:
+		return Packet{kind: Flush}, nil
+	case 1:
+		return Packet{kind: Delim}, nil
+	case 2:
+		return Packet{kind: ResponseEnd}, nil
+	case 3:
+		return Packet{}, fmt.Errorf("Malformed pkt-line length %q", header)
+	}
+	// nothing bigger than LARGE_PACKET_MAX is ever sent, so a length past it isn't worth allocating for
+	if n > headerLen+MaxPayload {
+		return Packet{}, fmt.Errorf("Malformed pkt-line length %q", header)
+	}
+
+	data := make([]byte, n-headerLen)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return Packet{}, fmt.Errorf("Couldn't read pkt-line payload: %w", err)
+	}
+	return Packet{kind: Data, data: data}, nil
+}
+
+// DecodeText reads a data packet and returns its text
+// anything other than data is an error
+func (d *Decoder) DecodeText() (string, error) {
+	p, err := d.Decode()
+	if err != nil {
+		return "", err
+	}
+	if p.kind != Data {
+		return "", fmt.Errorf("expected a data packet, got %s", p.kind)
+	}
+	return p.Text(), nil
+}
+
+// Peek gives the next n bytes without reading them
+// for telling what comes next apart, like a packet from the start of a pack without sideband
+func (d *Decoder) Peek(n int) ([]byte, error) {
+	return d.r.Peek(n)
+}
+
+// Raw hands out the buffered reader underneath
+// for protocols that switch to raw bytes halfway through, like a pack without sideband
+func (d *Decoder) Raw() io.Reader {
+	return d.r
+}
@@ -0,0 +1,51 @@
+package pktline
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDecodeLength(t *testing.T) {
+	largest := "fff0" + strings.Repeat("x", MaxPayload)
+	tests := []struct {
+		input string
+		kind  Kind
+		err   bool
+	}{
+		{"0000", Flush, false},
+		{"0001", Delim, false},
+		{"0002", ResponseEnd, false},
+		{"0003", Data, true},
+		{"0006a\n", Data, false},
+		{largest, Data, false},
+		// one past LARGE_PACKET_MAX
+		{"fff1" + strings.Repeat("x", MaxPayload+1), Data, true},
+		{"ffff", Data, true},
+		{"zzzz", Data, true},
+	}
+
+	for _, tt := range tests {
+		packet, err := NewDecoder(strings.NewReader(tt.input)).Decode()
+		if (err != nil) != tt.err {
+			t.Errorf("%.8q: error %v, want one %v", tt.input, err, tt.err)
+			continue
+		}
+		if err == nil && packet.Kind() != tt.kind {
+			t.Errorf("%.8q: %s packet, want %s", tt.input, packet.Kind(), tt.kind)
+		}
+	}
+
+	// the encoder never writes a packet the decoder won't read
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Encode(bytes.Repeat([]byte{'x'}, MaxPayload)); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Encode(bytes.Repeat([]byte{'x'}, MaxPayload+1)); err == nil {
+		t.Error("encoded a packet over LARGE_PACKET_MAX")
+	}
+	if _, err := NewDecoder(&buf).Decode(); err != nil {
+		t.Error(err)
+	}
+}
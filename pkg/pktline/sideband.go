@@ -0,0 +1,101 @@
+package pktline
+
+import (
+	"fmt"
+	"io"
+)
+
+/*
+ * With side-band each data packet starts with a band byte
+ * 1 => pack data, 2 => progress messages, 3 => a fatal error
+ * side-band allows 1000 byte packets, side-band-64k the full size
+ * both counting the 4 byte length and the band byte, so that's 995 and 65515 bytes of data
+ */
+
+const (
+	BandData     byte = 1
+	BandProgress byte = 2
+	BandError    byte = 3
+
+	SmallSideband = 1000 - 4 - 1
+	LargeSideband = MaxPayload - 1
+)
+
+type SidebandWriter struct {
+	enc  *Encoder
+	band byte
+	max  int
+}
+
+func NewSidebandWriter(enc *Encoder, band byte, max int) *SidebandWriter {
+	return &SidebandWriter{enc: enc, band: band, max: max}
+}
+
+func (s *SidebandWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), s.max)
+		packet := make([]byte, 0, n+1)
+		packet = append(packet, s.band)
+		packet = append(packet, p[:n]...)
+		if err := s.enc.Encode(packet); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Demuxer pulls pack data out of a sideband stream
+// sending progress off to its own writer
+type Demuxer struct {
+	dec      *Decoder
+	progress io.Writer
+	pending  []byte
+	done     bool
+}
+
+func NewDemuxer(dec *Decoder, progress io.Writer) *Demuxer {
+	if progress == nil {
+		progress = io.Discard
+	}
+	return &Demuxer{dec: dec, progress: progress}
+}
+
+func (d *Demuxer) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		packet, err := d.dec.Decode()
+		if err != nil {
+			return 0, err
+		}
+		if packet.kind != Data {
+			// a flush ends the stream
+			d.done = true
+			continue
+		}
+		if len(packet.data) == 0 {
+			continue
+		}
+
+		band, payload := packet.data[0], packet.data[1:]
+		switch band {
+		case BandData:
+			d.pending = payload
+		case BandProgress:
+			d.progress.Write(payload)
+		case BandError:
+			return 0, fmt.Errorf("remote error: %s", payload)
+		default:
+			return 0, fmt.Errorf("unknown sideband %d", band)
+		}
+	}
+
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,35 @@
+package pktline
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSidebandPacketSize(t *testing.T) {
+	tests := []struct {
+		max    int
+		packet int
+	}{
+		{SmallSideband, 1000},
+		{LargeSideband, 65520},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w := NewSidebandWriter(NewEncoder(&buf), BandData, tt.max)
+		if _, err := w.Write(bytes.Repeat([]byte{'x'}, tt.max*2+1)); err != nil {
+			t.Fatal(err)
+		}
+
+		dec := NewDecoder(&buf)
+		for _, want := range []int{tt.packet, tt.packet, 4 + 1 + 1} {
+			packet, err := dec.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := 4 + len(packet.data); got != want {
+				t.Errorf("max %d: packet of %d bytes, want %d", tt.max, got, want)
+			}
+		}
+	}
+}
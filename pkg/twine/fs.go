@@ -0,0 +1,389 @@
+package twine
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// TreeFS is a read-only fs.FS of everything under a tree
+//
+// It's also an fs.ReadDirFS, fs.StatFS and fs.ReadFileFS, so it can go
+// anywhere a directory on disk would, like fs.WalkDir, template.ParseFS
+// or http.FileServerFS. Files are read straight out of the object store,
+// big blobs a bit at a time, and seeking in them works.
+//
+// Modes are what a checkout would give: 0644 for a file, 0755 for an
+// executable or a directory. A symlink is followed when it's opened,
+// as long as it's relative and stays inside the tree, and shows up as
+// fs.ModeSymlink in a directory listing and from Lstat. A submodule is an
+// empty directory, since its commit isn't in this repository.
+//
+// Everything has the committer date of the commit the tree came from,
+// or no time at all for a bare tree. Sys on a FileInfo gives its TreeEntry.
+type TreeFS struct {
+	repo    *Repository
+	root    TreeEntry
+	modTime time.Time
+}
+
+// symlinks pointing at symlinks are followed this many times at most
+const maxSymlinkHops = 40
+
+// FS gives a read-only view of the tree rev names, which can also be a commit or a tag
+func (r *Repository) FS(rev string) (*TreeFS, error) {
+	obj, err := r.peel(rev)
+	if err != nil {
+		return nil, err
+	}
+	var modTime time.Time
+	if commit, ok := obj.(*Commit); ok {
+		modTime = commit.Committer().When
+	}
+	tree, err := r.Tree(obj.Hash())
+	if err != nil {
+		return nil, err
+	}
+	return &TreeFS{repo: r, root: TreeEntry{Name: ".", Mode: ModeTree, Hash: tree.Hash()}, modTime: modTime}, nil
+}
+
+// fsMode is the fs.FileMode a tree entry is checked out with
+func (m FileMode) fsMode() fs.FileMode {
+	switch m {
+	case ModeTree, ModeSubmodule:
+		return fs.ModeDir | 0o755
+	case ModeExecutable:
+		return 0o755
+	case ModeSymlink:
+		return fs.ModeSymlink | 0o777
+	default:
+		return 0o644
+	}
+}
+
+// lookup finds the entry name leads to
+// symlinks on the way are always followed, and the one at the end too if follow is set
+func (tfs *TreeFS) lookup(op, name string, follow bool) (TreeEntry, error) {
+	if !fs.ValidPath(name) {
+		return TreeEntry{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	notExist := &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+
+	entry := tfs.root
+	if name == "." {
+		return entry, nil
+	}
+	parts := strings.Split(name, "/")
+	hops := 0
+	for i := 0; i < len(parts); i++ {
+		// submodules are empty, so there's nothing in them either
+		if !entry.Mode.IsTree() {
+			return TreeEntry{}, notExist
+		}
+		tree, err := tfs.repo.Tree(entry.Hash)
+		if err != nil {
+			return TreeEntry{}, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		var ok bool
+		if entry, ok = tree.Entry(parts[i]); !ok {
+			return TreeEntry{}, notExist
+		}
+
+		if entry.Mode != ModeSymlink || (i == len(parts)-1 && !follow) {
+			continue
+		}
+		hops++
+		if hops > maxSymlinkHops {
+			return TreeEntry{}, notExist
+		}
+		target, err := tfs.repo.Blob(entry.Hash)
+		if err != nil {
+			return TreeEntry{}, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		resolved := path.Join(path.Join(parts[:i]...), string(target.Contents()))
+		if path.IsAbs(string(target.Contents())) || resolved == ".." || strings.HasPrefix(resolved, "../") {
+			return TreeEntry{}, notExist
+		}
+
+		// and start over from the top with where it points
+		rest := parts[i+1:]
+		parts = nil
+		if resolved != "." {
+			parts = strings.Split(resolved, "/")
+		}
+		parts = append(parts, rest...)
+		entry = tfs.root
+		i = -1
+	}
+	return entry, nil
+}
+
+func (tfs *TreeFS) info(name string, entry TreeEntry) (*treeFileInfo, error) {
+	info := &treeFileInfo{name: path.Base(name), entry: entry, modTime: tfs.modTime}
+	if entry.Mode.fsMode().IsDir() {
+		return info, nil
+	}
+	rc, size, err := tfs.repo.BlobReader(entry.Hash)
+	if err != nil {
+		return nil, err
+	}
+	rc.Close()
+	info.size = size
+	return info, nil
+}
+
+// entries lists a directory sorted by name, the way fs.ReadDir wants it
+func (tfs *TreeFS) entries(entry TreeEntry) ([]fs.DirEntry, error) {
+	if entry.Mode == ModeSubmodule {
+		return []fs.DirEntry{}, nil
+	}
+	tree, err := tfs.repo.Tree(entry.Hash)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, 0, len(tree.entries))
+	for _, child := range tree.entries {
+		entries = append(entries, &treeDirEntry{tfs, child})
+	}
+	// git puts a directory where it would be with a / on the end
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+func (tfs *TreeFS) Open(name string) (fs.File, error) {
+	entry, err := tfs.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info, err := tfs.info(name, entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if info.IsDir() {
+		entries, err := tfs.entries(entry)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &treeDir{info: info, entries: entries}, nil
+	}
+	return &treeFile{tfs: tfs, path: name, info: info}, nil
+}
+
+func (tfs *TreeFS) Stat(name string) (fs.FileInfo, error) {
+	entry, err := tfs.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info, err := tfs.info(name, entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+// Lstat is Stat without following a symlink at the end
+func (tfs *TreeFS) Lstat(name string) (fs.FileInfo, error) {
+	entry, err := tfs.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	info, err := tfs.info(name, entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+// ReadLink gives where a symlink points, as it's stored
+func (tfs *TreeFS) ReadLink(name string) (string, error) {
+	entry, err := tfs.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if entry.Mode != ModeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	blob, err := tfs.repo.Blob(entry.Hash)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return string(blob.Contents()), nil
+}
+
+func (tfs *TreeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := tfs.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.Mode.fsMode().IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := tfs.entries(entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// ReadFile reads a whole file into a slice that's the caller's to keep
+func (tfs *TreeFS) ReadFile(name string) ([]byte, error) {
+	entry, err := tfs.lookup("read", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Mode.fsMode().IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	blob, err := tfs.repo.Blob(entry.Hash)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return bytes.Clone(blob.Contents()), nil
+}
+
+type treeFileInfo struct {
+	name    string
+	entry   TreeEntry
+	size    int64
+	modTime time.Time
+}
+
+func (info *treeFileInfo) Name() string       { return info.name }
+func (info *treeFileInfo) Size() int64        { return info.size }
+func (info *treeFileInfo) Mode() fs.FileMode  { return info.entry.Mode.fsMode() }
+func (info *treeFileInfo) ModTime() time.Time { return info.modTime }
+func (info *treeFileInfo) IsDir() bool        { return info.Mode().IsDir() }
+func (info *treeFileInfo) Sys() any           { return info.entry }
+
+// treeDirEntry only reads a blob's size if Info is asked for
+type treeDirEntry struct {
+	tfs   *TreeFS
+	entry TreeEntry
+}
+
+func (d *treeDirEntry) Name() string      { return d.entry.Name }
+func (d *treeDirEntry) IsDir() bool       { return d.Type().IsDir() }
+func (d *treeDirEntry) Type() fs.FileMode { return d.entry.Mode.fsMode().Type() }
+
+func (d *treeDirEntry) Info() (fs.FileInfo, error) {
+	return d.tfs.info(d.entry.Name, d.entry)
+}
+
+type treeDir struct {
+	info    *treeFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *treeDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *treeDir) Close() error               { return nil }
+
+func (d *treeDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *treeDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(rest))
+	d.offset += n
+	return rest[:n], nil
+}
+
+/*
+ * a file is inflated as it's read, never held whole
+ * seeking only moves offset, the next read catches the stream up to it
+ * going forward skips ahead in the stream and going back starts it over
+ */
+type treeFile struct {
+	tfs  *TreeFS
+	path string
+	info *treeFileInfo
+
+	r io.ReadCloser
+	// how far into the file r is
+	pos int64
+	// where the next read starts
+	offset int64
+	closed bool
+}
+
+func (f *treeFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *treeFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.path, Err: fs.ErrClosed}
+	}
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+
+	if f.r == nil || f.pos > f.offset {
+		if f.r != nil {
+			f.r.Close()
+		}
+		r, _, err := f.tfs.repo.BlobReader(f.info.entry.Hash)
+		if err != nil {
+			f.r = nil
+			return 0, &fs.PathError{Op: "read", Path: f.path, Err: err}
+		}
+		f.r, f.pos = r, 0
+	}
+	if f.pos < f.offset {
+		skipped, err := io.CopyN(io.Discard, f.r, f.offset-f.pos)
+		f.pos += skipped
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.path, Err: err}
+		}
+	}
+
+	n, err := f.r.Read(p)
+	f.pos += int64(n)
+	f.offset = f.pos
+	return n, err
+}
+
+func (f *treeFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.path, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *treeFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.path, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	if f.r != nil {
+		return f.r.Close()
+	}
+	return nil
+}
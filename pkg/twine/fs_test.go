@@ -0,0 +1,96 @@
+package twine
+
+import (
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// writeTestFS commits a tree with a file of every kind in it, giving back the commit
+func writeTestFS(t *testing.T, r *Repository, when time.Time) string {
+	t.Helper()
+	blob := func(data string) string {
+		hash, err := r.WriteBlob([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	tree := func(entries ...TreeEntry) string {
+		hash, err := r.WriteTree(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	deep := tree(TreeEntry{"b.txt", ModeFile, blob("deep\n")})
+	root := tree(
+		TreeEntry{"README", ModeFile, blob("hello\n")},
+		TreeEntry{"big", ModeFile, blob(strings.Repeat("0123456789abcdef", 64<<10))},
+		TreeEntry{"bin", ModeTree, tree(TreeEntry{"run", ModeExecutable, blob("#!/bin/sh\n")})},
+		TreeEntry{"docs", ModeTree, tree(TreeEntry{"a", ModeTree, deep})},
+		TreeEntry{"link", ModeSymlink, blob("docs/a/b.txt")},
+		TreeEntry{"sub", ModeSubmodule, strings.Repeat("1", 40)},
+	)
+	commit, err := r.WriteCommit(CommitOptions{
+		Tree:    root,
+		Author:  Signature{Name: "A U Thor", Email: "author@example.com", When: when},
+		Message: "files",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commit
+}
+
+func TestTreeFS(t *testing.T) {
+	r, err := InitMemory(InitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Unix(1700000000, 0)
+	commit := writeTestFS(t, r, when)
+	fsys, err := r.FS(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fstest.TestFS(fsys, "README", "big", "bin/run", "docs/a/b.txt", "link", "sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := fs.ReadFile(fsys, "link"); err != nil || string(data) != "deep\n" {
+		t.Errorf("link reads %q: %v", data, err)
+	}
+	if info, err := fsys.Lstat("link"); err != nil || info.Mode().Type() != fs.ModeSymlink {
+		t.Errorf("link is %v: %v", info, err)
+	}
+	if info, err := fs.Stat(fsys, "bin/run"); err != nil || info.Mode() != 0o755 || !info.ModTime().Equal(when) {
+		t.Errorf("bin/run is %v: %v", info, err)
+	}
+
+	// big blobs seek like any file
+	file, err := fsys.Open("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	seeker := file.(io.ReadSeeker)
+	if _, err := seeker.Seek(-16*3-4, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(seeker, buf); err != nil || string(buf) != "cdef0123" {
+		t.Errorf("read %q after seeking: %v", buf, err)
+	}
+
+	for _, name := range []string{"missing", "README/x", "../README", "/README", "bin/"} {
+		if _, err := fsys.Open(name); err == nil {
+			t.Errorf("opened %q", name)
+		}
+	}
+}
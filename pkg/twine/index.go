@@ -0,0 +1,39 @@
+package twine
+
+import (
+	"time"
+)
+
+// IndexEntry is a file staged in the index
+type IndexEntry struct {
+	// where the file is in the work tree, with forward slashes
+	Path string
+	Hash string
+	Mode FileMode
+	// the file's size and modification time when it was staged
+	Size    uint32
+	ModTime time.Time
+	// 0 normally, or 1 for the base, 2 for ours and 3 for theirs in a conflict
+	Stage int
+}
+
+// Index reads the index as it is on disk, sorted by path and then stage
+// a bare repository doesn't have one
+func (r *Repository) Index() ([]IndexEntry, error) {
+	entries, err := r.repo.IndexEntries()
+	if err != nil {
+		return nil, err
+	}
+	index := make([]IndexEntry, 0, len(entries))
+	for _, entry := range entries {
+		index = append(index, IndexEntry{
+			Path:    entry.Path(),
+			Hash:    entry.Sha(),
+			Mode:    FileMode(entry.Mode()),
+			Size:    entry.Size(),
+			ModTime: entry.ModTime(),
+			Stage:   entry.Stage(),
+		})
+	}
+	return index, nil
+}
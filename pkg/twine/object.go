@@ -0,0 +1,327 @@
+package twine
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joeldotdias/twine/internal/repository"
+)
+
+// Object is a commit, tree, blob or tag
+type Object interface {
+	Hash() string
+	// commit, tree, blob or tag
+	Kind() string
+}
+
+// Signature is who made a commit or tag and when
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+// parseSignature reads a "name <email> unix-time zone" line
+// what can't be made sense of is left empty
+func parseSignature(line string) Signature {
+	var sig Signature
+	start := strings.IndexByte(line, '<')
+	end := strings.LastIndexByte(line, '>')
+	if start == -1 || end < start {
+		sig.Name = strings.TrimSpace(line)
+		return sig
+	}
+	sig.Name = strings.TrimSpace(line[:start])
+	sig.Email = line[start+1 : end]
+
+	fields := strings.Fields(line[end+1:])
+	if len(fields) == 0 {
+		return sig
+	}
+	seconds, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return sig
+	}
+	loc := time.UTC
+	if len(fields) > 1 {
+		if zone, err := time.Parse("-0700", fields[1]); err == nil {
+			loc = zone.Location()
+		}
+	}
+	sig.When = time.Unix(seconds, 0).In(loc)
+	return sig
+}
+
+// String is the signature the way commits and tags have it, "name <email> unix-time zone"
+func (s Signature) String() string {
+	when := s.When
+	if when.IsZero() {
+		when = time.Unix(0, 0).UTC()
+	}
+	return fmt.Sprintf("%s <%s> %d %s", s.Name, s.Email, when.Unix(), when.Format("-0700"))
+}
+
+type Commit struct {
+	hash   string
+	commit *repository.Commit
+}
+
+func (c *Commit) Hash() string { return c.hash }
+func (c *Commit) Kind() string { return "commit" }
+
+// Tree is the sha of the tree the commit records
+func (c *Commit) Tree() string {
+	return c.commit.Tree()
+}
+
+// Parents are the shas of the commit's parents, first parent first
+// a root commit has none and a merge more than one
+func (c *Commit) Parents() []string {
+	return c.commit.Parents()
+}
+
+func (c *Commit) Author() Signature {
+	return parseSignature(c.commit.Author())
+}
+
+func (c *Commit) Committer() Signature {
+	return parseSignature(c.commit.Committer())
+}
+
+func (c *Commit) Message() string {
+	return c.commit.Message()
+}
+
+type Tag struct {
+	hash string
+	tag  *repository.Tag
+}
+
+func (t *Tag) Hash() string { return t.hash }
+func (t *Tag) Kind() string { return "tag" }
+
+// Target is the sha of the object the tag points at
+func (t *Tag) Target() string {
+	return t.tag.Target()
+}
+
+// TargetKind is the kind of object the tag points at, usually commit
+func (t *Tag) TargetKind() string {
+	return t.tag.TargetKind()
+}
+
+func (t *Tag) Name() string {
+	return t.tag.Name()
+}
+
+func (t *Tag) Tagger() Signature {
+	return parseSignature(t.tag.Tagger())
+}
+
+func (t *Tag) Message() string {
+	return t.tag.Message()
+}
+
+// FileMode is the mode of a tree entry or an index entry
+type FileMode uint32
+
+const (
+	ModeTree       FileMode = 0o040000
+	ModeFile       FileMode = 0o100644
+	ModeExecutable FileMode = 0o100755
+	ModeSymlink    FileMode = 0o120000
+	// a commit in another repository
+	ModeSubmodule FileMode = 0o160000
+)
+
+func (m FileMode) IsTree() bool {
+	return m == ModeTree
+}
+
+// IsFile says if the mode is a regular file, executable or not
+func (m FileMode) IsFile() bool {
+	return m == ModeFile || m == ModeExecutable
+}
+
+// String is the mode the way ls-tree prints it
+func (m FileMode) String() string {
+	return fmt.Sprintf("%06o", uint32(m))
+}
+
+// TreeEntry is a single file, directory, symlink or submodule in a tree
+type TreeEntry struct {
+	Name string
+	Mode FileMode
+	Hash string
+}
+
+type Tree struct {
+	hash    string
+	entries []TreeEntry
+}
+
+func (t *Tree) Hash() string { return t.hash }
+func (t *Tree) Kind() string { return "tree" }
+
+// Entries are the tree's entries in git's order
+func (t *Tree) Entries() []TreeEntry {
+	return append([]TreeEntry(nil), t.entries...)
+}
+
+// Entry finds the entry called name directly in the tree
+func (t *Tree) Entry(name string) (TreeEntry, bool) {
+	for _, entry := range t.entries {
+		if entry.Name == name {
+			return entry, true
+		}
+	}
+	return TreeEntry{}, false
+}
+
+func newTree(hash string, tree *repository.Tree) *Tree {
+	leaves := tree.Entries()
+	entries := make([]TreeEntry, 0, len(leaves))
+	for _, leaf := range leaves {
+		mode, _ := strconv.ParseUint(leaf.Mode(), 8, 32)
+		entries = append(entries, TreeEntry{Name: leaf.Name(), Mode: FileMode(mode), Hash: leaf.Sha()})
+	}
+	return &Tree{hash: hash, entries: entries}
+}
+
+type Blob struct {
+	hash     string
+	contents []byte
+}
+
+func (b *Blob) Hash() string { return b.hash }
+func (b *Blob) Kind() string { return "blob" }
+
+func (b *Blob) Size() int64 {
+	return int64(len(b.contents))
+}
+
+// Contents are the blob's bytes, shared with the repository's cache so they mustn't be changed
+func (b *Blob) Contents() []byte {
+	return b.contents
+}
+
+// Object reads whatever object rev names
+func (r *Repository) Object(rev string) (Object, error) {
+	sha, err := r.repo.ResolveRevision(rev)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := r.repo.ReadObject(sha)
+	if err != nil {
+		return nil, err
+	}
+
+	switch o := obj.(type) {
+	case *repository.Commit:
+		return &Commit{hash: sha, commit: o}, nil
+	case *repository.Tree:
+		return newTree(sha, o), nil
+	case *repository.Blob:
+		return &Blob{hash: sha, contents: o.Contents()}, nil
+	case *repository.Tag:
+		return &Tag{hash: sha, tag: o}, nil
+	default:
+		return nil, fmt.Errorf("object %s is an unknown %s", sha, obj.Kind())
+	}
+}
+
+// peel follows tags from rev until it gets to an object that isn't one
+func (r *Repository) peel(rev string) (Object, error) {
+	obj, err := r.Object(rev)
+	// tags of tags of tags are allowed, but not forever
+	for depth := 0; err == nil && depth < 32; depth++ {
+		tag, ok := obj.(*Tag)
+		if !ok {
+			return obj, nil
+		}
+		obj, err = r.Object(tag.Target())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("too many tags in a row from %s", rev)
+}
+
+// Commit reads the commit rev names, going through any tags on the way
+func (r *Repository) Commit(rev string) (*Commit, error) {
+	obj, err := r.peel(rev)
+	if err != nil {
+		return nil, err
+	}
+	commit, ok := obj.(*Commit)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %s, not a commit", rev, obj.Kind())
+	}
+	return commit, nil
+}
+
+// Tree reads the tree rev names, which can also be a commit or a tag
+func (r *Repository) Tree(rev string) (*Tree, error) {
+	obj, err := r.peel(rev)
+	if err != nil {
+		return nil, err
+	}
+	if commit, ok := obj.(*Commit); ok {
+		if obj, err = r.Object(commit.Tree()); err != nil {
+			return nil, err
+		}
+	}
+	tree, ok := obj.(*Tree)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %s, not a tree", rev, obj.Kind())
+	}
+	return tree, nil
+}
+
+// Tag reads the annotated tag rev names
+func (r *Repository) Tag(rev string) (*Tag, error) {
+	obj, err := r.Object(rev)
+	if err != nil {
+		return nil, err
+	}
+	tag, ok := obj.(*Tag)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %s, not a tag", rev, obj.Kind())
+	}
+	return tag, nil
+}
+
+// Blob reads the blob rev names into memory
+func (r *Repository) Blob(rev string) (*Blob, error) {
+	obj, err := r.Object(rev)
+	if err != nil {
+		return nil, err
+	}
+	blob, ok := obj.(*Blob)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %s, not a blob", rev, obj.Kind())
+	}
+	return blob, nil
+}
+
+// BlobReader opens the blob rev names for reading a bit at a time
+// which is the way to read one that's too big to hold in memory
+// the size is how many bytes the reader has to give
+func (r *Repository) BlobReader(rev string) (io.ReadCloser, int64, error) {
+	sha, err := r.repo.ResolveRevision(rev)
+	if err != nil {
+		return nil, 0, err
+	}
+	kind, size, rc, err := r.repo.OpenObject(sha)
+	if err != nil {
+		return nil, 0, err
+	}
+	if kind != "blob" {
+		rc.Close()
+		return nil, 0, fmt.Errorf("%s is a %s, not a blob", rev, kind)
+	}
+	return rc, size, nil
+}
@@ -0,0 +1,41 @@
+package twine
+
+import (
+	"sort"
+)
+
+// Ref is a name like refs/heads/main with the sha it points at
+type Ref struct {
+	Name string
+	Hash string
+}
+
+// Refs lists the branches, tags and every other ref under refs/, sorted by name
+func (r *Repository) Refs() ([]Ref, error) {
+	refs, err := r.repo.Refs()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Ref, 0, len(refs))
+	for name, hash := range refs {
+		list = append(list, Ref{Name: name, Hash: hash})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+// Head gives the branch HEAD is on and the commit it's at
+// when HEAD is detached the name is just HEAD
+// and on a branch with no commits yet the hash is empty
+func (r *Repository) Head() (Ref, error) {
+	target, hash, err := r.repo.Head()
+	if err != nil {
+		return Ref{}, err
+	}
+	if target == "" {
+		target = "HEAD"
+	}
+	return Ref{Name: target, Hash: hash}, nil
+}
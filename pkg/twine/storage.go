@@ -0,0 +1,83 @@
+package twine
+
+import (
+	"github.com/joeldotdias/twine/internal/repository"
+)
+
+// ObjectStorage keeps objects by sha
+//
+//	ReadObject(sha string) (kind string, contents []byte, err error)
+//	HasObject(sha string) bool
+//	WriteObject(sha, kind string, contents []byte) error
+//	ObjectsWithPrefix(prefix string) ([]string, error)
+//
+// ReadObject's error wraps fs.ErrNotExist when there's no such object.
+// Contents handed to WriteObject or back from ReadObject mustn't be changed.
+type ObjectStorage = repository.ObjectStorage
+
+// RefStorage keeps refs, HEAD included, each holding a sha or "ref: <name>"
+//
+//	ReadRef(name string) (string, error)
+//	WriteRef(name, value string) error
+//	DeleteRef(name string) error
+//	ListRefs() (map[string]string, error)
+//
+// ReadRef's error wraps fs.ErrNotExist when there's no such ref
+// and ListRefs only gives the ones under refs/.
+type RefStorage = repository.RefStorage
+
+// IndexStorage keeps the index in the format git writes it in
+//
+//	ReadIndex() ([]byte, error)
+//	WriteIndex(data []byte) error
+//
+// ReadIndex's error wraps fs.ErrNotExist when nothing has been written yet.
+type IndexStorage = repository.IndexStorage
+
+// WorktreeFS is the work tree, an fs.FS that can also be written to
+//
+//	Lstat(name string) (fs.FileInfo, error)
+//	ReadLink(name string) (string, error)
+//	Create(name string, perm fs.FileMode) (io.WriteCloser, error)
+//	Symlink(target, name string) error
+//	MkdirAll(name string, perm fs.FileMode) error
+//	Remove(name string) error
+//
+// Names are slash separated and relative to the top, as io/fs has them.
+type WorktreeFS = repository.WorktreeFS
+
+// Storage is everywhere a repository keeps things
+type Storage struct {
+	Objects ObjectStorage
+	Refs    RefStorage
+	Index   IndexStorage
+	// nil for a bare repository
+	Worktree WorktreeFS
+}
+
+// OpenStorage opens a repository kept in the given storage, with objects named by objectFormat
+// the storage can be anything, the repository doesn't look at the disk at all
+// and its config is empty apart from core.bare
+func OpenStorage(storage Storage, objectFormat string) (*Repository, error) {
+	repo, err := repository.OpenStorage(storage.Objects, storage.Refs, storage.Index, storage.Worktree, objectFormat)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{repo: repo}, nil
+}
+
+// InitMemory creates an empty repository that's only ever kept in memory
+// which is the quick way to set up a repository for a test
+// HEAD starts out on master, with nothing on it
+func InitMemory(opts InitOptions) (*Repository, error) {
+	repo, err := repository.InitMemory(opts.Bare, opts.ObjectFormat)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{repo: repo}, nil
+}
+
+// Worktree is the repository's work tree, nil for a bare repository
+func (r *Repository) Worktree() WorktreeFS {
+	return r.repo.Worktree()
+}
@@ -0,0 +1,103 @@
+// Package twine reads and writes git repositories from Go programs
+//
+// It's the part of twine that's meant to be used as a library:
+// opening and creating repositories, reading commits, trees, blobs and tags,
+// walking trees and history, listing refs and the index,
+// and writing objects and refs. FS gives any tree as an fs.FS.
+// Nothing in here prints, everything that goes wrong comes back as an error.
+//
+// A repository is usually a .git directory on disk, but where it keeps
+// objects, refs, the index and the work tree can be swapped out with
+// OpenStorage. InitMemory makes one that lives entirely in memory,
+// which is meant for tests.
+//
+// Objects are named by their full hex sha, 40 characters in a sha1 repository
+// and 64 in a sha256 one. Anywhere a revision is taken, an abbreviated sha
+// or a ref name like HEAD, main or refs/tags/v1 works as well.
+//
+// A Repository is safe to read from many goroutines at once.
+package twine
+
+import (
+	"github.com/joeldotdias/twine/internal/repository"
+)
+
+type Repository struct {
+	repo *repository.Repository
+}
+
+// Open opens the bare repository at path, or the repository whose work tree path is in
+func Open(path string) (*Repository, error) {
+	repo, err := repository.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{repo: repo}, nil
+}
+
+type InitOptions struct {
+	// create a repository without a work tree, with path as its git directory
+	Bare bool
+	// sha1 or sha256, sha1 if it's left empty
+	ObjectFormat string
+}
+
+// Init creates an empty repository at path
+func Init(path string, opts InitOptions) (*Repository, error) {
+	repo, err := repository.Init(path, opts.Bare, opts.ObjectFormat)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{repo: repo}, nil
+}
+
+// GitDir is the directory holding the repository's objects, refs and config
+// empty for a repository that isn't on disk
+func (r *Repository) GitDir() string {
+	return r.repo.GitDir()
+}
+
+// WorkTree is the directory files are checked out into, empty for a bare repository
+func (r *Repository) WorkTree() string {
+	return r.repo.WorkTree()
+}
+
+// ObjectFormat is the hash objects are named with, sha1 or sha256
+func (r *Repository) ObjectFormat() string {
+	return r.repo.ObjectFormat()
+}
+
+// Config gives the value of a configuration variable like core.bare
+// looking at the repository's config and then the global and system ones
+func (r *Repository) Config(name string) (string, bool) {
+	return r.repo.Config().Get(name)
+}
+
+// Resolve turns a revision into the full sha of the object it names
+func (r *Repository) Resolve(rev string) (string, error) {
+	return r.repo.ResolveRevision(rev)
+}
+
+// ObjectStats says how reading objects has gone since the repository was opened
+type ObjectStats struct {
+	// reads answered from the cache of inflated objects
+	Hits int64
+	// reads that had to go to disk
+	Misses int64
+	// bytes inflated from loose objects and packs
+	BytesInflated int64
+	// what the cache is holding right now
+	CachedObjects int
+	CachedBytes   int64
+}
+
+func (r *Repository) ObjectStats() ObjectStats {
+	stats := r.repo.ObjectStats()
+	return ObjectStats{
+		Hits:          stats.Hits,
+		Misses:        stats.Misses,
+		BytesInflated: stats.BytesInflated,
+		CachedObjects: stats.CachedObjects,
+		CachedBytes:   stats.CachedBytes,
+	}
+}
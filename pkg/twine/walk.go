@@ -0,0 +1,82 @@
+package twine
+
+import (
+	"errors"
+	"io/fs"
+	"iter"
+	"path"
+)
+
+// WalkFunc is called for every entry under a tree, with its path from the top with forward slashes
+// returning fs.SkipDir for a tree leaves out what's under it
+// and fs.SkipAll stops the walk without an error
+type WalkFunc func(path string, entry TreeEntry) error
+
+// Walk calls fn for everything under the tree rev names, which can also be a commit or a tag
+// a tree's entries come right after the tree itself, in git's order
+func (r *Repository) Walk(rev string, fn WalkFunc) error {
+	tree, err := r.Tree(rev)
+	if err != nil {
+		return err
+	}
+	err = r.walk(tree, "", fn)
+	if errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+func (r *Repository) walk(tree *Tree, prefix string, fn WalkFunc) error {
+	for _, entry := range tree.entries {
+		entryPath := path.Join(prefix, entry.Name)
+		err := fn(entryPath, entry)
+		if errors.Is(err, fs.SkipDir) && entry.Mode.IsTree() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !entry.Mode.IsTree() {
+			continue
+		}
+
+		subtree, err := r.Tree(entry.Hash)
+		if err != nil {
+			return err
+		}
+		if err := r.walk(subtree, entryPath, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Log goes through the history of rev the way git log does
+// newest commit first by committer date, each commit once
+// a shallow clone's history ends at its shallow commits, same as it does for twine log
+// it stops at the first error, which comes with a nil commit
+func (r *Repository) Log(rev string) iter.Seq2[*Commit, error] {
+	return func(yield func(*Commit, error) bool) {
+		start, err := r.Commit(rev)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		var readErr error
+		err = r.repo.WalkHistory(start.Hash(), func(sha string) bool {
+			commit, err := r.Commit(sha)
+			if err != nil {
+				readErr = err
+				return false
+			}
+			return yield(commit, nil)
+		})
+		if err == nil {
+			err = readErr
+		}
+		if err != nil {
+			yield(nil, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package twine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/joeldotdias/twine/internal/repository"
+)
+
+// WriteBlob stores data as a blob, giving back its hash
+func (r *Repository) WriteBlob(data []byte) (string, error) {
+	return r.repo.WriteObject("blob", data)
+}
+
+// WriteTree stores a tree holding entries, which don't have to be in any order
+func (r *Repository) WriteTree(entries []TreeEntry) (string, error) {
+	leaves := make([]*repository.TreeLeaf, 0, len(entries))
+	for _, entry := range entries {
+		// trees have no leading zero on a directory's mode
+		leaf, err := repository.NewTreeLeaf(fmt.Sprintf("%o", uint32(entry.Mode)), entry.Name, entry.Hash)
+		if err != nil {
+			return "", err
+		}
+		leaves = append(leaves, leaf)
+	}
+	return r.repo.WriteTree(leaves)
+}
+
+type CommitOptions struct {
+	Tree    string
+	Parents []string
+	Author  Signature
+	// the author if it's left empty
+	Committer Signature
+	Message   string
+}
+
+// WriteCommit stores a commit, giving back its hash
+// nothing points at it until a ref is set to it
+func (r *Repository) WriteCommit(opts CommitOptions) (string, error) {
+	if opts.Tree == "" {
+		return "", fmt.Errorf("a commit needs a tree")
+	}
+	committer := opts.Committer
+	if committer == (Signature{}) {
+		committer = opts.Author
+	}
+	return r.repo.WriteCommit(opts.Tree, opts.Parents, opts.Author.String(), committer.String(), withNewline(opts.Message))
+}
+
+type TagOptions struct {
+	Name string
+	// the hash of what's being tagged, usually a commit
+	Target string
+	// left out of the tag when it's empty
+	Tagger  Signature
+	Message string
+}
+
+// WriteTag stores an annotated tag, giving back its hash
+// it's only findable by name once refs/tags/<name> is set to it
+func (r *Repository) WriteTag(opts TagOptions) (string, error) {
+	target, err := r.Object(opts.Target)
+	if err != nil {
+		return "", err
+	}
+	tagger := ""
+	if opts.Tagger != (Signature{}) {
+		tagger = opts.Tagger.String()
+	}
+	return r.repo.WriteTag(target.Hash(), target.Kind(), opts.Name, tagger, withNewline(opts.Message))
+}
+
+// withNewline ends a message with a newline, the way git always has it
+func withNewline(message string) string {
+	if message == "" || strings.HasSuffix(message, "\n") {
+		return message
+	}
+	return message + "\n"
+}
+
+// SetRef points a ref like refs/heads/main at an object that's already stored
+func (r *Repository) SetRef(name, hash string) error {
+	return r.repo.SetRef(name, hash)
+}
+
+// SetSymbolicRef points a ref at another ref, the way HEAD points at the branch that's checked out
+func (r *Repository) SetSymbolicRef(name, target string) error {
+	return r.repo.SetSymref(name, target)
+}
+
+func (r *Repository) DeleteRef(name string) error {
+	return r.repo.DeleteRef(name)
+}
+
+// Checkout writes the tree of the commit rev names out into the work tree
+// and makes the index match it, without moving HEAD
+func (r *Repository) Checkout(rev string) error {
+	commit, err := r.Commit(rev)
+	if err != nil {
+		return err
+	}
+	return r.repo.Checkout(commit.Hash())
+}
+
+// Add stages the file at path in the work tree
+func (r *Repository) Add(path string) error {
+	return r.repo.Add(path)
+}